@@ -0,0 +1,88 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/rocky-linux/srpmproc/pkg/srpmproc"
+	"github.com/spf13/cobra"
+)
+
+var (
+	batchManifest string
+	batchWorkers  int
+)
+
+var batch = &cobra.Command{
+	Use:   "batch",
+	Short: "Import all packages listed in a manifest",
+	Run:   runBatch,
+}
+
+func init() {
+	addProcessFlags(batch)
+	// set per package in the manifest
+	for _, name := range []string{"source-rpm", "source-rpm-git-name", "package-version", "package-release", "module-mode"} {
+		_ = batch.Flags().MarkHidden(name)
+	}
+
+	batch.Flags().StringVar(&batchManifest, "manifest", "", "YAML or JSON manifest listing the packages to import")
+	_ = batch.MarkFlagRequired("manifest")
+	batch.Flags().IntVar(&batchWorkers, "workers", 4, "Number of packages to import concurrently")
+
+	root.AddCommand(batch)
+}
+
+func runBatch(cmd *cobra.Command, _ []string) {
+	manifest, err := srpmproc.ReadBatchManifest(batchManifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req, err := processDataRequest(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// keep stdout for the report
+	req.LogWriter = os.Stderr
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	results, err := srpmproc.ProcessBatchContext(ctx, req, manifest, batchWorkers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = json.NewEncoder(os.Stdout).Encode(results)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, result := range results {
+		if result.Error != "" {
+			os.Exit(1)
+		}
+	}
+}
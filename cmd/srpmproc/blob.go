@@ -0,0 +1,259 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/srpmproc"
+	"github.com/spf13/cobra"
+)
+
+var (
+	blobManifest  string
+	gcGracePeriod time.Duration
+	gcDelete      bool
+	gcDigests     []string
+	gcOnlyListed  bool
+	verifyWorkers int
+	syncFrom      string
+	syncTo        string
+	syncWorkers   int
+)
+
+var blobCmd = &cobra.Command{
+	Use:   "blob",
+	Short: "Manage the lookaside blob storage",
+}
+
+var gc = &cobra.Command{
+	Use:   "gc [package...]",
+	Short: "Report or delete blobs no downstream repo references",
+	Long: `Scans the metadata files of every branch and tag of the downstream repos and
+reports the blobs none of them references. Repos are taken from the arguments
+and --manifest, for file:// upstream prefixes all repos are scanned by default.`,
+	Run: runGc,
+}
+
+var verify = &cobra.Command{
+	Use:   "verify [package...]",
+	Short: "Check every blob against its checksum",
+	Long: `Re-reads every blob and compares its digest with its key, reporting corrupt,
+truncated and unreadable blobs. If --upstream-prefix is set, blobs referenced by
+the downstream repos that are missing from storage are reported as well.
+Alias objects written with --blob-aliases are verified against the blob they
+point to. Consumers fetching blobs directly from storage only see the alias
+object under these keys, not the content.`,
+	Run: runVerify,
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Copy blobs between storage backends",
+	Long: `Copies every blob of --from that is missing in --to. Blobs are verified against
+their checksum while reading and again after copying. Several comma separated
+destinations can be given to replicate to all of them.
+Alias objects written with --blob-aliases are copied as is and stay aliases in
+the destination, their keys are only readable through srpmproc.`,
+	Run: runSync,
+}
+
+// addBlobRepoFlags adds the flags selecting and authenticating against downstream repos
+func addBlobRepoFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&upstreamPrefix, "upstream-prefix", "", "Upstream git repository prefix")
+	cmd.Flags().StringVar(&storageAddr, "storage-addr", "", "Bucket to use as blob storage, comma separated to replicate to several buckets")
+	_ = cmd.MarkFlagRequired("storage-addr")
+	cmd.Flags().StringVar(&blobManifest, "manifest", "", "YAML or JSON manifest listing the packages to scan")
+	cmd.Flags().StringVar(&sshKeyLocation, "ssh-key-location", "", "Location of the SSH key to use to authenticate against upstream")
+	cmd.Flags().StringVar(&sshUser, "ssh-user", "git", "SSH User")
+	cmd.Flags().BoolVar(&sshAskKeyPassword, "ssh-key-password", false, "If enabled, prompt for ssh key password")
+	cmd.Flags().StringVar(&basicUsername, "basic-username", "", "Basic auth username")
+	cmd.Flags().StringVar(&basicPassword, "basic-password", "", "Basic auth password")
+	addBlobEncodingFlags(cmd)
+}
+
+// blobPackages returns the packages given as arguments and in --manifest
+func blobPackages(args []string) []*srpmproc.BatchPackage {
+	var packages []*srpmproc.BatchPackage
+	for _, name := range args {
+		packages = append(packages, &srpmproc.BatchPackage{Name: name})
+	}
+	if blobManifest != "" {
+		manifest, err := srpmproc.ReadBatchManifest(blobManifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		packages = append(packages, manifest.Packages...)
+	}
+
+	return packages
+}
+
+func blobAuthenticator() transport.AuthMethod {
+	authenticator, err := srpmproc.NewAuthenticator(&srpmproc.ProcessDataRequest{
+		SshKeyLocation: sshKeyLocation,
+		SshUser:        sshUser,
+		SshKeyPassword: sshAskKeyPassword,
+		HttpUsername:   basicUsername,
+		HttpPassword:   basicPassword,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return authenticator
+}
+
+func init() {
+	addBlobRepoFlags(gc)
+	_ = gc.MarkFlagRequired("upstream-prefix")
+	gc.Flags().DurationVar(&gcGracePeriod, "grace-period", 7*24*time.Hour, "Unreferenced blobs modified within this period are kept")
+	gc.Flags().BoolVar(&gcDelete, "delete", false, "If enabled, unreferenced blobs are deleted instead of only reported")
+	gc.Flags().BoolVar(&gcOnlyListed, "only-listed-packages", false, "The listed packages are the only users of the storage, required to --delete with a package list")
+	gc.Flags().StringSliceVar(&gcDigests, "digests", nil, "Comma separated digest algorithms blobs are copied to with --blob-digests, copies of referenced blobs are kept")
+
+	addBlobRepoFlags(verify)
+	verify.Flags().IntVar(&verifyWorkers, "workers", 4, "Number of blobs to verify concurrently")
+
+	syncCmd.Flags().StringVar(&syncFrom, "from", "", "Blob storage to copy from")
+	_ = syncCmd.MarkFlagRequired("from")
+	syncCmd.Flags().StringVar(&syncTo, "to", "", "Blob storage to copy to, comma separated for several destinations")
+	_ = syncCmd.MarkFlagRequired("to")
+	syncCmd.Flags().IntVar(&syncWorkers, "workers", 4, "Number of blobs to copy concurrently")
+	addBlobEncodingFlags(syncCmd)
+
+	blobCmd.AddCommand(gc)
+	blobCmd.AddCommand(verify)
+	blobCmd.AddCommand(syncCmd)
+	root.AddCommand(blobCmd)
+}
+
+func runGc(cmd *cobra.Command, args []string) {
+	storage, err := srpmproc.NewBlobStorage(storageAddr, blobEncoding(cmd))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	result, err := srpmproc.CollectGarbage(ctx, &srpmproc.GCRequest{
+		UpstreamPrefix:     upstreamPrefix,
+		Packages:           blobPackages(args),
+		Storage:            storage,
+		Authenticator:      blobAuthenticator(),
+		GracePeriod:        gcGracePeriod,
+		Delete:             gcDelete,
+		OnlyListedPackages: gcOnlyListed,
+		Digests:            gcDigests,
+		// keep stdout for the report
+		LogWriter: os.Stderr,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = json.NewEncoder(os.Stdout).Encode(result)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	storage, err := srpmproc.NewBlobStorage(storageAddr, blobEncoding(cmd))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req := &srpmproc.VerifyRequest{
+		Storage:        storage,
+		UpstreamPrefix: upstreamPrefix,
+		Packages:       blobPackages(args),
+		Workers:        verifyWorkers,
+		// keep stdout for the report
+		LogWriter: os.Stderr,
+	}
+	if upstreamPrefix != "" {
+		req.Authenticator = blobAuthenticator()
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	result, err := srpmproc.VerifyBlobs(ctx, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = json.NewEncoder(os.Stdout).Encode(result)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(result.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runSync(cmd *cobra.Command, _ []string) {
+	from, err := srpmproc.NewBlobStorage(syncFrom, blobEncoding(cmd))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// every destination is synced on its own instead of as one replicated storage
+	var to []blob.Storage
+	for _, addr := range strings.Split(syncTo, ",") {
+		storage, err := srpmproc.NewBlobStorage(strings.TrimSpace(addr), blobEncoding(cmd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		to = append(to, storage)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	result, err := srpmproc.SyncBlobs(ctx, &srpmproc.SyncRequest{
+		From:    from,
+		To:      to,
+		Workers: syncWorkers,
+		// keep stdout for the report
+		LogWriter: os.Stderr,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = json.NewEncoder(os.Stdout).Encode(result)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(result.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"github.com/rocky-linux/srpmproc/pkg/srpmproc"
+	"github.com/spf13/cobra"
+)
+
+var branches = &cobra.Command{
+	Use:   "branches [BRANCH...]",
+	Short: "Print the downstream branch of upstream branches according to --branch-rules",
+	Run:   runBranches,
+}
+
+var (
+	branchesRules      string
+	branchesExplain    bool
+	branchesComponents bool
+	branchesSourceRpm  string
+	branchesRpmPrefix  string
+)
+
+func init() {
+	branches.Flags().StringVar(&branchesRules, "branch-rules", "", "YAML or JSON branch rules file")
+	_ = branches.MarkFlagRequired("branch-rules")
+	branches.Flags().BoolVar(&branchesExplain, "explain", false, "If enabled, print which rule matched every branch")
+	branches.Flags().BoolVar(&branchesComponents, "components", false, "If enabled, arguments are module component refs and the component rules are used")
+	branches.Flags().StringVar(&branchesSourceRpm, "source-rpm", "", "If set and no branches are given, the branches of this upstream package are mapped")
+	branches.Flags().StringVar(&branchesRpmPrefix, "rpm-prefix", srpmproc.RpmPrefixCentOS, "Where to list the branches of --source-rpm")
+
+	root.AddCommand(branches)
+}
+
+func runBranches(_ *cobra.Command, args []string) {
+	rules, err := srpmproc.ReadBranchRules(branchesRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := args
+	if len(names) == 0 {
+		if branchesSourceRpm == "" || branchesComponents {
+			log.Fatal("no branches given")
+		}
+		names, err = srpmproc.UpstreamBranches(fmt.Sprintf("%s/%s.git", strings.TrimSuffix(branchesRpmPrefix, "/"), branchesSourceRpm))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, name := range names {
+		match := rules.Branch(name)
+		unmatched := "not imported"
+		if branchesComponents {
+			// components without a rule stay on the branch of the module
+			match = rules.Component(name)
+			unmatched = "module branch"
+		}
+
+		fmt.Println(explainBranchMatch(match, unmatched, branchesExplain))
+	}
+}
+
+func explainBranchMatch(match *data.BranchMatch, unmatched string, explain bool) string {
+	var line string
+	switch {
+	case match.Rule == nil:
+		line = fmt.Sprintf("%s (%s)", match.Source, unmatched)
+	case match.Rule.Skip:
+		line = fmt.Sprintf("%s (skipped)", match.Source)
+	default:
+		line = fmt.Sprintf("%s -> %s", match.Source, match.Target)
+	}
+	if !explain {
+		return line
+	}
+
+	if match.Rule == nil {
+		return line + "\n\tno rule matched"
+	}
+	if match.Rule.Skip {
+		return fmt.Sprintf("%s\n\tskipped by rule %d: %s", line, match.Index+1, match.Rule.Match)
+	}
+
+	return fmt.Sprintf("%s\n\trule %d: %s -> %s", line, match.Index+1, match.Rule.Match, match.Rule.Target)
+}
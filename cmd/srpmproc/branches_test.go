@@ -0,0 +1,65 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+func TestExplainBranchMatch(t *testing.T) {
+	rules := &data.BranchRules{
+		Branches: []*data.BranchRule{
+			{Match: `c8s-stream-(.*)`, Target: "r8s-stream-$1"},
+			{Match: `c9-beta.*`, Skip: true},
+			{Match: `c(\d+)`, Target: "r$1"},
+		},
+	}
+	err := rules.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		branch  string
+		explain bool
+		want    string
+	}{
+		{"c8", false, "c8 -> r8"},
+		{"c8", true, "c8 -> r8\n\trule 3: c(\\d+) -> r$1"},
+		{"c8s-stream-httpd-2.4", true, "c8s-stream-httpd-2.4 -> r8s-stream-httpd-2.4\n\trule 1: c8s-stream-(.*) -> r8s-stream-$1"},
+		{"c9-beta", false, "c9-beta (skipped)"},
+		{"c9-beta", true, "c9-beta (skipped)\n\tskipped by rule 2: c9-beta.*"},
+		{"foo", false, "foo (not imported)"},
+		{"foo", true, "foo (not imported)\n\tno rule matched"},
+	} {
+		got := explainBranchMatch(rules.Branch(tt.branch), "not imported", tt.explain)
+		if got != tt.want {
+			t.Errorf("explainBranchMatch(%s, %v) = %q, want %q", tt.branch, tt.explain, got, tt.want)
+		}
+	}
+
+	got := explainBranchMatch(rules.Component("rhel-8.4"), "module branch", true)
+	if want := "rhel-8.4 (module branch)\n\tno rule matched"; got != want {
+		t.Errorf("explainBranchMatch of a component = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/rocky-linux/srpmproc/pkg/srpmproc"
+	"github.com/spf13/cobra"
+)
+
+var diff = &cobra.Command{
+	Use:   "diff",
+	Short: "Print the changes srpmproc makes to the upstream tree without pushing",
+	Run:   runDiff,
+}
+
+func init() {
+	addProcessFlags(diff)
+	_ = diff.MarkFlagRequired("source-rpm")
+	// always set for diff
+	_ = diff.Flags().MarkHidden("dry-run")
+	_ = diff.Flags().MarkHidden("diff-mode")
+
+	root.AddCommand(diff)
+}
+
+func runDiff(cmd *cobra.Command, _ []string) {
+	req, err := processDataRequest(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.DryRun = true
+	req.DiffMode = true
+	// keep stdout for the diff
+	req.LogWriter = os.Stderr
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	pd, err := srpmproc.NewProcessData(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	res, err := srpmproc.ProcessRPMContext(ctx, pd)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var branches []string
+	for branch := range res.BranchDiffs {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+
+	for _, branch := range branches {
+		fmt.Printf("# %s\n%s", branch, res.BranchDiffs[branch])
+	}
+}
@@ -49,7 +49,10 @@ func runFetch(_ *cobra.Command, _ []string) {
 		log.Fatalf("could not get working directory: %v", err)
 	}
 
-	err = srpmproc.Fetch(os.Stdout, cdnUrl, wd, osfs.New("/"), nil)
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	err = srpmproc.FetchContext(ctx, os.Stdout, cdnUrl, wd, osfs.New("/"), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
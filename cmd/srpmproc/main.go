@@ -21,13 +21,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/rocky-linux/srpmproc/pkg/blob/diskcache"
 	"github.com/rocky-linux/srpmproc/pkg/srpmproc"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -62,6 +71,26 @@ var (
 	taglessMode          bool
 	cdn                  string
 	moduleBranchNames    bool
+	dryRun               bool
+	diffMode             bool
+	downloadParallelism  int
+	downloadRetries      int
+	downloadTimeout      time.Duration
+	lookasideMirrors     string
+	lookasideProfiles    string
+	blobCacheDir         string
+	blobCacheSize        int64
+	metadataDigest       string
+	blobDigests          []string
+	blobAliases          bool
+	preserveHistory      bool
+	signingFormat        string
+	signingKey           string
+	reproducible         bool
+	commitMessageTmpl    string
+	tagNameTmpl          string
+	tagMessageTmpl       string
+	branchRules          string
 )
 
 var root = &cobra.Command{
@@ -69,46 +98,154 @@ var root = &cobra.Command{
 	Run: mn,
 }
 
-func mn(_ *cobra.Command, _ []string) {
-	pd, err := srpmproc.NewProcessData(&srpmproc.ProcessDataRequest{
-		Version:              version,
-		StorageAddr:          storageAddr,
-		Package:              sourceRpm,
-		PackageGitName:       sourceRpmGitName,
-		ModuleMode:           moduleMode,
-		TmpFsMode:            tmpFsMode,
-		ModulePrefix:         modulePrefix,
-		RpmPrefix:            rpmPrefix,
-		SshKeyLocation:       sshKeyLocation,
-		SshUser:              sshUser,
-		SshKeyPassword:       sshAskKeyPassword,
-		ManualCommits:        manualCommits,
-		UpstreamPrefix:       upstreamPrefix,
-		GitCommitterName:     gitCommitterName,
-		GitCommitterEmail:    gitCommitterEmail,
-		ImportBranchPrefix:   importBranchPrefix,
-		BranchPrefix:         branchPrefix,
-		NoDupMode:            noDupMode,
-		BranchSuffix:         branchSuffix,
-		StrictBranchMode:     strictBranchMode,
-		ModuleFallbackStream: moduleFallbackStream,
-		NoStorageUpload:      noStorageUpload,
-		NoStorageDownload:    noStorageDownload,
-		SingleTag:            singleTag,
-		CdnUrl:               cdnUrl,
-		HttpUsername:         basicUsername,
-		HttpPassword:         basicPassword,
-		PackageVersion:       packageVersion,
-		PackageRelease:       packageRelease,
-		TaglessMode:          taglessMode,
-		Cdn:                  cdn,
-		ModuleBranchNames:    moduleBranchNames,
-	})
+// profileDefault returns value, or an empty string if a --cdn profile
+// is used and the flag was not set, so the profile default applies
+func profileDefault(cmd *cobra.Command, flag string, value string) string {
+	if cdn != "" && !cmd.Flags().Changed(flag) {
+		return ""
+	}
+
+	return value
+}
+
+// addBlobEncodingFlags adds the blob compression and encryption flags to cmd,
+// they can also be set as SRPMPROC_BLOB_COMPRESSION, SRPMPROC_BLOB_ENCRYPTION_KEY_FILE
+// and SRPMPROC_BLOB_REJECT_PLAINTEXT
+func addBlobEncodingFlags(cmd *cobra.Command) {
+	cmd.Flags().String("blob-compression", "none", "Compression of stored blobs.  Valid values:  none, zstd")
+	cmd.Flags().String("blob-encryption-key-file", "", "If set, blobs are encrypted with AES-256-GCM using the 32 byte key (raw, hex or base64 encoded) in this file")
+	cmd.Flags().Bool("blob-reject-plaintext", false, "If enabled, blobs that are not encrypted fail to read")
+}
+
+// blobEncoding returns the blob compression and encryption settings of cmd,
+// flags take precedence over the environment
+func blobEncoding(cmd *cobra.Command) *srpmproc.BlobEncoding {
+	for _, name := range []string{"blob-compression", "blob-encryption-key-file", "blob-reject-plaintext"} {
+		_ = viper.BindPFlag(name, cmd.Flags().Lookup(name))
+	}
+
+	return &srpmproc.BlobEncoding{
+		Compression:       viper.GetString("blob-compression"),
+		EncryptionKeyFile: viper.GetString("blob-encryption-key-file"),
+		RejectPlaintext:   viper.GetBool("blob-reject-plaintext"),
+	}
+}
+
+func processDataRequest(cmd *cobra.Command) (*srpmproc.ProcessDataRequest, error) {
+	if lookasideProfiles != "" {
+		err := srpmproc.LoadLookasideProfiles(lookasideProfiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := &srpmproc.ProcessDataRequest{
+		Version:               version,
+		StorageAddr:           storageAddr,
+		Package:               sourceRpm,
+		PackageGitName:        sourceRpmGitName,
+		ModuleMode:            moduleMode,
+		TmpFsMode:             tmpFsMode,
+		ModulePrefix:          profileDefault(cmd, "module-prefix", modulePrefix),
+		RpmPrefix:             profileDefault(cmd, "rpm-prefix", rpmPrefix),
+		SshKeyLocation:        sshKeyLocation,
+		SshUser:               sshUser,
+		SshKeyPassword:        sshAskKeyPassword,
+		ManualCommits:         manualCommits,
+		UpstreamPrefix:        upstreamPrefix,
+		GitCommitterName:      gitCommitterName,
+		GitCommitterEmail:     gitCommitterEmail,
+		ImportBranchPrefix:    profileDefault(cmd, "import-branch-prefix", importBranchPrefix),
+		BranchPrefix:          profileDefault(cmd, "branch-prefix", branchPrefix),
+		NoDupMode:             noDupMode,
+		BranchSuffix:          branchSuffix,
+		StrictBranchMode:      strictBranchMode,
+		ModuleFallbackStream:  moduleFallbackStream,
+		NoStorageUpload:       noStorageUpload,
+		NoStorageDownload:     noStorageDownload,
+		SingleTag:             singleTag,
+		CdnUrl:                cdnUrl,
+		HttpUsername:          basicUsername,
+		HttpPassword:          basicPassword,
+		PackageVersion:        packageVersion,
+		PackageRelease:        packageRelease,
+		TaglessMode:           taglessMode,
+		Cdn:                   cdn,
+		ModuleBranchNames:     moduleBranchNames,
+		DryRun:                dryRun,
+		DiffMode:              diffMode,
+		DownloadParallelism:   downloadParallelism,
+		DownloadRetries:       downloadRetries,
+		DownloadTimeout:       downloadTimeout,
+		BlobCacheDir:          blobCacheDir,
+		BlobCacheSize:         blobCacheSize,
+		MetadataDigest:        metadataDigest,
+		BlobDigests:           blobDigests,
+		BlobAliases:           blobAliases,
+		PreserveHistory:       preserveHistory,
+		SigningFormat:         signingFormat,
+		SigningKeyLocation:    signingKey,
+		SigningKeyPassphrase:  viper.GetString("signing-key-passphrase"),
+		Reproducible:          reproducible,
+		CommitMessageTemplate: commitMessageTmpl,
+		TagNameTemplate:       tagNameTmpl,
+		TagMessageTemplate:    tagMessageTmpl,
+	}
+
+	encoding := blobEncoding(cmd)
+	req.BlobCompression = encoding.Compression
+	req.BlobEncryptionKeyFile = encoding.EncryptionKeyFile
+	req.BlobRejectPlaintext = encoding.RejectPlaintext
+
+	// https://reproducible-builds.org/specs/source-date-epoch/
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" && reproducible {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH %s: %v", epoch, err)
+		}
+		req.SourceDate = time.Unix(seconds, 0).UTC()
+	}
+
+	if lookasideMirrors != "" {
+		mirrors, err := srpmproc.ReadLookasideMirrors(lookasideMirrors)
+		if err != nil {
+			return nil, err
+		}
+		req.LookasideMirrors = mirrors
+	}
+
+	if branchRules != "" {
+		rules, err := srpmproc.ReadBranchRules(branchRules)
+		if err != nil {
+			return nil, err
+		}
+		req.BranchRules = rules
+	}
+
+	return req, nil
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM,
+// so an interrupted import stops before pushing and cleans up after itself
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func mn(cmd *cobra.Command, _ []string) {
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	req, err := processDataRequest(cmd)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	res, err := srpmproc.ProcessRPM(pd)
+	pd, err := srpmproc.NewProcessData(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	res, err := srpmproc.ProcessRPMContext(ctx, pd)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -119,44 +256,77 @@ func mn(_ *cobra.Command, _ []string) {
 	}
 }
 
+// addProcessFlags adds the flags used to build a ProcessDataRequest to cmd
+func addProcessFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&sourceRpm, "source-rpm", "", "Location of RPM to process. Either a package name in rpm-prefix, a path to a local .src.rpm file or a path to a local dist-git checkout")
+	cmd.Flags().StringVar(&upstreamPrefix, "upstream-prefix", "", "Upstream git repository prefix")
+	_ = cmd.MarkFlagRequired("upstream-prefix")
+	cmd.Flags().IntVar(&version, "version", 0, "Upstream version")
+	_ = cmd.MarkFlagRequired("version")
+	cmd.Flags().StringVar(&storageAddr, "storage-addr", "", "Bucket to use as blob storage, comma separated to replicate to several buckets")
+	_ = cmd.MarkFlagRequired("storage-addr")
+
+	cmd.Flags().StringVar(&sourceRpmGitName, "source-rpm-git-name", "", "Actual git repo name of package if name is different from source-rpm value")
+	cmd.Flags().StringVar(&sshKeyLocation, "ssh-key-location", "", "Location of the SSH key to use to authenticate against upstream")
+	cmd.Flags().StringVar(&sshUser, "ssh-user", "git", "SSH User")
+	cmd.Flags().BoolVar(&sshAskKeyPassword, "ssh-key-password", false, "If enabled, prompt for ssh key password")
+	cmd.Flags().StringVar(&gitCommitterName, "git-committer-name", "rockyautomation", "Name of committer")
+	cmd.Flags().StringVar(&gitCommitterEmail, "git-committer-email", "rockyautomation@rockylinux.org", "Email of committer")
+	cmd.Flags().StringVar(&modulePrefix, "module-prefix", "https://git.centos.org/modules", "Where to retrieve modules if exists. Only used when source-rpm is a git repo")
+	cmd.Flags().StringVar(&rpmPrefix, "rpm-prefix", "https://git.centos.org/rpms", "Where to retrieve SRPM content. Only used when source-rpm is not a local file")
+	cmd.Flags().StringVar(&importBranchPrefix, "import-branch-prefix", "c", "Import branch prefix")
+	cmd.Flags().StringVar(&branchPrefix, "branch-prefix", "r", "Branch prefix (replaces import-branch-prefix)")
+	cmd.Flags().StringVar(&cdnUrl, "cdn-url", "https://git.centos.org/sources", "CDN URL to download blobs from. Simple URL follows default rocky/centos patterns. Can be customized using macros (see docs)")
+	cmd.Flags().StringVar(&singleTag, "single-tag", "", "If set, only this tag is imported")
+	cmd.Flags().BoolVar(&noDupMode, "no-dup-mode", false, "If enabled, skips already imported tags")
+	cmd.Flags().BoolVar(&moduleMode, "module-mode", false, "If enabled, imports a module instead of a package")
+	cmd.Flags().StringVar(&tmpFsMode, "tmpfs-mode", "", "If set, packages are imported to path and patched but not pushed")
+	cmd.Flags().BoolVar(&noStorageDownload, "no-storage-download", false, "If enabled, blobs are always downloaded from upstream")
+	cmd.Flags().BoolVar(&noStorageUpload, "no-storage-upload", false, "If enabled, blobs are not uploaded to blob storage")
+	cmd.Flags().StringVar(&manualCommits, "manual-commits", "", "Comma separated branch and commit list for packages with broken release tags (Format: BRANCH:HASH)")
+	cmd.Flags().StringVar(&moduleFallbackStream, "module-fallback-stream", "", "Override fallback stream. Some module packages are published as collections and mostly use the same stream name, some of them deviate from the main stream")
+	cmd.Flags().StringVar(&branchSuffix, "branch-suffix", "", "Branch suffix to use for imported branches")
+	cmd.Flags().BoolVar(&strictBranchMode, "strict-branch-mode", false, "If enabled, only branches with the calculated name are imported and not prefix only")
+	cmd.Flags().StringVar(&basicUsername, "basic-username", "", "Basic auth username")
+	cmd.Flags().StringVar(&basicPassword, "basic-password", "", "Basic auth password")
+	cmd.Flags().StringVar(&packageVersion, "package-version", "", "Package version to fetch")
+	cmd.Flags().StringVar(&packageRelease, "package-release", "", "Package release to fetch")
+	cmd.Flags().BoolVar(&taglessMode, "taglessmode", false, "Tagless mode:  If set, pull the latest commit from the branch and determine version numbers from spec file.  This is auto-tried if tags aren't found.")
+	cmd.Flags().StringVar(&cdn, "cdn", "", "CDN URL shortcuts for well-known distros, auto-assigns --cdn-url.  Valid values:  rocky8, rocky, fedora, centos, centos-stream and profiles from --lookaside-profiles.  Setting this overrides --cdn-url")
+	cmd.Flags().StringVar(&lookasideProfiles, "lookaside-profiles", "", "YAML, TOML or JSON file with additional lookaside profiles for --cdn")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "If enabled, nothing is pushed or uploaded and a plan of the import is printed instead")
+	cmd.Flags().BoolVar(&diffMode, "diff-mode", false, "If enabled, a unified diff of the downstream changes to the upstream tree is included for every branch")
+	cmd.Flags().IntVar(&downloadParallelism, "download-parallelism", 4, "Number of lookaside sources to download concurrently")
+	cmd.Flags().IntVar(&downloadRetries, "download-retries", 3, "Number of times a failed lookaside download is retried, 0 disables retries")
+	cmd.Flags().DurationVar(&downloadTimeout, "download-timeout", 10*time.Minute, "Timeout of a single lookaside download request, interrupted downloads are resumed")
+	cmd.Flags().StringVar(&lookasideMirrors, "lookaside-mirrors", "", "YAML file listing lookaside mirrors to try in order, replaces --cdn and --cdn-url")
+	cmd.Flags().StringVar(&blobCacheDir, "blob-cache-dir", "", "If set, blobs are cached in this directory and verified on every read")
+	cmd.Flags().Int64Var(&blobCacheSize, "blob-cache-size", diskcache.DefaultMaxSize, "Size limit of the blob cache in bytes, least recently used blobs are evicted")
+	cmd.Flags().StringVar(&metadataDigest, "metadata-digest", "", "If set, downstream metadata files list sources with this digest (md5, sha1, sha256 or sha512) instead of the upstream one")
+	addBlobEncodingFlags(cmd)
+	cmd.Flags().StringSliceVar(&blobDigests, "blob-digests", nil, "Comma separated digest algorithms blobs are additionally stored under, e.g. sha256,sha512")
+	cmd.Flags().BoolVar(&blobAliases, "blob-aliases", false, "If enabled, blobs are stored once and the additional digests are small alias objects instead of copies, which only srpmproc resolves")
+	cmd.Flags().StringVar(&branchRules, "branch-rules", "", "YAML or JSON file mapping upstream branches to downstream branches, replaces --import-branch-prefix and --branch-prefix")
+	cmd.Flags().BoolVar(&preserveHistory, "preserve-history", false, "If enabled, upstream commits since the previous import are replayed with their original author and message before the import commit")
+	cmd.Flags().StringVar(&signingFormat, "signing-format", "", "If set, import commits and tags are signed.  Valid values:  openpgp, ssh")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "Armored OpenPGP private key or SSH private key to sign with, SSH signing defaults to --ssh-key-location")
+	cmd.Flags().BoolVar(&reproducible, "reproducible", false, "If enabled, commits, tags and generated archives use the upstream commit time or SOURCE_DATE_EPOCH instead of the current time")
+	cmd.Flags().StringVar(&commitMessageTmpl, "commit-message-template", "", "Go text/template for the import commit message, e.g. \"import {{.NVR}} ({{.UpstreamCommit}})\"")
+	cmd.Flags().StringVar(&tagNameTmpl, "tag-name-template", "", "Go text/template for the import tag name, e.g. \"imports/{{.Branch}}/{{.NVR}}\"")
+	cmd.Flags().StringVar(&tagMessageTmpl, "tag-message-template", "", "Go text/template for the import tag message")
+	cmd.Flags().BoolVar(&moduleBranchNames, "module-branch-names-only", false, "If enabled, module imports will use the branch name that is being imported, rather than use the commit hash.")
+
+}
+
 func main() {
-	root.Flags().StringVar(&sourceRpm, "source-rpm", "", "Location of RPM to process")
+	addProcessFlags(root)
 	_ = root.MarkFlagRequired("source-rpm")
-	root.Flags().StringVar(&upstreamPrefix, "upstream-prefix", "", "Upstream git repository prefix")
-	_ = root.MarkFlagRequired("upstream-prefix")
-	root.Flags().IntVar(&version, "version", 0, "Upstream version")
-	_ = root.MarkFlagRequired("version")
-	root.Flags().StringVar(&storageAddr, "storage-addr", "", "Bucket to use as blob storage")
-	_ = root.MarkFlagRequired("storage-addr")
-
-	root.Flags().StringVar(&sourceRpmGitName, "source-rpm-git-name", "", "Actual git repo name of package if name is different from source-rpm value")
-	root.Flags().StringVar(&sshKeyLocation, "ssh-key-location", "", "Location of the SSH key to use to authenticate against upstream")
-	root.Flags().StringVar(&sshUser, "ssh-user", "git", "SSH User")
-	root.Flags().BoolVar(&sshAskKeyPassword, "ssh-key-password", false, "If enabled, prompt for ssh key password")
-	root.Flags().StringVar(&gitCommitterName, "git-committer-name", "rockyautomation", "Name of committer")
-	root.Flags().StringVar(&gitCommitterEmail, "git-committer-email", "rockyautomation@rockylinux.org", "Email of committer")
-	root.Flags().StringVar(&modulePrefix, "module-prefix", "https://git.centos.org/modules", "Where to retrieve modules if exists. Only used when source-rpm is a git repo")
-	root.Flags().StringVar(&rpmPrefix, "rpm-prefix", "https://git.centos.org/rpms", "Where to retrieve SRPM content. Only used when source-rpm is not a local file")
-	root.Flags().StringVar(&importBranchPrefix, "import-branch-prefix", "c", "Import branch prefix")
-	root.Flags().StringVar(&branchPrefix, "branch-prefix", "r", "Branch prefix (replaces import-branch-prefix)")
-	root.Flags().StringVar(&cdnUrl, "cdn-url", "https://git.centos.org/sources", "CDN URL to download blobs from. Simple URL follows default rocky/centos patterns. Can be customized using macros (see docs)")
-	root.Flags().StringVar(&singleTag, "single-tag", "", "If set, only this tag is imported")
-	root.Flags().BoolVar(&noDupMode, "no-dup-mode", false, "If enabled, skips already imported tags")
-	root.Flags().BoolVar(&moduleMode, "module-mode", false, "If enabled, imports a module instead of a package")
-	root.Flags().StringVar(&tmpFsMode, "tmpfs-mode", "", "If set, packages are imported to path and patched but not pushed")
-	root.Flags().BoolVar(&noStorageDownload, "no-storage-download", false, "If enabled, blobs are always downloaded from upstream")
-	root.Flags().BoolVar(&noStorageUpload, "no-storage-upload", false, "If enabled, blobs are not uploaded to blob storage")
-	root.Flags().StringVar(&manualCommits, "manual-commits", "", "Comma separated branch and commit list for packages with broken release tags (Format: BRANCH:HASH)")
-	root.Flags().StringVar(&moduleFallbackStream, "module-fallback-stream", "", "Override fallback stream. Some module packages are published as collections and mostly use the same stream name, some of them deviate from the main stream")
-	root.Flags().StringVar(&branchSuffix, "branch-suffix", "", "Branch suffix to use for imported branches")
-	root.Flags().BoolVar(&strictBranchMode, "strict-branch-mode", false, "If enabled, only branches with the calculated name are imported and not prefix only")
-	root.Flags().StringVar(&basicUsername, "basic-username", "", "Basic auth username")
-	root.Flags().StringVar(&basicPassword, "basic-password", "", "Basic auth password")
-	root.Flags().StringVar(&packageVersion, "package-version", "", "Package version to fetch")
-	root.Flags().StringVar(&packageRelease, "package-release", "", "Package release to fetch")
-	root.Flags().BoolVar(&taglessMode, "taglessmode", false, "Tagless mode:  If set, pull the latest commit from the branch and determine version numbers from spec file.  This is auto-tried if tags aren't found.")
-	root.Flags().StringVar(&cdn, "cdn", "", "CDN URL shortcuts for well-known distros, auto-assigns --cdn-url.  Valid values:  rocky8, rocky, fedora, centos, centos-stream.  Setting this overrides --cdn-url")
-	root.Flags().BoolVar(&moduleBranchNames, "module-branch-names-only", false, "If enabled, module imports will use the branch name that is being imported, rather than use the commit hash.")
+
+	// backend settings such as s3-access-key or http-storage-bearer-token
+	// can be set as SRPMPROC_S3_ACCESS_KEY or SRPMPROC_HTTP_STORAGE_BEARER_TOKEN
+	viper.SetEnvPrefix("srpmproc")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
 
 	if err := root.Execute(); err != nil {
 		log.Fatal(err)
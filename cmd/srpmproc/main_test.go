@@ -0,0 +1,55 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestProfileDefault(t *testing.T) {
+	saved := cdn
+	t.Cleanup(func() { cdn = saved })
+
+	cmd := &cobra.Command{}
+	var prefix string
+	cmd.Flags().StringVar(&prefix, "branch-prefix", "r", "")
+
+	cdn = ""
+	if got := profileDefault(cmd, "branch-prefix", prefix); got != "r" {
+		t.Errorf("without --cdn = %q, want the flag default", got)
+	}
+
+	// the profile default applies instead of the flag default
+	cdn = "almalinux"
+	if got := profileDefault(cmd, "branch-prefix", prefix); got != "" {
+		t.Errorf("with --cdn = %q, want empty", got)
+	}
+
+	// an explicit flag wins over the profile
+	if err := cmd.Flags().Set("branch-prefix", "r"); err != nil {
+		t.Fatal(err)
+	}
+	if got := profileDefault(cmd, "branch-prefix", prefix); got != "r" {
+		t.Errorf("with --cdn and --branch-prefix = %q, want the flag value", got)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// An alias object stores the key of another blob instead of content,
+// so a blob can be found under several digests without storing copies.
+// The content is only found under an aliased key through OpenResolved or ReadResolved,
+// Reader and plain HTTP consumers of the storage get the alias object itself
+const (
+	aliasPrefix = "srpmproc-blob-alias:"
+	// MaxAliasSize is the largest size of an alias object
+	MaxAliasSize = 256
+)
+
+// WriteAlias stores an alias object at path pointing to target
+func WriteAlias(ctx context.Context, storage Storage, path string, target string) error {
+	return storage.Write(ctx, path, []byte(aliasPrefix+target+"\n"))
+}
+
+// ParseAlias returns the target of an alias object, or false if content is not an alias
+func ParseAlias(content []byte) (string, bool) {
+	if len(content) > MaxAliasSize || !bytes.HasPrefix(content, []byte(aliasPrefix)) {
+		return "", false
+	}
+	target := strings.TrimSpace(strings.TrimPrefix(string(content), aliasPrefix))
+	if target == "" || strings.ContainsAny(target, "/\n") {
+		return "", false
+	}
+
+	return target, true
+}
+
+type resolvedReader struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// OpenResolved opens path like Reader, following it if it is an alias object.
+// The target of the alias is returned as well, it is empty if path is not an alias.
+// A missing target is reported like a missing blob
+func OpenResolved(ctx context.Context, storage Storage, path string) (io.ReadCloser, string, error) {
+	r, err := storage.Reader(ctx, path)
+	if err != nil || r == nil {
+		return nil, "", err
+	}
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(aliasPrefix))
+	if string(head) != aliasPrefix {
+		return &resolvedReader{Reader: br, Closer: r}, "", nil
+	}
+
+	content, err := io.ReadAll(io.LimitReader(br, MaxAliasSize+1))
+	_ = r.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	target, ok := ParseAlias(content)
+	if !ok {
+		return nil, "", fmt.Errorf("invalid alias object %s", path)
+	}
+
+	r, err = storage.Reader(ctx, target)
+	if err != nil {
+		return nil, target, fmt.Errorf("could not read alias target %s: %w", target, err)
+	}
+
+	return r, target, nil
+}
+
+// ReadResolved reads path like Read, following it if it is an alias object
+func ReadResolved(ctx context.Context, storage Storage, path string) ([]byte, error) {
+	r, target, err := OpenResolved(ctx, storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		if target != "" {
+			return nil, fmt.Errorf("%w: %s (alias of %s)", ErrNotFound, target, path)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// ReadAlias returns the target of the alias object at path,
+// or an empty string if path is not an alias or does not exist
+func ReadAlias(ctx context.Context, storage Storage, path string) (string, error) {
+	r, err := storage.Reader(ctx, path)
+	if err != nil || r == nil {
+		return "", err
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(io.LimitReader(r, MaxAliasSize+1))
+	if err != nil {
+		return "", err
+	}
+	target, _ := ParseAlias(content)
+
+	return target, nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package blob_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+)
+
+func TestParseAlias(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		target  string
+		ok      bool
+	}{
+		{"alias", "srpmproc-blob-alias:abc\n", "abc", true},
+		{"without newline", "srpmproc-blob-alias:abc", "abc", true},
+		{"plain blob", "abc", "", false},
+		{"empty target", "srpmproc-blob-alias:\n", "", false},
+		{"target with slash", "srpmproc-blob-alias:../abc\n", "", false},
+		{"several lines", "srpmproc-blob-alias:abc\ndef\n", "", false},
+		{"too large", "srpmproc-blob-alias:" + strings.Repeat("a", blob.MaxAliasSize), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, ok := blob.ParseAlias([]byte(tt.content))
+			if target != tt.target || ok != tt.ok {
+				t.Errorf("ParseAlias(%q) = %q, %v, want %q, %v", tt.content, target, ok, tt.target, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWriteAlias(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage := file.New(dir)
+
+	err := blob.WriteAlias(ctx, storage, "alias", "target")
+	if err != nil {
+		t.Fatalf("WriteAlias: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "alias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) > blob.MaxAliasSize {
+		t.Fatalf("alias object is %d bytes, larger than MaxAliasSize", len(content))
+	}
+	target, ok := blob.ParseAlias(content)
+	if !ok || target != "target" {
+		t.Fatalf("ParseAlias of a written alias = %q, %v", target, ok)
+	}
+
+	target, err = blob.ReadAlias(ctx, storage, "alias")
+	if err != nil || target != "target" {
+		t.Fatalf("ReadAlias = %q, %v", target, err)
+	}
+	if err := storage.Write(ctx, "plain", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"plain", "missing"} {
+		target, err = blob.ReadAlias(ctx, storage, path)
+		if err != nil || target != "" {
+			t.Errorf("ReadAlias of %s = %q, %v, want no target", path, target, err)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage := file.New(dir)
+
+	for path, content := range map[string]string{
+		"target": "content",
+		"plain":  "plain content",
+		// starts like an alias but is too large to be one
+		"large": "srpmproc-blob-alias:" + strings.Repeat("a", blob.MaxAliasSize),
+	} {
+		if err := storage.Write(ctx, path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := blob.WriteAlias(ctx, storage, "alias", "target"); err != nil {
+		t.Fatal(err)
+	}
+	if err := blob.WriteAlias(ctx, storage, "dangling", "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		content string
+		target  string
+	}{
+		{"alias", "content", "target"},
+		{"plain", "plain content", ""},
+	}
+	for _, tt := range tests {
+		r, target, err := blob.OpenResolved(ctx, storage, tt.path)
+		if err != nil || r == nil || target != tt.target {
+			t.Fatalf("OpenResolved(%s) = %v, %q, %v", tt.path, r, target, err)
+		}
+		content, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil || string(content) != tt.content {
+			t.Errorf("OpenResolved(%s) content = %q, %v, want %q", tt.path, content, err, tt.content)
+		}
+
+		content, err = blob.ReadResolved(ctx, storage, tt.path)
+		if err != nil || string(content) != tt.content {
+			t.Errorf("ReadResolved(%s) = %q, %v, want %q", tt.path, content, err, tt.content)
+		}
+	}
+
+	// a missing target is reported like a missing blob
+	r, target, err := blob.OpenResolved(ctx, storage, "dangling")
+	if err != nil || r != nil || target != "gone" {
+		t.Fatalf("OpenResolved of a dangling alias = %v, %q, %v", r, target, err)
+	}
+	_, err = blob.ReadResolved(ctx, storage, "dangling")
+	if !errors.Is(err, blob.ErrNotFound) || !strings.Contains(err.Error(), "alias of dangling") {
+		t.Fatalf("ReadResolved of a dangling alias = %v, want ErrNotFound", err)
+	}
+
+	r, target, err = blob.OpenResolved(ctx, storage, "missing")
+	if err != nil || r != nil || target != "" {
+		t.Fatalf("OpenResolved of a missing blob = %v, %q, %v", r, target, err)
+	}
+	_, err = blob.ReadResolved(ctx, storage, "missing")
+	if !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("ReadResolved of a missing blob = %v, want ErrNotFound", err)
+	}
+
+	_, _, err = blob.OpenResolved(ctx, storage, "large")
+	if err == nil || !strings.Contains(err.Error(), "invalid alias object") {
+		t.Fatalf("OpenResolved of an object larger than MaxAliasSize = %v", err)
+	}
+}
@@ -20,8 +20,63 @@
 
 package blob
 
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Info describes a stored blob
+type Info struct {
+	Size    int64
+	ModTime time.Time
+	// Encoded is set if Size is the size of the stored, compressed or encrypted blob
+	// and not the size of its content
+	Encoded bool
+}
+
+// ListFunc is called for every blob found by List, returning an error stops the listing
+type ListFunc func(path string, info *Info) error
+
+// Storage is a blob storage backend.
+// Errors are classified as ErrNotFound, ErrPermission or ErrTransient where possible
 type Storage interface {
-	Write(path string, content []byte) error
-	Read(path string) ([]byte, error)
-	Exists(path string) (bool, error)
+	Write(ctx context.Context, path string, content []byte) error
+	// Read returns ErrNotFound if the blob does not exist
+	Read(ctx context.Context, path string) ([]byte, error)
+	// Exists only returns false without an error if the blob does not exist,
+	// a backend that can not be reached or accessed returns an error
+	Exists(ctx context.Context, path string) (bool, error)
+
+	// Reader streams a blob, it returns nil if the blob does not exist
+	Reader(ctx context.Context, path string) (io.ReadCloser, error)
+	// Writer streams a blob, the blob is stored once Close returns without error.
+	// Cancelling ctx before Close discards the blob
+	Writer(ctx context.Context, path string) (io.WriteCloser, error)
+	// Stat returns nil if the blob does not exist
+	Stat(ctx context.Context, path string) (*Info, error)
+	// List calls fn for every blob with a path starting with prefix
+	List(ctx context.Context, prefix string, fn ListFunc) error
+	// Delete removes a blob, deleting a missing blob is not an error
+	Delete(ctx context.Context, path string) error
+}
+
+// Copy streams r into path, nothing is stored if reading r fails
+func Copy(ctx context.Context, storage Storage, path string, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := storage.Writer(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		cancel()
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
 }
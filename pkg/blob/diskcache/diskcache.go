@@ -0,0 +1,442 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package diskcache
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+// DefaultMaxSize is the default size limit of the cache
+const DefaultMaxSize = 10 << 30
+
+// ErrChecksum is returned if a blob does not match the digest it is stored under
+var ErrChecksum = errors.New("blob does not match its checksum")
+
+// Cache keeps blobs of a backend on local disk, least recently used blobs
+// are evicted once the cache grows beyond its size limit.
+// Only blobs keyed by their digest are cached, as these never change.
+// Cached blobs are verified against their key every time they are read
+type Cache struct {
+	backend blob.Storage
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+type entry struct {
+	path string
+	size int64
+}
+
+// New returns a cache in dir in front of backend.
+// Blobs already in dir are reused, the most recently used first
+func New(backend blob.Storage, dir string, maxSize int64) (*Cache, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create blob cache directory: %v", err)
+	}
+
+	c := &Cache{
+		backend: backend,
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+
+	ls, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read blob cache directory: %v", err)
+	}
+	var infos []os.FileInfo
+	for _, f := range ls {
+		if !cacheable(f.Name()) || !f.Type().IsRegular() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	// the modification time is bumped on every use
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		c.add(info.Name(), info.Size())
+	}
+	c.evict()
+
+	return c, nil
+}
+
+// cacheable returns true for keys that are a digest of the blob
+func cacheable(path string) bool {
+	if data.NewHashForChecksum(path) == nil {
+		return false
+	}
+	_, err := hex.DecodeString(path)
+	return err == nil
+}
+
+func (c *Cache) file(path string) string {
+	return filepath.Join(c.dir, path)
+}
+
+// add records a cached blob as most recently used
+func (c *Cache) add(path string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[path]; ok {
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+	}
+	c.entries[path] = c.lru.PushFront(&entry{path: path, size: size})
+	c.size += size
+}
+
+func (c *Cache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[path]; ok {
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+		delete(c.entries, path)
+	}
+	_ = os.Remove(c.file(path))
+}
+
+// touch marks a cached blob as used, it returns false if the blob is not cached
+func (c *Cache) touch(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[path]
+	if !ok {
+		return false
+	}
+	c.lru.MoveToFront(el)
+	now := time.Now()
+	_ = os.Chtimes(c.file(path), now, now)
+
+	return true
+}
+
+func (c *Cache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*entry)
+		c.lru.Remove(el)
+		delete(c.entries, e.path)
+		c.size -= e.size
+		_ = os.Remove(c.file(e.path))
+	}
+}
+
+// open returns the verified cached blob, or nil if it is not cached.
+// Blobs failing verification are dropped from the cache and ErrChecksum is returned
+func (c *Cache) open(path string) (*os.File, error) {
+	if !c.touch(path) {
+		return nil, nil
+	}
+
+	f, err := os.Open(c.file(path))
+	if err != nil {
+		// evicted by another process sharing the directory
+		c.remove(path)
+		return nil, nil
+	}
+
+	hasher := data.NewHashForChecksum(path)
+	_, err = io.Copy(hasher, f)
+	if err == nil {
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != path {
+			err = fmt.Errorf("%w: cached %s has checksum %s", ErrChecksum, path, sum)
+		} else {
+			_, err = f.Seek(0, io.SeekStart)
+			if err == nil {
+				return f, nil
+			}
+		}
+	}
+	_ = f.Close()
+	c.remove(path)
+	if errors.Is(err, ErrChecksum) {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// cacheWriter writes a blob to a temporary file in the cache directory,
+// the blob is added to the cache by commit if its digest matches its key
+type cacheWriter struct {
+	c      *Cache
+	path   string
+	tmp    *os.File
+	hasher hash.Hash
+	size   int64
+	err    error
+}
+
+func (c *Cache) newWriter(path string) *cacheWriter {
+	w := &cacheWriter{
+		c:      c,
+		path:   path,
+		hasher: data.NewHashForChecksum(path),
+	}
+	w.tmp, w.err = os.CreateTemp(c.dir, fmt.Sprintf(".%s.tmp", path))
+
+	return w
+}
+
+// Write never fails, a failing cache write only skips caching the blob
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+
+	_, w.err = w.tmp.Write(p)
+	_, _ = w.hasher.Write(p)
+	w.size += int64(len(p))
+
+	return len(p), nil
+}
+
+func (w *cacheWriter) abort() {
+	if w.tmp != nil {
+		_ = w.tmp.Close()
+		_ = os.Remove(w.tmp.Name())
+	}
+}
+
+// commit returns ErrChecksum if the blob does not match its key,
+// failing to write the blob to the cache is not an error
+func (w *cacheWriter) commit() error {
+	if w.err != nil {
+		w.abort()
+		return nil
+	}
+	if sum := hex.EncodeToString(w.hasher.Sum(nil)); sum != w.path {
+		w.abort()
+		return fmt.Errorf("%w: %s has checksum %s", ErrChecksum, w.path, sum)
+	}
+
+	err := w.tmp.Close()
+	if err == nil {
+		err = os.Chmod(w.tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(w.tmp.Name(), w.c.file(w.path))
+	}
+	if err != nil {
+		_ = os.Remove(w.tmp.Name())
+		return nil
+	}
+
+	w.c.add(w.path, w.size)
+	w.c.evict()
+
+	return nil
+}
+
+// fill copies a blob from the backend into the cache.
+// It returns false if the backend does not have the blob.
+// Alias objects are stored under a digest they do not match, they are never cached
+func (c *Cache) fill(ctx context.Context, path string) (bool, error) {
+	r, err := c.backend.Reader(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	if r == nil {
+		return false, nil
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(blob.MaxAliasSize + 1)
+	if _, ok := blob.ParseAlias(head); ok {
+		return true, nil
+	}
+
+	w := c.newWriter(path)
+	_, err = io.Copy(w, br)
+	if err != nil {
+		w.abort()
+		return false, err
+	}
+	err = w.commit()
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (c *Cache) Write(ctx context.Context, path string, content []byte) error {
+	err := c.backend.Write(ctx, path, content)
+	if err != nil || !cacheable(path) {
+		return err
+	}
+
+	// alias objects do not match their key and are left uncached
+	w := c.newWriter(path)
+	_, _ = w.Write(content)
+	_ = w.commit()
+
+	return nil
+}
+
+func (c *Cache) Read(ctx context.Context, path string) ([]byte, error) {
+	r, err := c.Reader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("%w: %s", blob.ErrNotFound, path)
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// Exists is answered from the cache if possible, blobs never change once written
+func (c *Cache) Exists(ctx context.Context, path string) (bool, error) {
+	if cacheable(path) && c.touch(path) {
+		return true, nil
+	}
+
+	return c.backend.Exists(ctx, path)
+}
+
+func (c *Cache) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	if !cacheable(path) {
+		return c.backend.Reader(ctx, path)
+	}
+
+	// a corrupted cache file is dropped and fetched again
+	if f, _ := c.open(path); f != nil {
+		return f, nil
+	}
+
+	found, err := c.fill(ctx, path)
+	if err != nil || !found {
+		return nil, err
+	}
+	f, err := c.open(path)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		return f, nil
+	}
+
+	// alias objects and blobs that could not be cached are served from the backend
+	return c.backend.Reader(ctx, path)
+}
+
+// teeWriter writes to the backend and the cache, the blob
+// is only cached once the backend has stored it
+type teeWriter struct {
+	backend io.WriteCloser
+	cache   *cacheWriter
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	n, err := w.backend.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return w.cache.Write(p)
+}
+
+func (w *teeWriter) Close() error {
+	err := w.backend.Close()
+	if err != nil {
+		w.cache.abort()
+		return err
+	}
+	_ = w.cache.commit()
+
+	return nil
+}
+
+func (c *Cache) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	w, err := c.backend.Writer(ctx, path)
+	if err != nil || !cacheable(path) {
+		return w, err
+	}
+
+	return &teeWriter{
+		backend: w,
+		cache:   c.newWriter(path),
+	}, nil
+}
+
+// Stat is always answered by the backend, the cache does not know when a blob was stored
+func (c *Cache) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	return c.backend.Stat(ctx, path)
+}
+
+func (c *Cache) List(ctx context.Context, prefix string, fn blob.ListFunc) error {
+	return c.backend.List(ctx, prefix, fn)
+}
+
+func (c *Cache) Delete(ctx context.Context, path string) error {
+	if cacheable(path) {
+		c.remove(path)
+	}
+
+	return c.backend.Delete(ctx, path)
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package diskcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+)
+
+// countingStorage counts the blobs read from the backend
+type countingStorage struct {
+	blob.Storage
+	reads int
+}
+
+func (s *countingStorage) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	s.reads++
+	return s.Storage.Reader(ctx, path)
+}
+
+func digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func newCache(t *testing.T, dir string, maxSize int64) (*Cache, *countingStorage) {
+	backend := &countingStorage{Storage: file.New(t.TempDir())}
+	c, err := New(backend, dir, maxSize)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return c, backend
+}
+
+func readAll(t *testing.T, c *Cache, path string) string {
+	r, err := c.Reader(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Reader(%s): %v", path, err)
+	}
+	if r == nil {
+		t.Fatalf("Reader(%s): blob not found", path)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+
+	return string(content)
+}
+
+// cached returns the blobs in the cache directory
+func cached(t *testing.T, dir string) string {
+	ls, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range ls {
+		names = append(names, f.Name())
+	}
+
+	return strings.Join(names, ",")
+}
+
+func TestReader(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, backend := newCache(t, dir, 0)
+
+	content := "foo"
+	if err := backend.Write(ctx, digest(content), []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := readAll(t, c, digest(content)); got != content {
+			t.Fatalf("read %q, want %q", got, content)
+		}
+	}
+	if backend.reads != 1 {
+		t.Errorf("backend was read %d times, want once", backend.reads)
+	}
+	if got := cached(t, dir); got != digest(content) {
+		t.Errorf("cache directory has %s", got)
+	}
+
+	r, err := c.Reader(ctx, digest("missing"))
+	if r != nil || err != nil {
+		t.Errorf("Reader of a missing blob = %v, %v", r, err)
+	}
+
+	// only digests are cached, other keys may change
+	if err := backend.Write(ctx, "not-a-digest", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, c, "not-a-digest")
+	readAll(t, c, "not-a-digest")
+	if backend.reads != 4 {
+		t.Errorf("backend was read %d times, want 4", backend.reads)
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// room for three blobs
+	c, _ := newCache(t, dir, 9)
+
+	a, b, cc, d := digest("aaa"), digest("bbb"), digest("ccc"), digest("ddd")
+	for _, content := range []string{"aaa", "bbb", "ccc"} {
+		if err := c.Write(ctx, digest(content), []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a becomes the most recently used blob, b the least recently used one
+	readAll(t, c, a)
+	if err := c.Write(ctx, d, []byte("ddd")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{a: true, b: false, cc: true, d: true} {
+		if _, err := os.Stat(filepath.Join(dir, path)); (err == nil) != want {
+			t.Errorf("%s cached: %v, want %v", path, err == nil, want)
+		}
+	}
+
+	// the evicted blob is fetched from the backend again and evicts c
+	if got := readAll(t, c, b); got != "bbb" {
+		t.Fatalf("read %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, cc)); !os.IsNotExist(err) {
+		t.Errorf("%s was not evicted", cc)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	blobs := []string{"aaa", "bbb", "ccc"}
+	now := time.Now()
+	for i, content := range blobs {
+		path := filepath.Join(dir, digest(content))
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// aaa was used most recently, ccc least recently
+		mtime := now.Add(-time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// left over from an interrupted write and not a digest
+	if err := os.WriteFile(filepath.Join(dir, ".tmp-leftover"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the least recently used blob does not fit
+	c, backend := newCache(t, dir, 7)
+	if _, err := os.Stat(filepath.Join(dir, digest("ccc"))); !os.IsNotExist(err) {
+		t.Errorf("least recently used blob was not evicted on startup")
+	}
+
+	for _, content := range blobs[:2] {
+		if got := readAll(t, c, digest(content)); got != content {
+			t.Fatalf("read %q, want %q", got, content)
+		}
+	}
+	if backend.reads != 0 {
+		t.Errorf("backend was read %d times, blobs should be served from the cache", backend.reads)
+	}
+
+	// reading bumped bbb, so aaa is evicted next
+	if err := c.Write(ctx, digest("ddd"), []byte("ddd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, digest("aaa"))); !os.IsNotExist(err) {
+		t.Errorf("%s was not evicted", digest("aaa"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, digest("bbb"))); err != nil {
+		t.Errorf("%s was evicted", digest("bbb"))
+	}
+}
+
+func TestCorruptedCacheFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, backend := newCache(t, dir, 0)
+
+	path := digest("foo")
+	if err := c.Write(ctx, path, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, path), []byte("bar"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the corrupted file is dropped and the blob fetched again
+	if got := readAll(t, c, path); got != "foo" {
+		t.Fatalf("read %q, want foo", got)
+	}
+	if backend.reads != 1 {
+		t.Errorf("backend was read %d times, want once", backend.reads)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, path)); err != nil || string(content) != "foo" {
+		t.Errorf("cache file has %q, %v", content, err)
+	}
+}
+
+func TestCorruptedBackendBlob(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, backend := newCache(t, dir, 0)
+
+	path := digest("foo")
+	if err := backend.Write(ctx, path, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Reader(ctx, path)
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Reader = %v, %v, want ErrChecksum", r, err)
+	}
+	if _, err := c.Read(ctx, path); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Read = %v, want ErrChecksum", err)
+	}
+	if got := cached(t, dir); got != "" {
+		t.Errorf("cache directory has %s", got)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, _ := newCache(t, dir, 0)
+
+	target := digest("foo")
+	// an alias stored under a sha512 digest of the same content
+	alias := strings.Repeat("ab", 64)
+	if err := c.Write(ctx, target, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := blob.WriteAlias(ctx, c, alias, target); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		content, err := blob.ReadResolved(ctx, c, alias)
+		if err != nil {
+			t.Fatalf("ReadResolved: %v", err)
+		}
+		if !bytes.Equal(content, []byte("foo")) {
+			t.Fatalf("read %q through the alias", content)
+		}
+	}
+	if got := cached(t, dir); got != target {
+		t.Errorf("cache directory has %s, alias objects should not be cached", got)
+	}
+}
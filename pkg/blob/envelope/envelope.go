@@ -0,0 +1,546 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+)
+
+// Stored blobs start with a header:
+//
+//	magic | flags | key id | nonce | wrapped data key
+//
+// The key id, nonce and wrapped data key are only present for encrypted blobs.
+// Every blob is encrypted with its own random data key, which is sealed with the
+// configured key. The content is then split into chunks sealed with AES-GCM,
+// the chunk counter and a last chunk flag form the nonce so chunks can not
+// be reordered or dropped
+const (
+	magic = "SRPMENV1"
+
+	flagCompressed byte = 1 << 0
+	flagEncrypted  byte = 1 << 1
+
+	// KeySize is the size of an encryption key, keys are used for AES-256
+	KeySize = 32
+
+	keyIDSize = 8
+	chunkSize = 64 << 10
+)
+
+var (
+	errTruncated = fmt.Errorf("encrypted blob is truncated: %w", io.ErrUnexpectedEOF)
+	errPlaintext = errors.New("blob is not encrypted, plaintext blobs are rejected")
+)
+
+// Envelope compresses and/or encrypts blobs before they are stored in its backend.
+// Keys are left as is, so blobs are still addressed by the digest of their content.
+// Unless the envelope is strict, blobs stored without an envelope are read as is,
+// so existing storage can be switched over without migrating it first
+type Envelope struct {
+	backend  blob.Storage
+	key      cipher.AEAD
+	keyID    []byte
+	compress bool
+	strict   bool
+}
+
+// New returns an envelope around backend. Blobs are encrypted if key is set
+// and compressed with zstd if compress is true.
+// If strict is true and key is set, blobs that are not encrypted are rejected
+// instead of read as is, so an encrypted blob can not be swapped for plaintext
+func New(backend blob.Storage, key []byte, compress bool, strict bool) (*Envelope, error) {
+	e := &Envelope{
+		backend:  backend,
+		compress: compress,
+		strict:   strict && key != nil,
+	}
+	if key != nil {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		e.key = aead
+		e.keyID = sum[:keyIDSize]
+	}
+
+	return e, nil
+}
+
+// ReadKeyFile reads an encryption key from path.
+// The key can be stored raw or hex or base64 encoded
+func ReadKeyFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read encryption key: %v", err)
+	}
+	if len(content) == KeySize {
+		return content, nil
+	}
+
+	encoded := strings.TrimSpace(string(content))
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("encryption key in %s must be %d bytes, raw or hex or base64 encoded", path, KeySize)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encode writes the header to w and returns a writer encoding into w.
+// Closing the returned writer flushes the encoding, w is not closed
+func (e *Envelope) encode(w io.Writer) (io.WriteCloser, error) {
+	var flags byte
+	if e.compress {
+		flags |= flagCompressed
+	}
+	if e.key != nil {
+		flags |= flagEncrypted
+	}
+
+	header := append([]byte(magic), flags)
+	enc := &encodeWriter{w: w}
+	if e.key != nil {
+		dataKey := make([]byte, KeySize)
+		nonce := make([]byte, e.key.NonceSize())
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, fmt.Errorf("could not generate data key: %v", err)
+		}
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("could not generate nonce: %v", err)
+		}
+		header = append(header, e.keyID...)
+		wrapped := e.key.Seal(nil, nonce, dataKey, header)
+		header = append(append(header, nonce...), wrapped...)
+
+		aead, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		enc.seal = &sealWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}
+		w = enc.seal
+	}
+	if e.compress {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("could not create zstd writer: %v", err)
+		}
+		enc.zw = zw
+	}
+
+	_, err := enc.w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc, nil
+}
+
+// encodeWriter writes through the compression and encryption layers that are enabled
+type encodeWriter struct {
+	w    io.Writer
+	seal *sealWriter
+	zw   *zstd.Encoder
+}
+
+func (e *encodeWriter) Write(p []byte) (int, error) {
+	switch {
+	case e.zw != nil:
+		return e.zw.Write(p)
+	case e.seal != nil:
+		return e.seal.Write(p)
+	}
+
+	return e.w.Write(p)
+}
+
+func (e *encodeWriter) Close() error {
+	if e.zw != nil {
+		if err := e.zw.Close(); err != nil {
+			return fmt.Errorf("could not compress blob: %v", err)
+		}
+	}
+	if e.seal != nil {
+		return e.seal.Close()
+	}
+
+	return nil
+}
+
+// sealWriter encrypts everything written to it in chunks
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+func chunkNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more content follows,
+		// as the last chunk is sealed differently by Close
+		if len(s.buf) == chunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(s.buf[len(s.buf):chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+m]
+		p = p[m:]
+		n += m
+	}
+
+	return n, nil
+}
+
+func (s *sealWriter) flush(last bool) error {
+	sealed := s.aead.Seal(nil, chunkNonce(s.aead, s.counter, last), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+// openReader decrypts the chunks written by sealWriter
+type openReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	n, err := io.ReadFull(o.r, o.sealed[:cap(o.sealed)])
+	last := false
+	switch {
+	case err == io.EOF:
+		// the last chunk is never empty, even for empty content
+		return errTruncated
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		_, err := o.r.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	sealed := o.sealed[:n]
+
+	// chunks are opened in place, except for the last one as a failed
+	// open clears its output and the chunk is needed for a second try
+	dst := sealed[:0]
+	if last {
+		dst = nil
+	}
+	plain, err := o.aead.Open(dst, chunkNonce(o.aead, o.counter, last), sealed, nil)
+	if err != nil {
+		if last {
+			// a chunk that opens as a middle chunk means the following ones are missing
+			if _, err := o.aead.Open(nil, chunkNonce(o.aead, o.counter, false), sealed, nil); err == nil {
+				return errTruncated
+			}
+		}
+		return fmt.Errorf("could not decrypt blob, it is corrupt")
+	}
+	o.counter++
+	o.plain = plain
+	o.done = last
+
+	return nil
+}
+
+// decode reads the header from r and returns a reader decoding the content.
+// Content without a header is returned as is, unless the envelope is strict
+func (e *Envelope) decode(r io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReaderSize(r, chunkSize)
+	head, err := br.Peek(len(magic))
+	if err != nil || string(head) != magic {
+		if e.strict {
+			return nil, nil, errPlaintext
+		}
+		return br, func() {}, nil
+	}
+	_, _ = br.Discard(len(magic))
+
+	flags, err := br.ReadByte()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read blob header: %w", err)
+	}
+	if flags&^(flagCompressed|flagEncrypted) != 0 {
+		return nil, nil, fmt.Errorf("blob header has unknown flags %#x", flags)
+	}
+
+	if e.strict && flags&flagEncrypted == 0 {
+		return nil, nil, errPlaintext
+	}
+
+	var content io.Reader = br
+	if flags&flagEncrypted != 0 {
+		if e.key == nil {
+			return nil, nil, blob.Classify(blob.ErrPermission, errors.New("blob is encrypted but no encryption key is configured"))
+		}
+
+		keyID := make([]byte, keyIDSize)
+		nonce := make([]byte, e.key.NonceSize())
+		wrapped := make([]byte, KeySize+e.key.Overhead())
+		for _, field := range [][]byte{keyID, nonce, wrapped} {
+			if _, err := io.ReadFull(br, field); err != nil {
+				return nil, nil, fmt.Errorf("could not read blob header: %w", err)
+			}
+		}
+		if !bytes.Equal(keyID, e.keyID) {
+			return nil, nil, blob.Classify(blob.ErrPermission, errors.New("blob was encrypted with another key"))
+		}
+
+		header := append(append([]byte(magic), flags), keyID...)
+		dataKey, err := e.key.Open(nil, nonce, wrapped, header)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not decrypt data key, the blob header is corrupt")
+		}
+		aead, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		content = &openReader{
+			r:      br,
+			aead:   aead,
+			sealed: make([]byte, 0, chunkSize+aead.Overhead()),
+		}
+	}
+
+	if flags&flagCompressed != 0 {
+		dec, err := zstd.NewReader(content, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create zstd reader: %v", err)
+		}
+		return dec, dec.Close, nil
+	}
+
+	return content, func() {}, nil
+}
+
+func (e *Envelope) Write(ctx context.Context, path string, content []byte) error {
+	var buf bytes.Buffer
+	enc, err := e.encode(&buf)
+	if err != nil {
+		return err
+	}
+	_, err = enc.Write(content)
+	if err != nil {
+		return err
+	}
+	err = enc.Close()
+	if err != nil {
+		return err
+	}
+
+	return e.backend.Write(ctx, path, buf.Bytes())
+}
+
+func (e *Envelope) Read(ctx context.Context, path string) ([]byte, error) {
+	r, err := e.Reader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("%w: %s", blob.ErrNotFound, path)
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (e *Envelope) Exists(ctx context.Context, path string) (bool, error) {
+	return e.backend.Exists(ctx, path)
+}
+
+// envelopeReader closes the decoder and the backend reader
+type envelopeReader struct {
+	io.Reader
+	body  io.Closer
+	close func()
+}
+
+func (r *envelopeReader) Close() error {
+	r.close()
+	return r.body.Close()
+}
+
+func (e *Envelope) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	body, err := e.backend.Reader(ctx, path)
+	if err != nil || body == nil {
+		return nil, err
+	}
+
+	content, closeContent, err := e.decode(body)
+	if err != nil {
+		_ = body.Close()
+		return nil, fmt.Errorf("could not open blob %s: %w", path, err)
+	}
+
+	return &envelopeReader{
+		Reader: content,
+		body:   body,
+		close:  closeContent,
+	}, nil
+}
+
+// envelopeWriter encodes into a backend writer
+type envelopeWriter struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	enc     io.WriteCloser
+	backend io.WriteCloser
+}
+
+func (w *envelopeWriter) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+func (w *envelopeWriter) Close() error {
+	defer w.cancel()
+
+	// a cancelled ctx discards the blob, so there is nothing to flush
+	if w.ctx.Err() == nil {
+		if err := w.enc.Close(); err != nil {
+			w.cancel()
+			_ = w.backend.Close()
+			return err
+		}
+	}
+
+	return w.backend.Close()
+}
+
+func (e *Envelope) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	backend, err := e.backend.Writer(ctx, path)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	enc, err := e.encode(backend)
+	if err != nil {
+		cancel()
+		_ = backend.Close()
+		return nil, err
+	}
+
+	return &envelopeWriter{
+		ctx:     ctx,
+		cancel:  cancel,
+		enc:     enc,
+		backend: backend,
+	}, nil
+}
+
+// Stat returns the size of the stored blob, not of its content
+func (e *Envelope) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	info, err := e.backend.Stat(ctx, path)
+	if err != nil || info == nil {
+		return info, err
+	}
+	info.Encoded = true
+
+	return info, nil
+}
+
+func (e *Envelope) List(ctx context.Context, prefix string, fn blob.ListFunc) error {
+	return e.backend.List(ctx, prefix, func(path string, info *blob.Info) error {
+		info.Encoded = true
+		return fn(path, info)
+	})
+}
+
+func (e *Envelope) Delete(ctx context.Context, path string) error {
+	return e.backend.Delete(ctx, path)
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+)
+
+// size of the header of an encrypted blob
+const encryptedHeaderSize = len(magic) + 1 + keyIDSize + 12 + KeySize + 16
+
+func testKey(t *testing.T) []byte {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7 % 251)
+	}
+
+	return content
+}
+
+func newTestEnvelope(t *testing.T, key []byte, compress bool, strict bool) (*Envelope, string) {
+	dir := t.TempDir()
+	e, err := New(file.New(dir), key, compress, strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e, dir
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	key := testKey(t)
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 3*chunkSize + 17}
+
+	for _, mode := range []struct {
+		name     string
+		key      []byte
+		compress bool
+	}{
+		{"compressed", nil, true},
+		{"encrypted", key, false},
+		{"compressed and encrypted", key, true},
+	} {
+		for _, size := range sizes {
+			t.Run(fmt.Sprintf("%s/%d", mode.name, size), func(t *testing.T) {
+				e, dir := newTestEnvelope(t, mode.key, mode.compress, false)
+				content := testContent(size)
+
+				err := e.Write(ctx, "write", content)
+				if err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				err = blob.Copy(ctx, e, "stream", bytes.NewReader(content))
+				if err != nil {
+					t.Fatalf("Copy: %v", err)
+				}
+
+				for _, path := range []string{"write", "stream"} {
+					read, err := e.Read(ctx, path)
+					if err != nil {
+						t.Fatalf("Read %s: %v", path, err)
+					}
+					if !bytes.Equal(read, content) {
+						t.Fatalf("Read %s returned %d bytes that differ from the %d written", path, len(read), len(content))
+					}
+
+					stored, err := os.ReadFile(filepath.Join(dir, path))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if mode.key != nil && size > 16 && bytes.Contains(stored, content[:16]) {
+						t.Fatalf("%s is stored in plaintext", path)
+					}
+				}
+			})
+		}
+	}
+}
+
+// writeEncrypted stores content encrypted and uncompressed and returns the stored bytes
+func writeEncrypted(t *testing.T, e *Envelope, dir string, content []byte) []byte {
+	err := e.Write(context.Background(), "blob", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, "blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stored
+}
+
+func storeRaw(t *testing.T, dir string, content []byte) {
+	err := os.WriteFile(filepath.Join(dir, "blob"), content, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAll reads the blob through the envelope, returning errors of opening and reading
+func readAll(e *Envelope) ([]byte, error) {
+	return e.Read(context.Background(), "blob")
+}
+
+func TestTamper(t *testing.T) {
+	e, dir := newTestEnvelope(t, testKey(t), false, false)
+	stored := writeEncrypted(t, e, dir, testContent(2*chunkSize+100))
+
+	for _, offset := range []int{
+		len(magic) + 1,              // key id
+		len(magic) + 1 + keyIDSize,  // wrapped key nonce
+		encryptedHeaderSize - 1,     // wrapped key
+		encryptedHeaderSize,         // first chunk
+		encryptedHeaderSize + 70000, // second chunk
+		len(stored) - 1,             // last chunk tag
+	} {
+		tampered := bytes.Clone(stored)
+		tampered[offset] ^= 0x01
+		storeRaw(t, dir, tampered)
+
+		_, err := readAll(e)
+		if err == nil {
+			t.Errorf("flipping byte %d was not detected", offset)
+		}
+	}
+
+	// flags are authenticated as part of the wrapped key
+	tampered := bytes.Clone(stored)
+	tampered[len(magic)] |= flagCompressed
+	storeRaw(t, dir, tampered)
+	if _, err := readAll(e); err == nil {
+		t.Error("changing the flags was not detected")
+	}
+}
+
+func TestReorder(t *testing.T) {
+	e, dir := newTestEnvelope(t, testKey(t), false, false)
+	stored := writeEncrypted(t, e, dir, testContent(3*chunkSize+100))
+
+	sealedSize := chunkSize + 16
+	first := stored[encryptedHeaderSize : encryptedHeaderSize+sealedSize]
+	second := stored[encryptedHeaderSize+sealedSize : encryptedHeaderSize+2*sealedSize]
+
+	var reordered []byte
+	reordered = append(reordered, stored[:encryptedHeaderSize]...)
+	reordered = append(reordered, second...)
+	reordered = append(reordered, first...)
+	reordered = append(reordered, stored[encryptedHeaderSize+2*sealedSize:]...)
+	storeRaw(t, dir, reordered)
+
+	_, err := readAll(e)
+	if err == nil {
+		t.Fatal("swapped chunks were not detected")
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	e, dir := newTestEnvelope(t, testKey(t), false, false)
+	stored := writeEncrypted(t, e, dir, testContent(3*chunkSize+100))
+	sealedSize := chunkSize + 16
+
+	for _, size := range []int{
+		encryptedHeaderSize,                  // no chunks at all
+		encryptedHeaderSize + sealedSize,     // at a chunk boundary
+		encryptedHeaderSize + 2*sealedSize,   // at a chunk boundary
+		encryptedHeaderSize + sealedSize + 5, // within a chunk
+		len(stored) - 1,                      // within the last chunk
+	} {
+		storeRaw(t, dir, stored[:size])
+
+		_, err := readAll(e)
+		if err == nil {
+			t.Errorf("truncating to %d bytes was not detected", size)
+		}
+	}
+
+	// a cut at a chunk boundary is reported as truncation and not as corruption
+	storeRaw(t, dir, stored[:encryptedHeaderSize+sealedSize])
+	_, err := readAll(e)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncation at a chunk boundary = %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	// a truncated header
+	storeRaw(t, dir, stored[:encryptedHeaderSize-10])
+	if _, err := readAll(e); err == nil {
+		t.Error("truncated header was not detected")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	e, dir := newTestEnvelope(t, testKey(t), false, false)
+	writeEncrypted(t, e, dir, testContent(100))
+
+	other, err := New(file.New(dir), testKey(t), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAll(other)
+	if !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("Read with another key = %v, want ErrPermission", err)
+	}
+
+	noKey, err := New(file.New(dir), nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAll(noKey)
+	if !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("Read without a key = %v, want ErrPermission", err)
+	}
+
+	_, err = New(file.New(dir), []byte("short"), false, false)
+	if err == nil {
+		t.Fatal("New accepted a short key")
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	key := testKey(t)
+	content := []byte("stored before encryption was enabled")
+
+	e, dir := newTestEnvelope(t, key, false, false)
+	storeRaw(t, dir, content)
+	read, err := readAll(e)
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("Read of a plaintext blob = %q, %v", read, err)
+	}
+
+	strict, err := New(file.New(dir), key, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAll(strict)
+	if !errors.Is(err, errPlaintext) {
+		t.Fatalf("strict Read of a plaintext blob = %v, want errPlaintext", err)
+	}
+
+	// compressed but not encrypted blobs are plaintext too
+	compressed, err := New(file.New(dir), nil, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressed.Write(context.Background(), "blob", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAll(strict)
+	if !errors.Is(err, errPlaintext) {
+		t.Fatalf("strict Read of a compressed blob = %v, want errPlaintext", err)
+	}
+
+	// short blobs can not hold a header
+	storeRaw(t, dir, []byte("x"))
+	_, err = readAll(strict)
+	if !errors.Is(err, errPlaintext) {
+		t.Fatalf("strict Read of a short blob = %v, want errPlaintext", err)
+	}
+
+	// strict has no effect without a key
+	plain, err := New(file.New(dir), nil, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err = readAll(plain)
+	if err != nil || string(read) != "x" {
+		t.Fatalf("Read without a key = %q, %v", read, err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Errors returned by every backend, test for them with errors.Is
+var (
+	// ErrNotFound is returned by Read if a blob does not exist
+	ErrNotFound = errors.New("blob not found")
+	// ErrPermission is returned if the credentials are missing or not allowed to access a blob,
+	// or if the storage itself is misconfigured, such as a bucket that does not exist
+	ErrPermission = errors.New("blob storage permission denied")
+	// ErrTransient is returned for throttling, timeouts and server errors, retrying may succeed
+	ErrTransient = errors.New("blob storage temporarily unavailable")
+)
+
+// Classify wraps err with class, so errors.Is(err, class) holds.
+// err is returned as is if class is nil or err is already classified
+func Classify(class error, err error) error {
+	if class == nil || err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrPermission) || errors.Is(err, ErrTransient) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %v", class, err)
+}
+
+// ClassForStatus returns the error class of an HTTP status code, or nil if there is none
+func ClassForStatus(status int) error {
+	switch {
+	case status == http.StatusNotFound:
+		return ErrNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrPermission
+	case status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500:
+		return ErrTransient
+	}
+
+	return nil
+}
+
+// ClassifyNetwork marks network errors such as timeouts and refused connections as transient
+func ClassifyNetwork(err error) error {
+	var netErr net.Error
+	var opErr *net.OpError
+	if errors.As(err, &netErr) || errors.As(err, &opErr) {
+		return Classify(ErrTransient, err)
+	}
+
+	return err
+}
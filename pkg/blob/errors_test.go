@@ -0,0 +1,99 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClassForStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{http.StatusOK, nil},
+		{http.StatusBadRequest, nil},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusUnauthorized, ErrPermission},
+		{http.StatusForbidden, ErrPermission},
+		{http.StatusRequestTimeout, ErrTransient},
+		{http.StatusTooManyRequests, ErrTransient},
+		{http.StatusInternalServerError, ErrTransient},
+		{http.StatusServiceUnavailable, ErrTransient},
+	}
+	for _, tt := range tests {
+		if got := ClassForStatus(tt.status); got != tt.want {
+			t.Errorf("ClassForStatus(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	base := errors.New("boom")
+
+	err := Classify(ErrTransient, base)
+	if !errors.Is(err, ErrTransient) {
+		t.Fatalf("Classify did not wrap the class: %v", err)
+	}
+	if Classify(nil, base) != base {
+		t.Error("Classify with a nil class changed the error")
+	}
+	if Classify(ErrNotFound, nil) != nil {
+		t.Error("Classify of a nil error is not nil")
+	}
+	if again := Classify(ErrNotFound, err); again != err || errors.Is(again, ErrNotFound) {
+		t.Errorf("Classify reclassified an already classified error: %v", again)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyNetwork(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"plain", errors.New("bad request"), false},
+		{"timeout", fmt.Errorf("get: %w", timeoutError{}), true},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyNetwork(tt.err)
+			if errors.Is(got, ErrTransient) != tt.transient {
+				t.Errorf("ClassifyNetwork(%v) = %v, transient want %v", tt.err, got, tt.transient)
+			}
+			if !tt.transient && got != tt.err {
+				t.Errorf("ClassifyNetwork changed a non network error: %v", got)
+			}
+		})
+	}
+}
@@ -21,10 +21,15 @@
 package file
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
 )
 
 type File struct {
@@ -37,10 +42,23 @@ func New(path string) *File {
 	}
 }
 
-func (f *File) Write(path string, content []byte) error {
+// classify marks permission errors, the file system has no transient errors
+func classify(err error) error {
+	if os.IsPermission(err) {
+		return blob.Classify(blob.ErrPermission, err)
+	}
+
+	return err
+}
+
+func (f *File) Write(ctx context.Context, path string, content []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	w, err := os.OpenFile(filepath.Join(f.path, path), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
 	if err != nil {
-		return fmt.Errorf("could not open file: %v", err)
+		return fmt.Errorf("could not open file: %w", classify(err))
 	}
 
 	_, err = w.Write(content)
@@ -56,15 +74,21 @@ func (f *File) Write(path string, content []byte) error {
 	return nil
 }
 
-func (f *File) Read(path string) ([]byte, error) {
+func (f *File) Read(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	r, err := os.OpenFile(filepath.Join(f.path, path), os.O_RDONLY, 0o644)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return nil, fmt.Errorf("%w: %s", blob.ErrNotFound, path)
 		}
-		return nil, err
+		return nil, classify(err)
 	}
 
+	defer r.Close()
+
 	body, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
@@ -73,14 +97,166 @@ func (f *File) Read(path string) ([]byte, error) {
 	return body, nil
 }
 
-func (f *File) Exists(path string) (bool, error) {
+func (f *File) Exists(ctx context.Context, path string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
 	_, err := os.Stat(filepath.Join(f.path, path))
-	if !os.IsNotExist(err) {
-		if !os.IsExist(err) {
-			return false, err
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, classify(err)
+	}
+
+	return true, nil
+}
+
+func (f *File) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r, err := os.Open(filepath.Join(f.path, path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, classify(err)
+	}
+
+	return r, nil
+}
+
+// fileWriter writes to a temporary file that is renamed
+// into place on Close, so readers never see partial blobs
+type fileWriter struct {
+	ctx    context.Context
+	tmp    *os.File
+	target string
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return w.tmp.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	err := w.tmp.Close()
+	if err == nil {
+		err = w.ctx.Err()
+	}
+	if err != nil {
+		_ = os.Remove(w.tmp.Name())
+		return fmt.Errorf("could not close file writer to source: %v", err)
+	}
+
+	err = os.Chmod(w.tmp.Name(), 0o644)
+	if err != nil {
+		_ = os.Remove(w.tmp.Name())
+		return fmt.Errorf("could not set file mode: %v", err)
+	}
+
+	err = os.Rename(w.tmp.Name(), w.target)
+	if err != nil {
+		_ = os.Remove(w.tmp.Name())
+		return fmt.Errorf("could not move file into place: %v", err)
+	}
+
+	return nil
+}
+
+func (f *File) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	target := filepath.Join(f.path, path)
+	tmp, err := os.CreateTemp(filepath.Dir(target), fmt.Sprintf(".%s.tmp", filepath.Base(target)))
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", classify(err))
+	}
+
+	return &fileWriter{
+		ctx:    ctx,
+		tmp:    tmp,
+		target: target,
+	}, nil
+}
+
+func (f *File) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(filepath.Join(f.path, path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
-		return true, nil
+		return nil, classify(err)
 	}
 
-	return false, nil
+	return &blob.Info{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (f *File) List(ctx context.Context, prefix string, fn blob.ListFunc) error {
+	return filepath.WalkDir(f.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return classify(err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// skip writes in progress
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.path, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !strings.HasPrefix(rel, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			// removed while listing
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		return fn(rel, &blob.Info{
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	})
+}
+
+func (f *File) Delete(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(f.path, path))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not delete file: %w", classify(err))
+	}
+
+	return nil
 }
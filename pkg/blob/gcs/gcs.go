@@ -22,10 +22,14 @@ package gcs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 
 	"cloud.google.com/go/storage"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
 type GCS struct {
@@ -44,44 +48,131 @@ func New(name string) (*GCS, error) {
 	}, nil
 }
 
-func (g *GCS) Write(path string, content []byte) error {
-	ctx := context.Background()
+// classify maps gcs errors to the blob error classes
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return blob.Classify(blob.ErrNotFound, err)
+	}
+	// A missing bucket is a configuration error, not a missing blob
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return blob.Classify(blob.ErrPermission, err)
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return blob.Classify(blob.ClassForStatus(apiErr.Code), err)
+	}
+
+	return blob.ClassifyNetwork(err)
+}
+
+func (g *GCS) Write(ctx context.Context, path string, content []byte) error {
 	obj := g.bucket.Object(path)
 	w := obj.NewWriter(ctx)
 
 	_, err := w.Write(content)
 	if err != nil {
-		return fmt.Errorf("could not write file to gcs: %v", err)
+		return fmt.Errorf("could not write file to gcs: %w", classify(err))
 	}
 
 	// Close, just like writing a file.
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("could not close gcs writer to source: %v", err)
+		return fmt.Errorf("could not close gcs writer to source: %w", classify(err))
 	}
 
 	return nil
 }
 
-func (g *GCS) Read(path string) ([]byte, error) {
-	ctx := context.Background()
+func (g *GCS) Read(ctx context.Context, path string) ([]byte, error) {
 	obj := g.bucket.Object(path)
 
 	r, err := obj.NewReader(ctx)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
+	defer r.Close()
 
 	body, err := io.ReadAll(r)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 
 	return body, nil
 }
 
-func (g *GCS) Exists(path string) (bool, error) {
-	ctx := context.Background()
-	obj := g.bucket.Object(path)
-	_, err := obj.NewReader(ctx)
-	return err == nil, nil
+func (g *GCS) Exists(ctx context.Context, path string) (bool, error) {
+	_, err := g.bucket.Object(path).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, classify(err)
+	}
+
+	return true, nil
+}
+
+func (g *GCS) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	r, err := g.bucket.Object(path).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, nil
+		}
+		return nil, classify(err)
+	}
+
+	return r, nil
+}
+
+func (g *GCS) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	// the gcs writer already discards the object if ctx is cancelled
+	return g.bucket.Object(path).NewWriter(ctx), nil
+}
+
+func (g *GCS) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	attrs, err := g.bucket.Object(path).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, nil
+		}
+		return nil, classify(err)
+	}
+
+	return &blob.Info{
+		Size:    attrs.Size,
+		ModTime: attrs.Updated,
+	}, nil
+}
+
+func (g *GCS) List(ctx context.Context, prefix string, fn blob.ListFunc) error {
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not list gcs objects: %w", classify(err))
+		}
+
+		err = fn(attrs.Name, &blob.Info{
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (g *GCS) Delete(ctx context.Context, path string) error {
+	err := g.bucket.Object(path).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("could not delete gcs object: %w", classify(err))
+	}
+
+	return nil
 }
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"object not exist", fmt.Errorf("read: %w", storage.ErrObjectNotExist), blob.ErrNotFound},
+		{"bucket not exist", storage.ErrBucketNotExist, blob.ErrPermission},
+		{"api not found", &googleapi.Error{Code: 404}, blob.ErrNotFound},
+		{"api forbidden", &googleapi.Error{Code: 403}, blob.ErrPermission},
+		{"api rate limit", &googleapi.Error{Code: 429}, blob.ErrTransient},
+		{"api server error", &googleapi.Error{Code: 502}, blob.ErrTransient},
+		{"api bad request", &googleapi.Error{Code: 400}, nil},
+		{"other", errors.New("boom"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.err)
+			for _, class := range []error{blob.ErrNotFound, blob.ErrPermission, blob.ErrTransient} {
+				if errors.Is(got, class) != (class == tt.want) {
+					t.Errorf("classify(%v) = %v, want class %v", tt.err, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,669 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/spf13/viper"
+)
+
+const (
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	emptyMediaType    = "application/vnd.oci.empty.v1+json"
+	sourceMediaType   = "application/octet-stream"
+	// ArtifactType marks the manifests of lookaside sources
+	ArtifactType = "application/vnd.srpmproc.lookaside.v1"
+
+	titleAnnotation   = "org.opencontainers.image.title"
+	createdAnnotation = "org.opencontainers.image.created"
+)
+
+// the empty config every artifact manifest points to
+var (
+	emptyConfig       = []byte("{}")
+	emptyConfigDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+)
+
+// errNotSource is returned for manifests that were not written by this backend,
+// a repository may hold other artifacts next to the lookaside sources
+var errNotSource = errors.New("not a lookaside source")
+
+// tags may only contain these characters, which covers every hex digest up to sha512
+var tagRegex = regexp.MustCompile("^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$")
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// OCI stores blobs in a repository of an OCI registry.
+// Every blob is pushed as a single layer artifact tagged with its path,
+// the registry deduplicates the layers by their sha256 digest
+type OCI struct {
+	scheme     string
+	registry   string
+	repository string
+	client     *http.Client
+	username   string
+	password   string
+
+	mu    sync.Mutex
+	token string
+}
+
+// New returns a backend for addr in the form registry/repository.
+// Credentials are taken from the url or the oci-username and oci-password settings.
+// Registries are accessed over https unless oci-plain-http is set.
+// If client is nil, http.DefaultClient is used
+func New(addr string, client *http.Client) (*OCI, error) {
+	u, err := url.Parse("oci://" + strings.TrimPrefix(addr, "oci://"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse oci storage address: %w", err)
+	}
+	repository := strings.Trim(u.Path, "/")
+	if u.Host == "" || repository == "" {
+		return nil, fmt.Errorf("oci storage address has to be registry/repository")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	o := &OCI{
+		scheme:     "https",
+		registry:   u.Host,
+		repository: repository,
+		client:     client,
+		username:   viper.GetString("oci-username"),
+		password:   viper.GetString("oci-password"),
+	}
+	if viper.GetBool("oci-plain-http") {
+		o.scheme = "http"
+	}
+	if u.User != nil {
+		o.username = u.User.Username()
+		o.password, _ = u.User.Password()
+	}
+
+	return o, nil
+}
+
+func (o *OCI) url(format string, args ...interface{}) string {
+	return fmt.Sprintf("%s://%s/v2/%s/%s", o.scheme, o.registry, o.repository, fmt.Sprintf(format, args...))
+}
+
+// do sends a request, authenticating with a bearer token from the registry
+// if it asks for one. getBody has to return a fresh body for the retry
+func (o *OCI) do(ctx context.Context, method string, u string, header http.Header, getBody func() io.Reader) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		var body io.Reader
+		if getBody != nil {
+			body = getBody()
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, body)
+		if err != nil {
+			return nil, fmt.Errorf("could not create request: %w", err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if b, ok := body.(*bytes.Reader); ok {
+			req.ContentLength = int64(b.Len())
+		}
+
+		o.mu.Lock()
+		token := o.token
+		o.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if o.username != "" {
+			req.SetBasicAuth(o.username, o.password)
+		}
+
+		resp, err := o.client.Do(req)
+		if err != nil {
+			return nil, blob.ClassifyNetwork(err)
+		}
+
+		return resp, nil
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_ = resp.Body.Close()
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return nil, blob.Classify(blob.ErrPermission, fmt.Errorf("%s %s returned %s", method, u, resp.Status))
+	}
+	err = o.fetchToken(ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return send()
+}
+
+// fetchToken requests a bearer token as described by a WWW-Authenticate challenge
+func (o *OCI) fetchToken(ctx context.Context, challenge string) error {
+	params := map[string]string{}
+	for _, part := range strings.Split(challenge[len("bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid registry auth challenge: %s", challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	// always ask for push and pull, uploads need both
+	query.Set("scope", fmt.Sprintf("repository:%s:pull,push,delete", o.repository))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return fmt.Errorf("could not create token request: %w", err)
+	}
+	if o.username != "" {
+		req.SetBasicAuth(o.username, o.password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not get registry token: %w", blob.ClassifyNetwork(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return blob.Classify(blob.ClassForStatus(resp.StatusCode), fmt.Errorf("could not get registry token: %s", resp.Status))
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return fmt.Errorf("could not decode registry token: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = tokenResp.Token
+	if o.token == "" {
+		o.token = tokenResp.AccessToken
+	}
+
+	return nil
+}
+
+func statusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("%s %s returned %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	return blob.Classify(blob.ClassForStatus(resp.StatusCode), err)
+}
+
+// getManifest returns the manifest tagged path, or nil if there is none
+func (o *OCI) getManifest(ctx context.Context, path string) (*manifest, error) {
+	if !tagRegex.MatchString(path) {
+		return nil, fmt.Errorf("%s can not be stored in an oci registry", path)
+	}
+
+	resp, err := o.do(ctx, http.MethodGet, o.url("manifests/%s", path), http.Header{"Accept": {manifestMediaType}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+
+	var m manifest
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode manifest: %w", err)
+	}
+	if len(m.Layers) != 1 {
+		return nil, fmt.Errorf("manifest %s is %w", path, errNotSource)
+	}
+
+	return &m, nil
+}
+
+// startUpload returns the location of a new blob upload
+func (o *OCI) startUpload(ctx context.Context) (string, error) {
+	resp, err := o.do(ctx, http.MethodPost, o.url("blobs/uploads/"), nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not start upload: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", statusError(resp)
+	}
+
+	return o.location(resp)
+}
+
+func (o *OCI) location(resp *http.Response) (string, error) {
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location: %w", err)
+	}
+
+	return location.String(), nil
+}
+
+// finishUpload completes an upload at location with digest, content is sent along if not nil
+func (o *OCI) finishUpload(ctx context.Context, location string, digest string, content []byte) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid upload location: %w", err)
+	}
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	resp, err := o.do(ctx, http.MethodPut, u.String(), http.Header{"Content-Type": {"application/octet-stream"}}, func() io.Reader {
+		return bytes.NewReader(content)
+	})
+	if err != nil {
+		return fmt.Errorf("could not finish upload: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(resp)
+	}
+
+	return nil
+}
+
+// blobExists checks if the registry already has a blob, so it does not have to be uploaded again
+func (o *OCI) blobExists(ctx context.Context, digest string) (bool, error) {
+	resp, err := o.do(ctx, http.MethodHead, o.url("blobs/%s", digest), nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("could not check blob: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+func (o *OCI) pushBlob(ctx context.Context, digest string, content []byte) error {
+	exists, err := o.blobExists(ctx, digest)
+	if err != nil || exists {
+		return err
+	}
+
+	location, err := o.startUpload(ctx)
+	if err != nil {
+		return err
+	}
+
+	return o.finishUpload(ctx, location, digest, content)
+}
+
+// pushManifest tags a manifest pointing at the uploaded layer with path
+func (o *OCI) pushManifest(ctx context.Context, path string, digest string, size int64) error {
+	err := o.pushBlob(ctx, emptyConfigDigest, emptyConfig)
+	if err != nil {
+		return err
+	}
+
+	m := &manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		ArtifactType:  ArtifactType,
+		Config: descriptor{
+			MediaType: emptyMediaType,
+			Digest:    emptyConfigDigest,
+			Size:      int64(len(emptyConfig)),
+		},
+		Layers: []descriptor{
+			{
+				MediaType:   sourceMediaType,
+				Digest:      digest,
+				Size:        size,
+				Annotations: map[string]string{titleAnnotation: path},
+			},
+		},
+		Annotations: map[string]string{
+			createdAnnotation: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not encode manifest: %w", err)
+	}
+
+	resp, err := o.do(ctx, http.MethodPut, o.url("manifests/%s", path), http.Header{"Content-Type": {manifestMediaType}}, func() io.Reader {
+		return bytes.NewReader(content)
+	})
+	if err != nil {
+		return fmt.Errorf("could not push manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(resp)
+	}
+
+	return nil
+}
+
+func (o *OCI) Write(ctx context.Context, path string, content []byte) error {
+	if !tagRegex.MatchString(path) {
+		return fmt.Errorf("%s can not be stored in an oci registry", path)
+	}
+
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	err := o.pushBlob(ctx, digest, content)
+	if err != nil {
+		return err
+	}
+
+	return o.pushManifest(ctx, path, digest, int64(len(content)))
+}
+
+func (o *OCI) Read(ctx context.Context, path string) ([]byte, error) {
+	r, err := o.Reader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("%w: %s", blob.ErrNotFound, path)
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (o *OCI) Exists(ctx context.Context, path string) (bool, error) {
+	m, err := o.getManifest(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	return m != nil, nil
+}
+
+func (o *OCI) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	m, err := o.getManifest(ctx, path)
+	if err != nil || m == nil {
+		return nil, err
+	}
+
+	resp, err := o.do(ctx, http.MethodGet, o.url("blobs/%s", m.Layers[0].Digest), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get blob: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, statusError(resp)
+	}
+
+	return resp.Body, nil
+}
+
+// ociWriter streams a blob upload running in the background.
+// The manifest is pushed on Close once the digest is known
+type ociWriter struct {
+	o      *OCI
+	ctx    context.Context
+	path   string
+	pw     *io.PipeWriter
+	hasher hash.Hash
+	size   int64
+	done   chan struct{}
+	// location to finish the upload at, set once the upload succeeded
+	location string
+	err      error
+}
+
+func (w *ociWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	_, _ = w.hasher.Write(p[:n])
+	w.size += int64(n)
+	if err != nil {
+		// the upload failed early, report why instead of the closed pipe
+		<-w.done
+		if w.err != nil {
+			err = w.err
+		}
+	}
+
+	return n, err
+}
+
+func (w *ociWriter) Close() error {
+	// a cancelled ctx aborts the upload instead of completing it
+	_ = w.pw.CloseWithError(w.ctx.Err())
+	<-w.done
+	if w.err != nil {
+		return w.err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(w.hasher.Sum(nil))
+	err := w.o.finishUpload(w.ctx, w.location, digest, nil)
+	if err != nil {
+		return err
+	}
+
+	return w.o.pushManifest(w.ctx, w.path, digest, w.size)
+}
+
+func (o *OCI) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	if !tagRegex.MatchString(path) {
+		return nil, fmt.Errorf("%s can not be stored in an oci registry", path)
+	}
+
+	location, err := o.startUpload(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	w := &ociWriter{
+		o:      o,
+		ctx:    ctx,
+		path:   path,
+		pw:     pw,
+		hasher: sha256.New(),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		// the body can not be replayed, so the token has to be fetched before
+		// the upload starts. startUpload did that already if it was needed
+		resp, err := o.do(ctx, http.MethodPatch, location, http.Header{"Content-Type": {"application/octet-stream"}}, func() io.Reader {
+			return pr
+		})
+		if err == nil {
+			if resp.StatusCode != http.StatusAccepted {
+				err = statusError(resp)
+			} else {
+				w.location, err = o.location(resp)
+			}
+			_ = resp.Body.Close()
+		} else {
+			err = fmt.Errorf("could not upload blob: %w", err)
+		}
+		w.err = err
+		// unblock the writer if the upload failed early
+		_ = pr.CloseWithError(err)
+		close(w.done)
+	}()
+
+	return w, nil
+}
+
+func (o *OCI) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	m, err := o.getManifest(ctx, path)
+	if err != nil || m == nil {
+		return nil, err
+	}
+
+	info := &blob.Info{
+		Size: m.Layers[0].Size,
+	}
+	if created, err := time.Parse(time.RFC3339, m.Annotations[createdAnnotation]); err == nil {
+		info.ModTime = created
+	}
+
+	return info, nil
+}
+
+// List lists every tag of the repository that is a lookaside source
+func (o *OCI) List(ctx context.Context, prefix string, fn blob.ListFunc) error {
+	next := o.url("tags/list?n=1000")
+	for next != "" {
+		resp, err := o.do(ctx, http.MethodGet, next, nil, nil)
+		if err != nil {
+			return fmt.Errorf("could not list tags: %w", err)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			// the repository does not exist yet
+			_ = resp.Body.Close()
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := statusError(resp)
+			_ = resp.Body.Close()
+			return err
+		}
+
+		var tags struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&tags)
+		_ = resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("could not decode tags: %w", err)
+		}
+
+		next = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			// <url>; rel="next"
+			start, end := strings.Index(link, "<"), strings.Index(link, ">")
+			if start != -1 && end > start {
+				u, err := resp.Request.URL.Parse(link[start+1 : end])
+				if err == nil {
+					next = u.String()
+				}
+			}
+		}
+
+		for _, tag := range tags.Tags {
+			if !strings.HasPrefix(tag, prefix) {
+				continue
+			}
+			info, err := o.Stat(ctx, tag)
+			if errors.Is(err, errNotSource) {
+				// not every tag has to be a lookaside source
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("could not stat %s: %w", tag, err)
+			}
+			if info == nil {
+				// deleted since the tags were listed
+				continue
+			}
+			err = fn(tag, info)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the manifest tagged path, the registry garbage collects the layer
+func (o *OCI) Delete(ctx context.Context, path string) error {
+	if !tagRegex.MatchString(path) {
+		return fmt.Errorf("%s can not be stored in an oci registry", path)
+	}
+
+	resp, err := o.do(ctx, http.MethodHead, o.url("manifests/%s", path), http.Header{"Accept": {manifestMediaType}}, nil)
+	if err != nil {
+		return fmt.Errorf("could not get manifest: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HEAD manifest %s returned %s", path, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return fmt.Errorf("registry did not return the digest of manifest %s", path)
+	}
+
+	// registries only delete manifests by digest
+	resp, err = o.do(ctx, http.MethodDelete, o.url("manifests/%s", digest), nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not delete manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return statusError(resp)
+	}
+
+	return nil
+}
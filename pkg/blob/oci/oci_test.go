@@ -0,0 +1,516 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/spf13/viper"
+)
+
+const testRepository = "lookaside/sources"
+
+type fakeUpload struct {
+	content []byte
+	// number of PATCH requests, part of the location so stale locations are noticed
+	chunks int
+}
+
+// fakeRegistry implements the parts of the distribution API the backend uses
+type fakeRegistry struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	tags      map[string]string
+	uploads   map[string]*fakeUpload
+	nextID    int
+	posts     int
+	patches   int
+	pageSize  int
+
+	// bearer token auth, the token endpoint wants tokenUser:tokenPassword
+	token         string
+	tokenUser     string
+	tokenPassword string
+	// basic auth without a token endpoint
+	basic string
+	// requests whose path ends with a key fail with its status
+	fail map[string]int
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		t:         t,
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		tags:      map[string]string{},
+		uploads:   map[string]*fakeUpload{},
+		fail:      map[string]int{},
+	}
+	r.srv = httptest.NewServer(r)
+	t.Cleanup(r.srv.Close)
+
+	viper.Set("oci-plain-http", true)
+	t.Cleanup(func() { viper.Set("oci-plain-http", false) })
+
+	return r
+}
+
+func (r *fakeRegistry) addr() string {
+	return strings.TrimPrefix(r.srv.URL, "http://") + "/" + testRepository
+}
+
+func (r *fakeRegistry) backend(t *testing.T) *OCI {
+	o, err := New(r.addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return o
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		user, password, _ := req.BasicAuth()
+		if user != r.tokenUser || password != r.tokenPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if scope := req.URL.Query().Get("scope"); scope != "repository:"+testRepository+":pull,push,delete" {
+			r.t.Errorf("token scope = %s", scope)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+
+	switch {
+	case r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.srv.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case r.basic != "" && req.Header.Get("Authorization") != r.basic:
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	for suffix, status := range r.fail {
+		if strings.HasSuffix(req.URL.Path, suffix) {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	prefix := "/v2/" + testRepository + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, prefix)
+
+	switch {
+	case p == "blobs/uploads/" && req.Method == http.MethodPost:
+		r.posts++
+		r.nextID++
+		id := strconv.Itoa(r.nextID)
+		r.uploads[id] = &fakeUpload{}
+		// relative locations have to be resolved against the request
+		w.Header().Set("Location", prefix+"blobs/uploads/"+id+"?state=0")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(p, "blobs/uploads/"):
+		id := strings.TrimPrefix(p, "blobs/uploads/")
+		upload := r.uploads[id]
+		if upload == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.URL.Query().Get("state") != strconv.Itoa(upload.chunks) {
+			r.t.Errorf("upload %s used a stale location %s", id, req.URL)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		upload.content = append(upload.content, body...)
+
+		switch req.Method {
+		case http.MethodPatch:
+			r.patches++
+			upload.chunks++
+			w.Header().Set("Location", fmt.Sprintf("%sblobs/uploads/%s?state=%d", prefix, id, upload.chunks))
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			digest := req.URL.Query().Get("digest")
+			if digest != digestOf(upload.content) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			delete(r.uploads, id)
+			r.blobs[digest] = upload.content
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(p, "blobs/"):
+		content, ok := r.blobs[strings.TrimPrefix(p, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	case strings.HasPrefix(p, "manifests/"):
+		ref := strings.TrimPrefix(p, "manifests/")
+		switch req.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(req.Body)
+			digest := digestOf(body)
+			r.manifests[digest] = body
+			r.tags[ref] = digest
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet, http.MethodHead:
+			digest := ref
+			if tagged, ok := r.tags[ref]; ok {
+				digest = tagged
+			}
+			content, ok := r.manifests[digest]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", manifestMediaType)
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusOK)
+			if req.Method == http.MethodGet {
+				_, _ = w.Write(content)
+			}
+		case http.MethodDelete:
+			if _, ok := r.manifests[ref]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(r.manifests, ref)
+			for tag, digest := range r.tags {
+				if digest == ref {
+					delete(r.tags, tag)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case p == "tags/list":
+		var tags []string
+		for tag := range r.tags {
+			if tag > req.URL.Query().Get("last") {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		if r.pageSize > 0 && len(tags) > r.pageSize {
+			tags = tags[:r.pageSize]
+			w.Header().Set("Link", fmt.Sprintf(`<%stags/list?n=%d&last=%s>; rel="next"`, prefix, r.pageSize, tags[len(tags)-1]))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": testRepository, "tags": tags})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	o := r.backend(t)
+
+	content := []byte("lookaside source")
+	err := o.Write(ctx, "abc123", content)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !bytes.Equal(r.blobs[digestOf(content)], content) {
+		t.Fatal("layer was not uploaded")
+	}
+	if r.patches != 0 {
+		t.Fatalf("monolithic upload sent %d PATCH requests", r.patches)
+	}
+
+	read, err := o.Read(ctx, "abc123")
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("Read = %q, %v", read, err)
+	}
+
+	info, err := o.Stat(ctx, "abc123")
+	if err != nil || info == nil || info.Size != int64(len(content)) || info.ModTime.IsZero() {
+		t.Fatalf("Stat = %+v, %v", info, err)
+	}
+
+	exists, err := o.Exists(ctx, "abc123")
+	if err != nil || !exists {
+		t.Fatalf("Exists = %v, %v", exists, err)
+	}
+
+	// layers the registry has are found with HEAD and not uploaded again
+	posts := r.posts
+	err = o.Write(ctx, "def456", content)
+	if err != nil {
+		t.Fatalf("Write of a known layer: %v", err)
+	}
+	if r.posts != posts {
+		t.Fatalf("known layer was uploaded again")
+	}
+}
+
+func TestWriterChunked(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	o := r.backend(t)
+
+	content := bytes.Repeat([]byte("srpmproc"), 1<<16)
+	err := blob.Copy(ctx, o, "streamed", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if r.patches != 1 {
+		t.Fatalf("streamed upload sent %d PATCH requests, want 1", r.patches)
+	}
+	if len(r.uploads) != 0 {
+		t.Fatalf("%d uploads were not finished", len(r.uploads))
+	}
+
+	read, err := o.Read(ctx, "streamed")
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("Read returned %d bytes, %v", len(read), err)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	r.token = "secret-token"
+	r.tokenUser = "user"
+	r.tokenPassword = "password"
+
+	anonymous := r.backend(t)
+	_, err := anonymous.Exists(ctx, "abc123")
+	if !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("anonymous Exists error = %v, want ErrPermission", err)
+	}
+
+	o, err := New("user:password@"+r.addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blob.Copy(ctx, o, "abc123", strings.NewReader("authenticated"))
+	if err != nil {
+		t.Fatalf("Copy with token auth: %v", err)
+	}
+	read, err := o.Read(ctx, "abc123")
+	if err != nil || string(read) != "authenticated" {
+		t.Fatalf("Read = %q, %v", read, err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	r.basic = "Basic dXNlcjpwYXNzd29yZA=="
+
+	_, err := r.backend(t).Exists(ctx, "abc123")
+	if !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("anonymous Exists error = %v, want ErrPermission", err)
+	}
+
+	o, err := New("user:password@"+r.addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.Write(ctx, "abc123", []byte("x"))
+	if err != nil {
+		t.Fatalf("Write with basic auth: %v", err)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	o := r.backend(t)
+
+	_, err := o.Read(ctx, "missing")
+	if !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("Read of a missing blob = %v, want ErrNotFound", err)
+	}
+	info, err := o.Stat(ctx, "missing")
+	if err != nil || info != nil {
+		t.Fatalf("Stat of a missing blob = %v, %v", info, err)
+	}
+
+	// the manifest exists but its layer is gone
+	err = o.Write(ctx, "orphan", []byte("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(r.blobs, digestOf([]byte("orphan")))
+	_, err = o.Reader(ctx, "orphan")
+	if !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("Reader of a missing layer = %v, want ErrNotFound", err)
+	}
+
+	r.fail["manifests/denied"] = http.StatusForbidden
+	_, err = o.Exists(ctx, "denied")
+	if !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("Exists error = %v, want ErrPermission", err)
+	}
+
+	r.fail["manifests/broken"] = http.StatusServiceUnavailable
+	_, err = o.Stat(ctx, "broken")
+	if !errors.Is(err, blob.ErrTransient) {
+		t.Fatalf("Stat error = %v, want ErrTransient", err)
+	}
+
+	r.fail["blobs/uploads/"] = http.StatusInternalServerError
+	err = o.Write(ctx, "upload", []byte("upload"))
+	if !errors.Is(err, blob.ErrTransient) {
+		t.Fatalf("Write error = %v, want ErrTransient", err)
+	}
+
+	err = o.Write(ctx, "not/a/tag", []byte("x"))
+	if err == nil {
+		t.Fatal("Write accepted a path that is not a valid tag")
+	}
+}
+
+func TestListDelete(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	r.pageSize = 2
+	o := r.backend(t)
+
+	for _, name := range []string{"aa1", "aa2", "aa3", "bb1"} {
+		err := o.Write(ctx, name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var listed []string
+	err := o.List(ctx, "aa", func(path string, info *blob.Info) error {
+		listed = append(listed, path)
+		if info.Size != 3 {
+			t.Errorf("%s: Size = %d", path, info.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if strings.Join(listed, ",") != "aa1,aa2,aa3" {
+		t.Fatalf("List = %v", listed)
+	}
+
+	err = o.Delete(ctx, "aa2")
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	exists, err := o.Exists(ctx, "aa2")
+	if err != nil || exists {
+		t.Fatalf("Exists after Delete = %v, %v", exists, err)
+	}
+	err = o.Delete(ctx, "aa2")
+	if err != nil {
+		t.Fatalf("Delete of a missing blob: %v", err)
+	}
+}
+
+func TestListErrors(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	o := r.backend(t)
+
+	for _, name := range []string{"aa1", "aa2"} {
+		err := o.Write(ctx, name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// another artifact in the same repository
+	other := []byte(`{"schemaVersion":2,"layers":[{"digest":"sha256:1"},{"digest":"sha256:2"}]}`)
+	r.manifests[digestOf(other)] = other
+	r.tags["aa0"] = digestOf(other)
+
+	var listed []string
+	err := o.List(ctx, "aa", func(path string, info *blob.Info) error {
+		listed = append(listed, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if strings.Join(listed, ",") != "aa1,aa2" {
+		t.Fatalf("List = %v", listed)
+	}
+
+	for _, tt := range []struct {
+		status int
+		class  error
+	}{
+		{http.StatusServiceUnavailable, blob.ErrTransient},
+		{http.StatusForbidden, blob.ErrPermission},
+	} {
+		r.fail["manifests/aa2"] = tt.status
+		err = o.List(ctx, "aa", func(path string, info *blob.Info) error {
+			return nil
+		})
+		if !errors.Is(err, tt.class) {
+			t.Errorf("List with a failing manifest (%d) = %v, want %v", tt.status, err, tt.class)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Replicated writes to all of its backends and reads from the first backend that has a blob.
+// Backends are tried in order, so the fastest or most reliable one should come first
+type Replicated struct {
+	backends []Storage
+}
+
+func NewReplicated(backends ...Storage) *Replicated {
+	return &Replicated{
+		backends: backends,
+	}
+}
+
+func (r *Replicated) Write(ctx context.Context, path string, content []byte) error {
+	for i, backend := range r.backends {
+		err := backend.Write(ctx, path, content)
+		if err != nil {
+			return fmt.Errorf("could not write to replica %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicated) Read(ctx context.Context, path string) ([]byte, error) {
+	var lastErr error
+	for _, backend := range r.backends {
+		content, err := backend.Read(ctx, path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// a replica missing the blob is less interesting than one failing
+			if !errors.Is(err, ErrNotFound) || lastErr == nil {
+				lastErr = err
+			}
+			continue
+		}
+		if content != nil {
+			return content, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+
+	return nil, lastErr
+}
+
+func (r *Replicated) Exists(ctx context.Context, path string) (bool, error) {
+	var lastErr error
+	for _, backend := range r.backends {
+		exists, err := backend.Exists(ctx, path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+
+	return false, lastErr
+}
+
+func (r *Replicated) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	var lastErr error
+	for _, backend := range r.backends {
+		reader, err := backend.Reader(ctx, path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if reader != nil {
+			return reader, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// replicatedWriter streams to the writers of all backends
+type replicatedWriter struct {
+	io.Writer
+	writers []io.WriteCloser
+	cancel  context.CancelFunc
+}
+
+func (w *replicatedWriter) Close() error {
+	defer w.cancel()
+
+	var firstErr error
+	for i, writer := range w.writers {
+		err := writer.Close()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not write to replica %d: %w", i, err)
+		}
+	}
+
+	return firstErr
+}
+
+func (r *Replicated) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	// canceling the context before closing the writers
+	// aborts the writes that were already started
+	writeCtx, cancel := context.WithCancel(ctx)
+
+	var writers []io.WriteCloser
+	var ws []io.Writer
+	for i, backend := range r.backends {
+		writer, err := backend.Writer(writeCtx, path)
+		if err != nil {
+			cancel()
+			for _, w := range writers {
+				_ = w.Close()
+			}
+			return nil, fmt.Errorf("could not write to replica %d: %w", i, err)
+		}
+		writers = append(writers, writer)
+		ws = append(ws, writer)
+	}
+
+	return &replicatedWriter{
+		Writer:  io.MultiWriter(ws...),
+		writers: writers,
+		cancel:  cancel,
+	}, nil
+}
+
+func (r *Replicated) Stat(ctx context.Context, path string) (*Info, error) {
+	var lastErr error
+	for _, backend := range r.backends {
+		info, err := backend.Stat(ctx, path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if info != nil {
+			return info, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// List lists the blobs of all backends, blobs stored in several backends are listed once
+func (r *Replicated) List(ctx context.Context, prefix string, fn ListFunc) error {
+	seen := map[string]bool{}
+	for i, backend := range r.backends {
+		err := backend.List(ctx, prefix, func(path string, info *Info) error {
+			if seen[path] {
+				return nil
+			}
+			seen[path] = true
+
+			return fn(path, info)
+		})
+		if err != nil {
+			return fmt.Errorf("could not list replica %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicated) Delete(ctx context.Context, path string) error {
+	for i, backend := range r.backends {
+		err := backend.Delete(ctx, path)
+		if err != nil {
+			return fmt.Errorf("could not delete from replica %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package blob_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+)
+
+// brokenBackend returns a file backend whose root is a regular file,
+// so every operation fails with an error other than not found
+func brokenBackend(t *testing.T) *file.File {
+	root := filepath.Join(t.TempDir(), "broken")
+	if err := os.WriteFile(root, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return file.New(root)
+}
+
+func TestReplicatedRead(t *testing.T) {
+	ctx := context.Background()
+	first, second := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(second, "only-second"), []byte("second"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(first, "both"), []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(second, "both"), []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		replicas []blob.Storage
+		path     string
+		want     string
+	}{
+		{"first has it", []blob.Storage{file.New(first), file.New(second)}, "both", "first"},
+		{"first is missing it", []blob.Storage{file.New(first), file.New(second)}, "only-second", "second"},
+		{"first fails", []blob.Storage{brokenBackend(t), file.New(second)}, "both", "stale"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := blob.NewReplicated(tt.replicas...)
+
+			content, err := r.Read(ctx, tt.path)
+			if err != nil || string(content) != tt.want {
+				t.Fatalf("Read = %q, %v, want %q", content, err, tt.want)
+			}
+
+			reader, err := r.Reader(ctx, tt.path)
+			if err != nil || reader == nil {
+				t.Fatalf("Reader = %v, %v", reader, err)
+			}
+			content, err = io.ReadAll(reader)
+			_ = reader.Close()
+			if err != nil || string(content) != tt.want {
+				t.Fatalf("Reader content = %q, %v, want %q", content, err, tt.want)
+			}
+
+			exists, err := r.Exists(ctx, tt.path)
+			if err != nil || !exists {
+				t.Fatalf("Exists = %v, %v", exists, err)
+			}
+			info, err := r.Stat(ctx, tt.path)
+			if err != nil || info == nil || info.Size != int64(len(tt.want)) {
+				t.Fatalf("Stat = %v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestReplicatedReadMissing(t *testing.T) {
+	ctx := context.Background()
+
+	r := blob.NewReplicated(file.New(t.TempDir()), file.New(t.TempDir()))
+	_, err := r.Read(ctx, "missing")
+	if !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("Read of a missing blob = %v, want ErrNotFound", err)
+	}
+
+	// the failure is reported instead of the replica that does not have the blob
+	r = blob.NewReplicated(brokenBackend(t), file.New(t.TempDir()))
+	_, err = r.Read(ctx, "missing")
+	if err == nil || errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("Read with a failing replica = %v, want its error", err)
+	}
+	exists, err := r.Exists(ctx, "missing")
+	if exists || err == nil {
+		t.Fatalf("Exists with a failing replica = %v, %v", exists, err)
+	}
+}
+
+func TestReplicatedWrite(t *testing.T) {
+	ctx := context.Background()
+	first, second := t.TempDir(), t.TempDir()
+	r := blob.NewReplicated(file.New(first), file.New(second))
+
+	if err := r.Write(ctx, "written", []byte("content")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w, err := r.Writer(ctx, "streamed")
+	if err != nil {
+		t.Fatalf("Writer: %v", err)
+	}
+	if _, err := io.WriteString(w, "streamed content"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for _, dir := range []string{first, second} {
+		for path, want := range map[string]string{"written": "content", "streamed": "streamed content"} {
+			content, err := os.ReadFile(filepath.Join(dir, path))
+			if err != nil || string(content) != want {
+				t.Errorf("%s in %s = %q, %v, want %q", path, dir, content, err, want)
+			}
+		}
+	}
+
+	if err := r.Delete(ctx, "written"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, dir := range []string{first, second} {
+		if _, err := os.Stat(filepath.Join(dir, "written")); !os.IsNotExist(err) {
+			t.Errorf("written is still in %s after Delete", dir)
+		}
+	}
+}
+
+func TestReplicatedWriteFailure(t *testing.T) {
+	ctx := context.Background()
+	first := t.TempDir()
+	r := blob.NewReplicated(file.New(first), brokenBackend(t))
+
+	err := r.Write(ctx, "written", []byte("content"))
+	if err == nil || !strings.Contains(err.Error(), "replica 1") {
+		t.Fatalf("Write with a failing replica = %v, want an error for replica 1", err)
+	}
+
+	_, err = r.Writer(ctx, "streamed")
+	if err == nil || !strings.Contains(err.Error(), "replica 1") {
+		t.Fatalf("Writer with a failing replica = %v, want an error for replica 1", err)
+	}
+	// the write already started in the first replica is aborted
+	entries, err := os.ReadDir(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "written" {
+			t.Errorf("unexpected file %s left in the first replica", entry.Name())
+		}
+	}
+}
+
+func TestReplicatedList(t *testing.T) {
+	ctx := context.Background()
+	first, second := t.TempDir(), t.TempDir()
+	for dir, names := range map[string][]string{first: {"aa", "ab", "b"}, second: {"ab", "ac"}} {
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	r := blob.NewReplicated(file.New(first), file.New(second))
+	var listed []string
+	err := r.List(ctx, "a", func(path string, info *blob.Info) error {
+		listed = append(listed, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != "aa,ab,ac" {
+		t.Fatalf("List = %v, want every blob once", listed)
+	}
+
+	r = blob.NewReplicated(file.New(first), file.New(filepath.Join(t.TempDir(), "missing")))
+	err = r.List(ctx, "", func(path string, info *blob.Info) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "replica 1") {
+		t.Fatalf("List with a failing replica = %v", err)
+	}
+}
@@ -22,14 +22,18 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
 	"github.com/spf13/viper"
 )
 
@@ -70,47 +74,197 @@ func New(name string) *S3 {
 	}
 }
 
-func (s *S3) Write(path string, content []byte) error {
+// classify maps s3 errors to the blob error classes
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return blob.Classify(blob.ErrNotFound, err)
+		// A missing bucket is a configuration error, not a missing blob,
+		// so it must not be mistaken for an object that can be fetched again
+		case s3.ErrCodeNoSuchBucket, "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "NoCredentialProviders":
+			return blob.Classify(blob.ErrPermission, err)
+		case "SlowDown", "RequestTimeout", "RequestTimeTooSkewed", "Throttling", "ThrottlingException", request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+			return blob.Classify(blob.ErrTransient, err)
+		}
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if class := blob.ClassForStatus(reqErr.StatusCode()); class != nil {
+			return blob.Classify(class, err)
+		}
+	}
+
+	return blob.ClassifyNetwork(err)
+}
+
+// isNotFound returns true if err means the object does not exist
+func isNotFound(err error) bool {
+	return errors.Is(classify(err), blob.ErrNotFound)
+}
+
+func (s *S3) Write(ctx context.Context, path string, content []byte) error {
 	buf := bytes.NewBuffer(content)
 
-	_, err := s.uploader.Upload(&s3manager.UploadInput{
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(path),
 		Body:   buf,
 	})
 	if err != nil {
-		return err
+		return classify(err)
 	}
 
 	return nil
 }
 
-func (s *S3) Read(path string) ([]byte, error) {
-	obj, err := s.uploader.S3.GetObject(&s3.GetObjectInput{
+func (s *S3) Read(ctx context.Context, path string) ([]byte, error) {
+	obj, err := s.uploader.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(path),
 	})
 	if err != nil {
-		s3err, ok := err.(awserr.Error)
-		if !ok || s3err.Code() != s3.ErrCodeNoSuchKey {
-			return nil, err
-		}
-
-		return nil, nil
+		return nil, classify(err)
 	}
 
+	defer obj.Body.Close()
+
 	body, err := io.ReadAll(obj.Body)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 
 	return body, nil
 }
 
-func (s *S3) Exists(path string) (bool, error) {
-	_, err := s.uploader.S3.GetObject(&s3.GetObjectInput{
+func (s *S3) Exists(ctx context.Context, path string) (bool, error) {
+	_, err := s.uploader.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, classify(err)
+	}
+
+	return true, nil
+}
+
+func (s *S3) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	obj, err := s.uploader.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, classify(err)
+	}
+
+	return obj.Body, nil
+}
+
+// s3Writer feeds a multipart upload running in the background
+type s3Writer struct {
+	ctx  context.Context
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	// a read error aborts the upload instead of completing it
+	_ = w.pw.CloseWithError(w.ctx.Err())
+	return <-w.done
+}
+
+func (s *S3) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	w := &s3Writer{
+		ctx:  ctx,
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(path),
+			Body:   pr,
+		})
+		err = classify(err)
+		// unblock the writer if the upload failed early
+		_ = pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+func (s *S3) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	head, err := s.uploader.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, classify(err)
+	}
+
+	info := &blob.Info{
+		Size: aws.Int64Value(head.ContentLength),
+	}
+	if head.LastModified != nil {
+		info.ModTime = *head.LastModified
+	}
+
+	return info, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string, fn blob.ListFunc) error {
+	var fnErr error
+	err := s.uploader.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			info := &blob.Info{
+				Size: aws.Int64Value(obj.Size),
+			}
+			if obj.LastModified != nil {
+				info.ModTime = *obj.LastModified
+			}
+
+			fnErr = fn(aws.StringValue(obj.Key), info)
+			if fnErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return classify(err)
+}
+
+func (s *S3) Delete(ctx context.Context, path string) error {
+	// deleting a missing key succeeds in s3
+	_, err := s.uploader.S3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(path),
 	})
-	return err == nil, nil
+	return classify(err)
 }
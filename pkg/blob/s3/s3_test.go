@@ -0,0 +1,66 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package s3
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"no such key", awserr.New(s3.ErrCodeNoSuchKey, "missing", nil), blob.ErrNotFound},
+		{"head not found", awserr.NewRequestFailure(awserr.New("NotFound", "missing", nil), 404, "id"), blob.ErrNotFound},
+		{"no such bucket", awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchBucket, "missing bucket", nil), 404, "id"), blob.ErrPermission},
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id"), blob.ErrPermission},
+		{"no credentials", awserr.New("NoCredentialProviders", "no creds", nil), blob.ErrPermission},
+		{"slow down", awserr.NewRequestFailure(awserr.New("SlowDown", "slow", nil), 503, "id"), blob.ErrTransient},
+		{"request error", awserr.New(request.ErrCodeRequestError, "send failed", nil), blob.ErrTransient},
+		{"unknown code by status", awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "id"), blob.ErrTransient},
+		{"unknown", awserr.New("InvalidArgument", "bad", nil), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.err)
+			for _, class := range []error{blob.ErrNotFound, blob.ErrPermission, blob.ErrTransient} {
+				if errors.Is(got, class) != (class == tt.want) {
+					t.Errorf("classify(%v) = %v, want class %v", tt.err, got, tt.want)
+				}
+			}
+		})
+	}
+
+	if classify(nil) != nil {
+		t.Error("classify(nil) is not nil")
+	}
+	if isNotFound(awserr.New(s3.ErrCodeNoSuchBucket, "missing bucket", nil)) {
+		t.Error("a missing bucket is reported as a missing object")
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/spf13/viper"
+)
+
+// WebDAV stores blobs on an HTTP server using GET, HEAD, PUT and DELETE.
+// Listing needs a WebDAV server that supports PROPFIND
+type WebDAV struct {
+	base        *url.URL
+	client      *http.Client
+	username    string
+	password    string
+	bearerToken string
+}
+
+// New returns a backend storing blobs below base.
+// Basic auth credentials are taken from the url or the http-storage-username and
+// http-storage-password settings, a bearer token from http-storage-bearer-token.
+// If client is nil, http.DefaultClient is used
+func New(base string, client *http.Client) (*WebDAV, error) {
+	u, err := url.Parse(strings.TrimSuffix(base, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse http storage url: %v", err)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	w := &WebDAV{
+		base:        u,
+		client:      client,
+		username:    viper.GetString("http-storage-username"),
+		password:    viper.GetString("http-storage-password"),
+		bearerToken: viper.GetString("http-storage-bearer-token"),
+	}
+	if u.User != nil {
+		w.username = u.User.Username()
+		w.password, _ = u.User.Password()
+		u.User = nil
+	}
+
+	return w, nil
+}
+
+func (w *WebDAV) url(p string) string {
+	u := *w.base
+	u.Path = path.Join(u.Path, p)
+
+	return u.String()
+}
+
+func (w *WebDAV) authenticate(req *http.Request) {
+	if w.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	} else if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+}
+
+func (w *WebDAV) request(ctx context.Context, method string, p string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.url(p), body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	w.authenticate(req)
+	if b, ok := body.(*bytes.Reader); ok {
+		req.ContentLength = int64(b.Len())
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, blob.ClassifyNetwork(err)
+	}
+
+	return resp, nil
+}
+
+func statusError(method string, p string, resp *http.Response) error {
+	return blob.Classify(blob.ClassForStatus(resp.StatusCode), fmt.Errorf("%s %s returned %s", method, p, resp.Status))
+}
+
+func (w *WebDAV) Write(ctx context.Context, path string, content []byte) error {
+	resp, err := w.request(ctx, http.MethodPut, path, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("could not write file to http storage: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError(http.MethodPut, path, resp)
+	}
+
+	return nil
+}
+
+func (w *WebDAV) Read(ctx context.Context, path string) ([]byte, error) {
+	r, err := w.Reader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("%w: %s", blob.ErrNotFound, path)
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (w *WebDAV) Exists(ctx context.Context, path string) (bool, error) {
+	info, err := w.Stat(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	return info != nil, nil
+}
+
+func (w *WebDAV) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := w.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file from http storage: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, statusError(http.MethodGet, path, resp)
+	}
+
+	return resp.Body, nil
+}
+
+// webdavWriter streams a PUT request running in the background
+type webdavWriter struct {
+	ctx  context.Context
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (w *webdavWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	if err != nil {
+		// the request failed early, report why instead of the closed pipe
+		<-w.done
+		if w.err != nil {
+			err = w.err
+		}
+	}
+
+	return n, err
+}
+
+func (w *webdavWriter) Close() error {
+	// a cancelled ctx aborts the request instead of completing it
+	_ = w.pw.CloseWithError(w.ctx.Err())
+	<-w.done
+
+	return w.err
+}
+
+func (w *WebDAV) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	writer := &webdavWriter{
+		ctx:  ctx,
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		resp, err := w.request(ctx, http.MethodPut, path, pr)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = statusError(http.MethodPut, path, resp)
+			}
+		} else {
+			err = fmt.Errorf("could not write file to http storage: %w", err)
+		}
+		writer.err = err
+		// unblock the writer if the request failed early
+		_ = pr.CloseWithError(err)
+		close(writer.done)
+	}()
+
+	return writer, nil
+}
+
+func (w *WebDAV) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	resp, err := w.request(ctx, http.MethodHead, path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat file in http storage: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(http.MethodHead, path, resp)
+	}
+
+	info := &blob.Info{
+		Size: resp.ContentLength,
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+
+	return info, nil
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><getcontentlength/><getlastmodified/><resourcetype/></prop></propfind>`
+
+// List lists the blobs stored directly below the base url with a WebDAV PROPFIND request
+func (w *WebDAV) List(ctx context.Context, prefix string, fn blob.ListFunc) error {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", w.url("")+"/", strings.NewReader(propfindBody))
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	w.authenticate(req)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not list http storage: %w", blob.ClassifyNetwork(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		return fmt.Errorf("could not list http storage, the server does not support PROPFIND")
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return statusError("PROPFIND", "/", resp)
+	}
+
+	var ms multistatus
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return fmt.Errorf("could not decode http storage listing: %v", err)
+	}
+
+	for _, r := range ms.Responses {
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		name := path.Base(href)
+		if strings.HasSuffix(href, "/") || name == "" || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		info := &blob.Info{}
+		collection := false
+		for _, ps := range r.Propstat {
+			if ps.Prop.ResourceType.Collection != nil {
+				collection = true
+			}
+			if size, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+				info.Size = size
+			}
+			if modTime, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+				info.ModTime = modTime
+			}
+		}
+		if collection {
+			continue
+		}
+
+		err = fn(name, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *WebDAV) Delete(ctx context.Context, path string) error {
+	resp, err := w.request(ctx, http.MethodDelete, path, nil)
+	if err != nil {
+		return fmt.Errorf("could not delete file from http storage: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return statusError(http.MethodDelete, path, resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,383 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/spf13/viper"
+)
+
+var testModTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeDAV is a minimal WebDAV server storing files below /dav/
+type fakeDAV struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	auth     string
+	propfind bool
+	// requests to these paths fail with the status without reading the body
+	fail map[string]int
+}
+
+func newFakeDAV(t *testing.T, auth string) (*fakeDAV, *httptest.Server) {
+	f := &fakeDAV{
+		files:    map[string][]byte{},
+		auth:     auth,
+		propfind: true,
+		fail:     map[string]int{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, srv
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.auth != "" && r.Header.Get("Authorization") != f.auth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/dav/")
+	if status, ok := f.fail[name]; ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.files[name] = body
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		content, ok := f.files[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Header().Set("Last-Modified", testModTime.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	case http.MethodDelete:
+		if _, ok := f.files[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		if !f.propfind {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Depth") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var names []string
+		for name := range f.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+		// the listed collection itself and a sub collection
+		fmt.Fprint(w, `<D:response><D:href>/dav/</D:href><D:propstat><D:prop><D:resourcetype><D:collection/></D:resourcetype></D:prop></D:propstat></D:response>`)
+		fmt.Fprint(w, `<D:response><D:href>/dav/subdir</D:href><D:propstat><D:prop><D:resourcetype><D:collection/></D:resourcetype></D:prop></D:propstat></D:response>`)
+		for _, name := range names {
+			fmt.Fprintf(w, `<D:response><D:href>/dav/%s</D:href><D:propstat><D:prop><D:getcontentlength>%d</D:getcontentlength><D:getlastmodified>%s</D:getlastmodified><D:resourcetype/></D:prop></D:propstat></D:response>`, name, len(f.files[name]), testModTime.Format(http.TimeFormat))
+		}
+		fmt.Fprint(w, `</D:multistatus>`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestReadWriteStatDelete(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeDAV(t, "")
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Write(ctx, "abc", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if string(f.files["abc"]) != "hello" {
+		t.Fatalf("stored %q, want hello", f.files["abc"])
+	}
+
+	content, err := w.Read(ctx, "abc")
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("Read = %q, %v", content, err)
+	}
+
+	info, err := w.Stat(ctx, "abc")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 5 || !info.ModTime.Equal(testModTime) {
+		t.Fatalf("Stat = %+v", info)
+	}
+
+	exists, err := w.Exists(ctx, "abc")
+	if err != nil || !exists {
+		t.Fatalf("Exists = %v, %v", exists, err)
+	}
+
+	err = w.Delete(ctx, "abc")
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok := f.files["abc"]; ok {
+		t.Fatal("blob still stored after Delete")
+	}
+	err = w.Delete(ctx, "abc")
+	if err != nil {
+		t.Fatalf("Delete of a missing blob: %v", err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newFakeDAV(t, "")
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Reader(ctx, "missing")
+	if err != nil || r != nil {
+		t.Fatalf("Reader = %v, %v, want nil, nil", r, err)
+	}
+
+	info, err := w.Stat(ctx, "missing")
+	if err != nil || info != nil {
+		t.Fatalf("Stat = %v, %v, want nil, nil", info, err)
+	}
+
+	exists, err := w.Exists(ctx, "missing")
+	if err != nil || exists {
+		t.Fatalf("Exists = %v, %v, want false, nil", exists, err)
+	}
+
+	_, err = w.Read(ctx, "missing")
+	if !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("Read error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStatusClasses(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeDAV(t, "")
+	f.fail["forbidden"] = http.StatusForbidden
+	f.fail["broken"] = http.StatusBadGateway
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Stat(ctx, "forbidden")
+	if !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("Stat error = %v, want ErrPermission", err)
+	}
+	_, err = w.Reader(ctx, "broken")
+	if !errors.Is(err, blob.ErrTransient) {
+		t.Fatalf("Reader error = %v, want ErrTransient", err)
+	}
+	err = w.Write(ctx, "broken", []byte("x"))
+	if !errors.Is(err, blob.ErrTransient) {
+		t.Fatalf("Write error = %v, want ErrTransient", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newFakeDAV(t, "Basic dXNlcjpzZWNyZXQ=")
+
+	anonymous, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = anonymous.Stat(ctx, "abc")
+	if !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("anonymous Stat error = %v, want ErrPermission", err)
+	}
+
+	w, err := New(strings.Replace(srv.URL, "http://", "http://user:secret@", 1)+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(ctx, "abc", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Write with basic auth: %v", err)
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newFakeDAV(t, "Bearer token")
+
+	viper.Set("http-storage-bearer-token", "token")
+	t.Cleanup(func() { viper.Set("http-storage-bearer-token", "") })
+
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(ctx, "abc", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Write with bearer token: %v", err)
+	}
+	exists, err := w.Exists(ctx, "abc")
+	if err != nil || !exists {
+		t.Fatalf("Exists = %v, %v", exists, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeDAV(t, "")
+	f.files["aa1"] = []byte("1")
+	f.files["aa2"] = []byte("22")
+	f.files["bb1"] = []byte("333")
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := map[string]int64{}
+	err = w.List(ctx, "", func(path string, info *blob.Info) error {
+		listed[path] = info.Size
+		if !info.ModTime.Equal(testModTime) {
+			t.Errorf("%s: ModTime = %v", path, info.ModTime)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := map[string]int64{"aa1": 1, "aa2": 2, "bb1": 3}
+	if fmt.Sprint(listed) != fmt.Sprint(want) {
+		t.Fatalf("List = %v, want %v", listed, want)
+	}
+
+	var prefixed []string
+	err = w.List(ctx, "aa", func(path string, _ *blob.Info) error {
+		prefixed = append(prefixed, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List with prefix: %v", err)
+	}
+	if strings.Join(prefixed, ",") != "aa1,aa2" {
+		t.Fatalf("List with prefix = %v", prefixed)
+	}
+}
+
+func TestListWithoutPropfind(t *testing.T) {
+	f, srv := newFakeDAV(t, "")
+	f.propfind = false
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.List(context.Background(), "", func(string, *blob.Info) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "does not support PROPFIND") {
+		t.Fatalf("List error = %v, want missing PROPFIND support", err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeDAV(t, "")
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("srpmproc"), 1<<16)
+	err = blob.Copy(ctx, w, "streamed", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if !bytes.Equal(f.files["streamed"], content) {
+		t.Fatalf("stored %d bytes, want %d", len(f.files["streamed"]), len(content))
+	}
+}
+
+func TestWriterFailsEarly(t *testing.T) {
+	f, srv := newFakeDAV(t, "")
+	f.fail["denied"] = http.StatusForbidden
+	w, err := New(srv.URL+"/dav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := w.Writer(context.Background(), "denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server answers without reading the body, so writing fails eventually
+	chunk := make([]byte, 1<<20)
+	var writeErr error
+	for i := 0; i < 256 && writeErr == nil; i++ {
+		_, writeErr = writer.Write(chunk)
+	}
+	if writeErr == nil {
+		t.Fatal("Write did not fail")
+	}
+	if errors.Is(writeErr, io.ErrClosedPipe) || !errors.Is(writeErr, blob.ErrPermission) {
+		t.Fatalf("Write error = %v, want ErrPermission", writeErr)
+	}
+
+	err = writer.Close()
+	if errors.Is(err, io.ErrClosedPipe) || !errors.Is(err, blob.ErrPermission) {
+		t.Fatalf("Close error = %v, want ErrPermission", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package data
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// BranchRule maps upstream branches matching Match to the downstream branch Target.
+// Match is anchored at both ends, Target may refer to its submatches as $1 or ${name}.
+// Branches matching a Skip rule are not imported
+type BranchRule struct {
+	Match  string `json:"match" yaml:"match"`
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+	Skip   bool   `json:"skip,omitempty" yaml:"skip,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// BranchRules replace the prefix based branch translation.
+// Branches maps upstream branches to push branches, Components maps the refs
+// of module components to the downstream branch of the component.
+// The first matching rule of a list wins
+type BranchRules struct {
+	Branches   []*BranchRule `json:"branches" yaml:"branches"`
+	Components []*BranchRule `json:"components,omitempty" yaml:"components,omitempty"`
+}
+
+// BranchMatch is the outcome of matching a branch against a rule list.
+// Rule is nil if no rule matched, Index is the position of Rule in its list
+type BranchMatch struct {
+	Source string
+	Target string
+	Rule   *BranchRule
+	Index  int
+}
+
+// Ok returns true if a rule matched and the branch is not skipped
+func (m *BranchMatch) Ok() bool {
+	return m.Rule != nil && !m.Rule.Skip
+}
+
+// Compile checks every rule and compiles its pattern
+func (r *BranchRules) Compile() error {
+	err := compileBranchRules("branch", r.Branches)
+	if err != nil {
+		return err
+	}
+
+	return compileBranchRules("component", r.Components)
+}
+
+// Compiled returns true if every rule has been compiled
+func (r *BranchRules) Compiled() bool {
+	for _, rule := range append(r.Branches, r.Components...) {
+		if rule == nil || rule.regex == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compileBranchRules(name string, rules []*BranchRule) error {
+	for i, rule := range rules {
+		if rule == nil || rule.Match == "" {
+			return fmt.Errorf("%s rule %d has no match pattern", name, i+1)
+		}
+		if rule.Target == "" && !rule.Skip {
+			return fmt.Errorf("%s rule %d (%s) has no target", name, i+1, rule.Match)
+		}
+
+		regex, err := regexp.Compile("^(?:" + rule.Match + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid %s rule %d: %v", name, i+1, err)
+		}
+		rule.regex = regex
+	}
+
+	return nil
+}
+
+// Branch maps an upstream branch (e.g. c8s-stream-httpd-2.4) to its push branch
+func (r *BranchRules) Branch(name string) *BranchMatch {
+	return matchBranchRules(r.Branches, name)
+}
+
+// Component maps the ref of a module component (e.g. stream-rhel-8.4.0) to its downstream branch
+func (r *BranchRules) Component(ref string) *BranchMatch {
+	return matchBranchRules(r.Components, ref)
+}
+
+func matchBranchRules(rules []*BranchRule, name string) *BranchMatch {
+	for i, rule := range rules {
+		submatches := rule.regex.FindStringSubmatchIndex(name)
+		if submatches == nil {
+			continue
+		}
+
+		match := &BranchMatch{
+			Source: name,
+			Rule:   rule,
+			Index:  i,
+		}
+		if !rule.Skip {
+			match.Target = string(rule.regex.ExpandString(nil, rule.Target, name, submatches))
+		}
+
+		return match
+	}
+
+	return &BranchMatch{Source: name, Index: -1}
+}
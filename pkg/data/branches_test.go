@@ -0,0 +1,131 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func compiledRules(t *testing.T, rules *BranchRules) *BranchRules {
+	err := rules.Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	return rules
+}
+
+func TestBranchRules(t *testing.T) {
+	rules := compiledRules(t, &BranchRules{
+		Branches: []*BranchRule{
+			{Match: `c8s-stream-(.*)`, Target: "r8s-stream-$1"},
+			{Match: `c9-beta.*`, Skip: true},
+			{Match: `c(?P<version>\d+)(s?)`, Target: "r${version}$2"},
+			// never reached for c8, the rule above matches first
+			{Match: `c8`, Target: "unreachable"},
+		},
+		Components: []*BranchRule{
+			{Match: `stream-rhel-rhel-(\d+)\..*`, Target: "r$1"},
+		},
+	})
+
+	for _, tt := range []struct {
+		branch string
+		target string
+		index  int
+		ok     bool
+	}{
+		{"c8s-stream-httpd-2.4", "r8s-stream-httpd-2.4", 0, true},
+		{"c9-beta", "", 1, false},
+		{"c9-beta-2", "", 1, false},
+		{"c8", "r8", 2, true},
+		{"c9s", "r9s", 2, true},
+		// patterns are anchored at both ends
+		{"xc8", "", -1, false},
+		{"c8-foo", "", -1, false},
+		{"", "", -1, false},
+	} {
+		match := rules.Branch(tt.branch)
+		if match.Source != tt.branch || match.Target != tt.target || match.Index != tt.index || match.Ok() != tt.ok {
+			t.Errorf("Branch(%q) = %+v, ok %v, want target %q, index %d, ok %v", tt.branch, match, match.Ok(), tt.target, tt.index, tt.ok)
+		}
+		if (match.Index == -1) != (match.Rule == nil) {
+			t.Errorf("Branch(%q): Index %d does not agree with Rule %v", tt.branch, match.Index, match.Rule)
+		}
+	}
+
+	component := rules.Component("stream-rhel-rhel-8.4.0")
+	if !component.Ok() || component.Target != "r8" {
+		t.Errorf("Component = %+v, want r8", component)
+	}
+	if rules.Component("c8").Ok() {
+		t.Error("branch rules are used for components")
+	}
+}
+
+func TestBranchRulesCompile(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rules *BranchRules
+		err   string
+	}{
+		{
+			name:  "invalid branch regex",
+			rules: &BranchRules{Branches: []*BranchRule{{Match: "c8", Target: "r8"}, {Match: "c(", Target: "r"}}},
+			err:   "invalid branch rule 2",
+		},
+		{
+			name:  "invalid component regex",
+			rules: &BranchRules{Components: []*BranchRule{{Match: "[", Target: "r"}}},
+			err:   "invalid component rule 1",
+		},
+		{
+			name:  "missing match",
+			rules: &BranchRules{Branches: []*BranchRule{{Target: "r8"}}},
+			err:   "branch rule 1 has no match pattern",
+		},
+		{
+			name:  "missing target",
+			rules: &BranchRules{Branches: []*BranchRule{{Match: "c8"}}},
+			err:   "branch rule 1 (c8) has no target",
+		},
+		{
+			name:  "nil rule",
+			rules: &BranchRules{Branches: []*BranchRule{nil}},
+			err:   "branch rule 1 has no match pattern",
+		},
+	} {
+		err := tt.rules.Compile()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: Compile error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	rules := &BranchRules{Branches: []*BranchRule{{Match: "c8", Skip: true}}}
+	if rules.Compiled() {
+		t.Error("rules are compiled before Compile")
+	}
+	compiledRules(t, rules)
+	if !rules.Compiled() {
+		t.Error("rules are not compiled after Compile")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultBlobCacheMemLimit is the size up to which blobs are kept in memory
+const DefaultBlobCacheMemLimit = 8 << 20
+
+// BlobCache keeps downloaded sources around so they are only downloaded
+// once per import. Blobs up to the memory limit are kept in memory,
+// larger ones spill to a temporary directory that is removed on Close.
+// It is safe for concurrent use
+type BlobCache struct {
+	memLimit int64
+
+	mu   sync.Mutex
+	dir  string
+	mem  map[string][]byte
+	disk map[string]string
+}
+
+func NewBlobCache(memLimit int64) *BlobCache {
+	return &BlobCache{
+		memLimit: memLimit,
+		mem:      map[string][]byte{},
+		disk:     map[string]string{},
+	}
+}
+
+func (c *BlobCache) Has(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.mem[hash]; ok {
+		return true
+	}
+	_, ok := c.disk[hash]
+	return ok
+}
+
+// Open returns a reader for a cached blob
+func (c *BlobCache) Open(hash string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if body, ok := c.mem[hash]; ok {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	if path, ok := c.disk[hash]; ok {
+		return os.Open(path)
+	}
+
+	return nil, fmt.Errorf("blob %s is not cached", hash)
+}
+
+// CreateTemp creates a file in the cache directory, it can be
+// added to the cache with PutFile once it is complete
+func (c *BlobCache) CreateTemp() (*os.File, error) {
+	dir, err := c.ensureDir()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(dir, "partial")
+	if err != nil {
+		return nil, fmt.Errorf("could not create blob cache file: %v", err)
+	}
+
+	return f, nil
+}
+
+// Put stores everything read from r as hash
+func (c *BlobCache) Put(hash string, r io.Reader) error {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, c.memLimit+1)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not read blob: %v", err)
+	}
+	if n <= c.memLimit {
+		c.mu.Lock()
+		c.remove(hash)
+		c.mem[hash] = buf.Bytes()
+		c.mu.Unlock()
+		return nil
+	}
+
+	f, err := c.CreateTemp()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.MultiReader(&buf, r))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("could not write blob cache file: %v", err)
+	}
+
+	return c.PutFile(hash, f.Name())
+}
+
+// PutFile moves a complete file created with CreateTemp into the cache as hash
+func (c *BlobCache) PutFile(hash string, path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(hash)
+	target := filepath.Join(c.dir, hash)
+	err := os.Rename(path, target)
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("could not move blob into cache: %v", err)
+	}
+	c.disk[hash] = target
+
+	return nil
+}
+
+// Remove drops hash from the cache
+func (c *BlobCache) Remove(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(hash)
+}
+
+func (c *BlobCache) remove(hash string) {
+	delete(c.mem, hash)
+	if path, ok := c.disk[hash]; ok {
+		_ = os.Remove(path)
+		delete(c.disk, hash)
+	}
+}
+
+func (c *BlobCache) ensureDir() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dir == "" {
+		dir, err := os.MkdirTemp("", "srpmproc_blobcache")
+		if err != nil {
+			return "", fmt.Errorf("could not create blob cache directory: %v", err)
+		}
+		c.dir = dir
+	}
+
+	return c.dir, nil
+}
+
+// Close drops all cached blobs
+func (c *BlobCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mem = map[string][]byte{}
+	c.disk = map[string]string{}
+	if c.dir == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(c.dir)
+	c.dir = ""
+
+	return err
+}
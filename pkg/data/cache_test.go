@@ -0,0 +1,198 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package data
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readCached(t *testing.T, c *BlobCache, hash string) []byte {
+	r, err := c.Open(hash)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", hash, err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func cacheFiles(t *testing.T, c *BlobCache) []string {
+	if c.dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+func TestBlobCacheMemLimit(t *testing.T) {
+	c := NewBlobCache(DefaultBlobCacheMemLimit)
+	defer c.Close()
+
+	atLimit := bytes.Repeat([]byte("a"), DefaultBlobCacheMemLimit)
+	overLimit := bytes.Repeat([]byte("b"), DefaultBlobCacheMemLimit+1)
+
+	if err := c.Put("at-limit", bytes.NewReader(atLimit)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := c.mem["at-limit"]; !ok || c.dir != "" {
+		t.Fatal("a blob of exactly the memory limit was not kept in memory")
+	}
+
+	if err := c.Put("over-limit", bytes.NewReader(overLimit)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := c.mem["over-limit"]; ok {
+		t.Fatal("a blob over the memory limit was kept in memory")
+	}
+	if path := c.disk["over-limit"]; filepath.Dir(path) != c.dir || c.dir == "" {
+		t.Fatalf("a blob over the memory limit was spilled to %q, want a file in the cache dir", path)
+	}
+
+	if !c.Has("at-limit") || !c.Has("over-limit") || c.Has("missing") {
+		t.Fatal("Has does not report the cached blobs")
+	}
+	if !bytes.Equal(readCached(t, c, "at-limit"), atLimit) || !bytes.Equal(readCached(t, c, "over-limit"), overLimit) {
+		t.Fatal("cached content differs")
+	}
+	if _, err := c.Open("missing"); err == nil {
+		t.Fatal("Open of a blob that is not cached succeeded")
+	}
+
+	// replacing a spilled blob with a small one removes its file
+	if err := c.Put("over-limit", bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if files := cacheFiles(t, c); len(files) != 0 {
+		t.Fatalf("cache dir holds %v after the spilled blob was replaced", files)
+	}
+	if got := readCached(t, c, "over-limit"); string(got) != "small" {
+		t.Fatalf("replaced blob = %q", got)
+	}
+}
+
+func TestBlobCachePutFile(t *testing.T) {
+	c := NewBlobCache(4)
+	defer c.Close()
+
+	putFile := func(hash string, content string) {
+		f, err := c.CreateTemp()
+		if err != nil {
+			t.Fatalf("CreateTemp: %v", err)
+		}
+		_, err = f.WriteString(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.PutFile(hash, f.Name()); err != nil {
+			t.Fatalf("PutFile: %v", err)
+		}
+	}
+
+	putFile("hash", "first version")
+	putFile("hash", "second version")
+	if got := readCached(t, c, "hash"); string(got) != "second version" {
+		t.Fatalf("blob = %q, want the second version", got)
+	}
+	if files := cacheFiles(t, c); len(files) != 1 || files[0] != "hash" {
+		t.Fatalf("cache dir holds %v, want only hash", files)
+	}
+
+	// a file replaces a blob kept in memory
+	if err := c.Put("small", bytes.NewReader([]byte("mem"))); err != nil {
+		t.Fatal(err)
+	}
+	putFile("small", "from file")
+	if _, ok := c.mem["small"]; ok {
+		t.Fatal("the replaced blob is still kept in memory")
+	}
+	if got := readCached(t, c, "small"); string(got) != "from file" {
+		t.Fatalf("blob = %q, want the file content", got)
+	}
+
+	c.Remove("hash")
+	if c.Has("hash") {
+		t.Fatal("Has reports a removed blob")
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "hash")); !os.IsNotExist(err) {
+		t.Fatalf("the file of a removed blob is left: %v", err)
+	}
+}
+
+func TestBlobCacheClose(t *testing.T) {
+	c := NewBlobCache(4)
+	if err := c.Put("mem", bytes.NewReader([]byte("mem"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("disk", bytes.NewReader([]byte("spilled to disk"))); err != nil {
+		t.Fatal(err)
+	}
+	// partial downloads are removed as well
+	f, err := c.CreateTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	dir := c.dir
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("cache dir %s is left after Close: %v", dir, err)
+	}
+	if c.Has("mem") || c.Has("disk") {
+		t.Fatal("blobs are still cached after Close")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	// the cache can be used again and gets a new directory
+	if err := c.Put("disk", bytes.NewReader([]byte("spilled again"))); err != nil {
+		t.Fatalf("Put after Close: %v", err)
+	}
+	if got := readCached(t, c, "disk"); string(got) != "spilled again" {
+		t.Fatalf("blob after Close = %q", got)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
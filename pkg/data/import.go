@@ -21,14 +21,16 @@
 package data
 
 import (
+	"context"
 	"hash"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 )
 
 type ImportMode interface {
-	RetrieveSource(pd *ProcessData) (*ModeData, error)
-	WriteSource(pd *ProcessData, md *ModeData) error
+	RetrieveSource(ctx context.Context, pd *ProcessData) (*ModeData, error)
+	WriteSource(ctx context.Context, pd *ProcessData, md *ModeData) error
 	PostProcess(md *ModeData) error
 	ImportName(pd *ProcessData, md *ModeData) string
 }
@@ -42,7 +44,12 @@ type ModeData struct {
 	PushBranch      string
 	Branches        []string
 	SourcesToIgnore []*IgnoredSource
-	BlobCache       map[string][]byte
+	BlobCache       *BlobCache
+	// Commit time of reproducible imports, see ProcessData.CommitTime
+	SourceDate time.Time
+	// Last applied patch repository commit and the directive files applied from it
+	PatchCommit string
+	Directives  []string
 }
 
 type IgnoredSource struct {
@@ -0,0 +1,135 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package data
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// MetadataSource is a source listed in a .{name}.metadata file
+type MetadataSource struct {
+	Hash string
+	Path string
+}
+
+// ValidateTreePath returns an error if p is not a clean relative path inside a worktree.
+// Paths into the git directory are rejected as well
+func ValidateTreePath(p string) error {
+	switch {
+	case p == "":
+		return errors.New("path is empty")
+	case strings.ContainsAny(p, "\\\x00\r\n"):
+		return fmt.Errorf("%q contains invalid characters", p)
+	case path.IsAbs(p):
+		return fmt.Errorf("%s is absolute", p)
+	case path.Clean(p) != p:
+		return fmt.Errorf("%s is not a clean path", p)
+	case p == ".." || strings.HasPrefix(p, "../"):
+		return fmt.Errorf("%s is outside of the tree", p)
+	case p == ".git" || strings.HasPrefix(p, ".git/"):
+		return fmt.Errorf("%s is inside the git directory", p)
+	}
+
+	return nil
+}
+
+// ValidateSourcePath returns an error if p is not a clean relative path below SOURCES/
+func ValidateSourcePath(p string) error {
+	err := ValidateTreePath(p)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(p, "SOURCES/") {
+		return fmt.Errorf("%s is not below SOURCES/", p)
+	}
+
+	return nil
+}
+
+// CheckNoSymlinks returns an error if p or any of its parent directories below dir
+// is a symlink in fs, so writing to p can not escape dir
+func CheckNoSymlinks(fs billy.Filesystem, dir string, p string) error {
+	current := dir
+	for _, part := range strings.Split(p, "/") {
+		current = filepath.Join(current, part)
+		info, err := fs.Lstat(current)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("could not stat %s: %v", current, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", current)
+		}
+	}
+
+	return nil
+}
+
+// ParseMetadata parses the content of a .{name}.metadata file.
+// Checksums have to be hex digests of a supported algorithm and paths have to be
+// below SOURCES/. A path listed twice with different checksums is an error,
+// repeated lines are only returned once
+func ParseMetadata(content []byte) ([]*MetadataSource, error) {
+	var sources []*MetadataSource
+	seen := map[string]string{}
+	for i, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		lineInfo := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(lineInfo) != 2 {
+			return nil, fmt.Errorf("invalid metadata line %d: expected a checksum and a path", i+1)
+		}
+		source := &MetadataSource{
+			Hash: strings.TrimSpace(lineInfo[0]),
+			Path: strings.TrimSpace(lineInfo[1]),
+		}
+
+		if _, err := hex.DecodeString(source.Hash); err != nil || NewHashForChecksum(source.Hash) == nil {
+			return nil, fmt.Errorf("invalid metadata line %d: %q is not a supported checksum", i+1, source.Hash)
+		}
+		if err := ValidateSourcePath(source.Path); err != nil {
+			return nil, fmt.Errorf("invalid metadata line %d: %v", i+1, err)
+		}
+		if hash, ok := seen[source.Path]; ok {
+			if hash != source.Hash {
+				return nil, fmt.Errorf("invalid metadata line %d: %s is listed with different checksums", i+1, source.Path)
+			}
+			continue
+		}
+		seen[source.Path] = source.Hash
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestValidateSourcePath(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		// empty if the path is valid
+		tree   string
+		source string
+	}{
+		{"SOURCES/foo.tar.gz", "", ""},
+		{"SOURCES/sub/foo.tar.gz", "", ""},
+		{"SOURCES/..foo", "", ""},
+		{"foo.spec", "", "not below SOURCES/"},
+		{"SOURCESfoo", "", "not below SOURCES/"},
+		{"", "empty", "empty"},
+		{"..", "outside of the tree", "outside of the tree"},
+		{"../foo", "outside of the tree", "outside of the tree"},
+		{"SOURCES/../../x", "not a clean path", "not a clean path"},
+		{"SOURCES/../foo.spec", "not a clean path", "not a clean path"},
+		{"/etc/passwd", "absolute", "absolute"},
+		{"/SOURCES/foo", "absolute", "absolute"},
+		{"SOURCES//foo", "not a clean path", "not a clean path"},
+		{"SOURCES/./foo", "not a clean path", "not a clean path"},
+		{"SOURCES/", "not a clean path", "not a clean path"},
+		{"./SOURCES/foo", "not a clean path", "not a clean path"},
+		{"SOURCES\\..\\foo", "invalid characters", "invalid characters"},
+		{"SOURCES/foo\x00", "invalid characters", "invalid characters"},
+		{"SOURCES/foo\nbar", "invalid characters", "invalid characters"},
+		{".git", "git directory", "git directory"},
+		{".git/config", "git directory", "git directory"},
+		{".gitignore", "", "not below SOURCES/"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			check := func(name string, err error, want string) {
+				if want == "" {
+					if err != nil {
+						t.Errorf("%s(%q): %v", name, tt.path, err)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("%s(%q) = %v, want an error containing %q", name, tt.path, err, want)
+				}
+			}
+			check("ValidateTreePath", ValidateTreePath(tt.path), tt.tree)
+			check("ValidateSourcePath", ValidateSourcePath(tt.path), tt.source)
+		})
+	}
+}
+
+func TestCheckNoSymlinks(t *testing.T) {
+	fs := memfs.New()
+	for _, dir := range []string{"repo/SOURCES/sub", "outside"} {
+		if err := fs.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"repo/SOURCES/link":    "../../outside",
+		"repo/SOURCES/file":    "/outside/file",
+		"repo/SOURCES/dangles": "missing",
+		"repo/escape":          "../outside",
+	} {
+		if err := fs.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path string
+		err  string
+	}{
+		{"SOURCES/foo.tar.gz", ""},
+		{"SOURCES/sub/foo.tar.gz", ""},
+		{"SOURCES/new/dir/foo.tar.gz", ""},
+		{"SOURCES/link/foo.tar.gz", "repo/SOURCES/link is a symlink"},
+		{"SOURCES/file", "repo/SOURCES/file is a symlink"},
+		{"SOURCES/dangles", "repo/SOURCES/dangles is a symlink"},
+		{"escape/SOURCES/foo.tar.gz", "repo/escape is a symlink"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			err := CheckNoSymlinks(fs, "repo", tt.path)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("CheckNoSymlinks: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("CheckNoSymlinks = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -22,14 +22,32 @@ package data
 
 import (
 	"log"
+	"text/template"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/rocky-linux/srpmproc/pkg/blob"
 )
 
 type FsCreatorFunc func(branch string) (billy.Filesystem, error)
 
+// LookasideMirror is a lookaside server sources are downloaded from.
+// Url is either a --cdn-url style template or a base url that
+// is tried with the default <url>/<name>/<branch>/<hash> and <url>/<hash> patterns.
+// Cdn may name a well-known distro instead of setting Url.
+// If HashTypes is set, the mirror is only tried for sources of these hash types
+type LookasideMirror struct {
+	Url         string            `json:"url,omitempty" yaml:"url,omitempty"`
+	Cdn         string            `json:"cdn,omitempty" yaml:"cdn,omitempty"`
+	Username    string            `json:"username,omitempty" yaml:"username,omitempty"`
+	Password    string            `json:"password,omitempty" yaml:"password,omitempty"`
+	BearerToken string            `json:"bearer_token,omitempty" yaml:"bearer_token,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	HashTypes   []string          `json:"hash_types,omitempty" yaml:"hash_types,omitempty"`
+}
+
 type ProcessData struct {
 	RpmLocation          string
 	UpstreamPrefix       string
@@ -61,4 +79,32 @@ type ProcessData struct {
 	TaglessMode          bool
 	Cdn                  string
 	ModuleBranchNames    bool
+	DryRun               bool
+	DiffMode             bool
+	DownloadParallelism  int
+	DownloadRetries      int
+	DownloadTimeout      time.Duration
+	LookasideMirrors     []*LookasideMirror
+	MetadataDigest       string
+	BlobDigests          []string
+	BlobAliases          bool
+	PreserveHistory      bool
+	Signer               git.Signer
+	Reproducible         bool
+	SourceDate           time.Time
+	// Replace the default commit message, tag name and tag message if set
+	CommitMessageTemplate *template.Template
+	TagNameTemplate       *template.Template
+	TagMessageTemplate    *template.Template
+	BranchRules           *BranchRules
+}
+
+// CommitTime returns the time used for commits, tags and generated files of md.
+// Reproducible imports use the source date of md instead of the current time
+func (pd *ProcessData) CommitTime(md *ModeData) time.Time {
+	if pd.Reproducible {
+		return md.SourceDate
+	}
+
+	return time.Now()
 }
@@ -93,39 +93,68 @@ func StrContains(a []string, b string) bool {
 	return false
 }
 
-// CompareHash checks if content and checksum matches
-// returns the hash type if success else nil
-func (pd *ProcessData) CompareHash(content []byte, checksum string) hash.Hash {
-	var hashType hash.Hash
-
+// NewHashForChecksum returns a hash function matching the length of checksum,
+// nil if the length does not match any supported algorithm
+func NewHashForChecksum(checksum string) hash.Hash {
 	switch len(checksum) {
 	case 128:
-		hashType = sha512.New()
-		break
+		return sha512.New()
 	case 64:
-		hashType = sha256.New()
-		break
+		return sha256.New()
 	case 40:
-		hashType = sha1.New()
-		break
+		return sha1.New()
 	case 32:
-		hashType = md5.New()
-		break
-	default:
+		return md5.New()
+	}
+
+	return nil
+}
+
+// NewHash returns the hash function named name, one of md5, sha1, sha256 or sha512.
+// nil is returned for unknown names
+func NewHash(name string) hash.Hash {
+	switch name {
+	case "sha512":
+		return sha512.New()
+	case "sha256":
+		return sha256.New()
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	}
+
+	return nil
+}
+
+// CompareHash checks if content and checksum matches
+// returns the hash type if success else nil
+func (pd *ProcessData) CompareHash(content []byte, checksum string) hash.Hash {
+	hashType := NewHashForChecksum(checksum)
+	if hashType == nil {
 		return nil
 	}
 
-	hashType.Reset()
 	_, err := hashType.Write(content)
 	if err != nil {
 		return nil
 	}
 
+	if !pd.CheckHash(hashType, checksum) {
+		return nil
+	}
+
+	return hashType
+}
+
+// CheckHash checks if the sum of a hash function that has
+// been fed a stream matches checksum
+func (pd *ProcessData) CheckHash(hashType hash.Hash, checksum string) bool {
 	calculated := hex.EncodeToString(hashType.Sum(nil))
 	if calculated != checksum {
 		pd.Log.Printf("wanted checksum %s, but got %s", checksum, calculated)
-		return nil
+		return false
 	}
 
-	return hashType
+	return true
 }
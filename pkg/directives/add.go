@@ -21,6 +21,7 @@
 package directives
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -29,6 +30,7 @@ import (
 
 	"github.com/go-git/go-git/v5"
 	srpmprocpb "github.com/rocky-linux/srpmproc/pb"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
 	"github.com/rocky-linux/srpmproc/pkg/data"
 )
 
@@ -41,7 +43,7 @@ func eitherString(left string, right string) string {
 	return left
 }
 
-func add(cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
+func add(ctx context.Context, cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
 	for _, add := range cfg.Add {
 		var replacingBytes []byte
 		var filePath string
@@ -63,9 +65,12 @@ func add(cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, patchTree
 		case *srpmprocpb.Add_Lookaside:
 			filePath = checkAddPrefix(eitherString(filepath.Base(addType.Lookaside), add.Name))
 			var err error
-			replacingBytes, err = pd.BlobStorage.Read(addType.Lookaside)
+			replacingBytes, err = blob.ReadResolved(ctx, pd.BlobStorage, addType.Lookaside)
 			if err != nil {
-				return err
+				if errors.Is(err, blob.ErrNotFound) {
+					return errors.New(fmt.Sprintf("LOOKASIDE_NOT_FOUND:%s", addType.Lookaside))
+				}
+				return fmt.Errorf("COULD_NOT_READ_LOOKASIDE:%s: %w", addType.Lookaside, err)
 			}
 
 			hashFunction := pd.CompareHash(replacingBytes, addType.Lookaside)
@@ -80,6 +85,10 @@ func add(cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, patchTree
 			break
 		}
 
+		if err := checkTargetPath(pushTree, filePath); err != nil {
+			return fmt.Errorf("INVALID_ADD_TARGET:%s: %v", filePath, err)
+		}
+
 		f, err := pushTree.Filesystem.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
 		if err != nil {
 			return errors.New(fmt.Sprintf("COULD_NOT_OPEN_DESTINATION:%s", filePath))
@@ -21,6 +21,7 @@
 package directives
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -29,9 +30,12 @@ import (
 	"github.com/rocky-linux/srpmproc/pkg/data"
 )
 
-func del(cfg *srpmprocpb.Cfg, _ *data.ProcessData, _ *data.ModeData, _ *git.Worktree, pushTree *git.Worktree) error {
+func del(_ context.Context, cfg *srpmprocpb.Cfg, _ *data.ProcessData, _ *data.ModeData, _ *git.Worktree, pushTree *git.Worktree) error {
 	for _, del := range cfg.Delete {
 		filePath := del.File
+		if err := checkTargetPath(pushTree, filePath); err != nil {
+			return fmt.Errorf("INVALID_DELETE_TARGET:%s: %v", filePath, err)
+		}
 		_, err := pushTree.Filesystem.Stat(filePath)
 		if err != nil {
 			return errors.New(fmt.Sprintf("FILE_DOES_NOT_EXIST:%s", filePath))
@@ -24,6 +24,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -37,7 +38,7 @@ import (
 	"github.com/rocky-linux/srpmproc/pkg/data"
 )
 
-func lookaside(cfg *srpmprocpb.Cfg, _ *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
+func lookaside(_ context.Context, cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
 	for _, directive := range cfg.Lookaside {
 		var buf bytes.Buffer
 		writer := tar.NewWriter(&buf)
@@ -77,6 +78,10 @@ func lookaside(cfg *srpmprocpb.Cfg, _ *data.ProcessData, md *data.ModeData, patc
 					Mode: int64(stat.Mode()),
 					Size: stat.Size(),
 				}
+				// the archive must not depend on when it was created
+				if pd.Reproducible {
+					hdr.ModTime = time.Unix(0, 0)
+				}
 
 				err = writer.WriteHeader(hdr)
 				if err != nil {
@@ -116,7 +121,9 @@ func lookaside(cfg *srpmprocpb.Cfg, _ *data.ProcessData, md *data.ModeData, patc
 			var gbuf bytes.Buffer
 			gw := gzip.NewWriter(&gbuf)
 			gw.Name = fmt.Sprintf("%s.tar.gz", directive.ArchiveName)
-			gw.ModTime = time.Now()
+			if !pd.Reproducible {
+				gw.ModTime = time.Now()
+			}
 
 			_, err = gw.Write(buf.Bytes())
 			if err != nil {
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package directives
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/memory"
+	srpmprocpb "github.com/rocky-linux/srpmproc/pb"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+// lookasideArchive runs a lookaside directive archiving two sources and returns the archive
+func lookasideArchive(t *testing.T, pd *data.ProcessData) []byte {
+	fs := memfs.New()
+	for name, content := range map[string]string{
+		"SOURCES/a.conf": "a",
+		"SOURCES/b.conf": "b",
+	} {
+		if err := util.WriteFile(fs, name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &srpmprocpb.Cfg{
+		Lookaside: []*srpmprocpb.Lookaside{
+			{File: []string{"a.conf", "b.conf"}, Tar: true, ArchiveName: "conf"},
+		},
+	}
+	md := &data.ModeData{SourceDate: time.Unix(1600000000, 0)}
+	err = lookaside(context.Background(), cfg, pd, md, nil, w)
+	if err != nil {
+		t.Fatalf("lookaside: %v", err)
+	}
+	if len(md.SourcesToIgnore) != 1 || md.SourcesToIgnore[0].Name != "SOURCES/conf.tar.gz" {
+		t.Fatalf("ignored sources %v", md.SourcesToIgnore)
+	}
+
+	archive, err := util.ReadFile(fs, "SOURCES/conf.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+func TestLookasideReproducible(t *testing.T) {
+	pd := &data.ProcessData{Reproducible: true}
+	first := lookasideArchive(t, pd)
+	// the second import runs later
+	time.Sleep(1100 * time.Millisecond)
+	second := lookasideArchive(t, pd)
+	if !bytes.Equal(first, second) {
+		t.Fatal("archives of two reproducible imports differ")
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gr.ModTime.IsZero() {
+		t.Errorf("gzip header has mtime %s", gr.ModTime)
+	}
+	tr := tar.NewReader(gr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.ModTime.Unix() != 0 {
+			t.Errorf("%s has mtime %s", hdr.Name, hdr.ModTime)
+		}
+	}
+	if len(names) != 2 || names[0] != "a.conf" || names[1] != "b.conf" {
+		t.Errorf("archive has %v", names)
+	}
+}
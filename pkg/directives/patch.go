@@ -22,6 +22,7 @@ package directives
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 
@@ -31,7 +32,7 @@ import (
 	"github.com/rocky-linux/srpmproc/pkg/data"
 )
 
-func patch(cfg *srpmprocpb.Cfg, pd *data.ProcessData, _ *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
+func patch(_ context.Context, cfg *srpmprocpb.Cfg, pd *data.ProcessData, _ *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
 	for _, patch := range cfg.Patch {
 		patchFile, err := patchTree.Filesystem.Open(patch.File)
 		pd.Log.Printf("[directives.patch] Parsing File: %s", patchFile.Name())
@@ -50,6 +51,20 @@ func patch(cfg *srpmprocpb.Cfg, pd *data.ProcessData, _ *data.ModeData, patchTre
 			if !patch.Strict {
 				srcPath = checkAddPrefix(patchedFile.NewName)
 			}
+			oldName := patchedFile.OldName
+			if !patch.Strict {
+				oldName = checkAddPrefix(patchedFile.OldName)
+			}
+			if patchedFile.NewName != "" {
+				if err := checkTargetPath(pushTree, srcPath); err != nil {
+					return fmt.Errorf("INVALID_PATCH_TARGET:%s: %v", srcPath, err)
+				}
+			}
+			if patchedFile.OldName != "" {
+				if err := checkTargetPath(pushTree, oldName); err != nil {
+					return fmt.Errorf("INVALID_PATCH_TARGET:%s: %v", oldName, err)
+				}
+			}
 			var output bytes.Buffer
 			if !patchedFile.IsDelete && !patchedFile.IsNew {
 				patchSubjectFile, err := pushTree.Filesystem.Open(srcPath)
@@ -64,10 +79,6 @@ func patch(cfg *srpmprocpb.Cfg, pd *data.ProcessData, _ *data.ModeData, patchTre
 				}
 			}
 
-			oldName := patchedFile.OldName
-			if !patch.Strict {
-				oldName = checkAddPrefix(patchedFile.OldName)
-			}
 			_ = pushTree.Filesystem.Remove(oldName)
 			_ = pushTree.Filesystem.Remove(srcPath)
 
@@ -21,6 +21,7 @@
 package directives
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -28,12 +29,16 @@ import (
 
 	"github.com/go-git/go-git/v5"
 	srpmprocpb "github.com/rocky-linux/srpmproc/pb"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
 	"github.com/rocky-linux/srpmproc/pkg/data"
 )
 
-func replace(cfg *srpmprocpb.Cfg, pd *data.ProcessData, _ *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
+func replace(ctx context.Context, cfg *srpmprocpb.Cfg, pd *data.ProcessData, _ *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
 	for _, replace := range cfg.Replace {
 		filePath := checkAddPrefix(replace.File)
+		if err := checkTargetPath(pushTree, filePath); err != nil {
+			return fmt.Errorf("INVALID_REPLACE_TARGET:%s: %v", filePath, err)
+		}
 		stat, err := pushTree.Filesystem.Stat(filePath)
 		if replace.File == "" || err != nil {
 			return errors.New(fmt.Sprintf("INVALID_FILE:%s", filePath))
@@ -73,9 +78,12 @@ func replace(cfg *srpmprocpb.Cfg, pd *data.ProcessData, _ *data.ModeData, patchT
 			}
 			break
 		case *srpmprocpb.Replace_WithLookaside:
-			bts, err := pd.BlobStorage.Read(replacing.WithLookaside)
+			bts, err := blob.ReadResolved(ctx, pd.BlobStorage, replacing.WithLookaside)
 			if err != nil {
-				return err
+				if errors.Is(err, blob.ErrNotFound) {
+					return errors.New(fmt.Sprintf("LOOKASIDE_NOT_FOUND:%s", replacing.WithLookaside))
+				}
+				return fmt.Errorf("COULD_NOT_READ_LOOKASIDE:%s: %w", replacing.WithLookaside, err)
 			}
 			hasher := pd.CompareHash(bts, replacing.WithLookaside)
 			if hasher == nil {
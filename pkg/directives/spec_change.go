@@ -21,6 +21,7 @@
 package directives
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -30,7 +31,6 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/go-git/go-git/v5"
 	srpmprocpb "github.com/rocky-linux/srpmproc/pb"
@@ -188,7 +188,7 @@ func strSliceContains(slice []string, str string) bool {
 	return false
 }
 
-func specChange(cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, _ *git.Worktree, pushTree *git.Worktree) error {
+func specChange(_ context.Context, cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, _ *git.Worktree, pushTree *git.Worktree) error {
 	// no spec change operations present
 	// skip parsing spec
 	if cfg.SpecChange == nil {
@@ -434,7 +434,7 @@ func specChange(cfg *srpmprocpb.Cfg, pd *data.ProcessData, md *data.ModeData, _
 			}
 
 			if inSection == sectionChangelog {
-				now := time.Now().Format("Mon Jan 02 2006")
+				now := pd.CommitTime(md).Format("Mon Jan 02 2006")
 				for _, changelog := range cfg.SpecChange.Changelog {
 					newLines = append(newLines, fmt.Sprintf("* %s %s <%s> - %s", now, changelog.AuthorName, changelog.AuthorEmail, version))
 					for _, msg := range changelog.Message {
@@ -11,7 +11,10 @@ import (
 
 func GetTagImportRegex(pd *data.ProcessData) *regexp.Regexp {
 	branchRegex := regexp.QuoteMeta(fmt.Sprintf("%s%d%s", pd.ImportBranchPrefix, pd.Version, pd.BranchSuffix))
-	if !pd.StrictBranchMode {
+	if pd.BranchRules != nil {
+		// branch rules decide which branches are imported, see ImportBranchOk
+		branchRegex = "[^/]+"
+	} else if !pd.StrictBranchMode {
 		branchRegex += "(?:.+|)"
 	} else {
 		branchRegex += "(?:-stream-.+|)"
@@ -38,6 +41,10 @@ func GetTagImportRegex(pd *data.ProcessData) *regexp.Regexp {
 // if we are ok with importing that reference.  We are looking for the traditional <prefix><version><suffix> pattern, like "c9s", and also the
 // modular "stream-<NAME>-<VERSION>-rhel-<VERSION> branch pattern as well
 func TaglessRefOk(tag string, pd *data.ProcessData) bool {
+	if pd.BranchRules != nil {
+		return strings.HasPrefix(tag, "refs/heads/") && ImportBranchOk(pd, strings.TrimPrefix(tag, "refs/heads/"))
+	}
+
 	// First case is very easy: if we are exactly "refs/heads/<prefix><version><suffix>" , then this is def. a branch we should import
 	if tag == fmt.Sprintf("refs/heads/%s%d%s", pd.ImportBranchPrefix, pd.Version, pd.BranchSuffix) {
 		return true
@@ -51,3 +58,13 @@ func TaglessRefOk(tag string, pd *data.ProcessData) bool {
 
 	return false
 }
+
+// ImportBranchOk returns true if the upstream branch should be imported.
+// Without branch rules, every branch matched by GetTagImportRegex is imported
+func ImportBranchOk(pd *data.ProcessData, branch string) bool {
+	if pd.BranchRules == nil {
+		return true
+	}
+
+	return pd.BranchRules.Branch(branch).Ok()
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package modes
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Given a local repo on disk, ensure it's in the "traditional" format.  This means:
+//   - metadata file is named .pkgname.metadata
+//   - metadata file has the old "<SHASUM>  SOURCES/<filename>"  format
+//   - SPECS/ and SOURCES/ exist and are populated correctly
+func ConvertLocalRepo(pkgName string, localRepo string) (bool, error) {
+	// Make sure we have a SPECS and SOURCES folder made:
+	if err := os.MkdirAll(fmt.Sprintf("%s/SOURCES", localRepo), 0o755); err != nil {
+		return false, fmt.Errorf("Could not create SOURCES directory in: %s", localRepo)
+	}
+
+	if err := os.MkdirAll(fmt.Sprintf("%s/SPECS", localRepo), 0o755); err != nil {
+		return false, fmt.Errorf("Could not create SPECS directory in: %s", localRepo)
+	}
+
+	// Loop through each file/folder and operate accordingly:
+	files, err := os.ReadDir(localRepo)
+	if err != nil {
+		return false, err
+	}
+
+	for _, f := range files {
+		// We don't want to process SOURCES, SPECS, or any of our .git folders
+		if f.Name() == "SOURCES" || f.Name() == "SPECS" || strings.HasPrefix(f.Name(), ".git") || f.Name() == "."+pkgName+".metadata" {
+			continue
+		}
+
+		// If we have a metadata "sources" file, we need to read it and convert to the old .<pkgname>.metadata format
+		if f.Name() == "sources" {
+			convertStatus := ConvertMetaData(pkgName, localRepo)
+
+			if convertStatus != true {
+				return false, fmt.Errorf("Error converting sources metadata file to .metadata format")
+			}
+
+			continue
+		}
+
+		// Any file that ends in a ".spec" should be put into SPECS/
+		if strings.HasSuffix(f.Name(), ".spec") {
+			err := os.Rename(fmt.Sprintf("%s/%s", localRepo, f.Name()), fmt.Sprintf("%s/SPECS/%s", localRepo, f.Name()))
+			if err != nil {
+				return false, fmt.Errorf("Error moving .spec file to SPECS/")
+			}
+		}
+
+		// if a file isn't skipped in one of the above checks, then it must be a file that belongs in SOURCES/
+		os.Rename(fmt.Sprintf("%s/%s", localRepo, f.Name()), fmt.Sprintf("%s/SOURCES/%s", localRepo, f.Name()))
+	}
+
+	return true, nil
+}
+
+// Given a local "sources" metadata file (new CentOS Stream format), convert it into the older
+// classic CentOS style:  "<HASH>  SOURCES/<FILENAME>"
+func ConvertMetaData(pkgName string, localRepo string) bool {
+	lookAside, err := os.Open(fmt.Sprintf("%s/sources", localRepo))
+	if err != nil {
+		return false
+	}
+
+	// Split file into lines and start processing:
+	scanner := bufio.NewScanner(lookAside)
+	scanner.Split(bufio.ScanLines)
+
+	// convertedLA is our array of new "converted" lookaside lines
+	var convertedLA []string
+
+	// loop through each line, and:
+	//   - split by whitespace
+	//   - check each line begins with "SHA" or "MD" - validate
+	//   - take the
+	// Then check
+	for scanner.Scan() {
+		tmpLine := strings.Fields(scanner.Text())
+		// make sure line starts with a "SHA" or "MD" before processing - otherwise it might not be a valid format lookaside line!
+		if !(strings.HasPrefix(tmpLine[0], "SHA") || strings.HasPrefix(tmpLine[0], "MD")) {
+			continue
+		}
+
+		// Strip out "( )" characters from file name and prepend SOURCES/ to it
+		tmpLine[1] = strings.ReplaceAll(tmpLine[1], "(", "")
+		tmpLine[1] = strings.ReplaceAll(tmpLine[1], ")", "")
+		tmpLine[1] = fmt.Sprintf("SOURCES/%s", tmpLine[1])
+
+		convertedLA = append(convertedLA, fmt.Sprintf("%s %s", tmpLine[3], tmpLine[1]))
+	}
+	lookAside.Close()
+
+	// open .<NAME>.metadata file for writing our old-format lines
+	lookAside, err = os.OpenFile(fmt.Sprintf("%s/.%s.metadata", localRepo, pkgName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return false
+	}
+
+	writer := bufio.NewWriter(lookAside)
+
+	for _, convertedLine := range convertedLA {
+		_, _ = writer.WriteString(convertedLine + "\n")
+	}
+
+	writer.Flush()
+	lookAside.Close()
+
+	// Remove old "sources" metadata file - we don't need it now that conversion is complete
+	os.Remove(fmt.Sprintf("%s/sources", localRepo))
+
+	return true
+}
+
+// Given a local checked out folder and package name, including SPECS/ , SOURCES/ , and .package.metadata, this will:
+//   - create a "dummy" SRPM (using dummy sources files we use to populate tarballs from lookaside)
+//   - extract RPM version info from that SRPM, and return it
+//
+// If we are in tagless mode, we need to get a package version somehow!
+func GetVersionFromSpec(ctx context.Context, localRepo string, majorVersion int) (string, error) {
+	// Make sure we have "rpm" and "rpmbuild" and "cp" available in our PATH.  Otherwise, this won't work:
+	_, err := exec.LookPath("rpmspec")
+	if err != nil {
+		return "", fmt.Errorf("Could not find rpmspec program in PATH")
+	}
+
+	// Read the first file from SPECS/ to get our spec file
+	// (there should only be one file - we check that it ends in ".spec" just to be sure!)
+	lsTmp, err := os.ReadDir(fmt.Sprintf("%s/SPECS/", localRepo))
+	if err != nil {
+		return "", err
+	}
+	specFile := lsTmp[0].Name()
+
+	if !strings.HasSuffix(specFile, ".spec") {
+		return "", fmt.Errorf("First file found in SPECS/ is not a .spec file!  Check the SPECS/ directory in the repo?")
+	}
+
+	// Call the rpmspec binary to extract the version-release info out of it, and tack on ".el<VERSION>" at the end:
+	cmdArgs := []string{
+		"--srpm",
+		fmt.Sprintf(`--define=dist  .el%d`, majorVersion),
+		fmt.Sprintf(`--define=_topdir  %s`, localRepo),
+		"-q",
+		"--queryformat",
+		`%{NAME}|%{VERSION}|%{RELEASE}\n`,
+		fmt.Sprintf("%s/SPECS/%s", localRepo, specFile),
+	}
+	cmd := exec.CommandContext(ctx, "rpmspec", cmdArgs...)
+	nvrTmp, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error running rpmspec command to determine RPM name-version-release identifier. \nCommand attempted: %s \nCommand output: %s", cmd.String(), string(nvrTmp))
+	}
+
+	// Pull first line of the version output to get the name-version-release number (there should only be 1 line)
+	nvr := string(nvrTmp)
+	nvr = strings.Fields(nvr)[0]
+
+	// return name-version-release string we derived:
+	log.Printf("Derived NVR %s from tagless repo via rpmspec command\n", nvr)
+	return nvr, nil
+}
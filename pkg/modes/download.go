@@ -0,0 +1,323 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package modes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+const (
+	downloadBackoffBase = time.Second
+	downloadBackoffMax  = 30 * time.Second
+
+	// mirrors failing this many downloads in a row are tried last
+	mirrorUnhealthyAfter = 3
+)
+
+// downloadStatusError is returned for unexpected HTTP status codes
+type downloadStatusError struct {
+	url    string
+	status int
+}
+
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("could not download dist-git file %s (status code %d)", e.url, e.status)
+}
+
+func isTransientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+}
+
+// lookasideCandidate is a url a source may be downloaded from
+type lookasideCandidate struct {
+	url    string
+	mirror *data.LookasideMirror
+}
+
+// lookasideDownloader downloads lookaside sources with retries.
+// Interrupted downloads are resumed with range requests.
+// Mirrors are tried in order, mirrors that keep failing are moved to the end
+type lookasideDownloader struct {
+	pd      *data.ProcessData
+	client  *http.Client
+	mirrors []*data.LookasideMirror
+
+	mu       sync.Mutex
+	failures map[*data.LookasideMirror]int
+}
+
+func newLookasideDownloader(pd *data.ProcessData) *lookasideDownloader {
+	mirrors := pd.LookasideMirrors
+	if len(mirrors) == 0 {
+		mirrors = []*data.LookasideMirror{{Url: pd.CdnUrl}}
+	}
+
+	return &lookasideDownloader{
+		pd: pd,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DisableCompression: false,
+			},
+		},
+		mirrors:  mirrors,
+		failures: map[*data.LookasideMirror]int{},
+	}
+}
+
+// candidates returns the urls to try for a source, healthy mirrors first.
+// Templated mirror urls are used as-is, plain urls are tried with the
+// default <SITE>/<PKG>/<BRANCH>/<HASH> pattern and then the simple <SITE>/<HASH> pattern
+func (d *lookasideDownloader) candidates(name string, branch string, checksum string, hashType string, fileName string) []*lookasideCandidate {
+	d.mu.Lock()
+	mirrors := append([]*data.LookasideMirror{}, d.mirrors...)
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		return d.failures[mirrors[i]] < mirrorUnhealthyAfter && d.failures[mirrors[j]] >= mirrorUnhealthyAfter
+	})
+	d.mu.Unlock()
+
+	var candidates []*lookasideCandidate
+	for _, mirror := range mirrors {
+		if len(mirror.HashTypes) > 0 && !slices.Contains(mirror.HashTypes, hashType) {
+			continue
+		}
+
+		// Feed our template info to ProcessUrl and transform to the real values: ( {{.Name}}, {{.Branch}}, {{.Hash}}, {{.Hashtype}}, {{.Filename}} )
+		url, hasTemplate := ProcessUrl(mirror.Url, name, branch, checksum, hashType, fileName)
+		if hasTemplate {
+			candidates = append(candidates, &lookasideCandidate{url: url, mirror: mirror})
+			continue
+		}
+
+		candidates = append(candidates,
+			&lookasideCandidate{url: fmt.Sprintf("%s/%s/%s/%s", mirror.Url, name, branch, checksum), mirror: mirror},
+			&lookasideCandidate{url: fmt.Sprintf("%s/%s", mirror.Url, checksum), mirror: mirror},
+		)
+	}
+
+	return candidates
+}
+
+// recordResult tracks the health of a mirror.
+// A missing file does not make a mirror unhealthy, errors and transient statuses do
+func (d *lookasideDownloader) recordResult(mirror *data.LookasideMirror, err error) {
+	var statusErr *downloadStatusError
+	if err != nil && errors.As(err, &statusErr) && !isTransientStatus(statusErr.status) {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err == nil {
+		d.failures[mirror] = 0
+		return
+	}
+
+	d.failures[mirror]++
+	if d.failures[mirror] == mirrorUnhealthyAfter {
+		d.pd.Log.Printf("lookaside mirror %s is unhealthy, trying it last", mirror.Url)
+	}
+}
+
+// download tries candidates in order until one of them succeeds and writes the response to f.
+// verify checks the downloaded file, a candidate serving a file that fails verification
+// counts as failed and the next candidate is tried
+func (d *lookasideDownloader) download(ctx context.Context, candidates []*lookasideCandidate, f *os.File, verify func(f *os.File) error) error {
+	if len(candidates) == 0 {
+		return fmt.Errorf("no lookaside mirror serves this hash type")
+	}
+
+	var lastErr error
+	for _, candidate := range candidates {
+		d.pd.Log.Printf("downloading %s", candidate.url)
+
+		// never resume a partial download of another candidate
+		err := truncateFile(f)
+		if err != nil {
+			return err
+		}
+
+		err = d.downloadWithRetry(ctx, candidate, f)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			err = verify(f)
+			if err != nil {
+				d.pd.Log.Printf("%s: %v", candidate.url, err)
+			}
+		}
+		d.recordResult(candidate.mirror, err)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+
+	return lastErr
+}
+
+func (d *lookasideDownloader) downloadWithRetry(ctx context.Context, candidate *lookasideCandidate, f *os.File) error {
+	url := candidate.url
+	for attempt := 0; ; attempt++ {
+		retry, err := d.attempt(ctx, candidate, f)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= d.pd.DownloadRetries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := downloadBackoff(attempt)
+		d.pd.Log.Printf("download of %s failed, retrying in %s: %v", url, wait.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt does a single request for url, resuming at the end of f.
+// The returned bool reports whether the request is worth retrying
+func (d *lookasideDownloader) attempt(ctx context.Context, candidate *lookasideCandidate, f *os.File) (bool, error) {
+	url := candidate.url
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, fmt.Errorf("could not seek download file: %v", err)
+	}
+
+	if d.pd.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.pd.DownloadTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("could not create new http request: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "*")
+	for key, value := range candidate.mirror.Headers {
+		req.Header.Set(key, value)
+	}
+	if candidate.mirror.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+candidate.mirror.BearerToken)
+	} else if candidate.mirror.Username != "" {
+		req.SetBasicAuth(candidate.mirror.Username, candidate.mirror.Password)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("could not download dist-git file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range, start over
+		if offset > 0 {
+			err := truncateFile(f)
+			if err != nil {
+				return false, err
+			}
+		}
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp) == offset:
+		d.pd.Log.Printf("resuming %s at byte %d", url, offset)
+	case resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// unusable partial response, start over
+		err := truncateFile(f)
+		if err != nil {
+			return false, err
+		}
+		return true, &downloadStatusError{url: url, status: resp.StatusCode}
+	case isTransientStatus(resp.StatusCode):
+		return true, &downloadStatusError{url: url, status: resp.StatusCode}
+	default:
+		return false, &downloadStatusError{url: url, status: resp.StatusCode}
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		// keep what we got, the next attempt resumes from there
+		return true, fmt.Errorf("could not read the whole dist-git file: %v", err)
+	}
+
+	return false, nil
+}
+
+// downloadBackoff returns the exponential backoff for attempt with jitter,
+// so parallel downloads failing together do not retry together
+func downloadBackoff(attempt int) time.Duration {
+	backoff := downloadBackoffBase << attempt
+	if backoff <= 0 || backoff > downloadBackoffMax {
+		backoff = downloadBackoffMax
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// contentRangeStart returns the first byte of a "bytes start-end/size" Content-Range header, -1 if invalid
+func contentRangeStart(resp *http.Response) int64 {
+	contentRange := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	start, _, found := strings.Cut(contentRange, "-")
+	if !found {
+		return -1
+	}
+
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+
+	return offset
+}
+
+func truncateFile(f *os.File) error {
+	err := f.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("could not truncate download file: %v", err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not seek download file: %v", err)
+	}
+
+	return nil
+}
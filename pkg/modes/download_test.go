@@ -0,0 +1,261 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package modes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+func newTestDownloader(t *testing.T) (*lookasideDownloader, *os.File) {
+	pd := &data.ProcessData{
+		Log: log.New(io.Discard, "", 0),
+	}
+	f, err := os.CreateTemp(t.TempDir(), "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+
+	return newLookasideDownloader(pd), f
+}
+
+func verifyContent(want []byte) func(f *os.File) error {
+	return func(f *os.File) error {
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return errors.New("checksum mismatch")
+		}
+		return nil
+	}
+}
+
+func TestDownloadFallsThroughOnMismatch(t *testing.T) {
+	want := []byte("the real source tarball")
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("something else entirely"))
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(want)
+	}))
+	defer good.Close()
+
+	d, f := newTestDownloader(t)
+	badMirror := &data.LookasideMirror{Url: bad.URL}
+	err := d.download(context.Background(), []*lookasideCandidate{
+		{url: bad.URL + "/source", mirror: badMirror},
+		{url: good.URL + "/source", mirror: &data.LookasideMirror{Url: good.URL}},
+	}, f, verifyContent(want))
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if err := verifyContent(want)(f); err != nil {
+		t.Fatalf("downloaded file: %v", err)
+	}
+	if d.failures[badMirror] != 1 {
+		t.Fatalf("mismatching mirror has %d failures, want 1", d.failures[badMirror])
+	}
+
+	// every candidate serving a bad file fails the download
+	err = d.download(context.Background(), []*lookasideCandidate{
+		{url: bad.URL + "/source", mirror: badMirror},
+	}, f, verifyContent(want))
+	if err == nil {
+		t.Fatal("download of a mismatching file succeeded")
+	}
+}
+
+func TestDownloadDoesNotResumeAcrossCandidates(t *testing.T) {
+	want := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	// sends part of the file and drops the connection
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(want)))
+		_, _ = w.Write(want[:10])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer partial.Close()
+
+	var ranged bool
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged = true
+		}
+		_, _ = w.Write(want)
+	}))
+	defer good.Close()
+
+	d, f := newTestDownloader(t)
+	err := d.download(context.Background(), []*lookasideCandidate{
+		{url: partial.URL + "/source", mirror: &data.LookasideMirror{Url: partial.URL}},
+		{url: good.URL + "/source", mirror: &data.LookasideMirror{Url: good.URL}},
+	}, f, verifyContent(want))
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if ranged {
+		t.Fatal("the second candidate was asked to resume the partial download of the first")
+	}
+	if err := verifyContent(want)(f); err != nil {
+		t.Fatalf("downloaded file: %v", err)
+	}
+}
+
+func candidateUrls(candidates []*lookasideCandidate) []string {
+	var urls []string
+	for _, candidate := range candidates {
+		urls = append(urls, candidate.url)
+	}
+
+	return urls
+}
+
+func TestCandidates(t *testing.T) {
+	d, _ := newTestDownloader(t)
+	primary := &data.LookasideMirror{Url: "https://primary/repo/pkgs"}
+	templated := &data.LookasideMirror{Url: "https://templated/{{.Name}}/{{.Filename}}/{{.Hashtype}}/{{.Hash}}"}
+	sha512Only := &data.LookasideMirror{Url: "https://sha512", HashTypes: []string{"sha512"}}
+	d.mirrors = []*data.LookasideMirror{primary, templated, sha512Only}
+
+	got := candidateUrls(d.candidates("bash", "c8", "abc", "sha256", "bash.tar.gz"))
+	want := []string{
+		"https://primary/repo/pkgs/bash/c8/abc",
+		"https://primary/repo/pkgs/abc",
+		"https://templated/bash/bash.tar.gz/sha256/abc",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+
+	got = candidateUrls(d.candidates("bash", "c8", "abc", "sha512", "bash.tar.gz"))
+	if len(got) != 5 || got[3] != "https://sha512/bash/c8/abc" || got[4] != "https://sha512/abc" {
+		t.Fatalf("candidates for sha512 = %v", got)
+	}
+
+	d.mirrors = []*data.LookasideMirror{sha512Only}
+	if got := d.candidates("bash", "c8", "abc", "md5", "bash.tar.gz"); len(got) != 0 {
+		t.Fatalf("candidates of a filtered hash type = %v", candidateUrls(got))
+	}
+}
+
+func TestCandidatesUnhealthyLast(t *testing.T) {
+	d, _ := newTestDownloader(t)
+	first := &data.LookasideMirror{Url: "https://first"}
+	second := &data.LookasideMirror{Url: "https://second"}
+	third := &data.LookasideMirror{Url: "https://third"}
+	d.mirrors = []*data.LookasideMirror{first, second, third}
+
+	mirrorOrder := func() string {
+		var urls []string
+		for _, candidate := range d.candidates("bash", "c8", "abc", "sha256", "bash.tar.gz") {
+			if len(urls) == 0 || urls[len(urls)-1] != candidate.mirror.Url {
+				urls = append(urls, candidate.mirror.Url)
+			}
+		}
+		return strings.Join(urls, " ")
+	}
+
+	// a missing file is not the fault of the mirror
+	for i := 0; i < mirrorUnhealthyAfter; i++ {
+		d.recordResult(first, &downloadStatusError{url: "https://first/abc", status: http.StatusNotFound})
+	}
+	if got := mirrorOrder(); got != "https://first https://second https://third" {
+		t.Fatalf("order after not found errors = %s", got)
+	}
+
+	for i := 0; i < mirrorUnhealthyAfter-1; i++ {
+		d.recordResult(first, &downloadStatusError{url: "https://first/abc", status: http.StatusServiceUnavailable})
+	}
+	if got := mirrorOrder(); got != "https://first https://second https://third" {
+		t.Fatalf("order before the mirror is unhealthy = %s", got)
+	}
+	d.recordResult(first, errors.New("connection refused"))
+	if got := mirrorOrder(); got != "https://second https://third https://first" {
+		t.Fatalf("order with an unhealthy mirror = %s", got)
+	}
+
+	// a success makes the mirror healthy again
+	d.recordResult(first, nil)
+	if got := mirrorOrder(); got != "https://first https://second https://third" {
+		t.Fatalf("order after the mirror recovered = %s", got)
+	}
+}
+
+func TestDownloadAuth(t *testing.T) {
+	want := []byte("source")
+	var got []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Clone())
+		_, _ = w.Write(want)
+	}))
+	defer srv.Close()
+
+	mirrors := []*data.LookasideMirror{
+		{Url: srv.URL, BearerToken: "token", Headers: map[string]string{"X-Mirror": "bearer"}},
+		{Url: srv.URL, Username: "user", Password: "secret"},
+		{Url: srv.URL, Headers: map[string]string{"Authorization": "Custom abc"}},
+	}
+	for _, mirror := range mirrors {
+		d, f := newTestDownloader(t)
+		err := d.download(context.Background(), []*lookasideCandidate{{url: srv.URL + "/abc", mirror: mirror}}, f, verifyContent(want))
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("%d requests, want 3", len(got))
+	}
+	if auth := got[0].Get("Authorization"); auth != "Bearer token" {
+		t.Errorf("bearer Authorization = %q", auth)
+	}
+	if header := got[0].Get("X-Mirror"); header != "bearer" {
+		t.Errorf("X-Mirror = %q", header)
+	}
+	req := &http.Request{Header: got[1]}
+	if user, password, ok := req.BasicAuth(); !ok || user != "user" || password != "secret" {
+		t.Errorf("basic auth = %q, %q, %v", user, password, ok)
+	}
+	if auth := got[2].Get("Authorization"); auth != "Custom abc" {
+		t.Errorf("header Authorization = %q", auth)
+	}
+}
@@ -22,10 +22,13 @@ package modes
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"log"
-	"net/http"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -33,6 +36,7 @@ import (
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
 	"github.com/rocky-linux/srpmproc/pkg/misc"
 
 	"github.com/go-git/go-billy/v5/memfs"
@@ -42,6 +46,7 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/rocky-linux/srpmproc/pkg/data"
+	"golang.org/x/sync/errgroup"
 )
 
 type remoteTarget struct {
@@ -74,7 +79,7 @@ func (p remoteTargetSlice) Swap(i, j int) {
 
 type GitMode struct{}
 
-func (g *GitMode) RetrieveSource(pd *data.ProcessData) (*data.ModeData, error) {
+func (g *GitMode) RetrieveSource(ctx context.Context, pd *data.ProcessData) (*data.ModeData, error) {
 	repo, err := git.Init(memory.NewStorage(), memfs.New())
 	if err != nil {
 		return nil, fmt.Errorf("could not init git Repo: %v", err)
@@ -102,11 +107,11 @@ func (g *GitMode) RetrieveSource(pd *data.ProcessData) (*data.ModeData, error) {
 		Force:    true,
 	}
 
-	err = remote.Fetch(fetchOpts)
+	err = remote.FetchContext(ctx, fetchOpts)
 	if err != nil {
 		if err == transport.ErrInvalidAuthMethod || err == transport.ErrAuthenticationRequired {
 			fetchOpts.Auth = nil
-			err = remote.Fetch(fetchOpts)
+			err = remote.FetchContext(ctx, fetchOpts)
 			if err != nil {
 				return nil, fmt.Errorf("could not fetch upstream: %v", err)
 			}
@@ -120,10 +125,13 @@ func (g *GitMode) RetrieveSource(pd *data.ProcessData) (*data.ModeData, error) {
 	latestTags := map[string]*remoteTarget{}
 
 	tagAdd := func(tag *object.Tag) error {
-		if strings.HasPrefix(tag.Name, fmt.Sprintf("imports/%s%d", pd.ImportBranchPrefix, pd.Version)) {
+		if pd.BranchRules != nil || strings.HasPrefix(tag.Name, fmt.Sprintf("imports/%s%d", pd.ImportBranchPrefix, pd.Version)) {
 			refSpec := fmt.Sprintf("refs/tags/%s", tag.Name)
 			if misc.GetTagImportRegex(pd).MatchString(refSpec) {
 				match := misc.GetTagImportRegex(pd).FindStringSubmatch(refSpec)
+				if !misc.ImportBranchOk(pd, match[2]) {
+					return nil
+				}
 
 				exists := latestTags[match[2]]
 				if exists != nil && exists.when.After(tag.Tagger.When) {
@@ -174,11 +182,11 @@ func (g *GitMode) RetrieveSource(pd *data.ProcessData) (*data.ModeData, error) {
 	listOpts := &git.ListOptions{
 		Auth: pd.Authenticator,
 	}
-	list, err := remote.List(listOpts)
+	list, err := remote.ListContext(ctx, listOpts)
 	if err != nil {
 		if err == transport.ErrInvalidAuthMethod || err == transport.ErrAuthenticationRequired {
 			listOpts.Auth = nil
-			list, err = remote.List(listOpts)
+			list, err = remote.ListContext(ctx, listOpts)
 			if err != nil {
 				return nil, fmt.Errorf("could not list upstream: %v", err)
 			}
@@ -232,7 +240,7 @@ func (g *GitMode) RetrieveSource(pd *data.ProcessData) (*data.ModeData, error) {
 	}, nil
 }
 
-func (g *GitMode) WriteSource(pd *data.ProcessData, md *data.ModeData) error {
+func (g *GitMode) WriteSource(ctx context.Context, pd *data.ProcessData, md *data.ModeData) error {
 	remote, err := md.Repo.Remote("upstream")
 
 	if err != nil && !pd.TaglessMode {
@@ -263,11 +271,11 @@ func (g *GitMode) WriteSource(pd *data.ProcessData, md *data.ModeData) error {
 			Tags:       git.AllTags,
 			Force:      true,
 		}
-		err = remote.Fetch(fetchOpts)
+		err = remote.FetchContext(ctx, fetchOpts)
 		if err != nil && err != git.NoErrAlreadyUpToDate {
 			if err == transport.ErrInvalidAuthMethod || err == transport.ErrAuthenticationRequired {
 				fetchOpts.Auth = nil
-				err = remote.Fetch(fetchOpts)
+				err = remote.FetchContext(ctx, fetchOpts)
 				if err != nil && err != git.NoErrAlreadyUpToDate {
 					return fmt.Errorf("could not fetch upstream: %v", err)
 				}
@@ -294,6 +302,14 @@ func (g *GitMode) WriteSource(pd *data.ProcessData, md *data.ModeData) error {
 		branchName = fmt.Sprintf("%s%d%s", pd.ImportBranchPrefix, pd.Version, pd.BranchSuffix)
 	}
 
+	return writeMetadataSources(ctx, pd, md, branchName)
+}
+
+// writeMetadataSources reads the metadata file in the worktree root and
+// places every listed source in the worktree. Sources are taken from the
+// worktree itself if already present, the blob cache, blob storage or
+// lastly downloaded from the CDN
+func writeMetadataSources(ctx context.Context, pd *data.ProcessData, md *data.ModeData, branchName string) error {
 	metadataPath := ""
 	ls, err := md.Worktree.Filesystem.ReadDir(".")
 	if err != nil {
@@ -322,147 +338,215 @@ func (g *GitMode) WriteSource(pd *data.ProcessData, md *data.ModeData) error {
 		return fmt.Errorf("could not read metadata file: %v", err)
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			DisableCompression: false,
-		},
+	type metadataSource struct {
+		path   string
+		hash   string
+		inTree hash.Hash
+	}
+
+	parsed, err := data.ParseMetadata(fileBytes)
+	if err != nil {
+		return fmt.Errorf("%s: %v", metadataPath, err)
+	}
+	var sources []*metadataSource
+	for _, source := range parsed {
+		// an upstream symlink must not redirect the source out of the tree
+		err := data.CheckNoSymlinks(md.Worktree.Filesystem, "", source.Path)
+		if err != nil {
+			return fmt.Errorf("%s: unsafe source path: %v", metadataPath, err)
+		}
+		sources = append(sources, &metadataSource{
+			hash: source.Hash,
+			path: source.Path,
+		})
+	}
+
+	// download everything that is not in the tree or cache yet in parallel,
+	// the first failure cancels the remaining downloads
+	parallelism := pd.DownloadParallelism
+	if parallelism < 1 {
+		parallelism = 1
 	}
-	fileContent := strings.Split(string(fileBytes), "\n")
-	for _, line := range fileContent {
-		if strings.TrimSpace(line) == "" {
+	downloader := newLookasideDownloader(pd)
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(parallelism)
+
+	queued := map[string]bool{}
+	for _, source := range sources {
+		source.inTree = readInTree(md, source.path, source.hash)
+		if source.inTree != nil || queued[source.hash] {
 			continue
 		}
+		queued[source.hash] = true
 
-		lineInfo := strings.SplitN(line, " ", 2)
-		hash := strings.TrimSpace(lineInfo[0])
-		path := strings.TrimSpace(lineInfo[1])
+		if md.BlobCache.Has(source.hash) {
+			pd.Log.Printf("retrieving %s from cache", source.hash)
+			continue
+		}
 
-		var body []byte
+		source := source
+		group.Go(func() error {
+			return downloadSource(groupCtx, pd, md, downloader, branchName, source.path, source.hash)
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return err
+	}
 
-		if md.BlobCache[hash] != nil {
-			body = md.BlobCache[hash]
-			pd.Log.Printf("retrieving %s from cache", hash)
+	// place the sources in metadata order
+	for _, source := range sources {
+		hasher := source.inTree
+		if hasher != nil {
+			pd.Log.Printf("using in-tree %s", source.path)
 		} else {
-			fromBlobStorage, err := pd.BlobStorage.Read(hash)
+			hasher, err = copyFromCache(pd, md, source.path, source.hash)
 			if err != nil {
 				return err
 			}
-			if fromBlobStorage != nil && !pd.NoStorageDownload {
-				body = fromBlobStorage
-				pd.Log.Printf("downloading %s from blob storage", hash)
-			} else {
-
-				url := ""
-
-				// We need to figure out the hashtype for templating purposes:
-				hashType := "sha512"
-				switch len(hash) {
-				case 128:
-					hashType = "sha512"
-				case 64:
-					hashType = "sha256"
-				case 40:
-					hashType = "sha1"
-				case 32:
-					hashType = "md5"
-				}
+		}
 
-				// need the name of the file without "SOURCES/":
-				fileName := strings.Split(path, "/")[1]
+		md.SourcesToIgnore = append(md.SourcesToIgnore, &data.IgnoredSource{
+			Name:         source.path,
+			HashFunction: hasher,
+		})
+	}
 
-				// Feed our template info to ProcessUrl and transform to the real values: ( {{.Name}}, {{.Branch}}, {{.Hash}}, {{.Hashtype}}, {{.Filename}} )
-				url, hasTemplate := ProcessUrl(pd.CdnUrl, md.Name, branchName, hash, hashType, fileName)
+	return nil
+}
 
-				var req *http.Request
-				var resp *http.Response
+// downloadSource places a verified source in the blob cache.
+// The source is taken from blob storage if present, otherwise it is downloaded from the CDN
+func downloadSource(ctx context.Context, pd *data.ProcessData, md *data.ModeData, downloader *lookasideDownloader, branchName string, path string, checksum string) error {
+	hasher := data.NewHashForChecksum(checksum)
+	if hasher == nil {
+		return fmt.Errorf("checksum in metadata does not match dist-git file")
+	}
 
-				// Download the --cdn-url given, but *only* if it contains template strings ( {{.Name}} , {{.Hash}} , etc. )
-				// Otherwise we need to fall back to the traditional cdn-url patterns
-				if hasTemplate {
-					pd.Log.Printf("downloading %s", url)
+	if !pd.NoStorageDownload {
+		fromBlobStorage, _, err := blob.OpenResolved(ctx, pd.BlobStorage, checksum)
+		if err != nil {
+			return fmt.Errorf("could not read %s from blob storage: %w", checksum, err)
+		}
+		if fromBlobStorage != nil {
+			pd.Log.Printf("downloading %s from blob storage", checksum)
+			defer fromBlobStorage.Close()
 
-					req, err := http.NewRequest("GET", url, nil)
-					if err != nil {
-						return fmt.Errorf("could not create new http request: %v", err)
-					}
-					req.Header.Set("Accept-Encoding", "*")
+			// verify while streaming into the cache, so a bad blob is never used
+			err := md.BlobCache.Put(checksum, io.TeeReader(fromBlobStorage, hasher))
+			if err != nil {
+				return fmt.Errorf("could not read the whole blob: %v", err)
+			}
+			if !pd.CheckHash(hasher, checksum) {
+				md.BlobCache.Remove(checksum)
+				return fmt.Errorf("checksum in metadata does not match blob storage file")
+			}
 
-					resp, err = client.Do(req)
-					if err != nil {
-						return fmt.Errorf("could not download dist-git file: %v", err)
-					}
-				}
+			return nil
+		}
+	}
 
-				// Default cdn-url:  If we don't have a templated download string, try the default <SITE>/<PKG>/<BRANCH>/<HASH> pattern:
-				if resp == nil || resp.StatusCode != http.StatusOK {
-					url = fmt.Sprintf("%s/%s/%s/%s", pd.CdnUrl, md.Name, branchName, hash)
-					pd.Log.Printf("Attempting default URL: %s", url)
-					req, err = http.NewRequest("GET", url, nil)
-					if err != nil {
-						return fmt.Errorf("could not create new http request: %v", err)
-					}
-					req.Header.Set("Accept-Encoding", "*")
-					resp, err = client.Do(req)
-					if err != nil {
-						return fmt.Errorf("could not download dist-git file: %v", err)
-					}
-				}
+	// We need to figure out the hashtype for templating purposes:
+	hashType := "sha512"
+	switch len(checksum) {
+	case 128:
+		hashType = "sha512"
+	case 64:
+		hashType = "sha256"
+	case 40:
+		hashType = "sha1"
+	case 32:
+		hashType = "md5"
+	}
 
-				// If the default URL fails, we have one more pattern to try.  The simple <SITE>/<HASH> pattern
-				// If this one fails, we are truly lost, and have to bail out w/ an error:
-				if resp == nil || resp.StatusCode != http.StatusOK {
-					url = fmt.Sprintf("%s/%s", pd.CdnUrl, hash)
-					pd.Log.Printf("Attempting 2nd fallback URL: %s", url)
-					req, err = http.NewRequest("GET", url, nil)
-					if err != nil {
-						return fmt.Errorf("could not create new http request: %v", err)
-					}
-					req.Header.Set("Accept-Encoding", "*")
-					resp, err = client.Do(req)
-					if err != nil {
-						return fmt.Errorf("could not download dist-git file: %v", err)
-					}
-					if resp.StatusCode != http.StatusOK {
-						return fmt.Errorf("could not download dist-git file (status code %d): %v", resp.StatusCode, err)
-					}
-				}
+	// need the name of the file without "SOURCES/":
+	fileName := strings.Split(path, "/")[1]
+	candidates := downloader.candidates(md.Name, branchName, checksum, hashType, fileName)
 
-				body, err = io.ReadAll(resp.Body)
-				if err != nil {
-					return fmt.Errorf("could not read the whole dist-git file: %v", err)
-				}
-				err = resp.Body.Close()
-				if err != nil {
-					return fmt.Errorf("could not close body handle: %v", err)
-				}
-			}
+	f, err := md.BlobCache.CreateTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
 
-			md.BlobCache[hash] = body
+	err = downloader.download(ctx, candidates, f, func(f *os.File) error {
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("could not seek download file: %v", err)
 		}
-
-		f, err := md.Worktree.Filesystem.Create(path)
+		hasher := data.NewHashForChecksum(checksum)
+		_, err = io.Copy(hasher, f)
 		if err != nil {
-			return fmt.Errorf("could not open file pointer: %v", err)
+			return fmt.Errorf("could not read download file: %v", err)
 		}
-
-		hasher := pd.CompareHash(body, hash)
-		if hasher == nil {
+		if !pd.CheckHash(hasher, checksum) {
 			return fmt.Errorf("checksum in metadata does not match dist-git file")
 		}
 
-		md.SourcesToIgnore = append(md.SourcesToIgnore, &data.IgnoredSource{
-			Name:         path,
-			HashFunction: hasher,
-		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		_, err = f.Write(body)
-		if err != nil {
-			return fmt.Errorf("could not copy dist-git file to in-tree: %v", err)
-		}
-		_ = f.Close()
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close download file: %v", err)
 	}
 
-	return nil
+	return md.BlobCache.PutFile(checksum, f.Name())
+}
+
+// copyFromCache writes a cached source to the worktree
+// and returns the hash function of its checksum
+func copyFromCache(pd *data.ProcessData, md *data.ModeData, path string, checksum string) (hash.Hash, error) {
+	cached, err := md.BlobCache.Open(checksum)
+	if err != nil {
+		return nil, err
+	}
+	defer cached.Close()
+
+	f, err := md.Worktree.Filesystem.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file pointer: %v", err)
+	}
+	defer f.Close()
+
+	hasher := data.NewHashForChecksum(checksum)
+	_, err = io.Copy(io.MultiWriter(f, hasher), cached)
+	if err != nil {
+		return nil, fmt.Errorf("could not copy dist-git file to in-tree: %v", err)
+	}
+	if !pd.CheckHash(hasher, checksum) {
+		return nil, fmt.Errorf("checksum in metadata does not match dist-git file")
+	}
+
+	return hasher, nil
+}
+
+// readInTree returns the hash function of path if it already exists in the
+// worktree and matches checksum. Used for local checkouts that carry sources
+func readInTree(md *data.ModeData, path string, checksum string) hash.Hash {
+	f, err := md.Worktree.Filesystem.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	hasher := data.NewHashForChecksum(checksum)
+	if hasher == nil {
+		return nil
+	}
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return nil
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != checksum {
+		return nil
+	}
+
+	return hasher
 }
 
 func (g *GitMode) PostProcess(md *data.ModeData) error {
@@ -0,0 +1,214 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package modes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"github.com/rocky-linux/srpmproc/pkg/misc"
+)
+
+// LocalMode imports an already checked out dist-git tree from disk.
+// Both the classic SPECS/SOURCES layout with a .{name}.metadata file and
+// the flat Fedora/Stream layout with a "sources" file are supported.
+// The checkout itself is never modified
+type LocalMode struct {
+	Path string
+}
+
+// PackageName returns the package name of the checkout.
+// The name is derived from the metadata file, the spec file
+// or lastly the directory name
+func (l *LocalMode) PackageName() (string, error) {
+	ls, err := os.ReadDir(l.Path)
+	if err != nil {
+		return "", fmt.Errorf("could not read local checkout: %v", err)
+	}
+	for _, f := range ls {
+		if strings.HasPrefix(f.Name(), ".") && strings.HasSuffix(f.Name(), ".metadata") {
+			return strings.TrimSuffix(strings.TrimPrefix(f.Name(), "."), ".metadata"), nil
+		}
+	}
+
+	specs, _ := filepath.Glob(filepath.Join(l.Path, "SPECS", "*.spec"))
+	rootSpecs, _ := filepath.Glob(filepath.Join(l.Path, "*.spec"))
+	specs = append(specs, rootSpecs...)
+	if len(specs) == 1 {
+		return strings.TrimSuffix(filepath.Base(specs[0]), ".spec"), nil
+	}
+
+	return filepath.Base(filepath.Clean(l.Path)), nil
+}
+
+func (l *LocalMode) RetrieveSource(ctx context.Context, pd *data.ProcessData) (*data.ModeData, error) {
+	name, err := l.PackageName()
+	if err != nil {
+		return nil, err
+	}
+
+	// normalization moves files around, so work on a copy of the checkout
+	tmpDir, err := os.MkdirTemp("", fmt.Sprintf("srpmproclocal_%s", name))
+	if err != nil {
+		return nil, fmt.Errorf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = copyCheckout(l.Path, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	repoFixed, err := ConvertLocalRepo(name, tmpDir)
+	if !repoFixed {
+		return nil, fmt.Errorf("could not convert local checkout into SOURCES + SPECS + .package.metadata format: %v", err)
+	}
+
+	version := pd.PackageVersion
+	release := pd.PackageRelease
+	if version == "" || release == "" {
+		nvrString, err := GetVersionFromSpec(ctx, tmpDir, pd.Version)
+		if err != nil {
+			return nil, err
+		}
+		version = strings.Split(nvrString, "|")[1]
+		release = strings.Split(nvrString, "|")[2]
+	}
+
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		return nil, fmt.Errorf("could not init git Repo: %v", err)
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("could not get Worktree: %v", err)
+	}
+
+	err = data.CopyFromFs(osfs.New(tmpDir), w.Filesystem, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	// pretend the checkout is an upstream import tag, so branch and
+	// tag naming in ProcessRPM works the same as for git imports
+	tag := fmt.Sprintf("refs/tags/imports/%s%d%s/%s-%s-%s", pd.ImportBranchPrefix, pd.Version, pd.BranchSuffix, name, version, release)
+	pd.Log.Printf("tag: %s", strings.TrimPrefix(tag, "refs/tags/"))
+
+	return &data.ModeData{
+		Name:       name,
+		Repo:       repo,
+		Worktree:   w,
+		FileWrites: nil,
+		Branches:   []string{tag},
+	}, nil
+}
+
+func (l *LocalMode) WriteSource(ctx context.Context, pd *data.ProcessData, md *data.ModeData) error {
+	branchName := fmt.Sprintf("%s%d%s", pd.ImportBranchPrefix, pd.Version, pd.BranchSuffix)
+	return writeMetadataSources(ctx, pd, md, branchName)
+}
+
+func (l *LocalMode) PostProcess(md *data.ModeData) error {
+	for _, source := range md.SourcesToIgnore {
+		_, err := md.Worktree.Filesystem.Stat(source.Name)
+		if err == nil {
+			err := md.Worktree.Filesystem.Remove(source.Name)
+			if err != nil {
+				return fmt.Errorf("could not remove local source: %v", err)
+			}
+		}
+	}
+
+	_, err := md.Worktree.Add(".")
+	if err != nil {
+		return fmt.Errorf("could not add local sources: %v", err)
+	}
+
+	return nil
+}
+
+func (l *LocalMode) ImportName(pd *data.ProcessData, md *data.ModeData) string {
+	if misc.GetTagImportRegex(pd).MatchString(md.TagBranch) {
+		match := misc.GetTagImportRegex(pd).FindStringSubmatch(md.TagBranch)
+		return match[3]
+	}
+
+	return filepath.Base(l.Path)
+}
+
+// copyCheckout copies a checkout without its .git directory
+func copyCheckout(from string, to string) error {
+	return filepath.WalkDir(from, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		if rel == ".git" && d.IsDir() {
+			return filepath.SkipDir
+		}
+		target := filepath.Join(to, rel)
+
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %v", path, err)
+		}
+		defer src.Close()
+
+		dst, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return fmt.Errorf("could not create %s: %v", target, err)
+		}
+		defer dst.Close()
+
+		_, err = io.Copy(dst, src)
+		if err != nil {
+			return fmt.Errorf("could not copy %s: %v", path, err)
+		}
+
+		return nil
+	})
+}
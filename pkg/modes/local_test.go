@@ -0,0 +1,162 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package modes
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+// writeCheckout creates files below dir, their parent directories included
+func writeCheckout(t *testing.T, dir string, files map[string]string) {
+	for path, content := range files {
+		target := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocalPackageName(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"metadata", map[string]string{".bash.metadata": "", "SPECS/other.spec": ""}, "bash"},
+		{"spec in SPECS", map[string]string{"SPECS/zsh.spec": "", "SOURCES/zsh.patch": ""}, "zsh"},
+		{"spec in the root", map[string]string{"zsh.spec": "", "sources": ""}, "zsh"},
+		{"several specs", map[string]string{"SPECS/a.spec": "", "b.spec": ""}, "checkout"},
+		{"no spec", map[string]string{"README": ""}, "checkout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "checkout")
+			writeCheckout(t, dir, tt.files)
+
+			// a trailing slash does not change the directory name
+			name, err := (&LocalMode{Path: dir + "/"}).PackageName()
+			if err != nil || name != tt.want {
+				t.Fatalf("PackageName = %q, %v, want %q", name, err, tt.want)
+			}
+		})
+	}
+
+	_, err := (&LocalMode{Path: filepath.Join(t.TempDir(), "missing")}).PackageName()
+	if err == nil {
+		t.Fatal("PackageName of a missing checkout succeeded")
+	}
+}
+
+func TestCopyCheckout(t *testing.T) {
+	from, to := t.TempDir(), t.TempDir()
+	writeCheckout(t, from, map[string]string{
+		".git/HEAD":         "ref: refs/heads/c9s\n",
+		".git/objects/pack": "",
+		".gitignore":        "*.tar.gz\n",
+		"foo.spec":          "Name: foo\n",
+		"patches/fix.patch": "fix",
+	})
+
+	err := copyCheckout(from, to)
+	if err != nil {
+		t.Fatalf("copyCheckout: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(to, ".git")); !os.IsNotExist(err) {
+		t.Fatalf(".git was copied: %v", err)
+	}
+	for path, want := range map[string]string{
+		".gitignore":        "*.tar.gz\n",
+		"foo.spec":          "Name: foo\n",
+		"patches/fix.patch": "fix",
+	} {
+		content, err := os.ReadFile(filepath.Join(to, path))
+		if err != nil || string(content) != want {
+			t.Errorf("%s = %q, %v, want %q", path, content, err, want)
+		}
+	}
+}
+
+func TestLocalRetrieveSourceFlat(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "foo")
+	writeCheckout(t, dir, map[string]string{
+		".git/HEAD": "ref: refs/heads/c9s\n",
+		"foo.spec":  "Name: foo\n",
+		"fix.patch": "fix",
+		"sources":   "SHA512 (foo-1.0.tar.gz) = abc\n",
+	})
+
+	pd := &data.ProcessData{
+		Log:                log.New(io.Discard, "", 0),
+		Version:            9,
+		ImportBranchPrefix: "c",
+		BranchSuffix:       "s",
+		// rpmspec is not needed if the version is given
+		PackageVersion: "1.0",
+		PackageRelease: "1.el9",
+	}
+	md, err := (&LocalMode{Path: dir}).RetrieveSource(context.Background(), pd)
+	if err != nil {
+		t.Fatalf("RetrieveSource: %v", err)
+	}
+
+	if md.Name != "foo" {
+		t.Errorf("Name = %s, want foo", md.Name)
+	}
+	if len(md.Branches) != 1 || md.Branches[0] != "refs/tags/imports/c9s/foo-1.0-1.el9" {
+		t.Errorf("Branches = %v", md.Branches)
+	}
+
+	fs := md.Worktree.Filesystem
+	for path, want := range map[string]string{
+		"SPECS/foo.spec":    "Name: foo\n",
+		"SOURCES/fix.patch": "fix",
+		".foo.metadata":     "abc SOURCES/foo-1.0.tar.gz\n",
+	} {
+		content, err := util.ReadFile(fs, path)
+		if err != nil || string(content) != want {
+			t.Errorf("%s = %q, %v, want %q", path, content, err, want)
+		}
+	}
+	for _, path := range []string{".git", "sources", "foo.spec"} {
+		if _, err := fs.Stat(path); err == nil {
+			t.Errorf("%s is in the converted tree", path)
+		}
+	}
+
+	// the checkout itself is left alone
+	for _, path := range []string{"foo.spec", "sources", ".git/HEAD"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("%s was removed from the checkout: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package modes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"github.com/rocky-linux/srpmproc/pkg/misc"
+	"github.com/rocky-linux/srpmproc/pkg/rpmutils"
+)
+
+// binarySniffLen is how far into a file we look for a NUL byte
+// to decide if it belongs in the lookaside (same heuristic as git)
+const binarySniffLen = 8000
+
+// SrpmMode imports a local source RPM file.
+// Spec files are placed in SPECS, everything else in SOURCES and
+// binary sources are added to the lookaside metadata
+type SrpmMode struct {
+	Path string
+}
+
+func (s *SrpmMode) open() (*os.File, *rpmutils.Srpm, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open srpm: %v", err)
+	}
+
+	srpm, err := rpmutils.ReadSrpm(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("could not read srpm %s: %v", s.Path, err)
+	}
+
+	return f, srpm, nil
+}
+
+// PackageName returns the package name from the source RPM header
+func (s *SrpmMode) PackageName() (string, error) {
+	f, srpm, err := s.open()
+	if err != nil {
+		return "", err
+	}
+	_ = srpm.Close()
+	_ = f.Close()
+
+	return srpm.Name, nil
+}
+
+func (s *SrpmMode) RetrieveSource(_ context.Context, pd *data.ProcessData) (*data.ModeData, error) {
+	f, srpm, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	_ = srpm.Close()
+	_ = f.Close()
+
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		return nil, fmt.Errorf("could not init git Repo: %v", err)
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("could not get Worktree: %v", err)
+	}
+
+	// pretend the srpm is an upstream import tag, so branch and
+	// tag naming in ProcessRPM works the same as for git imports
+	tag := fmt.Sprintf("refs/tags/imports/%s%d%s/%s", pd.ImportBranchPrefix, pd.Version, pd.BranchSuffix, srpm.NVR())
+	pd.Log.Printf("tag: %s", strings.TrimPrefix(tag, "refs/tags/"))
+
+	return &data.ModeData{
+		Name:       srpm.Name,
+		Repo:       repo,
+		Worktree:   w,
+		FileWrites: nil,
+		Branches:   []string{tag},
+	}, nil
+}
+
+func (s *SrpmMode) WriteSource(ctx context.Context, pd *data.ProcessData, md *data.ModeData) error {
+	f, srpm, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer srpm.Close()
+
+	fs := md.Worktree.Filesystem
+	for _, dir := range []string{"SPECS", "SOURCES"} {
+		err := fs.MkdirAll(dir, 0o755)
+		if err != nil {
+			return fmt.Errorf("could not create %s: %v", dir, err)
+		}
+	}
+
+	metadataLines := []string{}
+	err = srpm.Walk(func(name string, mode os.FileMode, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// cpio names are not trusted, they must not leave SOURCES or SPECS
+		err := data.ValidateTreePath(name)
+		if err != nil {
+			return fmt.Errorf("invalid file in srpm: %v", err)
+		}
+
+		path := filepath.Join("SOURCES", name)
+		if strings.HasSuffix(name, ".spec") {
+			path = filepath.Join("SPECS", name)
+		}
+
+		// sources can be large, so they are streamed instead of read into memory.
+		// Peeking is enough to tell whether they belong in the lookaside
+		br := bufio.NewReaderSize(r, binarySniffLen)
+		sniff, _ := br.Peek(binarySniffLen)
+		lookaside := !strings.HasPrefix(path, "SPECS/") && isBinary(sniff)
+
+		out, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return fmt.Errorf("could not open file pointer: %v", err)
+		}
+		defer out.Close()
+
+		if !lookaside {
+			_, err = io.Copy(out, br)
+			if err != nil {
+				return fmt.Errorf("could not write %s to in-tree: %v", path, err)
+			}
+			return nil
+		}
+
+		cached, err := md.BlobCache.CreateTemp()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(cached.Name())
+		defer cached.Close()
+
+		hasher := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, hasher, cached), br)
+		if err != nil {
+			return fmt.Errorf("could not write %s to in-tree: %v", path, err)
+		}
+		err = cached.Close()
+		if err != nil {
+			return fmt.Errorf("could not close blob cache file: %v", err)
+		}
+		checksum := hex.EncodeToString(hasher.Sum(nil))
+		err = md.BlobCache.PutFile(checksum, cached.Name())
+		if err != nil {
+			return err
+		}
+
+		md.SourcesToIgnore = append(md.SourcesToIgnore, &data.IgnoredSource{
+			Name:         path,
+			HashFunction: hasher,
+		})
+		metadataLines = append(metadataLines, fmt.Sprintf("%s %s\n", checksum, path))
+		pd.Log.Printf("extracted %s from srpm to lookaside", path)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(metadataLines)
+	metadata, err := fs.Create(fmt.Sprintf(".%s.metadata", md.Name))
+	if err != nil {
+		return fmt.Errorf("could not create metadata file: %v", err)
+	}
+	_, err = metadata.Write([]byte(strings.Join(metadataLines, "")))
+	if err != nil {
+		return fmt.Errorf("could not write to metadata file: %v", err)
+	}
+	_ = metadata.Close()
+
+	pd.Log.Printf("unpacked %s", srpm.NVR())
+
+	return nil
+}
+
+func (s *SrpmMode) PostProcess(md *data.ModeData) error {
+	for _, source := range md.SourcesToIgnore {
+		_, err := md.Worktree.Filesystem.Stat(source.Name)
+		if err == nil {
+			err := md.Worktree.Filesystem.Remove(source.Name)
+			if err != nil {
+				return fmt.Errorf("could not remove srpm source: %v", err)
+			}
+		}
+	}
+
+	_, err := md.Worktree.Add(".")
+	if err != nil {
+		return fmt.Errorf("could not add srpm sources: %v", err)
+	}
+
+	return nil
+}
+
+func (s *SrpmMode) ImportName(pd *data.ProcessData, md *data.ModeData) string {
+	if misc.GetTagImportRegex(pd).MatchString(md.TagBranch) {
+		match := misc.GetTagImportRegex(pd).FindStringSubmatch(md.TagBranch)
+		return match[3]
+	}
+
+	return filepath.Base(s.Path)
+}
+
+func isBinary(content []byte) bool {
+	if len(content) > binarySniffLen {
+		content = content[:binarySniffLen]
+	}
+
+	return bytes.IndexByte(content, 0) != -1
+}
@@ -0,0 +1,422 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package rpmutils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Header tags srpmproc cares about when reading a source RPM
+const (
+	TagName              = 1000
+	TagVersion           = 1001
+	TagRelease           = 1002
+	TagEpoch             = 1003
+	TagPayloadFormat     = 1124
+	TagPayloadCompressor = 1125
+)
+
+const (
+	leadSize     = 96
+	leadTypeSrc  = 1
+	typeInt32    = 4
+	typeString   = 6
+	typeStrArray = 8
+	typeI18N     = 9
+	cpioTrailer  = "TRAILER!!!"
+	cpioHdrSize  = 110
+	cpioNewc     = "070701"
+	cpioNewcCrc  = "070702"
+	maxHdrLength = 256 << 20
+	// longer cpio names are rejected, no file system allows them
+	maxNameSize = 4096
+)
+
+var (
+	leadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	headerMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+)
+
+type headerEntry struct {
+	tag    int32
+	typ    uint32
+	offset int32
+	count  uint32
+}
+
+// Header is a parsed RPM header structure (signature or main header)
+type Header struct {
+	entries map[int32]headerEntry
+	store   []byte
+}
+
+// Srpm is a source RPM with its lead, signature and main header consumed.
+// The cpio payload can be walked exactly once using Walk, Close releases the decompressor
+type Srpm struct {
+	Name    string
+	Version string
+	Release string
+	Epoch   string
+	Header  *Header
+
+	payload io.Reader
+}
+
+// SrpmFileFunc is called for every regular file found in the payload of a source RPM
+type SrpmFileFunc func(name string, mode os.FileMode, r io.Reader) error
+
+// ReadSrpm parses the lead, signature and main header of a source RPM.
+// The returned Srpm keeps reading from r when its payload is walked
+func ReadSrpm(r io.Reader) (*Srpm, error) {
+	br := bufio.NewReader(r)
+
+	lead := make([]byte, leadSize)
+	if _, err := io.ReadFull(br, lead); err != nil {
+		return nil, fmt.Errorf("could not read rpm lead: %v", err)
+	}
+	if !bytes.Equal(lead[0:4], leadMagic) {
+		return nil, errors.New("not an rpm file")
+	}
+	if binary.BigEndian.Uint16(lead[6:8]) != leadTypeSrc {
+		return nil, errors.New("rpm is not a source rpm")
+	}
+
+	sigSize, err := skipHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signature header: %v", err)
+	}
+	// the signature header is padded to an 8 byte boundary
+	if pad := (8 - sigSize%8) % 8; pad > 0 {
+		if _, err := br.Discard(pad); err != nil {
+			return nil, fmt.Errorf("could not skip signature padding: %v", err)
+		}
+	}
+
+	hdr, err := readHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("could not read main header: %v", err)
+	}
+
+	srpm := &Srpm{
+		Name:    hdr.String(TagName),
+		Version: hdr.String(TagVersion),
+		Release: hdr.String(TagRelease),
+		Header:  hdr,
+	}
+	if epoch, ok := hdr.Int32(TagEpoch); ok {
+		srpm.Epoch = strconv.Itoa(int(epoch))
+	}
+	if srpm.Name == "" || srpm.Version == "" || srpm.Release == "" {
+		return nil, errors.New("source rpm header is missing name, version or release")
+	}
+
+	if format := hdr.String(TagPayloadFormat); format != "" && format != "cpio" {
+		return nil, fmt.Errorf("unsupported payload format %s", format)
+	}
+
+	srpm.payload, err = decompressor(hdr.String(TagPayloadCompressor), br)
+	if err != nil {
+		return nil, err
+	}
+
+	return srpm, nil
+}
+
+// Close releases the payload decompressor. The reader given to ReadSrpm is not closed
+func (s *Srpm) Close() error {
+	closer, ok := s.payload.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	return closer.Close()
+}
+
+// NVR returns the name-version-release of the source RPM
+func (s *Srpm) NVR() string {
+	return fmt.Sprintf("%s-%s-%s", s.Name, s.Version, s.Release)
+}
+
+// Walk calls fn for every regular file in the cpio payload.
+// Directory components are stripped as source RPMs have a flat layout
+func (s *Srpm) Walk(fn SrpmFileFunc) error {
+	hdr := make([]byte, cpioHdrSize)
+
+	for {
+		if _, err := io.ReadFull(s.payload, hdr); err != nil {
+			return fmt.Errorf("could not read cpio header: %v", err)
+		}
+		magic := string(hdr[0:6])
+		if magic != cpioNewc && magic != cpioNewcCrc {
+			return fmt.Errorf("unsupported cpio format %q", magic)
+		}
+
+		mode, err := cpioField(hdr, 1)
+		if err != nil {
+			return err
+		}
+		fileSize, err := cpioField(hdr, 6)
+		if err != nil {
+			return err
+		}
+		nameSize, err := cpioField(hdr, 11)
+		if err != nil {
+			return err
+		}
+
+		if nameSize == 0 || nameSize > maxNameSize {
+			return fmt.Errorf("invalid cpio file name size %d", nameSize)
+		}
+		nameBytes := make([]byte, nameSize)
+		if _, err := io.ReadFull(s.payload, nameBytes); err != nil {
+			return fmt.Errorf("could not read cpio file name: %v", err)
+		}
+		if err := discard(s.payload, pad4(cpioHdrSize+int64(nameSize))); err != nil {
+			return err
+		}
+		name := strings.TrimRight(string(nameBytes), "\x00")
+
+		if name == cpioTrailer {
+			return nil
+		}
+
+		body := &cpioBody{r: s.payload, left: int64(fileSize)}
+		if mode&0o170000 == 0o100000 {
+			err := fn(filepath.Base(name), os.FileMode(mode&0o777), body)
+			if err != nil {
+				return err
+			}
+		}
+		// drain whatever the callback did not consume
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return fmt.Errorf("could not read cpio file %s: %v", name, err)
+		}
+		if err := discard(s.payload, pad4(int64(fileSize))); err != nil {
+			return err
+		}
+	}
+}
+
+// cpioBody reads the content of a cpio entry.
+// Unlike io.LimitReader, a payload ending early is an error and not EOF
+type cpioBody struct {
+	r    io.Reader
+	left int64
+}
+
+func (b *cpioBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+
+	n, err := b.r.Read(p)
+	b.left -= int64(n)
+	if err == io.EOF && b.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// String returns the first string value of tag, or an empty string
+func (h *Header) String(tag int32) string {
+	entry, ok := h.entries[tag]
+	if !ok {
+		return ""
+	}
+	switch entry.typ {
+	case typeString, typeStrArray, typeI18N:
+	default:
+		return ""
+	}
+	if entry.offset < 0 || int(entry.offset) >= len(h.store) {
+		return ""
+	}
+
+	value := h.store[entry.offset:]
+	if end := bytes.IndexByte(value, 0); end >= 0 {
+		value = value[:end]
+	}
+
+	return string(value)
+}
+
+// Int32 returns the first int32 value of tag
+func (h *Header) Int32(tag int32) (int32, bool) {
+	entry, ok := h.entries[tag]
+	if !ok || entry.typ != typeInt32 || entry.count == 0 {
+		return 0, false
+	}
+	if entry.offset < 0 || int(entry.offset)+4 > len(h.store) {
+		return 0, false
+	}
+
+	return int32(binary.BigEndian.Uint32(h.store[entry.offset:])), true
+}
+
+func readHeaderIntro(r io.Reader) (uint32, uint32, error) {
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(intro[0:4], headerMagic) {
+		return 0, 0, errors.New("invalid header magic")
+	}
+
+	indexCount := binary.BigEndian.Uint32(intro[8:12])
+	storeSize := binary.BigEndian.Uint32(intro[12:16])
+	if int64(indexCount)*16+int64(storeSize) > maxHdrLength {
+		return 0, 0, errors.New("header too large")
+	}
+
+	return indexCount, storeSize, nil
+}
+
+// skipHeader discards a header and returns its total size in bytes
+func skipHeader(r *bufio.Reader) (int, error) {
+	indexCount, storeSize, err := readHeaderIntro(r)
+	if err != nil {
+		return 0, err
+	}
+
+	size := int(indexCount)*16 + int(storeSize)
+	if _, err := r.Discard(size); err != nil {
+		return 0, err
+	}
+
+	return 16 + size, nil
+}
+
+func readHeader(r io.Reader) (*Header, error) {
+	indexCount, storeSize, err := readHeaderIntro(r)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := readSized(r, int64(indexCount)*16)
+	if err != nil {
+		return nil, err
+	}
+	store, err := readSized(r, int64(storeSize))
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &Header{
+		entries: map[int32]headerEntry{},
+		store:   store,
+	}
+
+	for i := 0; i < int(indexCount); i++ {
+		raw := index[i*16 : (i+1)*16]
+		entry := headerEntry{
+			tag:    int32(binary.BigEndian.Uint32(raw[0:4])),
+			typ:    binary.BigEndian.Uint32(raw[4:8]),
+			offset: int32(binary.BigEndian.Uint32(raw[8:12])),
+			count:  binary.BigEndian.Uint32(raw[12:16]),
+		}
+		hdr.entries[entry.tag] = entry
+	}
+
+	return hdr, nil
+}
+
+// readSized reads exactly n bytes. The buffer grows with the data read,
+// so a bogus size in a truncated file does not allocate n bytes up front
+func readSized(r io.Reader, n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r, n)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressor(compressor string, r io.Reader) (io.Reader, error) {
+	switch compressor {
+	case "", "gzip":
+		return gzip.NewReader(r)
+	case "bzip2":
+		return bzip2.NewReader(r), nil
+	case "xz":
+		return xz.NewReader(r)
+	case "lzma":
+		return lzma.NewReader(r)
+	case "zstd":
+		// the payload is read sequentially, more goroutines do not help
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported payload compressor %s", compressor)
+	}
+}
+
+// cpioField parses the n-th 8 character hex field following the magic
+func cpioField(hdr []byte, n int) (uint32, error) {
+	start := 6 + n*8
+	value, err := strconv.ParseUint(string(hdr[start:start+8]), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cpio header field: %v", err)
+	}
+
+	return uint32(value), nil
+}
+
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+func discard(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	if err != nil {
+		return fmt.Errorf("could not skip cpio padding: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,447 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package rpmutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type testTag struct {
+	tag   int32
+	typ   uint32
+	value []byte
+}
+
+type testFile struct {
+	name    string
+	mode    uint32
+	content string
+	// overrides the sizes written to the cpio header when set
+	fileSize string
+	nameSize string
+}
+
+func stringTag(tag int32, value string) testTag {
+	return testTag{tag: tag, typ: typeString, value: append([]byte(value), 0)}
+}
+
+func buildHeader(indexCount uint32, tags []testTag) []byte {
+	var index, store bytes.Buffer
+	for _, tag := range tags {
+		entry := make([]byte, 16)
+		binary.BigEndian.PutUint32(entry[0:4], uint32(tag.tag))
+		binary.BigEndian.PutUint32(entry[4:8], tag.typ)
+		binary.BigEndian.PutUint32(entry[8:12], uint32(store.Len()))
+		binary.BigEndian.PutUint32(entry[12:16], 1)
+		index.Write(entry)
+		store.Write(tag.value)
+	}
+
+	intro := make([]byte, 16)
+	copy(intro, headerMagic)
+	binary.BigEndian.PutUint32(intro[8:12], indexCount)
+	binary.BigEndian.PutUint32(intro[12:16], uint32(store.Len()))
+
+	return append(append(intro, index.Bytes()...), store.Bytes()...)
+}
+
+func buildLead(rpmType uint16) []byte {
+	lead := make([]byte, leadSize)
+	copy(lead, leadMagic)
+	binary.BigEndian.PutUint16(lead[6:8], rpmType)
+
+	return lead
+}
+
+func buildCpio(files []testFile) []byte {
+	var buf bytes.Buffer
+	pad := func() {
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	for _, file := range append(files, testFile{name: cpioTrailer}) {
+		fileSize := file.fileSize
+		if fileSize == "" {
+			fileSize = fmt.Sprintf("%08x", len(file.content))
+		}
+		nameSize := file.nameSize
+		if nameSize == "" {
+			nameSize = fmt.Sprintf("%08x", len(file.name)+1)
+		}
+		fmt.Fprintf(&buf, "%s%08x%08x%08x%08x%08x%08x%s%08x%08x%08x%08x%s%08x",
+			cpioNewc, 0, file.mode, 0, 0, 1, 0, fileSize, 0, 0, 0, 0, nameSize, 0)
+		buf.WriteString(file.name)
+		buf.WriteByte(0)
+		pad()
+		buf.WriteString(file.content)
+		pad()
+	}
+
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func mainHeader() []byte {
+	return mainHeaderWith("gzip")
+}
+
+func mainHeaderWith(compressor string) []byte {
+	return buildHeader(4, []testTag{
+		stringTag(TagName, "foo"),
+		stringTag(TagVersion, "1.0"),
+		stringTag(TagRelease, "1.el8"),
+		stringTag(TagPayloadCompressor, compressor),
+	})
+}
+
+func buildSrpm(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	buf.Write(buildLead(leadTypeSrc))
+	buf.Write(buildHeader(0, nil))
+	buf.Write(mainHeader())
+	buf.Write(gzipped(t, buildCpio(files)))
+
+	return buf.Bytes()
+}
+
+var testFiles = []testFile{
+	{name: "foo.spec", mode: 0o100644, content: "Name: foo\n"},
+	{name: "SOURCES", mode: 0o040755},
+	{name: "SOURCES/foo-1.0.tar.gz", mode: 0o100600, content: strings.Repeat("x", 4097)},
+	{name: "empty.patch", mode: 0o100644},
+}
+
+// walkSrpm reads a source RPM and all of its files
+func walkSrpm(data []byte) (map[string]string, error) {
+	srpm, err := ReadSrpm(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{}
+	err = srpm.Walk(func(name string, mode os.FileMode, r io.Reader) error {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		files[name] = fmt.Sprintf("%o:%s", mode, content)
+		return nil
+	})
+
+	return files, err
+}
+
+func TestReadSrpm(t *testing.T) {
+	srpm, err := ReadSrpm(bytes.NewReader(buildSrpm(t, testFiles)))
+	if err != nil {
+		t.Fatalf("ReadSrpm: %v", err)
+	}
+	if srpm.NVR() != "foo-1.0-1.el8" {
+		t.Errorf("NVR = %s", srpm.NVR())
+	}
+	if srpm.Epoch != "" {
+		t.Errorf("Epoch = %q, want none", srpm.Epoch)
+	}
+
+	var names []string
+	err = srpm.Walk(func(name string, mode os.FileMode, r io.Reader) error {
+		names = append(names, name)
+		// leave the rest of the entry to Walk
+		_, err := r.Read(make([]byte, 1))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if got := strings.Join(names, ","); got != "foo.spec,foo-1.0.tar.gz,empty.patch" {
+		t.Errorf("walked %s", got)
+	}
+
+	files, err := walkSrpm(buildSrpm(t, testFiles))
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if files["foo.spec"] != "644:Name: foo\n" {
+		t.Errorf("foo.spec = %q", files["foo.spec"])
+	}
+	if files["foo-1.0.tar.gz"] != "600:"+strings.Repeat("x", 4097) {
+		t.Errorf("foo-1.0.tar.gz has %d bytes", len(files["foo-1.0.tar.gz"]))
+	}
+}
+
+func TestReadSrpmInvalid(t *testing.T) {
+	withLead := func(lead []byte) []byte {
+		return append(lead, buildSrpm(t, testFiles)[leadSize:]...)
+	}
+	withHeaders := func(sig []byte, main []byte) []byte {
+		data := buildLead(leadTypeSrc)
+		data = append(data, sig...)
+		data = append(data, main...)
+		return append(data, gzipped(t, buildCpio(testFiles))...)
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "could not read rpm lead"},
+		{"not an rpm", withLead(make([]byte, leadSize)), "not an rpm file"},
+		{"binary rpm", withLead(buildLead(0)), "not a source rpm"},
+		{
+			"huge signature index count",
+			withHeaders(buildHeader(0xffffffff, nil), mainHeader()),
+			"header too large",
+		},
+		{
+			"huge main index count",
+			withHeaders(buildHeader(0, nil), buildHeader(0xffffffff, nil)),
+			"header too large",
+		},
+		{
+			"signature larger than the file",
+			withHeaders(buildHeader(1<<20, nil), mainHeader()),
+			"could not read signature header",
+		},
+		{
+			"index larger than the file",
+			withHeaders(buildHeader(0, nil), buildHeader(1<<20, nil)),
+			"could not read main header: unexpected EOF",
+		},
+		{
+			"offsets outside the store",
+			withHeaders(buildHeader(0, nil), func() []byte {
+				hdr := mainHeader()
+				// point the name at the end of the store
+				binary.BigEndian.PutUint32(hdr[16+8:16+12], 0x7fffffff)
+				return hdr
+			}()),
+			"missing name, version or release",
+		},
+		{
+			"unknown compressor",
+			withHeaders(buildHeader(0, nil), buildHeader(4, []testTag{
+				stringTag(TagName, "foo"),
+				stringTag(TagVersion, "1.0"),
+				stringTag(TagRelease, "1.el8"),
+				stringTag(TagPayloadCompressor, "lz4"),
+			})),
+			"unsupported payload compressor lz4",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := walkSrpm(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadSrpmTruncated(t *testing.T) {
+	headers := append(append(buildLead(leadTypeSrc), buildHeader(0, nil)...), mainHeader()...)
+	for n := 0; n < len(headers); n++ {
+		if _, err := walkSrpm(headers[:n]); err == nil {
+			t.Errorf("no error for headers truncated to %d of %d bytes", n, len(headers))
+		}
+	}
+
+	// the gzip trailer is never read once the cpio trailer is reached,
+	// so truncate the uncompressed payload instead
+	payload := buildCpio(testFiles)
+	for n := 0; n < len(payload); n++ {
+		data := append(append([]byte{}, headers...), gzipped(t, payload[:n])...)
+		if _, err := walkSrpm(data); err == nil {
+			t.Errorf("no error for a payload truncated to %d of %d bytes", n, len(payload))
+		}
+	}
+}
+
+func TestWalkBogusCpio(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		file testFile
+		err  string
+	}{
+		{
+			"file size past the payload",
+			testFile{name: "foo.spec", mode: 0o100644, content: "x", fileSize: "ffffffff"},
+			"unexpected EOF",
+		},
+		{
+			"directory size past the payload",
+			testFile{name: "SOURCES", mode: 0o040755, fileSize: "ffffffff"},
+			"could not read cpio file SOURCES",
+		},
+		{
+			"huge name size",
+			testFile{name: "foo.spec", mode: 0o100644, nameSize: "ffffffff"},
+			"invalid cpio file name size",
+		},
+		{
+			"zero name size",
+			testFile{name: "foo.spec", mode: 0o100644, nameSize: "00000000"},
+			"invalid cpio file name size",
+		},
+		{
+			"name size past the payload",
+			testFile{name: "foo.spec", mode: 0o100644, nameSize: "00001000"},
+			"could not read cpio file name",
+		},
+		{
+			"file size not hex",
+			testFile{name: "foo.spec", mode: 0o100644, fileSize: "0000000z"},
+			"invalid cpio header field",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := walkSrpm(buildSrpm(t, []testFile{tt.file}))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	data := buildLead(leadTypeSrc)
+	data = append(data, buildHeader(0, nil)...)
+	data = append(data, mainHeader()...)
+	data = append(data, gzipped(t, []byte(strings.Repeat("0", cpioHdrSize)))...)
+	if _, err := walkSrpm(data); err == nil || !strings.Contains(err.Error(), "unsupported cpio format") {
+		t.Fatalf("got error %v for a bad cpio magic", err)
+	}
+}
+
+// Sizes read from the file must not be trusted for allocations
+func TestReadSrpmBoundedAllocation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{
+			"main header",
+			append(append(buildLead(leadTypeSrc), buildHeader(0, nil)...), buildHeader(maxHdrLength/16, nil)...),
+		},
+		{
+			"cpio entry",
+			buildSrpm(t, []testFile{{name: "foo.spec", mode: 0o100644, fileSize: "7fffffff"}}),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			if _, err := walkSrpm(tt.data); err == nil {
+				t.Fatal("expected an error")
+			}
+			runtime.ReadMemStats(&after)
+
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+				t.Errorf("allocated %d bytes for a %d byte file", alloc, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestReadSrpmZstd(t *testing.T) {
+	var payload bytes.Buffer
+	zw, err := zstd.NewWriter(&payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(buildCpio(testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	// Walk stops at the cpio trailer, leaving the decoder in the middle of the stream
+	trailing := make([]byte, 8<<20)
+	for i := range trailing {
+		trailing[i] = byte(i * 7919 >> 3)
+	}
+	if _, err := zw.Write(trailing); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buildLead(leadTypeSrc)
+	data = append(data, buildHeader(0, nil)...)
+	data = append(data, mainHeaderWith("zstd")...)
+	data = append(data, payload.Bytes()...)
+
+	// zstd decodes concurrently on hosts with several CPUs
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		srpm, err := ReadSrpm(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("ReadSrpm: %v", err)
+		}
+		files := 0
+		err = srpm.Walk(func(name string, mode os.FileMode, r io.Reader) error {
+			files++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Walk: %v", err)
+		}
+		if files != 3 {
+			t.Fatalf("walked %d files, want 3", files)
+		}
+		if err := srpm.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	// closed decoders stop their goroutines
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before reading, %d after closing", before, after)
+	}
+}
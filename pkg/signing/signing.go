@@ -0,0 +1,338 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package signing signs import commits and tags with OpenPGP or SSH keys.
+// Signatures are detached and armored the same way git signs objects,
+// so `git verify-commit` and `git verify-tag` can check them
+package signing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	FormatOpenPGP = "openpgp"
+	FormatSSH     = "ssh"
+)
+
+// ErrPassphraseMissing is returned if a key is encrypted and no passphrase was given
+var ErrPassphraseMissing = errors.New("signing key is encrypted but no passphrase was given")
+
+// OpenPGPSigner signs with the first private key of an armored key ring
+type OpenPGPSigner struct {
+	entity *openpgp.Entity
+	// creation time of signatures, the current time if zero
+	when time.Time
+}
+
+// NewOpenPGP reads an armored private key from path, decrypting it with passphrase if needed
+func NewOpenPGP(path string, passphrase []byte) (*OpenPGPSigner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open signing key: %v", err)
+	}
+	defer f.Close()
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key %s: %v", path, err)
+	}
+
+	for _, entity := range keyRing {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if len(passphrase) == 0 {
+				return nil, ErrPassphraseMissing
+			}
+			err := entity.DecryptPrivateKeys(passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("could not decrypt signing key %s: %v", path, err)
+			}
+		}
+
+		return &OpenPGPSigner{entity: entity}, nil
+	}
+
+	return nil, fmt.Errorf("no private key found in %s", path)
+}
+
+func (s *OpenPGPSigner) Sign(message io.Reader) ([]byte, error) {
+	config := &packet.Config{}
+	if !s.when.IsZero() {
+		when := s.signingTime()
+		config.Time = func() time.Time {
+			return when
+		}
+	}
+
+	var buf bytes.Buffer
+	err := openpgp.ArmoredDetachSign(&buf, s.entity, message, config)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// signingTime returns the fixed signature time, or the time the key became valid if that is later.
+// Reproducible imports of commits older than the key could not be signed otherwise
+func (s *OpenPGPSigner) signingTime() time.Time {
+	if _, ok := s.entity.SigningKey(s.when); ok {
+		return s.when
+	}
+	key, ok := s.entity.SigningKey(time.Now())
+	if !ok {
+		// signing fails with the reason
+		return s.when
+	}
+
+	valid := key.PublicKey.CreationTime
+	signatures := []*packet.Signature{key.SelfSignature}
+	if identity := s.entity.PrimaryIdentity(); identity != nil {
+		signatures = append(signatures, identity.SelfSignature)
+	}
+	for _, sig := range signatures {
+		if sig != nil && sig.CreationTime.After(valid) {
+			valid = sig.CreationTime
+		}
+	}
+
+	return valid
+}
+
+// SSHSigner signs in the SSHSIG format git uses for gpg.format=ssh
+type SSHSigner struct {
+	signer ssh.Signer
+}
+
+const (
+	sshSigMagic     = "SSHSIG"
+	sshSigVersion   = 1
+	sshSigNamespace = "git"
+	sshSigHash      = "sha512"
+	// ssh-keygen wraps armored signatures at 70 characters
+	sshSigLineLen = 70
+)
+
+// NewSSH reads a private key in OpenSSH or PEM format from path,
+// decrypting it with passphrase if needed
+func NewSSH(path string, passphrase []byte) (*SSHSigner, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseMissing
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key %s: %v", path, err)
+	}
+
+	return &SSHSigner{signer: signer}, nil
+}
+
+func (s *SSHSigner) Sign(message io.Reader) ([]byte, error) {
+	hash := sha512.New()
+	_, err := io.Copy(hash, message)
+	if err != nil {
+		return nil, fmt.Errorf("could not read message: %v", err)
+	}
+
+	signedData := ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		Hash      string
+		Digest    string
+	}{sshSigNamespace, "", sshSigHash, string(hash.Sum(nil))})
+	signedData = append([]byte(sshSigMagic), signedData...)
+
+	// RSA keys must not fall back to SHA-1 signatures
+	var signature *ssh.Signature
+	if algSigner, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signature, err = algSigner.SignWithAlgorithm(rand.Reader, signedData, ssh.KeyAlgoRSASHA512)
+	} else {
+		signature, err = s.signer.Sign(rand.Reader, signedData)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not sign: %v", err)
+	}
+
+	blob := ssh.Marshal(struct {
+		Version   uint32
+		PublicKey string
+		Namespace string
+		Reserved  string
+		Hash      string
+		Signature string
+	}{
+		sshSigVersion,
+		string(s.signer.PublicKey().Marshal()),
+		sshSigNamespace,
+		"",
+		sshSigHash,
+		string(ssh.Marshal(signature)),
+	})
+	encoded := base64.StdEncoding.EncodeToString(append([]byte(sshSigMagic), blob...))
+
+	var buf strings.Builder
+	buf.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > sshSigLineLen {
+		buf.WriteString(encoded[:sshSigLineLen] + "\n")
+		encoded = encoded[sshSigLineLen:]
+	}
+	buf.WriteString(encoded + "\n")
+	buf.WriteString("-----END SSH SIGNATURE-----\n")
+
+	return []byte(buf.String()), nil
+}
+
+// New returns the signer for format with the key at path
+func New(format string, path string, passphrase []byte) (git.Signer, error) {
+	switch format {
+	case FormatOpenPGP:
+		return NewOpenPGP(path, passphrase)
+	case FormatSSH:
+		return NewSSH(path, passphrase)
+	}
+
+	return nil, fmt.Errorf("unsupported signing format %s", format)
+}
+
+// At returns a signer stamping its signatures with when instead of the current time.
+// OpenPGP signatures carry their creation time, so signing the same object
+// twice only gives the same signature if the time is fixed.
+// SSH signatures have no time, other signers are returned as is
+func At(signer git.Signer, when time.Time) git.Signer {
+	if s, ok := signer.(*OpenPGPSigner); ok {
+		return &OpenPGPSigner{entity: s.entity, when: when}
+	}
+
+	return signer
+}
+
+// SignCommit sets the signature of commit, made at the commit time
+func SignCommit(signer git.Signer, commit *object.Commit) error {
+	encoded := &plumbing.MemoryObject{}
+	err := commit.EncodeWithoutSignature(encoded)
+	if err != nil {
+		return fmt.Errorf("could not encode commit: %v", err)
+	}
+	r, err := encoded.Reader()
+	if err != nil {
+		return fmt.Errorf("could not encode commit: %v", err)
+	}
+	signature, err := At(signer, commit.Committer.When).Sign(r)
+	if err != nil {
+		return err
+	}
+	commit.PGPSignature = string(signature)
+
+	return nil
+}
+
+// CreateTag is like repo.CreateTag, the tag is signed by signer at the tagger time if it is not nil.
+// go-git can only sign tags with OpenPGP entities
+func CreateTag(repo *git.Repository, name string, hash plumbing.Hash, opts *git.CreateTagOptions, signer git.Signer) (*plumbing.Reference, error) {
+	if signer == nil {
+		return repo.CreateTag(name, hash, opts)
+	}
+
+	refName := plumbing.NewTagReferenceName(name)
+	_, err := repo.Storer.Reference(refName)
+	if err == nil {
+		return nil, git.ErrTagExists
+	}
+	if err != plumbing.ErrReferenceNotFound {
+		return nil, err
+	}
+	err = opts.Validate(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := object.GetObject(repo.Storer, hash)
+	if err != nil {
+		return nil, fmt.Errorf("could not get tag target: %v", err)
+	}
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     *opts.Tagger,
+		Message:    opts.Message,
+		TargetType: target.Type(),
+		Target:     hash,
+	}
+
+	encoded := &plumbing.MemoryObject{}
+	err = tag.EncodeWithoutSignature(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode tag: %v", err)
+	}
+	r, err := encoded.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("could not encode tag: %v", err)
+	}
+	signature, err := At(signer, tag.Tagger.When).Sign(r)
+	if err != nil {
+		return nil, err
+	}
+	tag.PGPSignature = string(signature)
+
+	obj := repo.Storer.NewEncodedObject()
+	err = tag.Encode(obj)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode tag: %v", err)
+	}
+	tagHash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return nil, fmt.Errorf("could not store tag: %v", err)
+	}
+
+	ref := plumbing.NewHashReference(refName, tagHash)
+	err = repo.Storer.SetReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("could not set tag reference: %v", err)
+	}
+
+	return ref, nil
+}
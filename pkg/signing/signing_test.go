@@ -0,0 +1,534 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package signing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeOpenPGPKey writes an armored private key and returns its path and entity
+func writeOpenPGPKey(t *testing.T, config *packet.Config) (string, *openpgp.Entity) {
+	entity, err := openpgp.NewEntity("srpmproc", "", "srpmproc@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key.asc")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := armor.Encode(f, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, entity
+}
+
+// signedImport commits a file and tags the commit like an import
+// and returns the hashes of the commit and the tag
+func signedImport(t *testing.T, signer git.Signer, when time.Time) (plumbing.Hash, plumbing.Hash) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.WriteFile(fs, "foo.spec", []byte("Name: foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("foo.spec"); err != nil {
+		t.Fatal(err)
+	}
+
+	importer := &object.Signature{Name: "importer", Email: "importer@example.com", When: when}
+	commit, err := w.Commit("import foo-1.0-1.el8", &git.CommitOptions{
+		Author: importer,
+		Signer: At(signer, when),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := CreateTag(repo, "imports/r8/foo-1.0-1.el8", commit, &git.CreateTagOptions{
+		Tagger:  importer,
+		Message: "import foo-1.0-1.el8",
+	}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return commit, tag.Hash()
+}
+
+func TestReproducibleSignatures(t *testing.T) {
+	path, _ := writeOpenPGPKey(t, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	signer, err := NewOpenPGP(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	when := time.Unix(1600000000, 0).UTC()
+	commit, tag := signedImport(t, signer, when)
+	// a later run of the same import
+	time.Sleep(1100 * time.Millisecond)
+	commit2, tag2 := signedImport(t, signer, when)
+	if commit != commit2 || tag != tag2 {
+		t.Fatalf("got commit %s and tag %s, then commit %s and tag %s", commit, tag, commit2, tag2)
+	}
+
+	commit3, _ := signedImport(t, signer, when.Add(time.Hour))
+	if commit3 == commit {
+		t.Fatal("commits at different times have the same hash")
+	}
+}
+
+func TestSignatureTime(t *testing.T) {
+	path, entity := writeOpenPGPKey(t, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	signer, err := NewOpenPGP(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := entity.PrimaryKey.CreationTime
+
+	for _, tt := range []struct {
+		name string
+		when time.Time
+		want time.Time
+	}{
+		{"after the key was created", created.Add(time.Hour), created.Add(time.Hour)},
+		// an upstream commit older than the key
+		{"before the key was created", created.Add(-365 * 24 * time.Hour), created},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, err := At(signer, tt.when).Sign(strings.NewReader("message"))
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			block, err := armor.Decode(strings.NewReader(string(signature)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := packet.Read(block.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, ok := p.(*packet.Signature)
+			if !ok {
+				t.Fatalf("got packet %T", p)
+			}
+			if !sig.CreationTime.Equal(tt.want) {
+				t.Errorf("signature was made at %s, want %s", sig.CreationTime, tt.want)
+			}
+		})
+	}
+}
+
+// sshSig is the SSHSIG blob of an armored SSH signature
+type sshSig struct {
+	Version   uint32
+	PublicKey string
+	Namespace string
+	Reserved  string
+	Hash      string
+	Signature string
+}
+
+func writeSSHKey(t *testing.T, key crypto.PrivateKey, passphrase []byte) string {
+	var block *pem.Block
+	var err error
+	if passphrase != nil {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// verifySSHSignature checks an armored SSHSIG signature of message made by pub
+// and returns the signature algorithm
+func verifySSHSignature(t *testing.T, armored string, message []byte, pub ssh.PublicKey) (string, error) {
+	t.Helper()
+
+	lines := strings.Split(strings.TrimSpace(armored), "\n")
+	if lines[0] != "-----BEGIN SSH SIGNATURE-----" || lines[len(lines)-1] != "-----END SSH SIGNATURE-----" {
+		t.Fatalf("signature is not armored:\n%s", armored)
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) > sshSigLineLen {
+			t.Errorf("line of %d characters", len(line))
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte("SSHSIG")) {
+		t.Fatalf("signature does not start with the SSHSIG magic")
+	}
+
+	var blob sshSig
+	if err := ssh.Unmarshal(raw[len("SSHSIG"):], &blob); err != nil {
+		t.Fatalf("could not parse signature: %v", err)
+	}
+	if blob.Version != 1 || blob.Namespace != "git" || blob.Hash != "sha512" || blob.Reserved != "" {
+		t.Errorf("unexpected signature version %d, namespace %q, hash %q", blob.Version, blob.Namespace, blob.Hash)
+	}
+	if !bytes.Equal([]byte(blob.PublicKey), pub.Marshal()) {
+		t.Error("signature carries a different public key")
+	}
+
+	var signature ssh.Signature
+	if err := ssh.Unmarshal([]byte(blob.Signature), &signature); err != nil {
+		t.Fatalf("could not parse signature: %v", err)
+	}
+	digest := sha512.Sum512(message)
+	signedData := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		Hash      string
+		Digest    string
+	}{"git", "", "sha512", string(digest[:])})...)
+
+	return signature.Format, pub.Verify(signedData, &signature)
+}
+
+// payload returns the encoding of a commit or tag without its signature
+func payload(t *testing.T, encode func(o plumbing.EncodedObject) error) []byte {
+	obj := &plumbing.MemoryObject{}
+	if err := encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func signedObjects(t *testing.T, signer git.Signer) (*object.Commit, *object.Tag) {
+	commit := &object.Commit{
+		Author:    object.Signature{Name: "importer", Email: "importer@example.com", When: time.Now()},
+		Committer: object.Signature{Name: "importer", Email: "importer@example.com", When: time.Now()},
+		Message:   "import foo-1.0-1.el8\n",
+		TreeHash:  plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904"),
+	}
+	if err := SignCommit(signer, commit); err != nil {
+		t.Fatalf("SignCommit: %v", err)
+	}
+
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := CreateTag(repo, "imports/r8/foo-1.0-1.el8", hash, &git.CreateTagOptions{
+		Tagger:  &commit.Committer,
+		Message: "import foo-1.0-1.el8",
+	}, signer)
+	if err != nil {
+		t.Fatalf("CreateTag: %v", err)
+	}
+	if _, err := CreateTag(repo, "imports/r8/foo-1.0-1.el8", hash, &git.CreateTagOptions{
+		Tagger:  &commit.Committer,
+		Message: "again",
+	}, signer); err != git.ErrTagExists {
+		t.Errorf("CreateTag of an existing tag = %v", err)
+	}
+
+	stored, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := repo.TagObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Target != hash || tag.TargetType != plumbing.CommitObject {
+		t.Errorf("tag points to %s %s", tag.TargetType, tag.Target)
+	}
+
+	return stored, tag
+}
+
+func TestSSHSigner(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		key    crypto.PrivateKey
+		pub    crypto.PublicKey
+		format string
+	}{
+		{"ed25519", edKey, edPub, ssh.KeyAlgoED25519},
+		// never ssh-rsa, that is a SHA-1 signature
+		{"rsa", rsaKey, &rsaKey.PublicKey, ssh.KeyAlgoRSASHA512},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := ssh.NewPublicKey(tt.pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, err := New(FormatSSH, writeSSHKey(t, tt.key, nil), nil)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			message := []byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n")
+			signature, err := signer.Sign(bytes.NewReader(message))
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			format, err := verifySSHSignature(t, string(signature), message, pub)
+			if err != nil {
+				t.Fatalf("signature does not verify: %v", err)
+			}
+			if format != tt.format {
+				t.Errorf("signed with %s, want %s", format, tt.format)
+			}
+
+			commit, tag := signedObjects(t, signer)
+			commitPayload := payload(t, commit.EncodeWithoutSignature)
+			if _, err := verifySSHSignature(t, commit.PGPSignature, commitPayload, pub); err != nil {
+				t.Errorf("commit signature does not verify: %v", err)
+			}
+			if _, err := verifySSHSignature(t, tag.PGPSignature, payload(t, tag.EncodeWithoutSignature), pub); err != nil {
+				t.Errorf("tag signature does not verify: %v", err)
+			}
+
+			tampered := bytes.Replace(commitPayload, []byte("import"), []byte("imp0rt"), 1)
+			if _, err := verifySSHSignature(t, commit.PGPSignature, tampered, pub); err == nil {
+				t.Error("signature verifies for a tampered commit")
+			}
+		})
+	}
+}
+
+// ssh-keygen checks signatures the same way as git with gpg.format=ssh
+func TestSSHSignerKeygen(t *testing.T) {
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSSH(writeSSHKey(t, key, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n"
+	signature, err := signer.Sign(strings.NewReader(message))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "message.sig")
+	if err := os.WriteFile(path, signature, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(keygen, "-Y", "check-novalidate", "-n", "git", "-s", path)
+	cmd.Stdin = strings.NewReader(message)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen rejected the signature: %v\n%s", err, out)
+	}
+}
+
+func TestSSHSignerPassphrase(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeSSHKey(t, key, []byte("secret"))
+
+	if _, err := NewSSH(path, nil); err != ErrPassphraseMissing {
+		t.Errorf("NewSSH without passphrase = %v, want ErrPassphraseMissing", err)
+	}
+	if _, err := NewSSH(path, []byte("wrong")); err == nil {
+		t.Error("NewSSH with a wrong passphrase succeeded")
+	}
+	if _, err := NewSSH(path, []byte("secret")); err != nil {
+		t.Errorf("NewSSH: %v", err)
+	}
+}
+
+func TestOpenPGPSigner(t *testing.T) {
+	path, entity := writeOpenPGPKey(t, &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	signer, err := New(FormatOpenPGP, path, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	keyRing := openpgp.EntityList{entity}
+
+	commit, tag := signedObjects(t, signer)
+	for name, tt := range map[string]struct {
+		payload   []byte
+		signature string
+	}{
+		"commit": {payload(t, commit.EncodeWithoutSignature), commit.PGPSignature},
+		"tag":    {payload(t, tag.EncodeWithoutSignature), tag.PGPSignature},
+	} {
+		if !strings.HasPrefix(tt.signature, "-----BEGIN PGP SIGNATURE-----") {
+			t.Errorf("%s signature is not armored:\n%s", name, tt.signature)
+		}
+		signer, err := openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(tt.payload), strings.NewReader(tt.signature), nil)
+		if err != nil {
+			t.Errorf("%s signature does not verify: %v", name, err)
+		} else if signer.PrimaryKey.KeyId != entity.PrimaryKey.KeyId {
+			t.Errorf("%s was signed by %X", name, signer.PrimaryKey.KeyId)
+		}
+
+		tampered := bytes.Replace(tt.payload, []byte("import"), []byte("imp0rt"), 1)
+		_, err = openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(tampered), strings.NewReader(tt.signature), nil)
+		if err == nil {
+			t.Errorf("%s signature verifies for tampered content", name)
+		}
+	}
+
+	// go-git checks commit signatures the same way
+	var armoredKey bytes.Buffer
+	w, err := armor.Encode(&armoredKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commit.Verify(armoredKey.String()); err != nil {
+		t.Errorf("Commit.Verify: %v", err)
+	}
+	if _, err := tag.Verify(armoredKey.String()); err != nil {
+		t.Errorf("Tag.Verify: %v", err)
+	}
+}
+
+func TestOpenPGPSignerPassphrase(t *testing.T) {
+	entity, err := openpgp.NewEntity("srpmproc", "", "srpmproc@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.EncryptPrivateKeys([]byte("secret"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.asc")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewOpenPGP(path, nil); err != ErrPassphraseMissing {
+		t.Errorf("NewOpenPGP without passphrase = %v, want ErrPassphraseMissing", err)
+	}
+	if _, err := NewOpenPGP(path, []byte("wrong")); err == nil {
+		t.Error("NewOpenPGP with a wrong passphrase succeeded")
+	}
+	signer, err := NewOpenPGP(path, []byte("secret"))
+	if err != nil {
+		t.Fatalf("NewOpenPGP: %v", err)
+	}
+	if _, err := signer.Sign(strings.NewReader("message")); err != nil {
+		t.Errorf("Sign: %v", err)
+	}
+}
+
+func TestNewUnsupportedFormat(t *testing.T) {
+	if _, err := New("x509", "key", nil); err == nil {
+		t.Error("New accepted an unsupported format")
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	srpmprocpb "github.com/rocky-linux/srpmproc/pb"
+	"gopkg.in/yaml.v3"
+)
+
+// BatchPackage is a single package entry of a batch manifest
+type BatchPackage struct {
+	Name       string `json:"name" yaml:"name"`
+	GitName    string `json:"git_name,omitempty" yaml:"git_name,omitempty"`
+	Version    string `json:"version,omitempty" yaml:"version,omitempty"`
+	Release    string `json:"release,omitempty" yaml:"release,omitempty"`
+	ModuleMode bool   `json:"module,omitempty" yaml:"module,omitempty"`
+}
+
+// BatchManifest lists the packages to import in one batch run
+type BatchManifest struct {
+	Packages []*BatchPackage `json:"packages" yaml:"packages"`
+}
+
+// BatchResult is the outcome of importing a single package
+type BatchResult struct {
+	Package  string                      `json:"package"`
+	Response *srpmprocpb.ProcessResponse `json:"response,omitempty"`
+	Error    string                      `json:"error,omitempty"`
+}
+
+// ReadBatchManifest reads a YAML or JSON batch manifest
+func ReadBatchManifest(path string) (*BatchManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open manifest: %v", err)
+	}
+	defer f.Close()
+
+	var manifest BatchManifest
+	// JSON is valid YAML, so one decoder covers both
+	err = yaml.NewDecoder(f).Decode(&manifest)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not decode manifest: %v", err)
+	}
+
+	// a package listed twice would be imported to the same repo concurrently
+	seen := map[string]int{}
+	for i, pkg := range manifest.Packages {
+		if pkg == nil || pkg.Name == "" {
+			return nil, fmt.Errorf("manifest entry %d has no package name", i)
+		}
+		key := fmt.Sprintf("%s/%v", pkg.Name, pkg.ModuleMode)
+		if first, ok := seen[key]; ok {
+			return nil, fmt.Errorf("manifest entries %d and %d list the same package %s", first, i, pkg.Name)
+		}
+		seen[key] = i
+	}
+
+	return &manifest, nil
+}
+
+// ProcessBatch imports all packages of manifest using up to workers concurrent imports.
+// Every package gets a copy of base, with the package fields of its manifest entry applied.
+// The blob storage and authenticator are created once and shared by all imports,
+// so a blob cache is reused across packages.
+// Results are returned in manifest order
+func ProcessBatch(base *ProcessDataRequest, manifest *BatchManifest, workers int) ([]*BatchResult, error) {
+	return ProcessBatchContext(context.Background(), base, manifest, workers)
+}
+
+// ProcessBatchContext is ProcessBatch with a context.
+// Once ctx is cancelled running imports are aborted and packages
+// that have not started yet are reported with the context error
+func ProcessBatchContext(ctx context.Context, base *ProcessDataRequest, manifest *BatchManifest, workers int) ([]*BatchResult, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	blobStorage := base.BlobStorage
+	if blobStorage == nil {
+		var err error
+		blobStorage, err = newRequestBlobStorage(base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	authenticator := base.Authenticator
+	if authenticator == nil {
+		var err error
+		authenticator, err = NewAuthenticator(base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signer := base.Signer
+	if signer == nil && base.SigningFormat != "" {
+		var err error
+		signer, err = NewSigner(base)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// compiled once here, the workers share the rules
+	if base.BranchRules != nil && !base.BranchRules.Compiled() {
+		err := base.BranchRules.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("invalid branch rules: %v", err)
+		}
+	}
+
+	var logWriter io.Writer = os.Stdout
+	if base.LogWriter != nil {
+		logWriter = base.LogWriter
+	}
+
+	results := make([]*BatchResult, len(manifest.Packages))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				pkg := manifest.Packages[idx]
+
+				req := *base
+				req.Package = pkg.Name
+				req.PackageGitName = pkg.GitName
+				req.PackageVersion = pkg.Version
+				req.PackageRelease = pkg.Release
+				req.ModuleMode = pkg.ModuleMode
+				req.BlobStorage = blobStorage
+				req.Authenticator = authenticator
+				req.Signer = signer
+				req.LogWriter = &prefixWriter{prefix: fmt.Sprintf("[%s] ", pkg.Name), w: logWriter}
+				// packages would otherwise share the same branch directories,
+				// the index keeps a module and a package or two source RPMs
+				// with the same file name apart
+				if base.TmpFsMode != "" {
+					req.TmpFsMode = filepath.Join(base.TmpFsMode, batchTmpFsDir(idx, pkg))
+				}
+
+				results[idx] = processBatchPackage(ctx, &req)
+			}
+		}()
+	}
+
+	for i := range manifest.Packages {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results, nil
+}
+
+// batchTmpFsDir returns the directory below --tmpfs-mode the package at idx is imported to
+func batchTmpFsDir(idx int, pkg *BatchPackage) string {
+	return fmt.Sprintf("%d-%s", idx, filepath.Base(pkg.Name))
+}
+
+func processBatchPackage(ctx context.Context, req *ProcessDataRequest) *BatchResult {
+	result := &BatchResult{
+		Package: req.Package,
+	}
+
+	if err := ctx.Err(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	pd, err := NewProcessData(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	res, err := ProcessRPMContext(ctx, pd)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Response = res
+
+	return result
+}
+
+// prefixWriter prefixes every write with the package name,
+// the logger issues exactly one write per line
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	_, err := p.w.Write(append([]byte(p.prefix), b...))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
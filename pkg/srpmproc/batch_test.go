@@ -0,0 +1,157 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadBatchManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []BatchPackage
+		// substring of the error
+		err string
+	}{
+		{
+			name: "yaml",
+			manifest: `packages:
+  - name: bash
+  - name: nodejs
+    module: true
+  - name: kernel
+    git_name: kernel-rt
+    version: "4.18.0"
+    release: "372.9.1.el8"
+`,
+			want: []BatchPackage{
+				{Name: "bash"},
+				{Name: "nodejs", ModuleMode: true},
+				{Name: "kernel", GitName: "kernel-rt", Version: "4.18.0", Release: "372.9.1.el8"},
+			},
+		},
+		{
+			name:     "json",
+			manifest: `{"packages": [{"name": "bash"}, {"name": "nodejs", "module": true}, {"name": "kernel", "git_name": "kernel-rt", "version": "4.18.0"}]}`,
+			want: []BatchPackage{
+				{Name: "bash"},
+				{Name: "nodejs", ModuleMode: true},
+				{Name: "kernel", GitName: "kernel-rt", Version: "4.18.0"},
+			},
+		},
+		{
+			name:     "module and package of the same name",
+			manifest: "packages:\n  - name: nodejs\n  - name: nodejs\n    module: true\n",
+			want:     []BatchPackage{{Name: "nodejs"}, {Name: "nodejs", ModuleMode: true}},
+		},
+		{name: "empty", manifest: "", want: nil},
+		{name: "missing name", manifest: "packages:\n  - name: bash\n  - version: \"1.0\"\n", err: "manifest entry 1 has no package name"},
+		{name: "empty entry", manifest: "packages:\n  -\n", err: "manifest entry 0 has no package name"},
+		{name: "duplicate", manifest: "packages:\n  - name: bash\n  - name: zsh\n  - name: bash\n", err: "manifest entries 0 and 2 list the same package bash"},
+		{name: "invalid", manifest: "packages: {name: bash", err: "could not decode manifest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "manifest")
+			if err := os.WriteFile(path, []byte(tt.manifest), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			manifest, err := ReadBatchManifest(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ReadBatchManifest error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadBatchManifest: %v", err)
+			}
+			if len(manifest.Packages) != len(tt.want) {
+				t.Fatalf("ReadBatchManifest = %d packages, want %d", len(manifest.Packages), len(tt.want))
+			}
+			for i, pkg := range manifest.Packages {
+				if *pkg != tt.want[i] {
+					t.Errorf("package %d = %+v, want %+v", i, *pkg, tt.want[i])
+				}
+			}
+		})
+	}
+
+	_, err := ReadBatchManifest(filepath.Join(t.TempDir(), "missing"))
+	if err == nil || !strings.Contains(err.Error(), "could not open manifest") {
+		t.Fatalf("ReadBatchManifest of a missing file = %v", err)
+	}
+}
+
+func TestBatchTmpFsDir(t *testing.T) {
+	packages := []*BatchPackage{
+		{Name: "nodejs"},
+		{Name: "nodejs", ModuleMode: true},
+		{Name: "/srpms/a/foo.src.rpm"},
+		{Name: "/srpms/b/foo.src.rpm"},
+	}
+	seen := map[string]bool{}
+	for i, pkg := range packages {
+		dir := batchTmpFsDir(i, pkg)
+		if seen[dir] || strings.Contains(dir, "/") {
+			t.Errorf("batchTmpFsDir(%d, %s) = %s", i, pkg.Name, dir)
+		}
+		seen[dir] = true
+	}
+	if dir := batchTmpFsDir(2, packages[2]); dir != "2-foo.src.rpm" {
+		t.Errorf("batchTmpFsDir = %s, want 2-foo.src.rpm", dir)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("closed") }
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&prefixWriter{prefix: "[bash] ", w: &buf}, "", 0)
+	logger.Printf("first")
+	logger.Printf("second\n")
+
+	if got := buf.String(); got != "[bash] first\n[bash] second\n" {
+		t.Fatalf("prefixed log = %q", got)
+	}
+
+	w := &prefixWriter{prefix: "[bash] ", w: &buf}
+	n, err := w.Write([]byte("line\n"))
+	if err != nil || n != len("line\n") {
+		t.Fatalf("Write = %d, %v, want the length without the prefix", n, err)
+	}
+
+	w = &prefixWriter{prefix: "[bash] ", w: failingWriter{}}
+	n, err = w.Write([]byte("line\n"))
+	if err == nil || n != 0 {
+		t.Fatalf("Write to a failing writer = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadBranchRules reads and compiles a YAML or JSON branch rules file
+func ReadBranchRules(path string) (*data.BranchRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open branch rules: %v", err)
+	}
+	defer f.Close()
+
+	var rules data.BranchRules
+	// JSON is valid YAML, so one decoder covers both
+	err = yaml.NewDecoder(f).Decode(&rules)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not decode branch rules: %v", err)
+	}
+
+	err = rules.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid branch rules: %v", err)
+	}
+
+	return &rules, nil
+}
+
+// UpstreamBranches lists the branches of an upstream repository.
+// Both branch heads and the branches of import tags (imports/<branch>/<nvr>) are returned
+func UpstreamBranches(url string) ([]string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "upstream",
+		URLs: []string{url},
+	})
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list upstream refs: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		name := ref.Name()
+		switch {
+		case name.IsBranch():
+			seen[name.Short()] = true
+		case name.IsTag() && strings.HasPrefix(name.Short(), "imports/"):
+			parts := strings.SplitN(strings.TrimPrefix(name.Short(), "imports/"), "/", 2)
+			if len(parts) == 2 {
+				seen[parts[0]] = true
+			}
+		}
+	}
+
+	var branches []string
+	for branch := range seen {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+
+	return branches, nil
+}
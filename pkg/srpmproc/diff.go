@@ -0,0 +1,252 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// same heuristic as git, a NUL byte in the first 8000 bytes means binary
+const diffBinarySniffLen = 8000
+
+// snapshotFile is a file in a tree snapshot.
+// Content is only kept for text files
+type snapshotFile struct {
+	path    string
+	hash    plumbing.Hash
+	mode    filemode.FileMode
+	content string
+	binary  bool
+}
+
+func (f *snapshotFile) Hash() plumbing.Hash     { return f.hash }
+func (f *snapshotFile) Mode() filemode.FileMode { return f.mode }
+func (f *snapshotFile) Path() string            { return f.path }
+
+type treeSnapshot map[string]*snapshotFile
+
+type diffChunk struct {
+	content string
+	op      fdiff.Operation
+}
+
+func (c *diffChunk) Content() string       { return c.content }
+func (c *diffChunk) Type() fdiff.Operation { return c.op }
+
+type filePatch struct {
+	from   *snapshotFile
+	to     *snapshotFile
+	chunks []fdiff.Chunk
+}
+
+func (p *filePatch) IsBinary() bool {
+	return (p.from != nil && p.from.binary) || (p.to != nil && p.to.binary)
+}
+
+func (p *filePatch) Files() (fdiff.File, fdiff.File) {
+	// typed nil pointers are not nil interfaces, the encoder relies on nil
+	var from, to fdiff.File
+	if p.from != nil {
+		from = p.from
+	}
+	if p.to != nil {
+		to = p.to
+	}
+
+	return from, to
+}
+
+func (p *filePatch) Chunks() []fdiff.Chunk { return p.chunks }
+
+type treePatch struct {
+	patches []fdiff.FilePatch
+}
+
+func (p *treePatch) FilePatches() []fdiff.FilePatch { return p.patches }
+func (p *treePatch) Message() string                { return "" }
+
+// lookasideFiles returns a check for the paths of sources stored in the lookaside
+func lookasideFiles(md *data.ModeData) func(path string) bool {
+	return func(path string) bool {
+		for _, source := range md.SourcesToIgnore {
+			if !source.Expired && filepath.ToSlash(filepath.Clean(source.Name)) == path {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// snapshotTree records every file in fs except the git directory.
+// Files lookaside reports are only hashed while streaming them, as sources can be large,
+// and are diffed as binary files
+func snapshotTree(fs billy.Filesystem, lookaside func(path string) bool) (treeSnapshot, error) {
+	snapshot := treeSnapshot{}
+
+	err := util.Walk(fs, ".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		mode, err := filemode.NewFromOSFileMode(info.Mode())
+		if err != nil {
+			mode = filemode.Regular
+		}
+
+		f, err := fs.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %v", path, err)
+		}
+		defer f.Close()
+
+		slashPath := filepath.ToSlash(filepath.Clean(path))
+		if lookaside != nil && lookaside(slashPath) {
+			hasher := plumbing.NewHasher(plumbing.BlobObject, info.Size())
+			_, err := io.Copy(hasher, f)
+			if err != nil {
+				return fmt.Errorf("could not read %s: %v", path, err)
+			}
+			snapshot[slashPath] = &snapshotFile{
+				path:   slashPath,
+				hash:   hasher.Sum(),
+				mode:   mode,
+				binary: true,
+			}
+			return nil
+		}
+
+		content, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", path, err)
+		}
+
+		sniff := content
+		if len(sniff) > diffBinarySniffLen {
+			sniff = sniff[:diffBinarySniffLen]
+		}
+
+		file := &snapshotFile{
+			path:   slashPath,
+			hash:   plumbing.ComputeHash(plumbing.BlobObject, content),
+			mode:   mode,
+			binary: bytes.IndexByte(sniff, 0) != -1,
+		}
+		if !file.binary {
+			file.content = string(content)
+		}
+		snapshot[file.path] = file
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not snapshot tree: %v", err)
+	}
+
+	return snapshot, nil
+}
+
+// unifiedDiff returns a git style unified diff between two snapshots
+func unifiedDiff(from treeSnapshot, to treeSnapshot) (string, error) {
+	paths := map[string]bool{}
+	for path := range from {
+		paths[path] = true
+	}
+	for path := range to {
+		paths[path] = true
+	}
+
+	var sortedPaths []string
+	for path := range paths {
+		sortedPaths = append(sortedPaths, path)
+	}
+	sort.Strings(sortedPaths)
+
+	patch := &treePatch{}
+	for _, path := range sortedPaths {
+		fromFile := from[path]
+		toFile := to[path]
+		if fromFile != nil && toFile != nil && fromFile.hash == toFile.hash && fromFile.mode == toFile.mode {
+			continue
+		}
+
+		fp := &filePatch{from: fromFile, to: toFile}
+		if !fp.IsBinary() {
+			var fromContent, toContent string
+			if fromFile != nil {
+				fromContent = fromFile.content
+			}
+			if toFile != nil {
+				toContent = toFile.content
+			}
+
+			for _, d := range diff.Do(fromContent, toContent) {
+				op := fdiff.Equal
+				switch d.Type {
+				case diffmatchpatch.DiffInsert:
+					op = fdiff.Add
+				case diffmatchpatch.DiffDelete:
+					op = fdiff.Delete
+				}
+				fp.chunks = append(fp.chunks, &diffChunk{content: d.Text, op: op})
+			}
+		}
+		patch.patches = append(patch.patches, fp)
+	}
+
+	var buf bytes.Buffer
+	err := fdiff.NewUnifiedEncoder(&buf, fdiff.DefaultContextLines).Encode(patch)
+	if err != nil {
+		return "", fmt.Errorf("could not encode diff: %v", err)
+	}
+
+	return buf.String(), nil
+}
+
+// diffAgainstTree returns the diff between an upstream snapshot and the current state of fs
+func diffAgainstTree(upstream treeSnapshot, fs billy.Filesystem, lookaside func(path string) bool) (string, error) {
+	downstream, err := snapshotTree(fs, lookaside)
+	if err != nil {
+		return "", err
+	}
+
+	return unifiedDiff(upstream, downstream)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+func writeTestFile(t *testing.T, fs billy.Filesystem, path string, content string) {
+	err := util.WriteFile(fs, path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffAgainstTree(t *testing.T) {
+	fs := memfs.New()
+	writeTestFile(t, fs, "SPECS/foo.spec", "Name: foo\nRelease: 1\n")
+	writeTestFile(t, fs, "SOURCES/foo.tar.gz", "upstream tarball")
+	writeTestFile(t, fs, "SOURCES/unchanged.tar.gz", "other tarball")
+	// files that are only downstream are part of the snapshot and no addition
+	writeTestFile(t, fs, "README.downstream", "kept\n")
+
+	md := &data.ModeData{
+		SourcesToIgnore: []*data.IgnoredSource{
+			{Name: "SOURCES/foo.tar.gz"},
+			{Name: "SOURCES/unchanged.tar.gz"},
+		},
+	}
+	lookaside := lookasideFiles(md)
+
+	before, err := snapshotTree(fs, lookaside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before["SOURCES/foo.tar.gz"].content != "" || !before["SOURCES/foo.tar.gz"].binary {
+		t.Fatal("lookaside source was loaded as text")
+	}
+
+	writeTestFile(t, fs, "SPECS/foo.spec", "Name: foo\nRelease: 1.rocky\n")
+	writeTestFile(t, fs, "SOURCES/foo.tar.gz", "patched tarball")
+	writeTestFile(t, fs, "SOURCES/added.patch", "new patch\n")
+	err = fs.Remove("README.downstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := diffAgainstTree(before, fs, lookaside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"-Release: 1\n+Release: 1.rocky\n",
+		"+++ b/SOURCES/added.patch",
+		"--- a/README.downstream",
+		"Binary files a/SOURCES/foo.tar.gz and b/SOURCES/foo.tar.gz differ",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain %q:\n%s", want, diff)
+		}
+	}
+	if strings.Contains(diff, "unchanged.tar.gz") {
+		t.Errorf("diff contains an unchanged source:\n%s", diff)
+	}
+}
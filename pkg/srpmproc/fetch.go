@@ -1,6 +1,7 @@
 package srpmproc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,11 @@ import (
 )
 
 func Fetch(logger io.Writer, cdnUrl string, dir string, fs billy.Filesystem, storage blob.Storage) error {
+	return FetchContext(context.Background(), logger, cdnUrl, dir, fs, storage)
+}
+
+// FetchContext is Fetch with a context, cancelling ctx aborts the current download
+func FetchContext(ctx context.Context, logger io.Writer, cdnUrl string, dir string, fs billy.Filesystem, storage blob.Storage) error {
 	pd := &data.ProcessData{
 		Log: log.New(logger, "", log.LstdFlags),
 	}
@@ -51,31 +57,36 @@ func Fetch(logger io.Writer, cdnUrl string, dir string, fs billy.Filesystem, sto
 			DisableCompression: false,
 		},
 	}
-	fileContent := strings.Split(string(fileBytes), "\n")
-	for _, line := range fileContent {
-		if strings.TrimSpace(line) == "" {
-			continue
+	sources, err := data.ParseMetadata(fileBytes)
+	if err != nil {
+		return fmt.Errorf("%s: %v", metadataPath, err)
+	}
+	for _, source := range sources {
+		hash := source.Hash
+		path := source.Path
+		err := data.CheckNoSymlinks(fs, dir, path)
+		if err != nil {
+			return fmt.Errorf("%s: unsafe source path: %v", metadataPath, err)
 		}
 
-		lineInfo := strings.SplitN(line, " ", 2)
-		hash := strings.TrimSpace(lineInfo[0])
-		path := strings.TrimSpace(lineInfo[1])
-
 		url := fmt.Sprintf("%s/%s", cdnUrl, hash)
 		if storage != nil {
 			url = hash
 		}
 		pd.Log.Printf("downloading %s", url)
 
-		var body []byte
+		var body io.ReadCloser
 
 		if storage != nil {
-			body, err = storage.Read(hash)
+			body, _, err = blob.OpenResolved(ctx, storage, hash)
 			if err != nil {
-				return fmt.Errorf("could not read blob: %v", err)
+				return fmt.Errorf("could not read blob: %w", err)
+			}
+			if body == nil {
+				return fmt.Errorf("could not read blob: %s not found", hash)
 			}
 		} else {
-			req, err := http.NewRequest("GET", url, nil)
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 			if err != nil {
 				return fmt.Errorf("could not create new http request: %v", err)
 			}
@@ -85,37 +96,46 @@ func Fetch(logger io.Writer, cdnUrl string, dir string, fs billy.Filesystem, sto
 			if err != nil {
 				return fmt.Errorf("could not download dist-git file: %v", err)
 			}
-
-			body, err = io.ReadAll(resp.Body)
-			if err != nil {
-				return fmt.Errorf("could not read the whole dist-git file: %v", err)
-			}
-			err = resp.Body.Close()
-			if err != nil {
-				return fmt.Errorf("could not close body handle: %v", err)
-			}
+			body = resp.Body
 		}
 
-		hasher := pd.CompareHash(body, hash)
-		if hasher == nil {
-			return fmt.Errorf("checksum in metadata does not match dist-git file")
-		}
-
-		err = fs.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o755)
+		err = writeFetchedSource(pd, fs, filepath.Join(dir, path), hash, body)
+		_ = body.Close()
 		if err != nil {
-			return fmt.Errorf("could not create all directories")
+			return err
 		}
+	}
 
-		f, err := fs.Create(filepath.Join(dir, path))
-		if err != nil {
-			return fmt.Errorf("could not open file pointer: %v", err)
-		}
+	return nil
+}
 
-		_, err = f.Write(body)
-		if err != nil {
-			return fmt.Errorf("could not copy dist-git file to in-tree: %v", err)
-		}
-		_ = f.Close()
+// writeFetchedSource streams body to path, verifying it against hash on the way
+func writeFetchedSource(pd *data.ProcessData, fs billy.Filesystem, path string, hash string, body io.Reader) error {
+	hasher := data.NewHashForChecksum(hash)
+	if hasher == nil {
+		return fmt.Errorf("checksum in metadata does not match dist-git file")
+	}
+
+	err := fs.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create all directories")
+	}
+
+	f, err := fs.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not open file pointer: %v", err)
+	}
+
+	_, err = io.Copy(io.MultiWriter(f, hasher), body)
+	_ = f.Close()
+	if err != nil {
+		_ = fs.Remove(path)
+		return fmt.Errorf("could not copy dist-git file to in-tree: %v", err)
+	}
+
+	if !pd.CheckHash(hasher, hash) {
+		_ = fs.Remove(path)
+		return fmt.Errorf("checksum in metadata does not match dist-git file")
 	}
 
 	return nil
@@ -0,0 +1,387 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+// GCRequest describes a garbage collection run over blob storage
+type GCRequest struct {
+	UpstreamPrefix string
+	// Packages whose downstream repos are scanned.
+	// If empty, all repos of a file:// upstream prefix are scanned
+	Packages      []*BatchPackage
+	Storage       blob.Storage
+	Authenticator transport.AuthMethod
+	// Unreferenced blobs modified within the grace period are kept,
+	// they may belong to an import that has not been pushed yet
+	GracePeriod time.Duration
+	// Unreferenced blobs are only reported unless Delete is set
+	Delete bool
+	// OnlyListedPackages states that Packages are the only users of Storage.
+	// Without it, blobs are not deleted if Packages is set, as the blobs of
+	// packages that are not listed would be deleted as well
+	OnlyListedPackages bool
+	// Digest algorithms blobs are additionally stored under as copies.
+	// Referenced blobs are read to find these copies, so they are kept.
+	// Alias objects of referenced blobs are always kept
+	Digests   []string
+	LogWriter io.Writer
+}
+
+// GCBlob is an unreferenced blob
+type GCBlob struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// GCResult is the inventory of a garbage collection run
+type GCResult struct {
+	Repos         int       `json:"repos"`
+	Referenced    int       `json:"referenced"`
+	Linked        int       `json:"linked"`
+	Blobs         int       `json:"blobs"`
+	Unreferenced  []*GCBlob `json:"unreferenced"`
+	InGracePeriod int       `json:"in_grace_period"`
+	Deleted       int       `json:"deleted"`
+	DeletedBytes  int64     `json:"deleted_bytes"`
+}
+
+// DownstreamRepos returns the downstream repo urls of packages.
+// If packages is empty, the repos of a file:// prefix are discovered on disk
+func DownstreamRepos(upstreamPrefix string, packages []*BatchPackage) ([]string, error) {
+	var repos []string
+	for _, pkg := range packages {
+		remotePrefix := "rpms"
+		if pkg.ModuleMode {
+			remotePrefix = "modules"
+		}
+		repos = append(repos, fmt.Sprintf("%s/%s/%s.git", upstreamPrefix, remotePrefix, gitlabify(pkg.Name)))
+	}
+	if len(repos) > 0 {
+		return repos, nil
+	}
+
+	if !strings.HasPrefix(upstreamPrefix, "file://") {
+		return nil, fmt.Errorf("packages have to be listed for upstream prefix %s", upstreamPrefix)
+	}
+	root := strings.TrimPrefix(upstreamPrefix, "file://")
+	for _, remotePrefix := range []string{"rpms", "modules"} {
+		matches, err := filepath.Glob(filepath.Join(root, remotePrefix, "*.git"))
+		if err != nil {
+			return nil, fmt.Errorf("could not list repos: %v", err)
+		}
+		for _, match := range matches {
+			repos = append(repos, fmt.Sprintf("%s/%s/%s", upstreamPrefix, remotePrefix, filepath.Base(match)))
+		}
+	}
+
+	return repos, nil
+}
+
+// ReferencedBlobs returns the hashes listed in the metadata files of every
+// commit reachable from a branch or tag of the repo at remoteUrl
+func ReferencedBlobs(ctx context.Context, remoteUrl string, authenticator transport.AuthMethod) (map[string]bool, error) {
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not init git repo: %v", err)
+	}
+
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{remoteUrl},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create remote: %v", err)
+	}
+
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{
+			"+refs/heads/*:refs/heads/*",
+			"+refs/tags/*:refs/tags/*",
+		},
+		Auth: authenticator,
+		Tags: git.NoTags,
+	})
+	if err == transport.ErrEmptyRemoteRepository {
+		return map[string]bool{}, nil
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, fmt.Errorf("could not fetch %s: %v", remoteUrl, err)
+	}
+
+	commits, err := repo.CommitObjects()
+	if err != nil {
+		return nil, fmt.Errorf("could not list commits: %v", err)
+	}
+
+	hashes := map[string]bool{}
+	err = commits.ForEach(func(commit *object.Commit) error {
+		tree, err := commit.Tree()
+		if err != nil {
+			return fmt.Errorf("could not get tree of %s: %v", commit.Hash, err)
+		}
+
+		for _, entry := range tree.Entries {
+			if !strings.HasPrefix(entry.Name, ".") || !strings.HasSuffix(entry.Name, ".metadata") {
+				continue
+			}
+
+			f, err := tree.File(entry.Name)
+			if err != nil {
+				return fmt.Errorf("could not open %s in %s: %v", entry.Name, commit.Hash, err)
+			}
+			r, err := f.Reader()
+			if err != nil {
+				return fmt.Errorf("could not read %s in %s: %v", entry.Name, commit.Hash, err)
+			}
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) > 0 {
+					hashes[fields[0]] = true
+				}
+			}
+			_ = r.Close()
+			if err := scanner.Err(); err != nil {
+				return fmt.Errorf("could not read %s in %s: %v", entry.Name, commit.Hash, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// aliasScanSize is the size up to which stored blobs are checked for being alias objects,
+// it leaves room for the envelope of compressed or encrypted blobs
+const aliasScanSize = 1 << 10
+
+// linkedBlobs returns the unreferenced blobs that belong to a referenced blob:
+// targets of referenced aliases, aliases of referenced blobs and copies
+// stored under the additional digests of req
+func linkedBlobs(ctx context.Context, req *GCRequest, blobs map[string]*blob.Info, referenced map[string]bool) (map[string]bool, error) {
+	aliases := map[string]string{}
+	for path, info := range blobs {
+		if info.Size > aliasScanSize {
+			continue
+		}
+		target, err := blob.ReadAlias(ctx, req.Storage, path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read blob %s: %v", path, err)
+		}
+		if target != "" {
+			aliases[path] = target
+		}
+	}
+
+	kept := map[string]bool{}
+	for path := range referenced {
+		kept[path] = true
+		if target, ok := aliases[path]; ok {
+			kept[target] = true
+		}
+	}
+
+	if len(req.Digests) > 0 {
+		for path := range kept {
+			if _, ok := aliases[path]; ok || blobs[path] == nil {
+				continue
+			}
+			keys, err := blobDigests(ctx, req.Storage, path, req.Digests)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range keys {
+				kept[key] = true
+			}
+		}
+	}
+	for path, target := range aliases {
+		if kept[target] {
+			kept[path] = true
+		}
+	}
+
+	linked := map[string]bool{}
+	for path := range kept {
+		if !referenced[path] && blobs[path] != nil {
+			linked[path] = true
+		}
+	}
+
+	return linked, nil
+}
+
+// blobDigests returns the keys of a blob under the given digest algorithms
+func blobDigests(ctx context.Context, storage blob.Storage, path string, digests []string) ([]string, error) {
+	r, err := storage.Reader(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read blob %s: %v", path, err)
+	}
+	if r == nil {
+		return nil, nil
+	}
+	defer r.Close()
+
+	var hashers []hash.Hash
+	var writers []io.Writer
+	for _, digest := range digests {
+		hasher := data.NewHash(digest)
+		if hasher == nil {
+			return nil, fmt.Errorf("unsupported digest algorithm %s", digest)
+		}
+		hashers = append(hashers, hasher)
+		writers = append(writers, hasher)
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read blob %s: %v", path, err)
+	}
+
+	var keys []string
+	for _, hasher := range hashers {
+		keys = append(keys, hex.EncodeToString(hasher.Sum(nil)))
+	}
+
+	return keys, nil
+}
+
+// CollectGarbage finds the blobs not referenced by any downstream repo
+// and deletes them if req.Delete is set.
+// Nothing is deleted if any repo could not be scanned
+func CollectGarbage(ctx context.Context, req *GCRequest) (*GCResult, error) {
+	var writer io.Writer = os.Stdout
+	if req.LogWriter != nil {
+		writer = req.LogWriter
+	}
+	logger := log.New(writer, "", log.LstdFlags)
+
+	for _, digest := range req.Digests {
+		if data.NewHash(digest) == nil {
+			return nil, fmt.Errorf("unsupported digest algorithm %s", digest)
+		}
+	}
+
+	if req.Delete && len(req.Packages) > 0 && !req.OnlyListedPackages {
+		return nil, fmt.Errorf("refusing to delete blobs: only %d listed packages are scanned, blobs of other packages in the storage would be deleted", len(req.Packages))
+	}
+
+	repos, err := DownstreamRepos(req.UpstreamPrefix, req.Packages)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{}
+	for _, repo := range repos {
+		logger.Printf("scanning %s", repo)
+		hashes, err := ReferencedBlobs(ctx, repo, req.Authenticator)
+		if err != nil {
+			return nil, err
+		}
+		for hash := range hashes {
+			referenced[hash] = true
+		}
+	}
+
+	result := &GCResult{
+		Repos:        len(repos),
+		Referenced:   len(referenced),
+		Unreferenced: []*GCBlob{},
+	}
+	blobs := map[string]*blob.Info{}
+	err = req.Storage.List(ctx, "", func(path string, info *blob.Info) error {
+		blobs[path] = info
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list blobs: %v", err)
+	}
+	result.Blobs = len(blobs)
+
+	linked, err := linkedBlobs(ctx, req, blobs, referenced)
+	if err != nil {
+		return nil, err
+	}
+	result.Linked = len(linked)
+
+	graceStart := time.Now().Add(-req.GracePeriod)
+	for path, info := range blobs {
+		if referenced[path] || linked[path] {
+			continue
+		}
+		if info.ModTime.After(graceStart) {
+			result.InGracePeriod++
+			continue
+		}
+
+		result.Unreferenced = append(result.Unreferenced, &GCBlob{
+			Path:    path,
+			Size:    info.Size,
+			ModTime: info.ModTime,
+		})
+	}
+	sort.Slice(result.Unreferenced, func(i, j int) bool {
+		return result.Unreferenced[i].Path < result.Unreferenced[j].Path
+	})
+	logger.Printf("%d of %d blobs are unreferenced, %d more are in the grace period and %d are aliases or copies of referenced blobs", len(result.Unreferenced), result.Blobs, result.InGracePeriod, result.Linked)
+
+	if !req.Delete {
+		return result, nil
+	}
+
+	for _, b := range result.Unreferenced {
+		err := req.Storage.Delete(ctx, b.Path)
+		if err != nil {
+			return result, fmt.Errorf("could not delete blob %s: %v", b.Path, err)
+		}
+		logger.Printf("deleted %s", b.Path)
+		result.Deleted++
+		result.DeletedBytes += b.Size
+	}
+
+	return result, nil
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+)
+
+type testCommit struct {
+	branch string
+	// tag of the commit, if set
+	tag   string
+	files map[string]string
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTestDownstream pushes commits to the bare repo rpms/<name>.git below root
+// and returns its url. Every commit builds on the previous one
+func newTestDownstream(t *testing.T, root string, name string, commits []testCommit) string {
+	path := filepath.Join(root, "rpms", name+".git")
+	if _, err := git.PlainInit(path, true); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, commit := range commits {
+		branch := plumbing.NewBranchReferenceName(commit.branch)
+		if i == 0 {
+			err = repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch))
+		} else {
+			_, err = repo.Reference(branch, false)
+			err = w.Checkout(&git.CheckoutOptions{Branch: branch, Create: err != nil})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, content := range commit.files {
+			if err := util.WriteFile(w.Filesystem, name, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, err := w.Commit("import", &git.CommitOptions{
+			Author: &object.Signature{Name: "srpmproc", Email: "srpmproc@example.com", When: time.Unix(int64(i), 0)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if commit.tag != "" {
+			if _, err := repo.CreateTag(commit.tag, hash, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	url := "file://" + path
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return url
+}
+
+// writeTestBlob stores content under path with the given modification time
+func writeTestBlob(t *testing.T, dir string, path string, content string, modTime time.Time) {
+	if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, path), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReferencedBlobs(t *testing.T) {
+	root := t.TempDir()
+	url := newTestDownstream(t, root, "foo", []testCommit{
+		{branch: "r8", files: map[string]string{".foo.metadata": sha256Hex("old") + " SOURCES/foo.tar.gz\n"}},
+		{branch: "r8", tag: "imports/r8/foo-1.0-1.el8", files: map[string]string{
+			".foo.metadata": sha256Hex("new") + " SOURCES/foo.tar.gz\n\n",
+			// only metadata files are read
+			"sources": sha256Hex("ignored") + " SOURCES/foo.tar.gz\n",
+		}},
+		{branch: "tagged", tag: "imports/r9/foo-1.0-1.el9", files: map[string]string{".foo.metadata": sha256Hex("tagged") + " SOURCES/foo.tar.gz\n"}},
+	})
+
+	// the tag keeps its commit referenced after the branch is gone
+	bare, err := git.PlainOpen(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bare.Storer.RemoveReference(plumbing.NewBranchReferenceName("tagged")); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := ReferencedBlobs(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("ReferencedBlobs: %v", err)
+	}
+	for _, content := range []string{"old", "new", "tagged"} {
+		if !hashes[sha256Hex(content)] {
+			t.Errorf("blob %q is not referenced", content)
+		}
+	}
+	if len(hashes) != 3 {
+		t.Errorf("got %d referenced blobs, want 3", len(hashes))
+	}
+
+	empty := filepath.Join(root, "rpms", "empty.git")
+	if _, err := git.PlainInit(empty, true); err != nil {
+		t.Fatal(err)
+	}
+	hashes, err = ReferencedBlobs(context.Background(), "file://"+empty, nil)
+	if err != nil || len(hashes) != 0 {
+		t.Errorf("ReferencedBlobs of an empty repo = %v, %v", hashes, err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	storageDir := t.TempDir()
+	storage := file.New(storageDir)
+
+	newTestDownstream(t, root, "foo", []testCommit{
+		{branch: "r8", files: map[string]string{".foo.metadata": sha256Hex("foo") + " SOURCES/foo.tar.gz\n"}},
+	})
+	newTestDownstream(t, root, "bar", []testCommit{
+		{branch: "r8", files: map[string]string{".bar.metadata": sha256Hex("bar") + " SOURCES/bar.tar.gz\n"}},
+	})
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	md5Sum := md5.Sum([]byte("foo"))
+	sha512Sum := sha512.Sum512([]byte("bar"))
+	blobs := map[string]string{
+		sha256Hex("foo"):                 "foo",
+		sha256Hex("bar"):                 "bar",
+		hex.EncodeToString(md5Sum[:]):    "foo",
+		hex.EncodeToString(sha512Sum[:]): "srpmproc-blob-alias:" + sha256Hex("bar") + "\n",
+		sha256Hex("orphan"):              "orphan",
+	}
+	for path, content := range blobs {
+		writeTestBlob(t, storageDir, path, content, old)
+	}
+	// an import that has not been pushed yet
+	writeTestBlob(t, storageDir, sha256Hex("pending"), "pending", time.Now())
+
+	req := &GCRequest{
+		UpstreamPrefix: "file://" + root,
+		Storage:        storage,
+		GracePeriod:    7 * 24 * time.Hour,
+		Digests:        []string{"md5"},
+		LogWriter:      io.Discard,
+	}
+	result, err := CollectGarbage(ctx, req)
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Repos != 2 || result.Referenced != 2 || result.Linked != 2 || result.Blobs != 6 || result.InGracePeriod != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(result.Unreferenced) != 1 || result.Unreferenced[0].Path != sha256Hex("orphan") {
+		t.Fatalf("unreferenced blobs %v, want only the orphan", result.Unreferenced)
+	}
+	if result.Deleted != 0 {
+		t.Errorf("deleted %d blobs without Delete", result.Deleted)
+	}
+	if exists, _ := storage.Exists(ctx, sha256Hex("orphan")); !exists {
+		t.Fatal("blob was deleted without Delete")
+	}
+
+	req.Delete = true
+	result, err = CollectGarbage(ctx, req)
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Deleted != 1 || result.DeletedBytes != int64(len("orphan")) {
+		t.Errorf("deleted %d blobs with %d bytes", result.Deleted, result.DeletedBytes)
+	}
+	var left []string
+	err = storage.List(ctx, "", func(path string, _ *blob.Info) error {
+		left = append(left, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 5 {
+		t.Errorf("%d blobs left, want 5", len(left))
+	}
+	for _, path := range left {
+		if path == sha256Hex("orphan") {
+			t.Error("unreferenced blob was not deleted")
+		}
+	}
+}
+
+func TestCollectGarbagePackageList(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	storageDir := t.TempDir()
+
+	newTestDownstream(t, root, "foo", []testCommit{
+		{branch: "r8", files: map[string]string{".foo.metadata": sha256Hex("foo") + " SOURCES/foo.tar.gz\n"}},
+	})
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	writeTestBlob(t, storageDir, sha256Hex("foo"), "foo", old)
+	// a package that is not listed
+	writeTestBlob(t, storageDir, sha256Hex("bar"), "bar", old)
+
+	req := &GCRequest{
+		UpstreamPrefix: "file://" + root,
+		Packages:       []*BatchPackage{{Name: "foo"}},
+		Storage:        file.New(storageDir),
+		LogWriter:      io.Discard,
+	}
+	result, err := CollectGarbage(ctx, req)
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Repos != 1 || len(result.Unreferenced) != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	req.Delete = true
+	_, err = CollectGarbage(ctx, req)
+	if err == nil || !strings.Contains(err.Error(), "refusing to delete") {
+		t.Fatalf("CollectGarbage with a package list = %v, want a refusal", err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, sha256Hex("bar"))); err != nil {
+		t.Fatal("blob of an unlisted package was deleted")
+	}
+
+	req.OnlyListedPackages = true
+	result, err = CollectGarbage(ctx, req)
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Deleted != 1 {
+		t.Errorf("deleted %d blobs, want 1", result.Deleted)
+	}
+}
+
+func TestDownstreamRepos(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"rpms/foo.git", "rpms/bar.git", "modules/baz.git", "rpms/not-a-repo"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repos, err := DownstreamRepos("file://"+root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(repos)
+	want := []string{
+		"file://" + root + "/modules/baz.git",
+		"file://" + root + "/rpms/bar.git",
+		"file://" + root + "/rpms/foo.git",
+	}
+	if strings.Join(repos, ",") != strings.Join(want, ",") {
+		t.Errorf("got repos %v, want %v", repos, want)
+	}
+
+	repos, err = DownstreamRepos("https://git.example.com/downstream", []*BatchPackage{{Name: "foo"}, {Name: "bar", ModuleMode: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(repos, ",") != "https://git.example.com/downstream/rpms/foo.git,https://git.example.com/downstream/modules/bar.git" {
+		t.Errorf("got repos %v", repos)
+	}
+
+	if _, err := DownstreamRepos("https://git.example.com/downstream", nil); err == nil {
+		t.Error("repos of a remote prefix have to be listed")
+	}
+}
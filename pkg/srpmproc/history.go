@@ -0,0 +1,284 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"github.com/rocky-linux/srpmproc/pkg/signing"
+)
+
+// upstreamCommitTrailer links a downstream commit to the upstream commit it was created from
+const upstreamCommitTrailer = "Upstream-Commit"
+
+var trailerRegex = regexp.MustCompile(`^[A-Za-z0-9-]+: `)
+
+// addTrailer appends a "key: value" trailer to a commit message.
+// The trailer joins the last paragraph if that already is a trailer block
+func addTrailer(message string, key string, value string) string {
+	message = strings.TrimRight(message, " \t\n")
+	trailer := fmt.Sprintf("%s: %s", key, value)
+	if message == "" {
+		return trailer + "\n"
+	}
+
+	paragraphs := strings.Split(message, "\n\n")
+	last := paragraphs[len(paragraphs)-1]
+	isTrailerBlock := len(paragraphs) > 1
+	for _, line := range strings.Split(last, "\n") {
+		if !trailerRegex.MatchString(line) {
+			isTrailerBlock = false
+			break
+		}
+	}
+	if isTrailerBlock {
+		return message + "\n" + trailer + "\n"
+	}
+
+	return message + "\n\n" + trailer + "\n"
+}
+
+// upstreamCommitOf returns the hash of the upstream commit trailer in message, if any
+func upstreamCommitOf(message string) (plumbing.Hash, bool) {
+	prefix := upstreamCommitTrailer + ": "
+	lines := strings.Split(strings.TrimRight(message, "\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.HasPrefix(lines[i], prefix) {
+			value := strings.TrimSpace(strings.TrimPrefix(lines[i], prefix))
+			if plumbing.IsHash(value) {
+				return plumbing.NewHash(value), true
+			}
+		}
+	}
+
+	return plumbing.ZeroHash, false
+}
+
+// lastUpstreamCommit walks the first parent history of the downstream branch
+// and returns the upstream commit the newest linked commit was created from
+func lastUpstreamCommit(repo *git.Repository, head plumbing.Hash) (plumbing.Hash, bool, error) {
+	for !head.IsZero() {
+		commit, err := repo.CommitObject(head)
+		if err != nil {
+			return plumbing.ZeroHash, false, fmt.Errorf("could not get downstream commit %s: %v", head, err)
+		}
+		if hash, ok := upstreamCommitOf(commit.Message); ok {
+			return hash, true, nil
+		}
+
+		head = plumbing.ZeroHash
+		if len(commit.ParentHashes) > 0 {
+			head = commit.ParentHashes[0]
+		}
+	}
+
+	return plumbing.ZeroHash, false, nil
+}
+
+// importedUpstreamCommits returns the commits of upstream import tags for upstreamBranch,
+// except the tag currently being imported
+func importedUpstreamCommits(repo *git.Repository, upstreamBranch string, currentTag string) (map[plumbing.Hash]bool, error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("could not list upstream tags: %v", err)
+	}
+
+	prefix := fmt.Sprintf("refs/tags/imports/%s/", upstreamBranch)
+	commits := map[plumbing.Hash]bool{}
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, prefix) || name == currentTag {
+			return nil
+		}
+
+		hash := ref.Hash()
+		tag, err := repo.TagObject(hash)
+		if err == nil {
+			commit, err := tag.Commit()
+			if err != nil {
+				return nil
+			}
+			hash = commit.Hash
+		}
+		commits[hash] = true
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read upstream tags: %v", err)
+	}
+
+	return commits, nil
+}
+
+// upstreamHistory returns the first parent chain of upstream commits leading to tip, oldest first.
+// The chain stops at base, or if base is zero at the previous import tag of upstreamBranch.
+// Nothing is returned if base is set but not an ancestor of tip
+func upstreamHistory(pd *data.ProcessData, repo *git.Repository, upstreamBranch string, currentTag string, tip plumbing.Hash, base plumbing.Hash) ([]*object.Commit, error) {
+	if tip == base {
+		return nil, nil
+	}
+
+	var stop map[plumbing.Hash]bool
+	if base.IsZero() {
+		var err error
+		stop, err = importedUpstreamCommits(repo, upstreamBranch, currentTag)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		stop = map[plumbing.Hash]bool{base: true}
+	}
+
+	var commits []*object.Commit
+	hash := tip
+	for {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("could not get upstream commit %s: %v", hash, err)
+		}
+		commits = append(commits, commit)
+		if len(commit.ParentHashes) == 0 {
+			if !base.IsZero() {
+				pd.Log.Printf("previously imported upstream commit %s is not an ancestor of %s, not replaying history", base, tip)
+				return nil, nil
+			}
+			break
+		}
+
+		hash = commit.ParentHashes[0]
+		if stop[hash] {
+			break
+		}
+	}
+
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+
+	return commits, nil
+}
+
+// copyTree copies a tree and everything it references from one object storage to another
+func copyTree(from storer.EncodedObjectStorer, to storer.EncodedObjectStorer, hash plumbing.Hash) error {
+	if to.HasEncodedObject(hash) == nil {
+		return nil
+	}
+
+	tree, err := object.GetTree(from, hash)
+	if err != nil {
+		return fmt.Errorf("could not get upstream tree %s: %v", hash, err)
+	}
+	for _, entry := range tree.Entries {
+		switch entry.Mode {
+		case filemode.Submodule:
+			continue
+		case filemode.Dir:
+			err := copyTree(from, to, entry.Hash)
+			if err != nil {
+				return err
+			}
+		default:
+			err := copyObject(from, to, entry.Hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return copyObject(from, to, hash)
+}
+
+func copyObject(from storer.EncodedObjectStorer, to storer.EncodedObjectStorer, hash plumbing.Hash) error {
+	if to.HasEncodedObject(hash) == nil {
+		return nil
+	}
+
+	obj, err := from.EncodedObject(plumbing.AnyObject, hash)
+	if err != nil {
+		return fmt.Errorf("could not get upstream object %s: %v", hash, err)
+	}
+	_, err = to.SetEncodedObject(obj)
+	if err != nil {
+		return fmt.Errorf("could not store object %s: %v", hash, err)
+	}
+
+	return nil
+}
+
+// replayHistory recreates commits on top of parent in repo.
+// Trees, authors and messages are kept as is, a trailer links back to the upstream commit.
+// Replayed commits are signed like the import commit
+// Returns the last replayed commit, or parent if there was nothing to replay
+func replayHistory(pd *data.ProcessData, repo *git.Repository, upstream *git.Repository, commits []*object.Commit, parent plumbing.Hash) (plumbing.Hash, error) {
+	for _, upstreamCommit := range commits {
+		err := copyTree(upstream.Storer, repo.Storer, upstreamCommit.TreeHash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		when := time.Now()
+		if pd.Reproducible {
+			when = upstreamCommit.Committer.When
+		}
+		commit := &object.Commit{
+			Author: upstreamCommit.Author,
+			Committer: object.Signature{
+				Name:  pd.GitCommitterName,
+				Email: pd.GitCommitterEmail,
+				When:  when,
+			},
+			Message:  addTrailer(upstreamCommit.Message, upstreamCommitTrailer, upstreamCommit.Hash.String()),
+			TreeHash: upstreamCommit.TreeHash,
+		}
+		if !parent.IsZero() {
+			commit.ParentHashes = []plumbing.Hash{parent}
+		}
+		if pd.Signer != nil {
+			err := signing.SignCommit(pd.Signer, commit)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+		}
+
+		obj := repo.Storer.NewEncodedObject()
+		err = commit.Encode(obj)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("could not encode commit: %v", err)
+		}
+		parent, err = repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("could not store commit: %v", err)
+		}
+		pd.Log.Printf("replayed upstream commit %s as %s", upstreamCommit.Hash, parent)
+	}
+
+	return parent, nil
+}
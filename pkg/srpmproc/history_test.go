@@ -0,0 +1,306 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+func TestAddTrailer(t *testing.T) {
+	for _, tt := range []struct {
+		message string
+		want    string
+	}{
+		{"", "Key: value\n"},
+		{"subject", "subject\n\nKey: value\n"},
+		{"subject\n", "subject\n\nKey: value\n"},
+		{"subject\n\nbody\nmore body\n\n", "subject\n\nbody\nmore body\n\nKey: value\n"},
+		{"subject\n\nSigned-off-by: A <a@example.com>\n", "subject\n\nSigned-off-by: A <a@example.com>\nKey: value\n"},
+		{
+			"subject\n\nbody\n\nResolves: RHEL-1\nSigned-off-by: A <a@example.com>",
+			"subject\n\nbody\n\nResolves: RHEL-1\nSigned-off-by: A <a@example.com>\nKey: value\n",
+		},
+		// a subject alone is never a trailer block
+		{"Resolves: RHEL-1", "Resolves: RHEL-1\n\nKey: value\n"},
+		// a paragraph mixing trailers and text is not a trailer block
+		{"subject\n\nResolves: RHEL-1\nsome text", "subject\n\nResolves: RHEL-1\nsome text\n\nKey: value\n"},
+	} {
+		if got := addTrailer(tt.message, "Key", "value"); got != tt.want {
+			t.Errorf("addTrailer(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamCommitOf(t *testing.T) {
+	hash := strings.Repeat("ab", 20)
+	other := strings.Repeat("cd", 20)
+	for _, tt := range []struct {
+		message string
+		want    string
+	}{
+		{"import foo-1.0-1.el8\n", ""},
+		{"subject\n\nUpstream-Commit: " + hash + "\n", hash},
+		{"subject\n\nUpstream-Commit: " + hash + "  \nSigned-off-by: A <a@example.com>\n", hash},
+		// the last trailer wins
+		{"subject\n\nUpstream-Commit: " + other + "\nUpstream-Commit: " + hash, hash},
+		{"subject\n\nUpstream-Commit: not-a-hash\n", ""},
+		{"subject\n\nupstream-commit: " + hash + "\n", ""},
+	} {
+		got, ok := upstreamCommitOf(tt.message)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("upstreamCommitOf(%q) = %s, want none", tt.message, got)
+			}
+			continue
+		}
+		if !ok || got.String() != tt.want {
+			t.Errorf("upstreamCommitOf(%q) = %s, %v, want %s", tt.message, got, ok, tt.want)
+		}
+	}
+}
+
+type testHistory struct {
+	t    *testing.T
+	repo *git.Repository
+	w    *git.Worktree
+	n    int
+}
+
+func newTestHistory(t *testing.T) *testHistory {
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testHistory{t: t, repo: repo, w: w}
+}
+
+// commit adds a commit changing foo.spec on the current branch
+func (h *testHistory) commit(message string) plumbing.Hash {
+	h.n++
+	err := util.WriteFile(h.w.Filesystem, "foo.spec", []byte(strings.Repeat("x", h.n)), 0o644)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if _, err := h.w.Add("foo.spec"); err != nil {
+		h.t.Fatal(err)
+	}
+
+	when := time.Unix(int64(1600000000+h.n*60), 0).UTC()
+	hash, err := h.w.Commit(message, &git.CommitOptions{
+		Author:    &object.Signature{Name: "Upstream Author", Email: "author@example.com", When: when},
+		Committer: &object.Signature{Name: "Upstream Committer", Email: "committer@example.com", When: when.Add(time.Minute)},
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return hash
+}
+
+func testProcessData() *data.ProcessData {
+	return &data.ProcessData{
+		Log:               log.New(io.Discard, "", 0),
+		GitCommitterName:  "importer",
+		GitCommitterEmail: "importer@example.com",
+	}
+}
+
+func commitHashes(commits []*object.Commit) []plumbing.Hash {
+	var hashes []plumbing.Hash
+	for _, commit := range commits {
+		hashes = append(hashes, commit.Hash)
+	}
+
+	return hashes
+}
+
+func TestUpstreamHistory(t *testing.T) {
+	h := newTestHistory(t)
+	var c []plumbing.Hash
+	for i := 0; i < 5; i++ {
+		c = append(c, h.commit("change"))
+	}
+	// c[1] was imported before, c[4] is being imported
+	const currentTag = "refs/tags/imports/c8/foo-1.0-2.el8"
+	if _, err := h.repo.CreateTag("imports/c8/foo-1.0-1.el8", c[1], &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "tagger", When: time.Unix(0, 0)},
+		Message: "annotated",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.repo.CreateTag("imports/c8/foo-1.0-2.el8", c[4], nil); err != nil {
+		t.Fatal(err)
+	}
+	// tags of other branches are not a stop
+	if _, err := h.repo.CreateTag("imports/c9/foo-1.0-1.el9", c[2], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a commit that is not part of the history of c[4]
+	orphan := &object.Commit{
+		Author:    object.Signature{Name: "a", When: time.Unix(0, 0)},
+		Committer: object.Signature{Name: "a", When: time.Unix(0, 0)},
+		Message:   "orphan",
+	}
+	head, err := h.repo.CommitObject(c[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan.TreeHash = head.TreeHash
+	obj := h.repo.Storer.NewEncodedObject()
+	if err := orphan.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	orphanHash, err := h.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		branch string
+		tip    plumbing.Hash
+		base   plumbing.Hash
+		want   []plumbing.Hash
+	}{
+		{"previous import tag", "c8", c[4], plumbing.ZeroHash, c[2:]},
+		{"no previous import", "c10", c[4], plumbing.ZeroHash, c},
+		{"base", "c8", c[4], c[2], c[3:]},
+		{"base of the tag", "c8", c[4], c[1], c[2:]},
+		{"base is the tip", "c8", c[4], c[4], nil},
+		{"base is not an ancestor", "c8", c[4], orphanHash, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			commits, err := upstreamHistory(testProcessData(), h.repo, tt.branch, currentTag, tt.tip, tt.base)
+			if err != nil {
+				t.Fatalf("upstreamHistory: %v", err)
+			}
+			got := commitHashes(commits)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	upstream := newTestHistory(t)
+	upstream.commit("first")
+	second := upstream.commit("second change\n\nResolves: RHEL-1\n")
+	third := upstream.commit("third change")
+	commits, err := upstreamHistory(testProcessData(), upstream.repo, "c8", "", third, plumbing.ZeroHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits = commits[1:]
+
+	for _, reproducible := range []bool{false, true} {
+		repo, err := git.Init(memory.NewStorage(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pd := testProcessData()
+		pd.Reproducible = reproducible
+
+		tip, err := replayHistory(pd, repo, upstream.repo, commits, plumbing.ZeroHash)
+		if err != nil {
+			t.Fatalf("replayHistory: %v", err)
+		}
+
+		replayed, err := repo.CommitObject(tip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []*object.Commit
+		for {
+			got = append([]*object.Commit{replayed}, got...)
+			if replayed.NumParents() == 0 {
+				break
+			}
+			replayed, err = replayed.Parent(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(got) != 2 {
+			t.Fatalf("replayed %d commits, want 2", len(got))
+		}
+
+		for i, commit := range got {
+			original := commits[i]
+			if commit.TreeHash != original.TreeHash {
+				t.Errorf("tree of commit %d is %s, want %s", i, commit.TreeHash, original.TreeHash)
+			}
+			if _, err := commit.Tree(); err != nil {
+				t.Errorf("tree of commit %d was not copied: %v", i, err)
+			}
+			if commit.Author.Name != original.Author.Name || commit.Author.Email != original.Author.Email || !commit.Author.When.Equal(original.Author.When) {
+				t.Errorf("author of commit %d is %v, want %v", i, commit.Author, original.Author)
+			}
+			if commit.Committer.Name != "importer" || commit.Committer.Email != "importer@example.com" {
+				t.Errorf("committer of commit %d is %v", i, commit.Committer)
+			}
+			if reproducible != commit.Committer.When.Equal(original.Committer.When) {
+				t.Errorf("committer time of commit %d is %s, upstream %s", i, commit.Committer.When, original.Committer.When)
+			}
+			if hash, ok := upstreamCommitOf(commit.Message); !ok || hash != original.Hash {
+				t.Errorf("commit %d links to %s, want %s", i, hash, original.Hash)
+			}
+		}
+		if want := "second change\n\nResolves: RHEL-1\nUpstream-Commit: " + second.String() + "\n"; got[0].Message != want {
+			t.Errorf("message %q, want %q", got[0].Message, want)
+		}
+	}
+}
+
+func TestPreserveHistoryTagless(t *testing.T) {
+	for _, req := range []*ProcessDataRequest{
+		{Package: "foo", PreserveHistory: true, TaglessMode: true},
+		{Package: "foo", PreserveHistory: true, ManualCommits: "c9s:" + strings.Repeat("ab", 20)},
+	} {
+		_, err := NewProcessData(req)
+		if err == nil || !strings.Contains(err.Error(), "tagless") {
+			t.Errorf("NewProcessData = %v, want an error about tagless imports", err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// LookasideMirrorConfig is a file listing lookaside mirrors in the order they are tried
+type LookasideMirrorConfig struct {
+	Mirrors []*data.LookasideMirror `json:"mirrors" yaml:"mirrors"`
+}
+
+// ReadLookasideMirrors reads a YAML or JSON lookaside mirror file
+func ReadLookasideMirrors(path string) ([]*data.LookasideMirror, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lookaside mirrors: %v", err)
+	}
+	defer f.Close()
+
+	var config LookasideMirrorConfig
+	// JSON is valid YAML, so one decoder covers both
+	err = yaml.NewDecoder(f).Decode(&config)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not decode lookaside mirrors: %v", err)
+	}
+
+	return config.Mirrors, nil
+}
+
+// resolveLookasideMirrors validates mirrors and expands distro names into the mirrors of their profile.
+// The mirrors are copied, so requests sharing a mirror list can be resolved concurrently
+func resolveLookasideMirrors(mirrors []*data.LookasideMirror) ([]*data.LookasideMirror, error) {
+	var resolved []*data.LookasideMirror
+	for i, mirror := range mirrors {
+		if mirror == nil {
+			return nil, fmt.Errorf("lookaside mirror %d is empty", i)
+		}
+
+		if mirror.BearerToken != "" && mirror.Username != "" {
+			return nil, fmt.Errorf("lookaside mirror %d sets both basic auth and a bearer token", i)
+		}
+
+		if mirror.Cdn != "" {
+			if mirror.Url != "" {
+				return nil, fmt.Errorf("lookaside mirror %d sets both url and cdn", i)
+			}
+			profile, found := FindLookaside(mirror.Cdn)
+			if !found {
+				return nil, fmt.Errorf("lookaside mirror %d: unknown cdn distro %s", i, mirror.Cdn)
+			}
+			resolved = append(resolved, profileMirrors(profile, *mirror)...)
+			continue
+		}
+		if mirror.Url == "" {
+			return nil, fmt.Errorf("lookaside mirror %d has no url", i)
+		}
+
+		m := *mirror
+		resolved = append(resolved, &m)
+	}
+
+	return resolved, nil
+}
+
+var (
+	lookasideProfilesMu sync.RWMutex
+	lookasideProfiles   []LookasidePath
+)
+
+// RegisterLookasides makes profiles available as --cdn values.
+// Registered profiles take precedence over built-in distros and earlier registrations of the same name
+func RegisterLookasides(profiles ...LookasidePath) error {
+	for i, profile := range profiles {
+		if profile.Distro == "" {
+			return fmt.Errorf("lookaside profile %d has no name", i)
+		}
+		if profile.Url == "" {
+			return fmt.Errorf("lookaside profile %s has no url", profile.Distro)
+		}
+	}
+
+	lookasideProfilesMu.Lock()
+	defer lookasideProfilesMu.Unlock()
+	// newest first, so later registrations win
+	for _, profile := range profiles {
+		lookasideProfiles = append([]LookasidePath{profile}, lookasideProfiles...)
+	}
+
+	return nil
+}
+
+// LoadLookasideProfiles registers the lookaside profiles listed under "lookasides" in a YAML, TOML or JSON file
+func LoadLookasideProfiles(path string) error {
+	v := viper.New()
+	v.SetConfigFile(path)
+	err := v.ReadInConfig()
+	if err != nil {
+		return fmt.Errorf("could not read lookaside profiles: %v", err)
+	}
+
+	var profiles []LookasidePath
+	err = v.UnmarshalKey("lookasides", &profiles)
+	if err != nil {
+		return fmt.Errorf("could not decode lookaside profiles: %v", err)
+	}
+
+	return RegisterLookasides(profiles...)
+}
+
+// Lookasides returns all known lookaside profiles, registered profiles first
+func Lookasides() []LookasidePath {
+	lookasideProfilesMu.RLock()
+	defer lookasideProfilesMu.RUnlock()
+
+	return append(append([]LookasidePath{}, lookasideProfiles...), StaticLookasides()...)
+}
+
+// FindLookaside returns the lookaside profile named cdn
+func FindLookaside(cdn string) (*LookasidePath, bool) {
+	for _, profile := range Lookasides() {
+		if strings.ToLower(profile.Distro) == strings.ToLower(cdn) {
+			return &profile, true
+		}
+	}
+
+	return nil, false
+}
+
+// applyLookasideProfile points req at the lookaside of profile and
+// fills in the request fields that are not set with the profile defaults
+func applyLookasideProfile(req *ProcessDataRequest, profile *LookasidePath) {
+	req.CdnUrl = profile.Url
+	if req.BranchPrefix == "" {
+		req.BranchPrefix = profile.BranchPrefix
+	}
+	if req.ImportBranchPrefix == "" {
+		req.ImportBranchPrefix = profile.ImportBranchPrefix
+	}
+	if req.RpmPrefix == "" {
+		req.RpmPrefix = profile.RpmPrefix
+	}
+	if req.ModulePrefix == "" {
+		req.ModulePrefix = profile.ModulePrefix
+	}
+
+	// fallbacks and hash types need the mirror chain, explicit mirrors still win
+	if len(req.LookasideMirrors) == 0 && (len(profile.Fallbacks) > 0 || len(profile.HashTypes) > 0) {
+		req.LookasideMirrors = []*data.LookasideMirror{{Cdn: profile.Distro}}
+	}
+}
+
+// profileMirrors expands a profile into a mirror for its url and every fallback.
+// Auth and headers are taken from mirror
+func profileMirrors(profile *LookasidePath, mirror data.LookasideMirror) []*data.LookasideMirror {
+	mirror.Cdn = ""
+	if len(mirror.HashTypes) == 0 {
+		mirror.HashTypes = profile.HashTypes
+	}
+
+	var mirrors []*data.LookasideMirror
+	for _, url := range append([]string{profile.Url}, profile.Fallbacks...) {
+		m := mirror
+		m.Url = url
+		mirrors = append(mirrors, &m)
+	}
+
+	return mirrors
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+// resetLookasides restores the registered lookaside profiles when the test ends
+func resetLookasides(t *testing.T) {
+	lookasideProfilesMu.Lock()
+	saved := lookasideProfiles
+	lookasideProfilesMu.Unlock()
+
+	t.Cleanup(func() {
+		lookasideProfilesMu.Lock()
+		lookasideProfiles = saved
+		lookasideProfilesMu.Unlock()
+	})
+}
+
+func TestRegisterLookasides(t *testing.T) {
+	resetLookasides(t)
+
+	for _, tt := range []struct {
+		profiles []LookasidePath
+		err      string
+	}{
+		{[]LookasidePath{{Url: "https://lookaside/{{.Hash}}"}}, "lookaside profile 0 has no name"},
+		{[]LookasidePath{{Distro: "valid", Url: "https://valid/{{.Hash}}"}, {Distro: "internal"}}, "lookaside profile internal has no url"},
+	} {
+		err := RegisterLookasides(tt.profiles...)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("RegisterLookasides error = %v, want %q", err, tt.err)
+		}
+	}
+	// nothing is registered if a profile is invalid
+	if _, found := FindLookaside("valid"); found {
+		t.Fatal("a profile of a rejected registration was registered")
+	}
+
+	err := RegisterLookasides(
+		LookasidePath{Distro: "internal", Url: "https://internal/{{.Hash}}"},
+		LookasidePath{Distro: "centos", Url: "https://centos-mirror/{{.Hash}}"},
+	)
+	if err != nil {
+		t.Fatalf("RegisterLookasides: %v", err)
+	}
+	err = RegisterLookasides(LookasidePath{Distro: "Internal", Url: "https://internal-v2/{{.Hash}}"})
+	if err != nil {
+		t.Fatalf("RegisterLookasides: %v", err)
+	}
+
+	for cdn, want := range map[string]string{
+		// later registrations win, names are case insensitive
+		"internal": "https://internal-v2/{{.Hash}}",
+		// registered profiles win over built-in distros
+		"CentOS": "https://centos-mirror/{{.Hash}}",
+		"rocky":  "https://sources.build.resf.org/{{.Hash}}",
+	} {
+		url, found := FindDistro(cdn)
+		if !found || url != want {
+			t.Errorf("FindDistro(%s) = %q, %v, want %q", cdn, url, found, want)
+		}
+	}
+	if _, found := FindDistro("unknown"); found {
+		t.Error("FindDistro found an unknown distro")
+	}
+
+	lookasides := Lookasides()
+	if len(lookasides) != 3+len(StaticLookasides()) || lookasides[0].Url != "https://internal-v2/{{.Hash}}" {
+		t.Errorf("Lookasides = %v, want the registered profiles first", lookasides)
+	}
+}
+
+func TestResolveLookasideMirrors(t *testing.T) {
+	resetLookasides(t)
+	err := RegisterLookasides(LookasidePath{
+		Distro:    "internal",
+		Url:       "https://internal/{{.Hash}}",
+		Fallbacks: []string{"https://fallback/{{.Hash}}"},
+		HashTypes: []string{"sha512"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mirrors := []*data.LookasideMirror{
+		{Url: "https://first"},
+		{Cdn: "internal", BearerToken: "token"},
+	}
+	resolved, err := resolveLookasideMirrors(mirrors)
+	if err != nil {
+		t.Fatalf("resolveLookasideMirrors: %v", err)
+	}
+	if len(resolved) != 3 {
+		t.Fatalf("resolved %d mirrors, want 3", len(resolved))
+	}
+	for i, url := range []string{"https://first", "https://internal/{{.Hash}}", "https://fallback/{{.Hash}}"} {
+		if resolved[i].Url != url || resolved[i].Cdn != "" {
+			t.Errorf("mirror %d = %+v, want url %s", i, resolved[i], url)
+		}
+	}
+	for _, mirror := range resolved[1:] {
+		if mirror.BearerToken != "token" || strings.Join(mirror.HashTypes, ",") != "sha512" {
+			t.Errorf("profile mirror = %+v, want the auth of the entry and the hash types of the profile", mirror)
+		}
+	}
+	if resolved[0] == mirrors[0] {
+		t.Error("mirrors were not copied")
+	}
+
+	for _, tt := range []struct {
+		mirror *data.LookasideMirror
+		err    string
+	}{
+		{nil, "lookaside mirror 0 is empty"},
+		{&data.LookasideMirror{}, "lookaside mirror 0 has no url"},
+		{&data.LookasideMirror{Url: "https://a", Cdn: "internal"}, "sets both url and cdn"},
+		{&data.LookasideMirror{Cdn: "unknown"}, "unknown cdn distro unknown"},
+		{&data.LookasideMirror{Url: "https://a", Username: "user", BearerToken: "token"}, "both basic auth and a bearer token"},
+	} {
+		_, err := resolveLookasideMirrors([]*data.LookasideMirror{tt.mirror})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("resolveLookasideMirrors(%+v) error = %v, want %q", tt.mirror, err, tt.err)
+		}
+	}
+}
+
+const testLookasideProfiles = `lookasides:
+  - name: almalinux
+    url: "https://sources.almalinux.org/{{.Name}}/{{.Hash}}"
+    fallbacks:
+      - "https://sources.almalinux.org/{{.Hash}}"
+    rpm_prefix: "https://git.almalinux.org/rpms"
+    module_prefix: "https://git.almalinux.org/modules"
+    import_branch_prefix: "a"
+    branch_prefix: "al"
+  - name: plain
+    url: "https://plain/{{.Hash}}"
+`
+
+func TestLoadLookasideProfiles(t *testing.T) {
+	resetLookasides(t)
+	path := filepath.Join(t.TempDir(), "lookasides.yaml")
+	if err := os.WriteFile(path, []byte(testLookasideProfiles), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := LoadLookasideProfiles(path)
+	if err != nil {
+		t.Fatalf("LoadLookasideProfiles: %v", err)
+	}
+	profile, found := FindLookaside("almalinux")
+	if !found {
+		t.Fatal("profile almalinux was not registered")
+	}
+	want := LookasidePath{
+		Distro:             "almalinux",
+		Url:                "https://sources.almalinux.org/{{.Name}}/{{.Hash}}",
+		Fallbacks:          []string{"https://sources.almalinux.org/{{.Hash}}"},
+		BranchPrefix:       "al",
+		ImportBranchPrefix: "a",
+		RpmPrefix:          "https://git.almalinux.org/rpms",
+		ModulePrefix:       "https://git.almalinux.org/modules",
+	}
+	if fmt.Sprintf("%+v", *profile) != fmt.Sprintf("%+v", want) {
+		t.Fatalf("profile = %+v, want %+v", *profile, want)
+	}
+
+	for name, content := range map[string]string{
+		"missing url": "lookasides:\n  - name: broken\n",
+		"invalid":     "lookasides: [",
+	} {
+		path := filepath.Join(t.TempDir(), "lookasides.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadLookasideProfiles(path); err == nil {
+			t.Errorf("LoadLookasideProfiles of a %s profile file succeeded", name)
+		}
+	}
+	if err := LoadLookasideProfiles(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadLookasideProfiles of a missing file succeeded")
+	}
+}
+
+func TestApplyLookasideProfile(t *testing.T) {
+	resetLookasides(t)
+	path := filepath.Join(t.TempDir(), "lookasides.yaml")
+	if err := os.WriteFile(path, []byte(testLookasideProfiles), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadLookasideProfiles(path); err != nil {
+		t.Fatal(err)
+	}
+	almalinux, _ := FindLookaside("almalinux")
+	plain, _ := FindLookaside("plain")
+
+	// the profile fills in every empty field
+	req := &ProcessDataRequest{CdnUrl: "https://ignored"}
+	applyLookasideProfile(req, almalinux)
+	if req.CdnUrl != almalinux.Url || req.BranchPrefix != "al" || req.ImportBranchPrefix != "a" ||
+		req.RpmPrefix != "https://git.almalinux.org/rpms" || req.ModulePrefix != "https://git.almalinux.org/modules" {
+		t.Errorf("request with defaults = %+v", req)
+	}
+	// fallbacks are tried through the mirror chain
+	if len(req.LookasideMirrors) != 1 || req.LookasideMirrors[0].Cdn != "almalinux" {
+		t.Errorf("LookasideMirrors = %v, want the almalinux profile", req.LookasideMirrors)
+	}
+
+	// explicit values win over the profile defaults
+	mirrors := []*data.LookasideMirror{{Url: "https://explicit"}}
+	req = &ProcessDataRequest{
+		BranchPrefix:       "r",
+		ImportBranchPrefix: "c",
+		RpmPrefix:          "https://git.example.com/rpms",
+		LookasideMirrors:   mirrors,
+	}
+	applyLookasideProfile(req, almalinux)
+	if req.BranchPrefix != "r" || req.ImportBranchPrefix != "c" || req.RpmPrefix != "https://git.example.com/rpms" {
+		t.Errorf("explicit values were replaced: %+v", req)
+	}
+	if req.ModulePrefix != "https://git.almalinux.org/modules" {
+		t.Errorf("ModulePrefix = %s, want the profile default", req.ModulePrefix)
+	}
+	if len(req.LookasideMirrors) != 1 || req.LookasideMirrors[0] != mirrors[0] {
+		t.Errorf("explicit mirrors were replaced: %v", req.LookasideMirrors)
+	}
+
+	// a profile without defaults leaves the fields empty for the built-in defaults
+	req = &ProcessDataRequest{}
+	applyLookasideProfile(req, plain)
+	if req.CdnUrl != plain.Url || req.BranchPrefix != "" || req.RpmPrefix != "" || req.LookasideMirrors != nil {
+		t.Errorf("request with a plain profile = %+v", req)
+	}
+}
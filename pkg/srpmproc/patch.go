@@ -21,6 +21,7 @@
 package srpmproc
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -44,7 +45,7 @@ import (
 	"google.golang.org/protobuf/encoding/prototext"
 )
 
-func cfgPatches(pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
+func cfgPatches(ctx context.Context, pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
 	// check CFG patches
 	// use PATCHES directory if it exists otherwise ROCKY/CFG
 	cfgdir := "PATCHES"
@@ -83,18 +84,19 @@ func cfgPatches(pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree
 				return fmt.Errorf("could not unmarshal cfg file: %v", err)
 			}
 
-			errs := directives.Apply(&cfg, pd, md, patchTree, pushTree)
+			errs := directives.Apply(ctx, &cfg, pd, md, patchTree, pushTree)
 			if errs != nil {
 				fmt.Printf("errors: %v\n", errs)
 				return fmt.Errorf("directives could not be applied")
 			}
+			md.Directives = append(md.Directives, filePath)
 		}
 	}
 
 	return nil
 }
 
-func applyPatches(pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
+func applyPatches(ctx context.Context, pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktree, pushTree *git.Worktree) error {
 	// check if patches exist
 	cfgdir := "PATCHES"
 	_, err := patchTree.Filesystem.Stat(cfgdir)
@@ -103,7 +105,7 @@ func applyPatches(pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktr
 	}
 	_, err = patchTree.Filesystem.Stat(cfgdir)
 	if err == nil {
-		err := cfgPatches(pd, md, patchTree, pushTree)
+		err := cfgPatches(ctx, pd, md, patchTree, pushTree)
 		if err != nil {
 			return err
 		}
@@ -112,7 +114,10 @@ func applyPatches(pd *data.ProcessData, md *data.ModeData, patchTree *git.Worktr
 	return nil
 }
 
-func executePatchesRpm(pd *data.ProcessData, md *data.ModeData) error {
+func executePatchesRpm(ctx context.Context, pd *data.ProcessData, md *data.ModeData) error {
+	md.PatchCommit = ""
+	md.Directives = nil
+
 	// fetch patch repository
 	repo, err := git.Init(memory.NewStorage(), memfs.New())
 	if err != nil {
@@ -143,16 +148,23 @@ func executePatchesRpm(pd *data.ProcessData, md *data.ModeData) error {
 	if !strings.HasPrefix(pd.UpstreamPrefix, "http") {
 		fetchOptions.Auth = pd.Authenticator
 	}
-	err = repo.Fetch(fetchOptions)
+	err = repo.FetchContext(ctx, fetchOptions)
 
 	refName := plumbing.NewBranchReferenceName(md.PushBranch)
 	pd.Log.Printf("set reference to ref: %s", refName)
 
 	if err != nil {
+		// a cancelled fetch does not mean there are no patches
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err == transport.ErrInvalidAuthMethod || err == transport.ErrAuthenticationRequired {
 			fetchOptions.Auth = nil
-			err = repo.Fetch(fetchOptions)
+			err = repo.FetchContext(ctx, fetchOptions)
 			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
 				// no patches active
 				log.Println("info: patch repo not found")
 				return nil
@@ -170,10 +182,11 @@ func executePatchesRpm(pd *data.ProcessData, md *data.ModeData) error {
 	})
 	// common patches found, apply them
 	if err == nil {
-		err := applyPatches(pd, md, w, md.Worktree)
+		err := applyPatches(ctx, pd, md, w, md.Worktree)
 		if err != nil {
 			return err
 		}
+		md.PatchCommit = patchCommit(repo)
 	} else {
 		log.Println("info: no common patches found")
 	}
@@ -184,10 +197,11 @@ func executePatchesRpm(pd *data.ProcessData, md *data.ModeData) error {
 	})
 	// branch specific patches found, apply them
 	if err == nil {
-		err := applyPatches(pd, md, w, md.Worktree)
+		err := applyPatches(ctx, pd, md, w, md.Worktree)
 		if err != nil {
 			return err
 		}
+		md.PatchCommit = patchCommit(repo)
 	} else {
 		log.Println("info: no branch specific patches found")
 	}
@@ -195,7 +209,17 @@ func executePatchesRpm(pd *data.ProcessData, md *data.ModeData) error {
 	return nil
 }
 
-func getTipStream(pd *data.ProcessData, module string, pushBranch string, origPushBranch string, tries int) (string, error) {
+// patchCommit returns the checked out commit of the patch repository
+func patchCommit(repo *git.Repository) string {
+	head, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+
+	return head.Hash().String()
+}
+
+func getTipStream(ctx context.Context, pd *data.ProcessData, module string, pushBranch string, origPushBranch string, tries int) (string, error) {
 	repo, err := git.Init(memory.NewStorage(), memfs.New())
 	if err != nil {
 		return "", fmt.Errorf("could not init git Repo: %v", err)
@@ -212,15 +236,19 @@ func getTipStream(pd *data.ProcessData, module string, pushBranch string, origPu
 		return "", fmt.Errorf("could not create remote: %v", err)
 	}
 
-	list, err := remote.List(&git.ListOptions{
+	list, err := remote.ListContext(ctx, &git.ListOptions{
 		Auth: pd.Authenticator,
 	})
 	if err != nil {
 		pd.Log.Printf("could not import module: %s", module)
-		if tries < 3 {
+		if tries < 3 && ctx.Err() == nil {
 			pd.Log.Printf("could not get rpm refs. will retry in 3s. %v", err)
-			time.Sleep(3 * time.Second)
-			return getTipStream(pd, module, pushBranch, origPushBranch, tries+1)
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(3 * time.Second):
+			}
+			return getTipStream(ctx, pd, module, pushBranch, origPushBranch, tries+1)
 		}
 
 		return "", fmt.Errorf("could not get rpm refs. import the rpm before the module: %v", err)
@@ -286,7 +314,7 @@ func getTipStream(pd *data.ProcessData, module string, pushBranch string, origPu
 	return strings.TrimSpace(tipHash), nil
 }
 
-func patchModuleYaml(pd *data.ProcessData, md *data.ModeData) error {
+func patchModuleYaml(ctx context.Context, pd *data.ProcessData, md *data.ModeData) error {
 	// special case for platform.yaml
 	_, err := md.Worktree.Filesystem.Open("platform.yaml")
 	if err == nil {
@@ -371,7 +399,13 @@ func patchModuleYaml(pd *data.ProcessData, md *data.ModeData) error {
 		// TODO: maybe point to correct release tag? but refer to latest for now,
 		// we're bootstrapping a new distro for latest RHEL8 anyways. So earlier
 		// versions are not that important
-		if strings.HasPrefix(rpm.Ref, "stream-rhel-rhel-") {
+		if pd.BranchRules != nil {
+			// components that no rule matches use the branch of the module
+			pushBranch = defaultBranch
+			if match := pd.BranchRules.Component(rpm.Ref); match.Ok() {
+				pushBranch = match.Target
+			}
+		} else if strings.HasPrefix(rpm.Ref, "stream-rhel-rhel-") {
 			pushBranch = defaultBranch
 		} else if strings.HasPrefix(rpm.Ref, "stream-rhel-") && len(split) > 4 {
 			repString := fmt.Sprintf("%s%ss-", pd.BranchPrefix, string(split[4][0]))
@@ -390,13 +424,13 @@ func patchModuleYaml(pd *data.ProcessData, md *data.ModeData) error {
 			return fmt.Errorf("could not recognize modulemd ref")
 		}
 
-		tipHash, err = getTipStream(pd, name, pushBranch, md.PushBranch, 0)
+		tipHash, err = getTipStream(ctx, pd, name, pushBranch, md.PushBranch, 0)
 		if err != nil {
 			return err
 		}
 		if tipHash == "0000000000000000000000000000000000000000" {
 			pushBranch = defaultBranch
-			tipHash, err = getTipStream(pd, name, pushBranch, md.PushBranch, 0)
+			tipHash, err = getTipStream(ctx, pd, name, pushBranch, md.PushBranch, 0)
 			if err != nil {
 				return err
 			}
@@ -21,15 +21,17 @@
 package srpmproc
 
 import (
-	"bufio"
+	"context"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -42,12 +44,17 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	srpmprocpb "github.com/rocky-linux/srpmproc/pb"
 	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/diskcache"
+	"github.com/rocky-linux/srpmproc/pkg/blob/envelope"
 	"github.com/rocky-linux/srpmproc/pkg/blob/file"
 	"github.com/rocky-linux/srpmproc/pkg/blob/gcs"
+	"github.com/rocky-linux/srpmproc/pkg/blob/oci"
 	"github.com/rocky-linux/srpmproc/pkg/blob/s3"
+	"github.com/rocky-linux/srpmproc/pkg/blob/webdav"
 	"github.com/rocky-linux/srpmproc/pkg/misc"
 	"github.com/rocky-linux/srpmproc/pkg/modes"
 	"github.com/rocky-linux/srpmproc/pkg/rpmutils"
+	"github.com/rocky-linux/srpmproc/pkg/signing"
 
 	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
@@ -108,11 +115,78 @@ type ProcessDataRequest struct {
 	Cdn         string
 
 	ModuleBranchNames bool
+
+	DryRun   bool
+	DiffMode bool
+
+	// Lookaside downloads, defaults are used if DownloadParallelism or DownloadTimeout are zero.
+	// DownloadRetries is the number of retries of a failed download, zero disables them
+	DownloadParallelism int
+	DownloadRetries     int
+	DownloadTimeout     time.Duration
+
+	// Lookaside mirrors tried in order, replaces CdnUrl and Cdn if set
+	LookasideMirrors []*data.LookasideMirror
+
+	// Local disk cache in front of blob storage, disabled if BlobCacheDir is empty
+	BlobCacheDir  string
+	BlobCacheSize int64
+
+	// Compression (none or zstd) and encryption of stored blobs, see BlobEncoding
+	BlobCompression       string
+	BlobEncryptionKeyFile string
+	BlobRejectPlaintext   bool
+
+	// Digest algorithm (md5, sha1, sha256 or sha512) used in downstream metadata files,
+	// the upstream algorithm is kept if empty
+	MetadataDigest string
+	// Additional digest algorithms blobs are stored under, as copies or as alias objects
+	BlobDigests []string
+	BlobAliases bool
+
+	// Ordered upstream to downstream branch mappings, replaces ImportBranchPrefix,
+	// BranchPrefix and the stream branch parsing if set
+	BranchRules *data.BranchRules
+
+	// Replay upstream commits since the previous import instead of
+	// creating a single import commit, git upstreams only
+	PreserveHistory bool
+
+	// Use SourceDate, or the time of the upstream commit if it is zero,
+	// instead of the current time so imports produce identical commits
+	Reproducible bool
+	SourceDate   time.Time
+
+	// Go text/template strings replacing the default commit message,
+	// tag name and tag message, see ImportTemplate for the available fields
+	CommitMessageTemplate string
+	TagNameTemplate       string
+	TagMessageTemplate    string
+
+	// Import commits and tags are signed if SigningFormat (openpgp or ssh) is set.
+	// SSH signing uses SshKeyLocation if SigningKeyLocation is empty
+	SigningFormat        string
+	SigningKeyLocation   string
+	SigningKeyPassphrase string
+
+	// Shared clients, created from the request if nil
+	BlobStorage   blob.Storage
+	Authenticator transport.AuthMethod
+	Signer        git.Signer
 }
 
+// LookasidePath is a named lookaside profile usable as --cdn.
+// Fallbacks are tried after Url, HashTypes limits the profile to sources of these hash types.
+// The prefixes are used as defaults for the request fields of the same name
 type LookasidePath struct {
-	Distro string
-	Url    string
+	Distro             string   `mapstructure:"name"`
+	Url                string   `mapstructure:"url"`
+	Fallbacks          []string `mapstructure:"fallbacks"`
+	HashTypes          []string `mapstructure:"hash_types"`
+	BranchPrefix       string   `mapstructure:"branch_prefix"`
+	ImportBranchPrefix string   `mapstructure:"import_branch_prefix"`
+	RpmPrefix          string   `mapstructure:"rpm_prefix"`
+	ModulePrefix       string   `mapstructure:"module_prefix"`
 }
 
 func gitlabify(str string) string {
@@ -123,6 +197,17 @@ func gitlabify(str string) string {
 	return strings.Replace(str, "+", "plus", -1)
 }
 
+// isLocalCheckout returns true if the package is a path to a directory.
+// Package names never contain a slash, so only paths are considered
+func isLocalCheckout(pkg string) bool {
+	if !strings.Contains(pkg, "/") {
+		return false
+	}
+
+	fi, err := os.Stat(pkg)
+	return err == nil && fi.IsDir()
+}
+
 // List of distros and their lookaside patterns
 // If we find one of these passed as --cdn (ex: "--cdn fedora"), then we override, and assign this URL to be our --cdn-url
 func StaticLookasides() []LookasidePath {
@@ -154,16 +239,12 @@ func StaticLookasides() []LookasidePath {
 // Given a "--cdn" entry like "centos", we can search through our struct list of distros, and return the proper lookaside URL
 // If we can't find it, we return false and the calling function will error out
 func FindDistro(cdn string) (string, bool) {
-	var cdnUrl = ""
-
-	// Loop through each distro in the static list defined, try to find a match with "--cdn":
-	for _, distro := range StaticLookasides() {
-		if distro.Distro == strings.ToLower(cdn) {
-			cdnUrl = distro.Url
-			return cdnUrl, true
-		}
+	profile, found := FindLookaside(cdn)
+	if !found {
+		return "", false
 	}
-	return "", false
+
+	return profile.Url, true
 }
 
 func NewProcessData(req *ProcessDataRequest) (*data.ProcessData, error) {
@@ -174,6 +255,21 @@ func NewProcessData(req *ProcessDataRequest) (*data.ProcessData, error) {
 	}
 	logger := log.New(writer, "", log.LstdFlags)
 
+	// If a Cdn distro is defined, we try to find a match in the registered profiles and StaticLookasides()
+	// see if we have a match to --cdn (matching values are things like fedora, centos, rocky8, etc.)
+	// If we match, then we want to short-circuit the CdnUrl to the assigned distro's one
+	// and fill in the request fields the profile has defaults for
+	if req.Cdn != "" {
+		profile, foundDistro := FindLookaside(req.Cdn)
+
+		if !foundDistro {
+			return nil, fmt.Errorf("Error, distro name given as --cdn argument is not valid.")
+		}
+
+		applyLookasideProfile(req, profile)
+		logger.Printf("Discovered --cdn distro: %s .  Using override CDN URL Pattern: %s", req.Cdn, req.CdnUrl)
+	}
+
 	// Set defaults
 	if req.ModulePrefix == "" {
 		req.ModulePrefix = ModulePrefixCentOS
@@ -202,19 +298,19 @@ func NewProcessData(req *ProcessDataRequest) (*data.ProcessData, error) {
 	if req.CdnUrl == "" {
 		req.CdnUrl = "https://git.centos.org/sources"
 	}
+	if req.DownloadParallelism == 0 {
+		req.DownloadParallelism = 4
+	}
+	if req.DownloadTimeout == 0 {
+		req.DownloadTimeout = 10 * time.Minute
+	}
 
-	// If a Cdn distro is defined, we try to find a match from StaticLookasides() array of structs
-	// see if we have a match to --cdn (matching values are things like fedora, centos, rocky8, etc.)
-	// If we match, then we want to short-circuit the CdnUrl to the assigned distro's one
-	if req.Cdn != "" {
-		newCdn, foundDistro := FindDistro(req.Cdn)
-
-		if !foundDistro {
-			return nil, fmt.Errorf("Error, distro name given as --cdn argument is not valid.")
-		}
-
-		req.CdnUrl = newCdn
-		logger.Printf("Discovered --cdn distro: %s .  Using override CDN URL Pattern: %s", req.Cdn, req.CdnUrl)
+	lookasideMirrors, err := resolveLookasideMirrors(req.LookasideMirrors)
+	if err != nil {
+		return nil, err
+	}
+	for _, mirror := range lookasideMirrors {
+		logger.Printf("using lookaside mirror: %s", mirror.Url)
 	}
 
 	// Validate required
@@ -222,71 +318,98 @@ func NewProcessData(req *ProcessDataRequest) (*data.ProcessData, error) {
 		return nil, fmt.Errorf("package cannot be empty")
 	}
 
+	// history is only replayed for imports of upstream tags
+	if req.PreserveHistory && (req.TaglessMode || strings.TrimSpace(req.ManualCommits) != "") {
+		return nil, fmt.Errorf("preserving history is not supported for tagless imports")
+	}
+
 	// tells srpmproc what the source name actually is
 	if req.PackageGitName == "" {
 		req.PackageGitName = req.Package
 	}
 
 	var importer data.ImportMode
-	var blobStorage blob.Storage
 
-	if strings.HasPrefix(req.StorageAddr, "gs://") {
+	for _, digest := range append([]string{req.MetadataDigest}, req.BlobDigests...) {
+		if digest != "" && data.NewHash(digest) == nil {
+			return nil, fmt.Errorf("unsupported digest algorithm %s", digest)
+		}
+	}
+
+	blobStorage := req.BlobStorage
+	if blobStorage == nil {
 		var err error
-		blobStorage, err = gcs.New(strings.Replace(req.StorageAddr, "gs://", "", 1))
+		blobStorage, err = newRequestBlobStorage(req)
 		if err != nil {
 			return nil, err
 		}
-	} else if strings.HasPrefix(req.StorageAddr, "s3://") {
-		blobStorage = s3.New(strings.Replace(req.StorageAddr, "s3://", "", 1))
-	} else if strings.HasPrefix(req.StorageAddr, "file://") {
-		blobStorage = file.New(strings.Replace(req.StorageAddr, "file://", "", 1))
-	} else {
-		return nil, fmt.Errorf("invalid blob storage")
 	}
 
 	sourceRpmLocation := ""
-	if req.ModuleMode {
-		sourceRpmLocation = fmt.Sprintf("%s/%s", req.ModulePrefix, req.PackageGitName)
+	if strings.HasSuffix(req.Package, ".src.rpm") {
+		// local source rpm, the location is used to derive the package name
+		// so point it at the package name next to the srpm
+		srpmMode := &modes.SrpmMode{Path: req.Package}
+		name, err := srpmMode.PackageName()
+		if err != nil {
+			return nil, err
+		}
+		sourceRpmLocation = filepath.Join(filepath.Dir(req.Package), name)
+		importer = srpmMode
+	} else if isLocalCheckout(req.Package) {
+		// local dist-git checkout, same naming rules as a local source rpm
+		localMode := &modes.LocalMode{Path: req.Package}
+		name, err := localMode.PackageName()
+		if err != nil {
+			return nil, err
+		}
+		sourceRpmLocation = filepath.Join(filepath.Dir(filepath.Clean(req.Package)), name)
+		importer = localMode
 	} else {
-		sourceRpmLocation = fmt.Sprintf("%s/%s", req.RpmPrefix, req.PackageGitName)
+		if req.ModuleMode {
+			sourceRpmLocation = fmt.Sprintf("%s/%s", req.ModulePrefix, req.PackageGitName)
+		} else {
+			sourceRpmLocation = fmt.Sprintf("%s/%s", req.RpmPrefix, req.PackageGitName)
+		}
+		importer = &modes.GitMode{}
 	}
-	importer = &modes.GitMode{}
 
-	lastKeyLocation := req.SshKeyLocation
-	if lastKeyLocation == "" {
-		usr, err := user.Current()
+	authenticator := req.Authenticator
+	if authenticator == nil {
+		var err error
+		authenticator, err = NewAuthenticator(req)
 		if err != nil {
-			return nil, fmt.Errorf("could not get user: %v", err)
+			return nil, err
 		}
-		lastKeyLocation = filepath.Join(usr.HomeDir, ".ssh/id_rsa")
 	}
 
-	var authenticator transport.AuthMethod
-
-	var err error
-	if req.HttpUsername != "" {
-		authenticator = &http.BasicAuth{
-			Username: req.HttpUsername,
-			Password: req.HttpPassword,
-		}
-	} else {
-		var sshPassword string = ""
-		if req.SshKeyPassword {
-
-			fmt.Print("Enter SSH key password: ")
-			sshBytePassword, err := term.ReadPassword(int(syscall.Stdin))
-			if err != nil {
-				return nil, fmt.Errorf("could not read password for ssh key: %v", err)
-			}
-
-			sshPassword = string(sshBytePassword)
+	if req.BranchRules != nil && !req.BranchRules.Compiled() {
+		err := req.BranchRules.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("invalid branch rules: %v", err)
 		}
+	}
 
-		// create ssh key authenticator
-		authenticator, err = ssh.NewPublicKeysFromFile(req.SshUser, lastKeyLocation, sshPassword)
+	commitMessageTemplate, err := parseImportTemplate("commit message", req.CommitMessageTemplate)
+	if err != nil {
+		return nil, err
 	}
+	tagNameTemplate, err := parseImportTemplate("tag name", req.TagNameTemplate)
 	if err != nil {
-		return nil, fmt.Errorf("could not get git authenticator: %v", err)
+		return nil, err
+	}
+	tagMessageTemplate, err := parseImportTemplate("tag message", req.TagMessageTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := req.Signer
+	if signer == nil && req.SigningFormat != "" {
+		var err error
+		signer, err = NewSigner(req)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	fsCreator := func(branch string) (billy.Filesystem, error) {
@@ -329,38 +452,235 @@ func NewProcessData(req *ProcessDataRequest) (*data.ProcessData, error) {
 	}
 
 	return &data.ProcessData{
-		Importer:             importer,
-		RpmLocation:          sourceRpmLocation,
-		UpstreamPrefix:       req.UpstreamPrefix,
-		Version:              req.Version,
-		BlobStorage:          blobStorage,
-		GitCommitterName:     req.GitCommitterName,
-		GitCommitterEmail:    req.GitCommitterEmail,
-		ModulePrefix:         req.ModulePrefix,
-		ImportBranchPrefix:   req.ImportBranchPrefix,
-		BranchPrefix:         req.BranchPrefix,
-		SingleTag:            req.SingleTag,
-		Authenticator:        authenticator,
-		NoDupMode:            req.NoDupMode,
-		ModuleMode:           req.ModuleMode,
-		TmpFsMode:            req.TmpFsMode,
-		NoStorageDownload:    req.NoStorageDownload,
-		NoStorageUpload:      req.NoStorageUpload,
-		ManualCommits:        manualCs,
-		ModuleFallbackStream: req.ModuleFallbackStream,
-		BranchSuffix:         req.BranchSuffix,
-		StrictBranchMode:     req.StrictBranchMode,
-		FsCreator:            fsCreator,
-		CdnUrl:               req.CdnUrl,
-		Log:                  logger,
-		PackageVersion:       req.PackageVersion,
-		PackageRelease:       req.PackageRelease,
-		TaglessMode:          req.TaglessMode,
-		Cdn:                  req.Cdn,
-		ModuleBranchNames:    req.ModuleBranchNames,
+		Importer:              importer,
+		RpmLocation:           sourceRpmLocation,
+		UpstreamPrefix:        req.UpstreamPrefix,
+		Version:               req.Version,
+		BlobStorage:           blobStorage,
+		GitCommitterName:      req.GitCommitterName,
+		GitCommitterEmail:     req.GitCommitterEmail,
+		ModulePrefix:          req.ModulePrefix,
+		ImportBranchPrefix:    req.ImportBranchPrefix,
+		BranchPrefix:          req.BranchPrefix,
+		SingleTag:             req.SingleTag,
+		Authenticator:         authenticator,
+		NoDupMode:             req.NoDupMode,
+		ModuleMode:            req.ModuleMode,
+		TmpFsMode:             req.TmpFsMode,
+		NoStorageDownload:     req.NoStorageDownload,
+		NoStorageUpload:       req.NoStorageUpload,
+		ManualCommits:         manualCs,
+		ModuleFallbackStream:  req.ModuleFallbackStream,
+		BranchSuffix:          req.BranchSuffix,
+		StrictBranchMode:      req.StrictBranchMode,
+		FsCreator:             fsCreator,
+		CdnUrl:                req.CdnUrl,
+		Log:                   logger,
+		PackageVersion:        req.PackageVersion,
+		PackageRelease:        req.PackageRelease,
+		TaglessMode:           req.TaglessMode,
+		Cdn:                   req.Cdn,
+		ModuleBranchNames:     req.ModuleBranchNames,
+		DryRun:                req.DryRun,
+		DiffMode:              req.DiffMode,
+		DownloadParallelism:   req.DownloadParallelism,
+		DownloadRetries:       req.DownloadRetries,
+		DownloadTimeout:       req.DownloadTimeout,
+		LookasideMirrors:      lookasideMirrors,
+		MetadataDigest:        req.MetadataDigest,
+		BlobDigests:           req.BlobDigests,
+		BlobAliases:           req.BlobAliases,
+		BranchRules:           req.BranchRules,
+		PreserveHistory:       req.PreserveHistory,
+		Signer:                signer,
+		Reproducible:          req.Reproducible,
+		SourceDate:            req.SourceDate,
+		CommitMessageTemplate: commitMessageTemplate,
+		TagNameTemplate:       tagNameTemplate,
+		TagMessageTemplate:    tagMessageTemplate,
 	}, nil
 }
 
+// BlobEncoding configures how blobs are encoded before they are stored
+type BlobEncoding struct {
+	// Compression is none or zstd
+	Compression string
+	// EncryptionKeyFile holds the key blobs are encrypted with, see envelope.ReadKeyFile
+	EncryptionKeyFile string
+	// RejectPlaintext fails reads of blobs stored without encryption if a key is set.
+	// Otherwise they are read as is, which is only meant for migrating existing storage
+	RejectPlaintext bool
+}
+
+// NewBlobStorage returns the blob storage for addr.
+// Blobs are compressed and encrypted as configured by encoding, which may be nil
+func NewBlobStorage(addr string, encoding *BlobEncoding) (blob.Storage, error) {
+	storage, err := newBlobBackend(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoding == nil || ((encoding.Compression == "" || encoding.Compression == "none") && encoding.EncryptionKeyFile == "") {
+		return storage, nil
+	}
+	compression := encoding.Compression
+	if compression != "" && compression != "none" && compression != "zstd" {
+		return nil, fmt.Errorf("unsupported blob compression %s", compression)
+	}
+
+	var key []byte
+	if encoding.EncryptionKeyFile != "" {
+		key, err = envelope.ReadKeyFile(encoding.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return envelope.New(storage, key, compression == "zstd", encoding.RejectPlaintext)
+}
+
+// newBlobBackend returns the blob storage backend for addr.
+// Supported schemes are gs://, s3://, file://, http(s):// for WebDAV style servers
+// and oci:// for OCI registries.
+// A comma separated list of addresses is replicated to every backend
+// and read from the first backend that has a blob
+func newBlobBackend(addr string) (blob.Storage, error) {
+	if strings.Contains(addr, ",") {
+		var backends []blob.Storage
+		for _, backendAddr := range strings.Split(addr, ",") {
+			backend, err := newBlobBackend(strings.TrimSpace(backendAddr))
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, backend)
+		}
+
+		return blob.NewReplicated(backends...), nil
+	}
+
+	if strings.HasPrefix(addr, "gs://") {
+		return gcs.New(strings.Replace(addr, "gs://", "", 1))
+	} else if strings.HasPrefix(addr, "s3://") {
+		return s3.New(strings.Replace(addr, "s3://", "", 1)), nil
+	} else if strings.HasPrefix(addr, "file://") {
+		return file.New(strings.Replace(addr, "file://", "", 1)), nil
+	} else if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return webdav.New(addr, nil)
+	} else if strings.HasPrefix(addr, "oci://") {
+		return oci.New(addr, nil)
+	}
+
+	return nil, fmt.Errorf("invalid blob storage")
+}
+
+// newRequestBlobStorage returns the blob storage of req,
+// with the disk cache in front of it if one is configured
+func newRequestBlobStorage(req *ProcessDataRequest) (blob.Storage, error) {
+	blobStorage, err := NewBlobStorage(req.StorageAddr, &BlobEncoding{
+		Compression:       req.BlobCompression,
+		EncryptionKeyFile: req.BlobEncryptionKeyFile,
+		RejectPlaintext:   req.BlobRejectPlaintext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if req.BlobCacheDir == "" {
+		return blobStorage, nil
+	}
+
+	return diskcache.New(blobStorage, req.BlobCacheDir, req.BlobCacheSize)
+}
+
+// NewAuthenticator returns the git authenticator for req.
+// Basic auth is used if a username is set, otherwise an SSH key
+func NewAuthenticator(req *ProcessDataRequest) (transport.AuthMethod, error) {
+	lastKeyLocation, err := sshKeyLocation(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var authenticator transport.AuthMethod
+
+	if req.HttpUsername != "" {
+		authenticator = &http.BasicAuth{
+			Username: req.HttpUsername,
+			Password: req.HttpPassword,
+		}
+	} else {
+		var sshPassword string = ""
+		if req.SshKeyPassword {
+
+			fmt.Print("Enter SSH key password: ")
+			sshBytePassword, err := term.ReadPassword(int(syscall.Stdin))
+			if err != nil {
+				return nil, fmt.Errorf("could not read password for ssh key: %v", err)
+			}
+
+			sshPassword = string(sshBytePassword)
+		}
+
+		// create ssh key authenticator
+		authenticator, err = ssh.NewPublicKeysFromFile(req.SshUser, lastKeyLocation, sshPassword)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get git authenticator: %v", err)
+	}
+
+	return authenticator, nil
+}
+
+// sshKeyLocation returns the SSH key of req, ~/.ssh/id_rsa by default
+func sshKeyLocation(req *ProcessDataRequest) (string, error) {
+	if req.SshKeyLocation != "" {
+		return req.SshKeyLocation, nil
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("could not get user: %v", err)
+	}
+
+	return filepath.Join(usr.HomeDir, ".ssh/id_rsa"), nil
+}
+
+// NewSigner returns the signer for import commits and tags of req.
+// The passphrase of an encrypted SSH key is prompted for if SshKeyPassword is set
+// and SigningKeyPassphrase is empty
+func NewSigner(req *ProcessDataRequest) (git.Signer, error) {
+	if req.SigningFormat != signing.FormatOpenPGP && req.SigningFormat != signing.FormatSSH {
+		return nil, fmt.Errorf("unsupported signing format %s", req.SigningFormat)
+	}
+
+	keyLocation := req.SigningKeyLocation
+	if keyLocation == "" {
+		if req.SigningFormat == signing.FormatOpenPGP {
+			return nil, fmt.Errorf("a signing key is required for %s signing", req.SigningFormat)
+		}
+
+		var err error
+		keyLocation, err = sshKeyLocation(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signer, err := signing.New(req.SigningFormat, keyLocation, []byte(req.SigningKeyPassphrase))
+	if err == signing.ErrPassphraseMissing && req.SshKeyPassword {
+		fmt.Print("Enter signing key password: ")
+		passphrase, err := term.ReadPassword(int(syscall.Stdin))
+		if err != nil {
+			return nil, fmt.Errorf("could not read password for signing key: %v", err)
+		}
+
+		return signing.New(req.SigningFormat, keyLocation, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
 // ProcessRPM checks the RPM specs and discards any remote files
 // This functions also sorts files into directories
 // .spec files goes into -> SPECS
@@ -369,18 +689,26 @@ func NewProcessData(req *ProcessDataRequest) (*data.ProcessData, error) {
 // all files that are remote goes into .gitignore
 // all ignored files' hash goes into .{Name}.metadata
 func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
+	return ProcessRPMContext(context.Background(), pd)
+}
+
+// ProcessRPMContext is ProcessRPM with a context.
+// Cancelling ctx aborts the import before the next network or storage
+// operation, nothing is pushed for the branch that was in progress
+func ProcessRPMContext(ctx context.Context, pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 	// if we are using "tagless mode", then we need to jump to a completely different import process:
 	// Version info needs to be derived from rpmbuild + spec file, not tags
 	if pd.TaglessMode {
-		result, err := processRPMTagless(pd)
+		result, err := processRPMTagless(ctx, pd)
 		return result, err
 	}
 
-	md, err := pd.Importer.RetrieveSource(pd)
+	md, err := pd.Importer.RetrieveSource(ctx, pd)
 	if err != nil {
 		return nil, err
 	}
-	md.BlobCache = map[string][]byte{}
+	md.BlobCache = data.NewBlobCache(data.DefaultBlobCacheMemLimit)
+	defer md.BlobCache.Close()
 
 	remotePrefix := "rpms"
 	if pd.ModuleMode {
@@ -389,6 +717,8 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 
 	latestHashForBranch := map[string]string{}
 	versionForBranch := map[string]*srpmprocpb.VersionRelease{}
+	var branchPlans []*srpmprocpb.BranchPlan
+	branchDiffs := map[string]string{}
 
 	// already uploaded blobs are skipped
 	var alreadyUploadedBlobs []string
@@ -412,7 +742,7 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 			return nil, fmt.Errorf("could not create remote: %v", err)
 		}
 
-		list, err := remote.List(&git.ListOptions{
+		list, err := remote.ListContext(ctx, &git.ListOptions{
 			Auth: pd.Authenticator,
 		})
 
@@ -438,18 +768,22 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 	} else if len(pd.ManualCommits) > 0 {
 		log.Println("Manual commits were listed for import.  Switching to perform a tagless import of these commit(s).")
 		pd.TaglessMode = true
-		return processRPMTagless(pd)
+		return processRPMTagless(ctx, pd)
 	}
 
 	// If we have no valid branches to consider, then we'll automatically switch to attempt a tagless import:
 	if len(md.Branches) == 0 {
 		log.Println("No valid tags (refs/tags/imports/*) found in repository!  Switching to perform a tagless import.")
 		pd.TaglessMode = true
-		result, err := processRPMTagless(pd)
+		result, err := processRPMTagless(ctx, pd)
 		return result, err
 	}
 
 	for _, branch := range md.Branches {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		md.Repo = &sourceRepo
 		md.Worktree = &sourceWorktree
 		md.TagBranch = branch
@@ -461,6 +795,9 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 		if !misc.GetTagImportRegex(pd).MatchString(md.TagBranch) {
 			if pd.ModuleMode {
 				prefix := fmt.Sprintf("refs/heads/%s%d", pd.ImportBranchPrefix, pd.Version)
+				if pd.BranchRules != nil {
+					prefix = "refs/heads/"
+				}
 				if strings.HasPrefix(md.TagBranch, prefix) {
 					replace := strings.Replace(md.TagBranch, "refs/heads/", "", 1)
 					matchString = fmt.Sprintf("refs/tags/imports/%s/%s", replace, filepath.Base(pd.RpmLocation))
@@ -475,10 +812,17 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 		}
 
 		match := misc.GetTagImportRegex(pd).FindStringSubmatch(matchString)
+		if !misc.ImportBranchOk(pd, match[2]) {
+			continue
+		}
 
 		md.PushBranch = pd.BranchPrefix + strings.TrimPrefix(match[2], pd.ImportBranchPrefix)
 
 		newTag := "imports/" + pd.BranchPrefix + strings.TrimPrefix(match[1], "imports/"+pd.ImportBranchPrefix)
+		if pd.BranchRules != nil {
+			md.PushBranch = pd.BranchRules.Branch(match[2]).Target
+			newTag = "imports/" + md.PushBranch + "/" + match[3]
+		}
 		newTag = strings.Replace(newTag, "%", "_", -1)
 
 		createdFs, err := pd.FsCreator(md.PushBranch)
@@ -496,14 +840,18 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 			return nil, fmt.Errorf("could not get dist Worktree: %v", err)
 		}
 
-		shouldContinue := true
-		for _, ignoredTag := range tagIgnoreList {
-			if ignoredTag == "refs/tags/"+newTag {
-				pd.Log.Printf("skipping %s", ignoredTag)
-				shouldContinue = false
-			}
+		plan := &srpmprocpb.BranchPlan{
+			Branch: md.PushBranch,
+			Tag:    newTag,
 		}
-		if !shouldContinue {
+
+		// a tag name template may use fields that are only known after patching
+		if pd.TagNameTemplate == nil && slices.Contains(tagIgnoreList, "refs/tags/"+newTag) {
+			pd.Log.Printf("skipping refs/tags/%s", newTag)
+			if pd.DryRun {
+				plan.Skipped = true
+				branchPlans = append(branchPlans, plan)
+			}
 			continue
 		}
 
@@ -522,11 +870,15 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 			return nil, fmt.Errorf("could not create remote: %v", err)
 		}
 
-		err = repo.Fetch(&git.FetchOptions{
+		err = repo.FetchContext(ctx, &git.FetchOptions{
 			RemoteName: "origin",
 			RefSpecs:   []config.RefSpec{refspec},
 			Auth:       pd.Authenticator,
 		})
+		// a cancelled fetch must not be mistaken for a new branch
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
 		refName := plumbing.NewBranchReferenceName(md.PushBranch)
 		pd.Log.Printf("set reference to ref: %s", refName)
@@ -552,11 +904,27 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 			}
 		}
 
-		err = pd.Importer.WriteSource(pd, md)
+		err = pd.Importer.WriteSource(ctx, pd, md)
 		if err != nil {
 			return nil, err
 		}
 
+		if pd.Reproducible {
+			md.SourceDate, err = sourceDate(pd, md.Repo)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// srpm and local imports have no upstream commit
+		var upstreamHead plumbing.Hash
+		upstreamRef, err := md.Repo.Head()
+		if err == nil {
+			upstreamHead = upstreamRef.Hash()
+		} else if pd.PreserveHistory {
+			pd.Log.Printf("no upstream commit found, not preserving history: %v", err)
+		}
+
 		err = data.CopyFromFs(md.Worktree.Filesystem, w.Filesystem, ".")
 		if err != nil {
 			return nil, err
@@ -564,13 +932,29 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 		md.Repo = repo
 		md.Worktree = w
 
+		// the downstream tree with the upstream content, before any directive ran
+		var upstreamTree treeSnapshot
+		if pd.DiffMode {
+			upstreamTree, err = snapshotTree(w.Filesystem, lookasideFiles(md))
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		if pd.ModuleMode {
-			err := patchModuleYaml(pd, md)
+			err := patchModuleYaml(ctx, pd, md)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			err := executePatchesRpm(pd, md)
+			err := executePatchesRpm(ctx, pd, md)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if pd.DiffMode {
+			branchDiffs[md.PushBranch], err = diffAgainstTree(upstreamTree, w.Filesystem, lookasideFiles(md))
 			if err != nil {
 				return nil, err
 			}
@@ -605,21 +989,10 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 				continue
 			}
 
-			sourceFile, err := w.Filesystem.Open(sourcePath)
-			if err != nil {
-				return nil, fmt.Errorf("could not open ignored source file %s: %v", sourcePath, err)
-			}
-			sourceFileBts, err := io.ReadAll(sourceFile)
+			checksum, aliases, err := hashSource(pd, w.Filesystem, sourcePath, source.HashFunction)
 			if err != nil {
-				return nil, fmt.Errorf("could not read the whole of ignored source file: %v", err)
-			}
-
-			source.HashFunction.Reset()
-			_, err = source.HashFunction.Write(sourceFileBts)
-			if err != nil {
-				return nil, fmt.Errorf("could not write bytes to hash function: %v", err)
+				return nil, err
 			}
-			checksum := hex.EncodeToString(source.HashFunction.Sum(nil))
 			checksumLine := fmt.Sprintf("%s %s\n", checksum, sourcePath)
 			_, err = metadata.Write([]byte(checksumLine))
 			if err != nil {
@@ -629,18 +1002,13 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 			if data.StrContains(alreadyUploadedBlobs, checksum) {
 				continue
 			}
-			exists, err := pd.BlobStorage.Exists(checksum)
-			if err != nil {
-				return nil, err
-			}
-			if !exists && !pd.NoStorageUpload {
-				err := pd.BlobStorage.Write(checksum, sourceFileBts)
+			for _, key := range append([]string{checksum}, aliases...) {
+				err := storeSource(ctx, pd, w.Filesystem, sourcePath, key, checksum, plan)
 				if err != nil {
 					return nil, err
 				}
-				pd.Log.Printf("wrote %s to blob storage", checksum)
+				alreadyUploadedBlobs = append(alreadyUploadedBlobs, key)
 			}
-			alreadyUploadedBlobs = append(alreadyUploadedBlobs, checksum)
 		}
 
 		_, err = w.Add(metadataFile)
@@ -659,15 +1027,54 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 			}
 		}
 
+		templateData := &ImportTemplate{
+			Name:        md.Name,
+			NVR:         pd.Importer.ImportName(pd, md),
+			Source:      pd.RpmLocation,
+			SourceRef:   md.TagBranch,
+			Branch:      md.PushBranch,
+			PatchCommit: md.PatchCommit,
+			Directives:  md.Directives,
+		}
+		if !upstreamHead.IsZero() {
+			templateData.UpstreamCommit = upstreamHead.String()
+		}
+
 		nvrMatch := rpmutils.Nvr.FindStringSubmatch(match[3])
 		if len(nvrMatch) >= 4 {
 			versionForBranch[md.PushBranch] = &srpmprocpb.VersionRelease{
 				Version: nvrMatch[2],
 				Release: nvrMatch[3],
 			}
+			templateData.Version = nvrMatch[2]
+			templateData.Release = nvrMatch[3]
+		}
+
+		if pd.TagNameTemplate != nil {
+			newTag, err = renderTagName(pd.TagNameTemplate, templateData, newTag)
+			if err != nil {
+				return nil, err
+			}
+			plan.Tag = newTag
+
+			if slices.Contains(tagIgnoreList, "refs/tags/"+newTag) {
+				pd.Log.Printf("skipping refs/tags/%s", newTag)
+				if pd.DryRun {
+					plan.Skipped = true
+					branchPlans = append(branchPlans, plan)
+				}
+				continue
+			}
 		}
+		templateData.Tag = newTag
 
+		// the tmpfs worktree is left on disk as is and never pushed
 		if pd.TmpFsMode != "" {
+			if pd.DryRun {
+				status, _ := w.Status()
+				addStatusToPlan(plan, status)
+				branchPlans = append(branchPlans, plan)
+			}
 			continue
 		}
 
@@ -678,6 +1085,12 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 
 		// show status
 		status, _ := w.Status()
+		if pd.DryRun {
+			addStatusToPlan(plan, status)
+			branchPlans = append(branchPlans, plan)
+			pd.Log.Printf("dry run, not pushing %s", md.PushBranch)
+			continue
+		}
 		if !pd.ModuleMode {
 			if status.IsClean() {
 				pd.Log.Printf("No changes detected. Our downstream is up to date.")
@@ -717,15 +1130,46 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 			pushRefspecs = append(pushRefspecs, config.RefSpec(fmt.Sprintf("HEAD:%s", refOrigin)))
 		}
 
+		commitMessage, err := renderImportTemplate(pd.CommitMessageTemplate, templateData, "import "+pd.Importer.ImportName(pd, md))
+		if err != nil {
+			return nil, err
+		}
+		if pd.PreserveHistory && !upstreamHead.IsZero() {
+			var parent, base plumbing.Hash
+			if len(hashes) > 0 {
+				parent = hashes[0]
+				base, _, err = lastUpstreamCommit(repo, parent)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			history, err := upstreamHistory(pd, &sourceRepo, match[2], md.TagBranch, upstreamHead, base)
+			if err != nil {
+				return nil, err
+			}
+			// the import commit on top applies the directives to the last upstream tree
+			parent, err = replayHistory(pd, repo, &sourceRepo, history, parent)
+			if err != nil {
+				return nil, err
+			}
+			if !parent.IsZero() {
+				hashes = []plumbing.Hash{parent}
+			}
+			commitMessage = addTrailer(commitMessage, upstreamCommitTrailer, upstreamHead.String())
+		}
+
 		// we are now finished with the tree and are going to push it to the src Repo
 		// create import commit
-		commit, err := w.Commit("import "+pd.Importer.ImportName(pd, md), &git.CommitOptions{
+		commitTime := pd.CommitTime(md)
+		commit, err := w.Commit(commitMessage, &git.CommitOptions{
 			Author: &object.Signature{
 				Name:  pd.GitCommitterName,
 				Email: pd.GitCommitterEmail,
-				When:  time.Now(),
+				When:  commitTime,
 			},
 			Parents: hashes,
+			Signer:  signing.At(pd.Signer, commitTime),
 		})
 		if err != nil {
 			return nil, fmt.Errorf("could not commit object: %v", err)
@@ -738,22 +1182,25 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 
 		pd.Log.Printf("committed:\n%s", obj.String())
 
-		_, err = repo.CreateTag(newTag, commit, &git.CreateTagOptions{
+		tagMessage, err := renderImportTemplate(pd.TagMessageTemplate, templateData, "import "+md.TagBranch+" from "+pd.RpmLocation)
+		if err != nil {
+			return nil, err
+		}
+		_, err = signing.CreateTag(repo, newTag, commit, &git.CreateTagOptions{
 			Tagger: &object.Signature{
 				Name:  pd.GitCommitterName,
 				Email: pd.GitCommitterEmail,
-				When:  time.Now(),
+				When:  commitTime,
 			},
-			Message: "import " + md.TagBranch + " from " + pd.RpmLocation,
-			SignKey: nil,
-		})
+			Message: tagMessage,
+		}, pd.Signer)
 		if err != nil {
 			return nil, fmt.Errorf("could not create tag: %v", err)
 		}
 
 		pushRefspecs = append(pushRefspecs, config.RefSpec("HEAD:"+plumbing.NewTagReferenceName(newTag)))
 
-		err = repo.Push(&git.PushOptions{
+		err = repo.PushContext(ctx, &git.PushOptions{
 			RemoteName: "origin",
 			Auth:       pd.Authenticator,
 			RefSpecs:   pushRefspecs,
@@ -770,13 +1217,65 @@ func ProcessRPM(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 	return &srpmprocpb.ProcessResponse{
 		BranchCommits:  latestHashForBranch,
 		BranchVersions: versionForBranch,
+		BranchPlans:    branchPlans,
+		BranchDiffs:    branchDiffs,
 	}, nil
 }
 
+// sourceDate returns the commit time of reproducible imports.
+// SOURCE_DATE_EPOCH takes precedence over the time of the upstream commit
+func sourceDate(pd *data.ProcessData, upstream *git.Repository) (time.Time, error) {
+	if !pd.SourceDate.IsZero() {
+		return pd.SourceDate, nil
+	}
+
+	head, err := upstream.Head()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reproducible imports without an upstream commit need a source date: %v", err)
+	}
+	commit, err := upstream.CommitObject(head.Hash())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get upstream commit: %v", err)
+	}
+
+	return commit.Committer.When, nil
+}
+
+// addStatusToPlan sorts the changed files of a worktree status into the plan
+func addStatusToPlan(plan *srpmprocpb.BranchPlan, status git.Status) {
+	var files []string
+	for file := range status {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		fileStatus := status[file]
+		code := fileStatus.Staging
+		if code == git.Unmodified {
+			code = fileStatus.Worktree
+		}
+
+		switch code {
+		case git.Added, git.Untracked, git.Copied:
+			plan.Added = append(plan.Added, file)
+		case git.Modified, git.Renamed, git.UpdatedButUnmerged:
+			plan.Modified = append(plan.Modified, file)
+		case git.Deleted:
+			plan.Deleted = append(plan.Deleted, file)
+		}
+	}
+}
+
 // Process for when we want to import a tagless repo (like from CentOS Stream)
-func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
+func processRPMTagless(ctx context.Context, pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error) {
 	pd.Log.Println("Tagless mode detected, attempting import of latest commit")
 
+	// also reached if the upstream repo has no import tags
+	if pd.PreserveHistory {
+		return nil, fmt.Errorf("preserving history is not supported for tagless imports")
+	}
+
 	// In tagless mode, we *automatically* set StrictBranchMode to true
 	// Only the exact <PREFIX><VERSION><SUFFIX> branch should be pulled from the source repo
 	pd.StrictBranchMode = true
@@ -785,14 +1284,17 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 	// and a mapping of branches to: version = X, release = Y
 	latestHashForBranch := map[string]string{}
 	versionForBranch := map[string]*srpmprocpb.VersionRelease{}
+	var branchPlans []*srpmprocpb.BranchPlan
+	branchDiffs := map[string]string{}
 
-	md, err := pd.Importer.RetrieveSource(pd)
+	md, err := pd.Importer.RetrieveSource(ctx, pd)
 	if err != nil {
 		pd.Log.Println("Error detected in  RetrieveSource!")
 		return nil, err
 	}
 
-	md.BlobCache = map[string][]byte{}
+	md.BlobCache = data.NewBlobCache(data.DefaultBlobCacheMemLimit)
+	defer md.BlobCache.Close()
 
 	// TODO: add tagless module support
 	remotePrefix := "rpms"
@@ -819,7 +1321,7 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 			return nil, fmt.Errorf("could not create remote: %v", err)
 		}
 
-		list, err := remote.List(&git.ListOptions{
+		list, err := remote.ListContext(ctx, &git.ListOptions{
 			Auth: pd.Authenticator,
 		})
 		if err != nil {
@@ -838,6 +1340,14 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 	sourceWorktree := *md.Worktree
 	localPath := ""
 
+	// temporary checkouts are removed however the import ends, including cancellation
+	var tmpDirs []string
+	defer func() {
+		for _, dir := range tmpDirs {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
 	// if a manual commit list is provided, we want to create our md.Branches[] array in a special format:
 	if len(pd.ManualCommits) > 0 {
 		md.Branches = []string{}
@@ -853,6 +1363,10 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 	}
 
 	for _, branch := range md.Branches {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		md.Repo = &sourceRepo
 		md.Worktree = &sourceWorktree
 		md.TagBranch = branch
@@ -863,6 +1377,7 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 
 		// Create a temporary place to check out our tag/branch : /tmp/srpmproctmp_<PKG_NAME><RANDOMSTRING>/
 		localPath, _ = os.MkdirTemp("/tmp", fmt.Sprintf("srpmproctmp_%s", md.Name))
+		tmpDirs = append(tmpDirs, localPath, localPath+"_gitpush")
 
 		if err := os.RemoveAll(localPath); err != nil {
 			return nil, fmt.Errorf("Could not remove previous temporary directory: %s", localPath)
@@ -876,9 +1391,21 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 			branch = fmt.Sprintf("refs/heads/%s", strings.Split(branch, ":")[1])
 		}
 
+		// call extra function to determine the proper way to convert the tagless branch name.
+		// c9s becomes r9s (in the usual case), or in the modular case, stream-httpd-2.4-rhel-9.1.0 becomes r9s-stream-httpd-2.4_r9.1.0
+		pushBranch, err := taglessBranchName(branch, pd)
+		if err != nil {
+			// manual commits were asked for explicitly, so they are not skipped silently
+			if strings.HasPrefix(md.TagBranch, "COMMIT:") {
+				return nil, err
+			}
+			pd.Log.Printf("skipping %s: %v", branch, err)
+			continue
+		}
+
 		// Clone repo into the temporary path, but only the tag we're interested in:
 		// (TODO: will probably need to assign this a variable or use the md struct gitrepo object to perform a successful tag+push later)
-		rTmp, err := git.PlainClone(localPath, false, &git.CloneOptions{
+		rTmp, err := git.PlainCloneContext(ctx, localPath, false, &git.CloneOptions{
 			URL:           pd.RpmLocation,
 			SingleBranch:  true,
 			ReferenceName: plumbing.ReferenceName(branch),
@@ -901,22 +1428,27 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 			}
 		}
 
+		if pd.Reproducible {
+			md.SourceDate, err = sourceDate(pd, rTmp)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Now that we're cloned into localPath, we need to "covert" the import into the old format
 		// We want sources to become .PKGNAME.metadata, we want SOURCES and SPECS folders, etc.
-		repoFixed, _ := convertLocalRepo(md.Name, localPath)
+		repoFixed, _ := modes.ConvertLocalRepo(md.Name, localPath)
 		if !repoFixed {
 			return nil, fmt.Errorf("Error converting repository into SOURCES + SPECS + .package.metadata format")
 		}
 
-		// call extra function to determine the proper way to convert the tagless branch name.
-		// c9s becomes r9s (in the usual case), or in the modular case, stream-httpd-2.4-rhel-9.1.0 becomes r9s-stream-httpd-2.4_r9.1.0
-		md.PushBranch = taglessBranchName(branch, pd)
+		md.PushBranch = pushBranch
 
 		rpmVersion := ""
 
 		// get name-version-release of tagless repo, only if we're not a module repo:
 		if !pd.ModuleMode {
-			nvrString, err := getVersionFromSpec(localPath, pd.Version)
+			nvrString, err := modes.GetVersionFromSpec(ctx, localPath, pd.Version)
 			if err != nil {
 				return nil, err
 			}
@@ -931,7 +1463,7 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 			pd.Log.Println("Successfully determined version of tagless checkout: ", rpmVersion)
 		} else {
 			// In case of module mode, we just set rpmVersion to the current date - that's what our tag will end up being
-			rpmVersion = time.Now().Format("2006-01-02")
+			rpmVersion = pd.CommitTime(md).Format("2006-01-02")
 		}
 
 		// Make an initial repo we will use to push to our target
@@ -960,11 +1492,14 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 		}
 
 		// fetch our branch data (md.PushBranch) into this new repo
-		err = pushRepo.Fetch(&git.FetchOptions{
+		err = pushRepo.FetchContext(ctx, &git.FetchOptions{
 			RemoteName: "origin",
 			RefSpecs:   []config.RefSpec{refspec},
 			Auth:       pd.Authenticator,
 		})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
 		refName := plumbing.NewBranchReferenceName(md.PushBranch)
 
@@ -994,27 +1529,46 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 		md.Repo = pushRepo
 		md.Worktree = w
 
+		plan := &srpmprocpb.BranchPlan{
+			Branch: md.PushBranch,
+		}
+
 		// Download lookaside sources (tarballs) into the push git repo:
-		err = pd.Importer.WriteSource(pd, md)
+		err = pd.Importer.WriteSource(ctx, pd, md)
 		if err != nil {
 			return nil, err
 		}
 
 		// Call function to upload source to target lookaside and
 		// ensure the sources are added to .gitignore
-		err = processLookasideSources(pd, md, localPath+"_gitpush")
+		err = processLookasideSources(ctx, pd, md, localPath+"_gitpush", plan)
 		if err != nil {
 			return nil, err
 		}
 
+		var upstreamTree treeSnapshot
+		if pd.DiffMode {
+			upstreamTree, err = snapshotTree(w.Filesystem, lookasideFiles(md))
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Apply patch(es) if needed:
 		if pd.ModuleMode {
-			err := patchModuleYaml(pd, md)
+			err := patchModuleYaml(ctx, pd, md)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			err := executePatchesRpm(pd, md)
+			err := executePatchesRpm(ctx, pd, md)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if pd.DiffMode {
+			branchDiffs[md.PushBranch], err = diffAgainstTree(upstreamTree, w.Filesystem, lookasideFiles(md))
 			if err != nil {
 				return nil, err
 			}
@@ -1026,6 +1580,48 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 		}
 
 		status, _ := w.Status()
+
+		templateData := &ImportTemplate{
+			Name:        md.Name,
+			NVR:         rpmVersion,
+			Version:     pd.PackageVersion,
+			Release:     pd.PackageRelease,
+			Source:      pd.RpmLocation,
+			SourceRef:   md.TagBranch,
+			Branch:      md.PushBranch,
+			PatchCommit: md.PatchCommit,
+			Directives:  md.Directives,
+		}
+		if upstreamRef, err := rTmp.Head(); err == nil {
+			templateData.UpstreamCommit = upstreamRef.Hash().String()
+		}
+
+		// assign tag for our new remote we're about to push (derived from the SRPM version)
+		newTag := "refs/tags/imports/" + md.PushBranch + "/" + rpmVersion
+		newTag = strings.Replace(newTag, "%", "_", -1)
+		if pd.TagNameTemplate != nil {
+			tag, err := renderTagName(pd.TagNameTemplate, templateData, "")
+			if err != nil {
+				return nil, err
+			}
+			newTag = "refs/tags/" + tag
+		}
+		templateData.Tag = strings.TrimPrefix(newTag, "refs/tags/")
+
+		if pd.DryRun {
+			plan.Tag = templateData.Tag
+			addStatusToPlan(plan, status)
+			branchPlans = append(branchPlans, plan)
+			versionForBranch[md.PushBranch] = &srpmprocpb.VersionRelease{
+				Version: pd.PackageVersion,
+				Release: pd.PackageRelease,
+			}
+			pd.Log.Printf("dry run, not pushing %s", md.PushBranch)
+
+			_ = os.RemoveAll(localPath)
+			_ = os.RemoveAll(fmt.Sprintf("%s_gitpush", localPath))
+			continue
+		}
 		if !pd.ModuleMode {
 			if status.IsClean() {
 				pd.Log.Printf("No changes detected. Our downstream is up to date.")
@@ -1039,10 +1635,6 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 		}
 		pd.Log.Printf("successfully processed:\n%s", status)
 
-		// assign tag for our new remote we're about to push (derived from the SRPM version)
-		newTag := "refs/tags/imports/" + md.PushBranch + "/" + rpmVersion
-		newTag = strings.Replace(newTag, "%", "_", -1)
-
 		// pushRefspecs is a list of all the references we want to push (tags + heads)
 		// It's an array of colon-separated strings which map local references to their remote counterparts
 		var pushRefspecs []config.RefSpec
@@ -1051,7 +1643,10 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 		// If it doesn't, we want to add *:* to our references for commit.  This will allow us to push the new branch
 		// If it does, we can simply push HEAD:refs/heads/<BRANCH>
 		newRepo := true
-		refList, _ := pushRepoRemote.List(&git.ListOptions{Auth: pd.Authenticator})
+		refList, _ := pushRepoRemote.ListContext(ctx, &git.ListOptions{Auth: pd.Authenticator})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		for _, ref := range refList {
 			if strings.HasSuffix(ref.Name().String(), fmt.Sprintf("heads/%s", md.PushBranch)) {
 				newRepo = false
@@ -1069,13 +1664,20 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 		pushRefspecs = append(pushRefspecs, config.RefSpec(fmt.Sprintf("HEAD:refs/heads/%s", md.PushBranch)))
 		pushRefspecs = append(pushRefspecs, config.RefSpec(fmt.Sprintf("HEAD:%s", newTag)))
 
+		commitMessage, err := renderImportTemplate(pd.CommitMessageTemplate, templateData, "import from tagless source "+pd.Importer.ImportName(pd, md))
+		if err != nil {
+			return nil, err
+		}
+
 		// Actually do the commit (locally)
-		commit, err := w.Commit("import from tagless source "+pd.Importer.ImportName(pd, md), &git.CommitOptions{
+		commitTime := pd.CommitTime(md)
+		commit, err := w.Commit(commitMessage, &git.CommitOptions{
 			Author: &object.Signature{
 				Name:  pd.GitCommitterName,
 				Email: pd.GitCommitterEmail,
-				When:  time.Now(),
+				When:  commitTime,
 			},
+			Signer: signing.At(pd.Signer, commitTime),
 		})
 		if err != nil {
 			return nil, fmt.Errorf("could not commit object: %v", err)
@@ -1088,16 +1690,20 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 
 		pd.Log.Printf("Committed local repo tagless mode transform:\n%s", obj.String())
 
+		tagMessage, err := renderImportTemplate(pd.TagMessageTemplate, templateData, "import "+md.TagBranch+" from "+pd.RpmLocation+"(import from tagless source)")
+		if err != nil {
+			return nil, err
+		}
+
 		// After commit, we will now tag our local repo on disk:
-		_, err = pushRepo.CreateTag(newTag, commit, &git.CreateTagOptions{
+		_, err = signing.CreateTag(pushRepo, newTag, commit, &git.CreateTagOptions{
 			Tagger: &object.Signature{
 				Name:  pd.GitCommitterName,
 				Email: pd.GitCommitterEmail,
-				When:  time.Now(),
+				When:  commitTime,
 			},
-			Message: "import " + md.TagBranch + " from " + pd.RpmLocation + "(import from tagless source)",
-			SignKey: nil,
-		})
+			Message: tagMessage,
+		}, pd.Signer)
 		if err != nil {
 			return nil, fmt.Errorf("could not create tag: %v", err)
 		}
@@ -1105,7 +1711,7 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 		pd.Log.Printf("Pushing these references to the remote:  %+v \n", pushRefspecs)
 
 		// Do the actual push to the remote target repository
-		err = pushRepo.Push(&git.PushOptions{
+		err = pushRepo.PushContext(ctx, &git.PushOptions{
 			RemoteName: "origin",
 			Auth:       pd.Authenticator,
 			RefSpecs:   pushRefspecs,
@@ -1136,173 +1742,18 @@ func processRPMTagless(pd *data.ProcessData) (*srpmprocpb.ProcessResponse, error
 	return &srpmprocpb.ProcessResponse{
 		BranchCommits:  latestHashForBranch,
 		BranchVersions: versionForBranch,
+		BranchPlans:    branchPlans,
+		BranchDiffs:    branchDiffs,
 	}, nil
 }
 
-// Given a local repo on disk, ensure it's in the "traditional" format.  This means:
-//   - metadata file is named .pkgname.metadata
-//   - metadata file has the old "<SHASUM>  SOURCES/<filename>"  format
-//   - SPECS/ and SOURCES/ exist and are populated correctly
-func convertLocalRepo(pkgName string, localRepo string) (bool, error) {
-	// Make sure we have a SPECS and SOURCES folder made:
-	if err := os.MkdirAll(fmt.Sprintf("%s/SOURCES", localRepo), 0o755); err != nil {
-		return false, fmt.Errorf("Could not create SOURCES directory in: %s", localRepo)
-	}
-
-	if err := os.MkdirAll(fmt.Sprintf("%s/SPECS", localRepo), 0o755); err != nil {
-		return false, fmt.Errorf("Could not create SPECS directory in: %s", localRepo)
-	}
-
-	// Loop through each file/folder and operate accordingly:
-	files, err := os.ReadDir(localRepo)
-	if err != nil {
-		return false, err
-	}
-
-	for _, f := range files {
-		// We don't want to process SOURCES, SPECS, or any of our .git folders
-		if f.Name() == "SOURCES" || f.Name() == "SPECS" || strings.HasPrefix(f.Name(), ".git") || f.Name() == "."+pkgName+".metadata" {
-			continue
-		}
-
-		// If we have a metadata "sources" file, we need to read it and convert to the old .<pkgname>.metadata format
-		if f.Name() == "sources" {
-			convertStatus := convertMetaData(pkgName, localRepo)
-
-			if convertStatus != true {
-				return false, fmt.Errorf("Error converting sources metadata file to .metadata format")
-			}
-
-			continue
-		}
-
-		// Any file that ends in a ".spec" should be put into SPECS/
-		if strings.HasSuffix(f.Name(), ".spec") {
-			err := os.Rename(fmt.Sprintf("%s/%s", localRepo, f.Name()), fmt.Sprintf("%s/SPECS/%s", localRepo, f.Name()))
-			if err != nil {
-				return false, fmt.Errorf("Error moving .spec file to SPECS/")
-			}
-		}
-
-		// if a file isn't skipped in one of the above checks, then it must be a file that belongs in SOURCES/
-		os.Rename(fmt.Sprintf("%s/%s", localRepo, f.Name()), fmt.Sprintf("%s/SOURCES/%s", localRepo, f.Name()))
-	}
-
-	return true, nil
-}
-
-// Given a local "sources" metadata file (new CentOS Stream format), convert it into the older
-// classic CentOS style:  "<HASH>  SOURCES/<FILENAME>"
-func convertMetaData(pkgName string, localRepo string) bool {
-	lookAside, err := os.Open(fmt.Sprintf("%s/sources", localRepo))
-	if err != nil {
-		return false
-	}
-
-	// Split file into lines and start processing:
-	scanner := bufio.NewScanner(lookAside)
-	scanner.Split(bufio.ScanLines)
-
-	// convertedLA is our array of new "converted" lookaside lines
-	var convertedLA []string
-
-	// loop through each line, and:
-	//   - split by whitespace
-	//   - check each line begins with "SHA" or "MD" - validate
-	//   - take the
-	// Then check
-	for scanner.Scan() {
-		tmpLine := strings.Fields(scanner.Text())
-		// make sure line starts with a "SHA" or "MD" before processing - otherwise it might not be a valid format lookaside line!
-		if !(strings.HasPrefix(tmpLine[0], "SHA") || strings.HasPrefix(tmpLine[0], "MD")) {
-			continue
-		}
-
-		// Strip out "( )" characters from file name and prepend SOURCES/ to it
-		tmpLine[1] = strings.ReplaceAll(tmpLine[1], "(", "")
-		tmpLine[1] = strings.ReplaceAll(tmpLine[1], ")", "")
-		tmpLine[1] = fmt.Sprintf("SOURCES/%s", tmpLine[1])
-
-		convertedLA = append(convertedLA, fmt.Sprintf("%s %s", tmpLine[3], tmpLine[1]))
-	}
-	lookAside.Close()
-
-	// open .<NAME>.metadata file for writing our old-format lines
-	lookAside, err = os.OpenFile(fmt.Sprintf("%s/.%s.metadata", localRepo, pkgName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
-	if err != nil {
-		fmt.Errorf("Error opening new .metadata file for writing.")
-		return false
-	}
-
-	writer := bufio.NewWriter(lookAside)
-
-	for _, convertedLine := range convertedLA {
-		_, _ = writer.WriteString(convertedLine + "\n")
-	}
-
-	writer.Flush()
-	lookAside.Close()
-
-	// Remove old "sources" metadata file - we don't need it now that conversion is complete
-	os.Remove(fmt.Sprintf("%s/sources", localRepo))
-
-	return true
-}
-
-// Given a local checked out folder and package name, including SPECS/ , SOURCES/ , and .package.metadata, this will:
-//   - create a "dummy" SRPM (using dummy sources files we use to populate tarballs from lookaside)
-//   - extract RPM version info from that SRPM, and return it
-//
-// If we are in tagless mode, we need to get a package version somehow!
-func getVersionFromSpec(localRepo string, majorVersion int) (string, error) {
-	// Make sure we have "rpm" and "rpmbuild" and "cp" available in our PATH.  Otherwise, this won't work:
-	_, err := exec.LookPath("rpmspec")
-	if err != nil {
-		return "", fmt.Errorf("Could not find rpmspec program in PATH")
-	}
-
-	// Read the first file from SPECS/ to get our spec file
-	// (there should only be one file - we check that it ends in ".spec" just to be sure!)
-	lsTmp, err := os.ReadDir(fmt.Sprintf("%s/SPECS/", localRepo))
-	if err != nil {
-		return "", err
-	}
-	specFile := lsTmp[0].Name()
-
-	if !strings.HasSuffix(specFile, ".spec") {
-		return "", fmt.Errorf("First file found in SPECS/ is not a .spec file!  Check the SPECS/ directory in the repo?")
-	}
-
-	// Call the rpmspec binary to extract the version-release info out of it, and tack on ".el<VERSION>" at the end:
-	cmdArgs := []string{
-		"--srpm",
-		fmt.Sprintf(`--define=dist  .el%d`, majorVersion),
-		fmt.Sprintf(`--define=_topdir  %s`, localRepo),
-		"-q",
-		"--queryformat",
-		`%{NAME}|%{VERSION}|%{RELEASE}\n`,
-		fmt.Sprintf("%s/SPECS/%s", localRepo, specFile),
-	}
-	cmd := exec.Command("rpmspec", cmdArgs...)
-	nvrTmp, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("Error running rpmspec command to determine RPM name-version-release identifier. \nCommand attempted: %s \nCommand output: %s", cmd.String(), string(nvrTmp))
-	}
-
-	// Pull first line of the version output to get the name-version-release number (there should only be 1 line)
-	nvr := string(nvrTmp)
-	nvr = strings.Fields(nvr)[0]
-
-	// return name-version-release string we derived:
-	log.Printf("Derived NVR %s from tagless repo via rpmspec command\n", nvr)
-	return nvr, nil
-}
-
 // We need to loop through the lookaside blob files ("SourcesToIgnore"),
 // and upload them to our target storage (usually an S3 bucket, but could be a local folder)
 //
 // We also need to add the source paths to .gitignore in the git repo, so we don't accidentally commit + push them
-func processLookasideSources(pd *data.ProcessData, md *data.ModeData, localDir string) error {
+//
+// In dry-run mode nothing is uploaded, the blobs are added to the plan instead
+func processLookasideSources(ctx context.Context, pd *data.ProcessData, md *data.ModeData, localDir string, plan *srpmprocpb.BranchPlan) error {
 	w := md.Worktree
 	metadata, err := w.Filesystem.Create(fmt.Sprintf(".%s.metadata", md.Name))
 	if err != nil {
@@ -1325,21 +1776,10 @@ func processLookasideSources(pd *data.ProcessData, md *data.ModeData, localDir s
 			continue
 		}
 
-		sourceFile, err := w.Filesystem.Open(sourcePath)
+		checksum, aliases, err := hashSource(pd, w.Filesystem, sourcePath, source.HashFunction)
 		if err != nil {
-			return fmt.Errorf("could not open ignored source file %s: %v", sourcePath, err)
-		}
-		sourceFileBts, err := io.ReadAll(sourceFile)
-		if err != nil {
-			return fmt.Errorf("could not read the whole of ignored source file: %v", err)
-		}
-
-		source.HashFunction.Reset()
-		_, err = source.HashFunction.Write(sourceFileBts)
-		if err != nil {
-			return fmt.Errorf("could not write bytes to hash function: %v", err)
+			return err
 		}
-		checksum := hex.EncodeToString(source.HashFunction.Sum(nil))
 		checksumLine := fmt.Sprintf("%s %s\n", checksum, sourcePath)
 		_, err = metadata.Write([]byte(checksumLine))
 		if err != nil {
@@ -1349,18 +1789,13 @@ func processLookasideSources(pd *data.ProcessData, md *data.ModeData, localDir s
 		if data.StrContains(alreadyUploadedBlobs, checksum) {
 			continue
 		}
-		exists, err := pd.BlobStorage.Exists(checksum)
-		if err != nil {
-			return err
-		}
-		if !exists && !pd.NoStorageUpload {
-			err := pd.BlobStorage.Write(checksum, sourceFileBts)
+		for _, key := range append([]string{checksum}, aliases...) {
+			err := storeSource(ctx, pd, w.Filesystem, sourcePath, key, checksum, plan)
 			if err != nil {
 				return err
 			}
-			pd.Log.Printf("wrote %s to blob storage", checksum)
+			alreadyUploadedBlobs = append(alreadyUploadedBlobs, key)
 		}
-		alreadyUploadedBlobs = append(alreadyUploadedBlobs, checksum)
 
 		// Add this SOURCES/ lookaside file to be excluded
 		w.Excludes = append(w.Excludes, gitignore.ParsePattern(sourcePath, nil))
@@ -1381,16 +1816,129 @@ func processLookasideSources(pd *data.ProcessData, md *data.ModeData, localDir s
 	return nil
 }
 
+// hashSource streams a source through its hash function and the configured digests.
+// It returns the checksum for the metadata file, which uses the metadata digest if one
+// is configured, and the other keys the source is stored under
+func hashSource(pd *data.ProcessData, fs billy.Filesystem, path string, hashFunction hash.Hash) (string, []string, error) {
+	sourceFile, err := fs.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not open ignored source file %s: %v", path, err)
+	}
+	defer sourceFile.Close()
+
+	// the hash function of the source comes first, as an empty name
+	names := []string{""}
+	hashers := []hash.Hash{hashFunction}
+	for _, name := range append([]string{pd.MetadataDigest}, pd.BlobDigests...) {
+		if name == "" || slices.Contains(names, name) {
+			continue
+		}
+		names = append(names, name)
+		hashers = append(hashers, data.NewHash(name))
+	}
+
+	hashFunction.Reset()
+	writers := make([]io.Writer, len(hashers))
+	for i, hasher := range hashers {
+		writers[i] = hasher
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), sourceFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read the whole of ignored source file: %v", err)
+	}
+
+	checksum := hex.EncodeToString(hashFunction.Sum(nil))
+	var keys []string
+	for i, hasher := range hashers {
+		key := hex.EncodeToString(hasher.Sum(nil))
+		if names[i] != "" && names[i] == pd.MetadataDigest {
+			checksum = key
+		}
+		keys = append(keys, key)
+	}
+
+	var aliases []string
+	for _, key := range keys {
+		if key != checksum && !slices.Contains(aliases, key) {
+			aliases = append(aliases, key)
+		}
+	}
+
+	return checksum, aliases, nil
+}
+
+// storeSource stores a source in blob storage under key, unless the key already exists.
+// For keys other than checksum an alias object is stored instead if aliases are enabled.
+// In dry-run mode the key is added to the plan instead
+func storeSource(ctx context.Context, pd *data.ProcessData, fs billy.Filesystem, path string, key string, checksum string, plan *srpmprocpb.BranchPlan) error {
+	exists, err := pd.BlobStorage.Exists(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not check blob storage for %s: %w", key, err)
+	}
+	if exists || pd.NoStorageUpload {
+		return nil
+	}
+	if pd.DryRun {
+		plan.Blobs = append(plan.Blobs, key)
+		return nil
+	}
+
+	if key != checksum && pd.BlobAliases {
+		err := blob.WriteAlias(ctx, pd.BlobStorage, key, checksum)
+		if err != nil {
+			return fmt.Errorf("could not write alias %s to blob storage: %v", key, err)
+		}
+		pd.Log.Printf("wrote %s to blob storage as alias of %s", key, checksum)
+		return nil
+	}
+
+	err = uploadSource(ctx, pd, fs, path, key)
+	if err != nil {
+		return err
+	}
+	pd.Log.Printf("wrote %s to blob storage", key)
+
+	return nil
+}
+
+// uploadSource streams a source to blob storage
+func uploadSource(ctx context.Context, pd *data.ProcessData, fs billy.Filesystem, path string, checksum string) error {
+	sourceFile, err := fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open ignored source file %s: %v", path, err)
+	}
+	defer sourceFile.Close()
+
+	err = blob.Copy(ctx, pd.BlobStorage, checksum, sourceFile)
+	if err != nil {
+		return fmt.Errorf("could not write %s to blob storage: %v", checksum, err)
+	}
+
+	return nil
+}
+
 // Given an input branch name to import from, like "refs/heads/c9s", produce the tagless branch name we want to commit to, like "r9s"
 // Modular translation of CentOS stream branches i is also done - branch stream-maven-3.8-rhel-9.1.0  ---->  r9s-stream-maven-3.8_9.1.0
-func taglessBranchName(fullBranch string, pd *data.ProcessData) string {
+// With branch rules, a branch that no rule maps or that is skipped is an error
+func taglessBranchName(fullBranch string, pd *data.ProcessData) (string, error) {
 	// Split the full branch name "refs/heads/blah" to only get the short name - last entry
 	tmpBranch := strings.Split(fullBranch, "/")
 	branch := tmpBranch[len(tmpBranch)-1]
 
+	if pd.BranchRules != nil {
+		match := pd.BranchRules.Branch(branch)
+		if match.Rule == nil {
+			return "", fmt.Errorf("no branch rule matches %s", branch)
+		}
+		if !match.Ok() {
+			return "", fmt.Errorf("branch %s is skipped by branch rule %d", branch, match.Index+1)
+		}
+		return match.Target, nil
+	}
+
 	// Simple case:  if our branch is not a modular stream branch, just return the normal <prefix><version><suffix> pattern
 	if !strings.HasPrefix(branch, "stream-") {
-		return fmt.Sprintf("%s%d%s", pd.BranchPrefix, pd.Version, pd.BranchSuffix)
+		return fmt.Sprintf("%s%d%s", pd.BranchPrefix, pd.Version, pd.BranchSuffix), nil
 	}
 
 	// index where the "-rhel-" starts near the end of the string
@@ -1403,5 +1951,5 @@ func taglessBranchName(fullBranch string, pd *data.ProcessData) string {
 	majorMinor := branch[rhelSpot+6:]
 
 	// return translated modular branch:
-	return fmt.Sprintf("%s%d%s-%s_%s", pd.BranchPrefix, pd.Version, pd.BranchSuffix, moduleString, majorMinor)
+	return fmt.Sprintf("%s%d%s-%s_%s", pd.BranchPrefix, pd.Version, pd.BranchSuffix, moduleString, majorMinor), nil
 }
@@ -0,0 +1,381 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	srpmprocpb "github.com/rocky-linux/srpmproc/pb"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+)
+
+func TestTaglessBranchName(t *testing.T) {
+	pd := &data.ProcessData{
+		BranchPrefix: "r",
+		Version:      9,
+		BranchSuffix: "s",
+	}
+	for branch, want := range map[string]string{
+		"refs/heads/c9s":                         "r9s",
+		"refs/heads/stream-maven-3.8-rhel-9.1.0": "r9s-stream-maven-3.8_9.1.0",
+	} {
+		got, err := taglessBranchName(branch, pd)
+		if err != nil || got != want {
+			t.Errorf("taglessBranchName(%s) = %q, %v, want %q", branch, got, err, want)
+		}
+	}
+
+	pd.BranchRules = &data.BranchRules{
+		Branches: []*data.BranchRule{
+			{Match: `c9-beta`, Skip: true},
+			{Match: `c(\d+)s`, Target: "x${1}s"},
+		},
+	}
+	err := pd.BranchRules.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := taglessBranchName("refs/heads/c9s", pd)
+	if err != nil || got != "x9s" {
+		t.Errorf("taglessBranchName with rules = %q, %v, want x9s", got, err)
+	}
+	_, err = taglessBranchName("refs/heads/c9-beta", pd)
+	if err == nil || !strings.Contains(err.Error(), "skipped by branch rule 1") {
+		t.Errorf("taglessBranchName of a skipped branch error = %v", err)
+	}
+	_, err = taglessBranchName("refs/heads/main", pd)
+	if err == nil || !strings.Contains(err.Error(), "no branch rule matches main") {
+		t.Errorf("taglessBranchName of an unmatched branch error = %v", err)
+	}
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha512Hex(content string) string {
+	sum := sha512.Sum512([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTestSource returns a worktree with SOURCES/foo.tar.gz
+func newTestSource(t *testing.T, content string) *git.Worktree {
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, w.Filesystem, "SOURCES/foo.tar.gz", content)
+
+	return w
+}
+
+func TestHashSource(t *testing.T) {
+	w := newTestSource(t, "foo")
+
+	tests := []struct {
+		name           string
+		metadataDigest string
+		blobDigests    []string
+		checksum       string
+		aliases        []string
+	}{
+		{"upstream digest", "", nil, md5Hex("foo"), nil},
+		{"metadata digest", "sha256", nil, sha256Hex("foo"), []string{md5Hex("foo")}},
+		{"blob digests", "", []string{"sha512", "sha256"}, md5Hex("foo"), []string{sha512Hex("foo"), sha256Hex("foo")}},
+		{"duplicate digests", "sha256", []string{"sha256", "md5", "sha512"}, sha256Hex("foo"), []string{md5Hex("foo"), sha512Hex("foo")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pd := testProcessData()
+			pd.MetadataDigest = tt.metadataDigest
+			pd.BlobDigests = tt.blobDigests
+
+			// a hash function that was used before is reset
+			hashFunction := md5.New()
+			_, _ = hashFunction.Write([]byte("previous source"))
+
+			checksum, aliases, err := hashSource(pd, w.Filesystem, "SOURCES/foo.tar.gz", hashFunction)
+			if err != nil {
+				t.Fatalf("hashSource: %v", err)
+			}
+			if checksum != tt.checksum {
+				t.Errorf("checksum = %s, want %s", checksum, tt.checksum)
+			}
+			if strings.Join(aliases, ",") != strings.Join(tt.aliases, ",") {
+				t.Errorf("aliases = %v, want %v", aliases, tt.aliases)
+			}
+		})
+	}
+
+	_, _, err := hashSource(testProcessData(), w.Filesystem, "SOURCES/missing.tar.gz", md5.New())
+	if err == nil {
+		t.Fatal("hashSource of a missing source did not fail")
+	}
+}
+
+func TestStoreSource(t *testing.T) {
+	ctx := context.Background()
+	w := newTestSource(t, "foo")
+	checksum := sha256Hex("foo")
+	alias := md5Hex("foo")
+
+	tests := []struct {
+		name      string
+		configure func(pd *data.ProcessData)
+		key       string
+		// content already stored under key
+		existing string
+		want     string
+		planned  bool
+	}{
+		{"upload", nil, checksum, "", "foo", false},
+		{"existing", nil, checksum, "kept", "kept", false},
+		{"no storage upload", func(pd *data.ProcessData) { pd.NoStorageUpload = true }, checksum, "", "", false},
+		{"dry run", func(pd *data.ProcessData) { pd.DryRun = true }, checksum, "", "", true},
+		{"copy", nil, alias, "", "foo", false},
+		{"alias", func(pd *data.ProcessData) { pd.BlobAliases = true }, alias, "", "srpmproc-blob-alias:" + checksum + "\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pd := testProcessData()
+			pd.BlobStorage = file.New(dir)
+			if tt.configure != nil {
+				tt.configure(pd)
+			}
+			if tt.existing != "" {
+				if err := os.WriteFile(filepath.Join(dir, tt.key), []byte(tt.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			plan := &srpmprocpb.BranchPlan{}
+			err := storeSource(ctx, pd, w.Filesystem, "SOURCES/foo.tar.gz", tt.key, checksum, plan)
+			if err != nil {
+				t.Fatalf("storeSource: %v", err)
+			}
+
+			content, err := os.ReadFile(filepath.Join(dir, tt.key))
+			if tt.want == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("%s was stored: %q, %v", tt.key, content, err)
+				}
+			} else if err != nil || string(content) != tt.want {
+				t.Errorf("stored %q, %v, want %q", content, err, tt.want)
+			}
+			if planned := len(plan.Blobs) == 1 && plan.Blobs[0] == tt.key; planned != tt.planned {
+				t.Errorf("plan blobs = %v", plan.Blobs)
+			}
+		})
+	}
+}
+
+func TestProcessLookasideSources(t *testing.T) {
+	ctx := context.Background()
+	dir, localDir := t.TempDir(), t.TempDir()
+	w := newTestSource(t, "foo")
+	writeTestFile(t, w.Filesystem, "SOURCES/old.tar.gz", "old")
+
+	pd := testProcessData()
+	pd.BlobStorage = file.New(dir)
+	pd.MetadataDigest = "sha256"
+	pd.BlobAliases = true
+	md := &data.ModeData{
+		Name:     "foo",
+		Worktree: w,
+		SourcesToIgnore: []*data.IgnoredSource{
+			{Name: "SOURCES/foo.tar.gz", HashFunction: md5.New()},
+			{Name: "SOURCES/old.tar.gz", HashFunction: md5.New(), Expired: true},
+			// listed but not in the worktree
+			{Name: "SOURCES/gone.tar.gz", HashFunction: md5.New()},
+		},
+	}
+
+	err := processLookasideSources(ctx, pd, md, localDir, &srpmprocpb.BranchPlan{})
+	if err != nil {
+		t.Fatalf("processLookasideSources: %v", err)
+	}
+
+	// the metadata file lists the --metadata-digest checksum instead of the upstream md5
+	metadata, err := util.ReadFile(w.Filesystem, ".foo.metadata")
+	if want := sha256Hex("foo") + " SOURCES/foo.tar.gz\n"; err != nil || string(metadata) != want {
+		t.Errorf(".foo.metadata = %q, %v, want %q", metadata, err, want)
+	}
+	content, err := blob.ReadResolved(ctx, pd.BlobStorage, md5Hex("foo"))
+	if err != nil || string(content) != "foo" {
+		t.Errorf("upstream key resolves to %q, %v", content, err)
+	}
+	target, err := blob.ReadAlias(ctx, pd.BlobStorage, md5Hex("foo"))
+	if err != nil || target != sha256Hex("foo") {
+		t.Errorf("upstream key is not an alias of the metadata checksum: %q, %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, md5Hex("old"))); !os.IsNotExist(err) {
+		t.Error("an expired source was stored")
+	}
+
+	gitignore, err := os.ReadFile(filepath.Join(localDir, ".gitignore"))
+	if err != nil || string(gitignore) != "SOURCES/foo.tar.gz\n" {
+		t.Errorf(".gitignore = %q, %v", gitignore, err)
+	}
+}
+
+func TestAddStatusToPlan(t *testing.T) {
+	status := git.Status{
+		"staged-new":      {Staging: git.Added, Worktree: git.Unmodified},
+		"untracked":       {Staging: git.Untracked, Worktree: git.Untracked},
+		"copied":          {Staging: git.Copied, Worktree: git.Unmodified},
+		"staged-change":   {Staging: git.Modified, Worktree: git.Unmodified},
+		"worktree-change": {Staging: git.Unmodified, Worktree: git.Modified},
+		"renamed":         {Staging: git.Renamed, Worktree: git.Unmodified},
+		"conflict":        {Staging: git.UpdatedButUnmerged, Worktree: git.Unmodified},
+		"removed":         {Staging: git.Deleted, Worktree: git.Unmodified},
+		"worktree-remove": {Staging: git.Unmodified, Worktree: git.Deleted},
+		// the staged state wins over later worktree changes
+		"added-then-edited": {Staging: git.Added, Worktree: git.Modified},
+		"unchanged":         {Staging: git.Unmodified, Worktree: git.Unmodified},
+	}
+
+	plan := &srpmprocpb.BranchPlan{}
+	addStatusToPlan(plan, status)
+
+	for name, tt := range map[string]struct {
+		got  []string
+		want string
+	}{
+		"added":    {plan.Added, "added-then-edited,copied,staged-new,untracked"},
+		"modified": {plan.Modified, "conflict,renamed,staged-change,worktree-change"},
+		"deleted":  {plan.Deleted, "removed,worktree-remove"},
+	} {
+		if got := strings.Join(tt.got, ","); got != tt.want {
+			t.Errorf("%s = %s, want %s", name, got, tt.want)
+		}
+	}
+}
+
+func TestAddStatusToPlanWorktree(t *testing.T) {
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, w.Filesystem, "SPECS/foo.spec", "Release: 1\n")
+	writeTestFile(t, w.Filesystem, "SOURCES/old.patch", "old")
+	if _, err := w.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Commit("upstream", &git.CommitOptions{Author: &object.Signature{Name: "upstream", Email: "upstream@example.com", When: time.Unix(0, 0)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the changes an import makes to the upstream tree
+	writeTestFile(t, w.Filesystem, "SPECS/foo.spec", "Release: 1.rocky\n")
+	if err := w.Filesystem.Remove("SOURCES/old.patch"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, w.Filesystem, "SOURCES/new.patch", "new")
+	if _, err := w.Add("SOURCES/new.patch"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, w.Filesystem, ".foo.metadata", "")
+
+	status, err := w.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &srpmprocpb.BranchPlan{}
+	addStatusToPlan(plan, status)
+
+	if got := strings.Join(plan.Added, ","); got != ".foo.metadata,SOURCES/new.patch" {
+		t.Errorf("Added = %s", got)
+	}
+	if got := strings.Join(plan.Modified, ","); got != "SPECS/foo.spec" {
+		t.Errorf("Modified = %s", got)
+	}
+	if got := strings.Join(plan.Deleted, ","); got != "SOURCES/old.patch" {
+		t.Errorf("Deleted = %s", got)
+	}
+}
+
+func TestProcessLookasideSourcesPlan(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	w := newTestSource(t, "foo")
+	writeTestFile(t, w.Filesystem, "SOURCES/bar.tar.gz", "bar")
+	// already stored, so not part of the plan
+	writeTestBlob(t, dir, sha256Hex("bar"), "bar", time.Now())
+
+	pd := testProcessData()
+	pd.BlobStorage = file.New(dir)
+	pd.MetadataDigest = "sha256"
+	pd.BlobDigests = []string{"sha512"}
+	pd.DryRun = true
+	md := &data.ModeData{
+		Name:     "foo",
+		Worktree: w,
+		SourcesToIgnore: []*data.IgnoredSource{
+			{Name: "SOURCES/foo.tar.gz", HashFunction: md5.New()},
+			{Name: "SOURCES/bar.tar.gz", HashFunction: md5.New()},
+		},
+	}
+
+	plan := &srpmprocpb.BranchPlan{}
+	err := processLookasideSources(ctx, pd, md, t.TempDir(), plan)
+	if err != nil {
+		t.Fatalf("processLookasideSources: %v", err)
+	}
+
+	want := []string{sha256Hex("foo"), md5Hex("foo"), sha512Hex("foo"), md5Hex("bar"), sha512Hex("bar")}
+	if strings.Join(plan.Blobs, ",") != strings.Join(want, ",") {
+		t.Errorf("plan blobs = %v, want %v", plan.Blobs, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("a dry run wrote %d blobs", len(entries)-1)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"golang.org/x/sync/errgroup"
+)
+
+// SyncRequest describes a bulk copy between blob storage backends.
+// Every destination is synced on its own, so a blob missing in
+// one destination is copied even if another one has it
+type SyncRequest struct {
+	From blob.Storage
+	To   []blob.Storage
+	// Number of blobs copied concurrently
+	Workers   int
+	LogWriter io.Writer
+}
+
+// SyncFailure is a blob that could not be copied to a destination
+type SyncFailure struct {
+	Path        string `json:"path"`
+	Destination int    `json:"destination"`
+	Error       string `json:"error"`
+}
+
+// SyncResult is the outcome of a bulk copy.
+// Copied and Present count every destination of a blob
+type SyncResult struct {
+	Blobs       int            `json:"blobs"`
+	Copied      int            `json:"copied"`
+	CopiedBytes int64          `json:"copied_bytes"`
+	Present     int            `json:"present"`
+	Failed      []*SyncFailure `json:"failed"`
+}
+
+// SyncBlobs copies every blob of req.From to the destinations that do not have it yet.
+// Blobs with digest keys are verified while reading the source and
+// again after copying by re-reading the destination
+func SyncBlobs(ctx context.Context, req *SyncRequest) (*SyncResult, error) {
+	var writer io.Writer = os.Stdout
+	if req.LogWriter != nil {
+		writer = req.LogWriter
+	}
+	logger := log.New(writer, "", log.LstdFlags)
+
+	result := &SyncResult{
+		Failed: []*SyncFailure{},
+	}
+	var mu sync.Mutex
+
+	workers := req.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(workers)
+
+	err := req.From.List(egCtx, "", func(path string, info *blob.Info) error {
+		mu.Lock()
+		result.Blobs++
+		mu.Unlock()
+
+		eg.Go(func() error {
+			for i, to := range req.To {
+				exists, err := to.Exists(egCtx, path)
+				if err == nil && !exists {
+					err = syncBlob(egCtx, req.From, to, path)
+				}
+				if egCtx.Err() != nil {
+					return egCtx.Err()
+				}
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					logger.Printf("could not copy %s to destination %d: %v", path, i, err)
+					result.Failed = append(result.Failed, &SyncFailure{Path: path, Destination: i, Error: err.Error()})
+				case exists:
+					result.Present++
+				default:
+					logger.Printf("copied %s to destination %d", path, i)
+					result.Copied++
+					result.CopiedBytes += info.Size
+				}
+				mu.Unlock()
+			}
+
+			return nil
+		})
+
+		return nil
+	})
+	waitErr := eg.Wait()
+	if waitErr != nil {
+		return nil, waitErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list blobs: %v", err)
+	}
+
+	sort.Slice(result.Failed, func(i, j int) bool {
+		if result.Failed[i].Path == result.Failed[j].Path {
+			return result.Failed[i].Destination < result.Failed[j].Destination
+		}
+		return result.Failed[i].Path < result.Failed[j].Path
+	})
+	logger.Printf("%d blobs, %d copies made, %d already present, %d failed", result.Blobs, result.Copied, result.Present, len(result.Failed))
+
+	return result, nil
+}
+
+// syncBlob copies a single blob and verifies the copy
+func syncBlob(ctx context.Context, from blob.Storage, to blob.Storage, path string) error {
+	r, err := from.Reader(ctx, path)
+	if err != nil {
+		return fmt.Errorf("could not read source: %v", err)
+	}
+	if r == nil {
+		// deleted while syncing
+		return fmt.Errorf("source blob disappeared")
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	hasher := data.NewHashForChecksum(path)
+	// alias objects are copied as is, their target is synced on its own
+	if hasher != nil {
+		head, _ := br.Peek(blob.MaxAliasSize + 1)
+		if _, ok := blob.ParseAlias(head); ok {
+			hasher = nil
+		}
+	}
+	if hasher != nil {
+		src = io.TeeReader(br, hasher)
+	}
+
+	// a corrupt source must not be stored, so the digest
+	// is checked before the writer is closed
+	copyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := to.Writer(copyCtx, path)
+	if err != nil {
+		return fmt.Errorf("could not write destination: %v", err)
+	}
+	_, err = io.Copy(w, src)
+	if err == nil && hasher != nil {
+		if calculated := hex.EncodeToString(hasher.Sum(nil)); calculated != path {
+			err = fmt.Errorf("source is corrupt, got checksum %s", calculated)
+		}
+	}
+	if err != nil {
+		cancel()
+		_ = w.Close()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("could not write destination: %v", err)
+	}
+
+	if hasher == nil {
+		return nil
+	}
+
+	copied, err := to.Reader(ctx, path)
+	if err != nil {
+		return fmt.Errorf("could not read back destination: %v", err)
+	}
+	if copied == nil {
+		return fmt.Errorf("destination blob is missing after copying")
+	}
+	defer copied.Close()
+
+	verifier := data.NewHashForChecksum(path)
+	_, err = io.Copy(verifier, copied)
+	if err != nil {
+		return fmt.Errorf("could not read back destination: %v", err)
+	}
+	if calculated := hex.EncodeToString(verifier.Sum(nil)); calculated != path {
+		return fmt.Errorf("destination is corrupt after copying, got checksum %s", calculated)
+	}
+
+	return nil
+}
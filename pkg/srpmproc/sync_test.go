@@ -0,0 +1,160 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+)
+
+func TestSyncBlobs(t *testing.T) {
+	ctx := context.Background()
+	from, present, missing := t.TempDir(), t.TempDir(), t.TempDir()
+	now := time.Now()
+	writeTestBlob(t, from, sha256Hex("copied"), "copied", now)
+	writeTestBlob(t, from, sha256Hex("present"), "present", now)
+	writeTestBlob(t, present, sha256Hex("present"), "present", now)
+	// keys that are not digests are copied without verification
+	writeTestBlob(t, from, "README", "not a blob", now)
+
+	result, err := SyncBlobs(ctx, &SyncRequest{
+		From:      file.New(from),
+		To:        []blob.Storage{file.New(present), file.New(missing)},
+		Workers:   2,
+		LogWriter: io.Discard,
+	})
+	if err != nil {
+		t.Fatalf("SyncBlobs: %v", err)
+	}
+	if result.Blobs != 3 || result.Copied != 5 || result.Present != 1 || len(result.Failed) != 0 {
+		t.Fatalf("result = %+v, want 3 blobs, 5 copies, 1 present", result)
+	}
+	if want := int64(2*len("copied") + len("present") + 2*len("not a blob")); result.CopiedBytes != want {
+		t.Errorf("CopiedBytes = %d, want %d", result.CopiedBytes, want)
+	}
+
+	for _, dir := range []string{present, missing} {
+		for path, want := range map[string]string{sha256Hex("copied"): "copied", sha256Hex("present"): "present", "README": "not a blob"} {
+			content, err := os.ReadFile(filepath.Join(dir, path))
+			if err != nil || string(content) != want {
+				t.Errorf("%s in %s = %q, %v, want %q", path, dir, content, err, want)
+			}
+		}
+	}
+
+	// a second sync finds everything present
+	result, err = SyncBlobs(ctx, &SyncRequest{
+		From:      file.New(from),
+		To:        []blob.Storage{file.New(present), file.New(missing)},
+		LogWriter: io.Discard,
+	})
+	if err != nil {
+		t.Fatalf("SyncBlobs: %v", err)
+	}
+	if result.Copied != 0 || result.Present != 6 {
+		t.Fatalf("second sync = %+v, want everything present", result)
+	}
+}
+
+func TestSyncBlobsCorrupt(t *testing.T) {
+	ctx := context.Background()
+	from, to := t.TempDir(), t.TempDir()
+	corrupt := sha256Hex("original")
+	writeTestBlob(t, from, corrupt, "tampered", time.Now())
+	writeTestBlob(t, from, sha256Hex("intact"), "intact", time.Now())
+
+	result, err := SyncBlobs(ctx, &SyncRequest{
+		From:      file.New(from),
+		To:        []blob.Storage{file.New(to)},
+		LogWriter: io.Discard,
+	})
+	if err != nil {
+		t.Fatalf("SyncBlobs: %v", err)
+	}
+	if result.Copied != 1 || len(result.Failed) != 1 {
+		t.Fatalf("result = %+v, want 1 copy and 1 failure", result)
+	}
+	failure := result.Failed[0]
+	if failure.Path != corrupt || failure.Destination != 0 || !strings.Contains(failure.Error, "corrupt") {
+		t.Fatalf("failure = %+v", failure)
+	}
+
+	// neither the corrupt blob nor a partial write is stored
+	entries, err := os.ReadDir(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != sha256Hex("intact") {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Fatalf("destination holds %v, want only the intact blob", names)
+	}
+}
+
+func TestSyncBlobsAlias(t *testing.T) {
+	ctx := context.Background()
+	from, to := t.TempDir(), t.TempDir()
+	target := sha256Hex("content")
+	md5Sum := md5.Sum([]byte("content"))
+	alias := hex.EncodeToString(md5Sum[:])
+	writeTestBlob(t, from, target, "content", time.Now())
+	if err := blob.WriteAlias(ctx, file.New(from), alias, target); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := SyncBlobs(ctx, &SyncRequest{
+		From:      file.New(from),
+		To:        []blob.Storage{file.New(to)},
+		LogWriter: io.Discard,
+	})
+	if err != nil {
+		t.Fatalf("SyncBlobs: %v", err)
+	}
+	if result.Copied != 2 || len(result.Failed) != 0 {
+		t.Fatalf("result = %+v, want 2 copies", result)
+	}
+
+	// the alias object is copied as is instead of being verified against its key
+	want, err := os.ReadFile(filepath.Join(from, alias))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(to, alias))
+	if err != nil || string(got) != string(want) {
+		t.Fatalf("alias in destination = %q, %v, want %q", got, err, want)
+	}
+	content, err := blob.ReadResolved(ctx, file.New(to), alias)
+	if err != nil || string(content) != "content" {
+		t.Fatalf("ReadResolved of the copied alias = %q, %v", content, err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// ImportTemplate is the data available to the commit message,
+// tag name and tag message templates of an import
+type ImportTemplate struct {
+	// Package name
+	Name string
+	// Name-version-release of the import, the branch name for tagless imports of unknown versions
+	NVR     string
+	Version string
+	Release string
+	// Upstream repository and the tag or branch imported from it
+	Source    string
+	SourceRef string
+	// Imported upstream commit, empty for source RPM and local imports
+	UpstreamCommit string
+	// Downstream branch, and the downstream tag (empty in tag name templates)
+	Branch string
+	Tag    string
+	// Last applied patch repository commit and the directive files applied from the patch repository
+	PatchCommit string
+	Directives  []string
+}
+
+var importTemplateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// parseImportTemplate parses text, unknown fields are reported here instead of during an import
+func parseImportTemplate(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New(name).Funcs(importTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s template: %v", name, err)
+	}
+	err = tmpl.Execute(&bytes.Buffer{}, &ImportTemplate{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+
+	return tmpl, nil
+}
+
+// renderImportTemplate executes tmpl, or returns fallback if no template was given
+func renderImportTemplate(tmpl *template.Template, data *ImportTemplate, fallback string) (string, error) {
+	if tmpl == nil {
+		return fallback, nil
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("could not render %s template: %v", tmpl.Name(), err)
+	}
+
+	return buf.String(), nil
+}
+
+// renderTagName renders the tag name template, fallback is used if no template was given
+func renderTagName(tmpl *template.Template, data *ImportTemplate, fallback string) (string, error) {
+	tag, err := renderImportTemplate(tmpl, data, fallback)
+	if err != nil {
+		return "", err
+	}
+
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", fmt.Errorf("tag name template rendered an empty tag name")
+	}
+	err = plumbing.NewTagReferenceName(tag).Validate()
+	if err != nil {
+		return "", fmt.Errorf("invalid tag name %q: %v", tag, err)
+	}
+
+	return tag, nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseImportTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// substring of the error, empty if the template is valid
+		err string
+	}{
+		{"empty", "", ""},
+		{"fields", "import {{.NVR}} ({{.UpstreamCommit}}) on {{.Branch}}", ""},
+		{"join", "{{join .Directives \", \"}}", ""},
+		{"unknown field", "import {{.Nvr}}", "invalid commit message template"},
+		{"unknown function", "{{upper .NVR}}", "could not parse commit message template"},
+		{"syntax error", "{{.NVR", "could not parse commit message template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseImportTemplate("commit message", tt.text)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("parseImportTemplate(%q) = %v", tt.text, err)
+				}
+				if (tmpl == nil) != (tt.text == "") {
+					t.Fatalf("parseImportTemplate(%q) template = %v", tt.text, tmpl)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("parseImportTemplate(%q) error = %v, want %q", tt.text, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRenderTagName(t *testing.T) {
+	data := &ImportTemplate{
+		Name:   "foo",
+		NVR:    "foo-1.0-1.el8",
+		Branch: "r8",
+	}
+	tests := []struct {
+		name     string
+		text     string
+		fallback string
+		want     string
+		// substring of the error
+		err string
+	}{
+		{"fallback", "", "imports/r8/foo-1.0-1.el8", "imports/r8/foo-1.0-1.el8", ""},
+		{"template", "imports/{{.Branch}}/{{.NVR}}", "unused", "imports/r8/foo-1.0-1.el8", ""},
+		{"trimmed", "  {{.NVR}}\n", "unused", "foo-1.0-1.el8", ""},
+		{"empty", "{{if .Tag}}{{.Tag}}{{end}}", "unused", "", "empty tag name"},
+		{"only spaces", " \n ", "unused", "", "empty tag name"},
+		{"empty fallback", "", "", "", "empty tag name"},
+		{"space", "imports/{{.Branch}} {{.NVR}}", "unused", "", "invalid tag name"},
+		{"double dot", "imports/{{.Branch}}/..{{.NVR}}", "unused", "", "invalid tag name"},
+		{"lock suffix", "{{.NVR}}.lock", "unused", "", "invalid tag name"},
+		{"trailing slash", "imports/{{.Branch}}/", "unused", "", "invalid tag name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseImportTemplate("tag name", tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tag, err := renderTagName(tmpl, data, tt.fallback)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("renderTagName = %q, %v, want error %q", tag, err, tt.err)
+				}
+				return
+			}
+			if err != nil || tag != tt.want {
+				t.Fatalf("renderTagName = %q, %v, want %q", tag, err, tt.want)
+			}
+		})
+	}
+}
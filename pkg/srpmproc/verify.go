@@ -0,0 +1,216 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/data"
+	"golang.org/x/sync/errgroup"
+)
+
+// Problems reported by VerifyBlobs
+const (
+	BlobCorrupt    = "corrupt"
+	BlobTruncated  = "truncated"
+	BlobMissing    = "missing"
+	BlobUnreadable = "unreadable"
+)
+
+// VerifyRequest describes an integrity audit of blob storage
+type VerifyRequest struct {
+	Storage blob.Storage
+	// If set, blobs referenced by the downstream repos are checked to exist.
+	// The repos are selected the same way as for CollectGarbage
+	UpstreamPrefix string
+	Packages       []*BatchPackage
+	Authenticator  transport.AuthMethod
+	// Number of blobs verified concurrently
+	Workers   int
+	LogWriter io.Writer
+}
+
+// VerifyProblem is a blob that failed verification
+type VerifyProblem struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// VerifyResult is the outcome of an integrity audit
+type VerifyResult struct {
+	Blobs    int              `json:"blobs"`
+	Verified int              `json:"verified"`
+	Skipped  []string         `json:"skipped"`
+	Problems []*VerifyProblem `json:"problems"`
+}
+
+// VerifyBlobs re-reads every blob and compares its digest with its key.
+// The digest algorithm is implied by the key length, keys that are not a
+// known digest are skipped
+func VerifyBlobs(ctx context.Context, req *VerifyRequest) (*VerifyResult, error) {
+	var writer io.Writer = os.Stdout
+	if req.LogWriter != nil {
+		writer = req.LogWriter
+	}
+	logger := log.New(writer, "", log.LstdFlags)
+
+	referenced := map[string]bool{}
+	if req.UpstreamPrefix != "" {
+		repos, err := DownstreamRepos(req.UpstreamPrefix, req.Packages)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range repos {
+			logger.Printf("scanning %s", repo)
+			hashes, err := ReferencedBlobs(ctx, repo, req.Authenticator)
+			if err != nil {
+				return nil, err
+			}
+			for hash := range hashes {
+				referenced[hash] = true
+			}
+		}
+	}
+
+	result := &VerifyResult{
+		Skipped:  []string{},
+		Problems: []*VerifyProblem{},
+	}
+	var mu sync.Mutex
+
+	workers := req.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(workers)
+
+	err := req.Storage.List(egCtx, "", func(path string, info *blob.Info) error {
+		mu.Lock()
+		result.Blobs++
+		delete(referenced, path)
+		mu.Unlock()
+
+		if data.NewHashForChecksum(path) == nil {
+			mu.Lock()
+			result.Skipped = append(result.Skipped, path)
+			mu.Unlock()
+			return nil
+		}
+
+		eg.Go(func() error {
+			problem, err := verifyBlob(egCtx, req.Storage, path, info)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if problem != nil {
+				logger.Printf("%s is %s: %s", path, problem.Problem, problem.Detail)
+				result.Problems = append(result.Problems, problem)
+			} else {
+				result.Verified++
+			}
+
+			return nil
+		})
+
+		return nil
+	})
+	waitErr := eg.Wait()
+	if waitErr != nil {
+		return nil, waitErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list blobs: %v", err)
+	}
+
+	for hash := range referenced {
+		logger.Printf("%s is referenced but missing", hash)
+		result.Problems = append(result.Problems, &VerifyProblem{
+			Path:    hash,
+			Problem: BlobMissing,
+		})
+	}
+
+	sort.Strings(result.Skipped)
+	sort.Slice(result.Problems, func(i, j int) bool {
+		return result.Problems[i].Path < result.Problems[j].Path
+	})
+	logger.Printf("verified %d of %d blobs, %d problems", result.Verified, result.Blobs, len(result.Problems))
+
+	return result, nil
+}
+
+// verifyBlob returns the problem of a single blob, or nil if the blob is intact.
+// Errors are only returned if verification itself could not continue
+func verifyBlob(ctx context.Context, storage blob.Storage, path string, info *blob.Info) (*VerifyProblem, error) {
+	// an alias object is verified by the content it points to
+	r, target, err := blob.OpenResolved(ctx, storage, path)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return &VerifyProblem{Path: path, Problem: BlobUnreadable, Detail: err.Error()}, nil
+	}
+	if r == nil {
+		if target != "" {
+			return &VerifyProblem{Path: path, Problem: BlobMissing, Detail: fmt.Sprintf("alias target %s is missing", target)}, nil
+		}
+		// deleted while verifying
+		return &VerifyProblem{Path: path, Problem: BlobMissing}, nil
+	}
+	defer r.Close()
+
+	hasher := data.NewHashForChecksum(path)
+	n, err := io.Copy(hasher, r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return &VerifyProblem{Path: path, Problem: BlobTruncated, Detail: err.Error()}, nil
+		}
+		return &VerifyProblem{Path: path, Problem: BlobUnreadable, Detail: err.Error()}, nil
+	}
+	if target == "" && !info.Encoded && n < info.Size {
+		return &VerifyProblem{Path: path, Problem: BlobTruncated, Detail: fmt.Sprintf("read %d of %d bytes", n, info.Size)}, nil
+	}
+
+	calculated := hex.EncodeToString(hasher.Sum(nil))
+	if calculated != path {
+		return &VerifyProblem{Path: path, Problem: BlobCorrupt, Detail: fmt.Sprintf("got checksum %s", calculated)}, nil
+	}
+
+	return nil, nil
+}
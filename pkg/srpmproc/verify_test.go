@@ -0,0 +1,203 @@
+// Copyright (c) 2021 The Srpmproc Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package srpmproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rocky-linux/srpmproc/pkg/blob"
+	"github.com/rocky-linux/srpmproc/pkg/blob/file"
+)
+
+// faultyStorage fails reading some of the blobs of a storage
+type faultyStorage struct {
+	blob.Storage
+	// reading these blobs fails with the error
+	errors map[string]error
+	// these blobs end after the given number of bytes
+	short map[string]int64
+	// reading these blobs is interrupted like a connection that is closed early
+	interrupted map[string]bool
+}
+
+type faultyReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *faultyStorage) Reader(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err, ok := s.errors[path]; ok {
+		return nil, err
+	}
+	r, err := s.Storage.Reader(ctx, path)
+	if err != nil || r == nil {
+		return r, err
+	}
+	if n, ok := s.short[path]; ok {
+		return &faultyReader{Reader: io.LimitReader(r, n), Closer: r}, nil
+	}
+	if s.interrupted[path] {
+		return &faultyReader{Reader: io.MultiReader(io.LimitReader(r, 1), unexpectedEOF{}), Closer: r}, nil
+	}
+
+	return r, nil
+}
+
+// unexpectedEOF fails like a stream that ends before its length
+type unexpectedEOF struct{}
+
+func (unexpectedEOF) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+
+func TestVerifyBlobs(t *testing.T) {
+	ctx := context.Background()
+	root, dir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	intact := sha256Hex("intact")
+	corrupt := sha256Hex("original")
+	truncated := sha256Hex("truncated")
+	unreadable := sha256Hex("unreadable")
+	interrupted := sha256Hex("interrupted")
+	referenced := sha256Hex("referenced")
+	gone := sha256Hex("gone")
+	for path, content := range map[string]string{
+		intact:      "intact",
+		corrupt:     "tampered",
+		truncated:   "truncated",
+		unreadable:  "unreadable",
+		interrupted: "interrupted",
+		referenced:  "referenced",
+		"README":    "not a blob",
+	} {
+		writeTestBlob(t, dir, path, content, now)
+	}
+	storage := file.New(dir)
+	aliasOf := map[string]string{
+		md5Hex("intact"):   intact,
+		md5Hex("original"): corrupt,
+		md5Hex("gone"):     gone,
+	}
+	for alias, target := range aliasOf {
+		if err := blob.WriteAlias(ctx, storage, alias, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newTestDownstream(t, root, "foo", []testCommit{
+		{branch: "r8", files: map[string]string{".foo.metadata": fmt.Sprintf("%s SOURCES/a.tar.gz\n%s SOURCES/b.tar.gz\n", referenced, gone)}},
+	})
+
+	result, err := VerifyBlobs(ctx, &VerifyRequest{
+		Storage: &faultyStorage{
+			Storage: storage,
+			errors: map[string]error{
+				unreadable: blob.Classify(blob.ErrPermission, errors.New("access denied")),
+			},
+			short:       map[string]int64{truncated: 4},
+			interrupted: map[string]bool{interrupted: true},
+		},
+		UpstreamPrefix: "file://" + root,
+		Workers:        2,
+		LogWriter:      io.Discard,
+	})
+	if err != nil {
+		t.Fatalf("VerifyBlobs: %v", err)
+	}
+
+	want := map[string]string{
+		corrupt:            BlobCorrupt,
+		truncated:          BlobTruncated,
+		interrupted:        BlobTruncated,
+		unreadable:         BlobUnreadable,
+		gone:               BlobMissing,
+		md5Hex("original"): BlobCorrupt,
+		md5Hex("gone"):     BlobMissing,
+	}
+	got := map[string]string{}
+	for _, problem := range result.Problems {
+		got[problem.Path] = problem.Problem
+	}
+	for path, problem := range want {
+		if got[path] != problem {
+			t.Errorf("%s: problem = %q, want %q", path, got[path], problem)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("problems = %v, want %v", got, want)
+	}
+	for _, problem := range result.Problems {
+		if problem.Path == md5Hex("gone") && !strings.Contains(problem.Detail, "alias target "+gone) {
+			t.Errorf("dangling alias detail = %q", problem.Detail)
+		}
+	}
+
+	if strings.Join(result.Skipped, ",") != "README" {
+		t.Errorf("Skipped = %v, want README", result.Skipped)
+	}
+	// intact, referenced and the alias of intact
+	if result.Blobs != 10 || result.Verified != 3 {
+		t.Errorf("Blobs = %d, Verified = %d, want 10 and 3", result.Blobs, result.Verified)
+	}
+}
+
+func TestVerifyBlob(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := sha256Hex("content")
+	writeTestBlob(t, dir, path, "content", time.Now())
+	storage := &faultyStorage{Storage: file.New(dir)}
+
+	problem, err := verifyBlob(ctx, storage, path, &blob.Info{Size: 7})
+	if err != nil || problem != nil {
+		t.Fatalf("verifyBlob of an intact blob = %+v, %v", problem, err)
+	}
+
+	// a listed size larger than the content
+	problem, err = verifyBlob(ctx, storage, path, &blob.Info{Size: 8})
+	if err != nil || problem == nil || problem.Problem != BlobTruncated {
+		t.Fatalf("verifyBlob of a short blob = %+v, %v", problem, err)
+	}
+	// the stored size of encoded blobs differs from the content
+	problem, err = verifyBlob(ctx, storage, path, &blob.Info{Size: 8, Encoded: true})
+	if err != nil || problem != nil {
+		t.Fatalf("verifyBlob of an encoded blob = %+v, %v", problem, err)
+	}
+
+	storage.interrupted = map[string]bool{path: true}
+	problem, err = verifyBlob(ctx, storage, path, &blob.Info{Size: 7})
+	if err != nil || problem == nil || problem.Problem != BlobTruncated {
+		t.Fatalf("verifyBlob of an interrupted read = %+v, %v", problem, err)
+	}
+
+	// a canceled verification is an error, not a problem of the blob
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = verifyBlob(canceled, storage, path, &blob.Info{Size: 7})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("verifyBlob with a canceled context = %v", err)
+	}
+}